@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 单个用户的刷屏检测状态
+type abuseState struct {
+	Times         []time.Time // 窗口内的消息时间
+	LastContent   string
+	Repeats       int       // 连续相同内容的次数
+	Strikes       int       // 触发次数，用于递增冷却时长
+	LastStrike    time.Time // 最近一次触发时间
+	CooldownUntil time.Time
+}
+
+// 检测状态保存在状态存储中，本实例内的读改写由 abuseMu 串行化
+var abuseMu sync.Mutex
+
+func abuseKey(openID string) string { return "abuse:" + openID }
+
+func loadAbuseState(openID string) *abuseState {
+	st := &abuseState{}
+	if data, err := state.Get(context.Background(), abuseKey(openID)); err == nil {
+		_ = json.Unmarshal(data, st)
+	}
+	return st
+}
+
+// 冷却结束且超过 abuse.strike_reset 无活动后，状态自动过期
+func saveAbuseState(openID string, st *abuseState) {
+	ttl := viper.GetDuration("abuse.strike_reset")
+	if remaining := time.Until(st.CooldownUntil); remaining > 0 {
+		ttl += remaining
+	}
+	data, _ := json.Marshal(st)
+	if err := state.Set(context.Background(), abuseKey(openID), data, ttl); err != nil {
+		log.Printf("⚠️ 保存防刷状态失败 (%s): %v", openID, err)
+	}
+}
+
+// 检查用户是否刷屏，返回 false 时附带提示语
+func checkAbuse(openID, content string) (string, bool) {
+	if !viper.GetBool("abuse.enabled") {
+		return "", true
+	}
+
+	window := viper.GetDuration("abuse.window")
+	now := time.Now()
+
+	abuseMu.Lock()
+	st := loadAbuseState(openID)
+
+	if now.Before(st.CooldownUntil) {
+		remaining := st.CooldownUntil.Sub(now)
+		abuseMu.Unlock()
+		return fmt.Sprintf(viper.GetString("abuse.reply"), int(remaining.Seconds())+1), false
+	}
+
+	// 长时间未再触发则清零
+	if st.Strikes > 0 && now.Sub(st.LastStrike) > viper.GetDuration("abuse.strike_reset") {
+		st.Strikes = 0
+	}
+
+	kept := st.Times[:0]
+	for _, t := range st.Times {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	st.Times = append(kept, now)
+
+	// “继续”本身就需要重复发送，不计入重复内容
+	if content != "" && content != "继续" && content == st.LastContent {
+		st.Repeats++
+	} else {
+		st.LastContent, st.Repeats = content, 1
+	}
+
+	flooding := len(st.Times) > viper.GetInt("abuse.max_messages")
+	repeating := st.Repeats > viper.GetInt("abuse.max_repeats")
+	if !flooding && !repeating {
+		saveAbuseState(openID, st)
+		abuseMu.Unlock()
+		return "", true
+	}
+
+	// 冷却时长随触发次数翻倍，不超过 abuse.max_cooldown
+	st.Strikes++
+	st.LastStrike = now
+	cooldown := viper.GetDuration("abuse.cooldown") << uint(st.Strikes-1)
+	if maxCooldown := viper.GetDuration("abuse.max_cooldown"); cooldown > maxCooldown || cooldown <= 0 {
+		cooldown = maxCooldown
+	}
+	st.CooldownUntil = now.Add(cooldown)
+	st.Times, st.Repeats = nil, 0
+	strikes := st.Strikes
+	saveAbuseState(openID, st)
+	abuseMu.Unlock()
+
+	reason := "频繁发送消息"
+	if repeating {
+		reason = "重复发送相同内容"
+	}
+	log.Printf("🧊 用户 %s %s，冷却 %s（第 %d 次）", openID, reason, cooldown, strikes)
+
+	if strikes >= viper.GetInt("abuse.notify_after") {
+		go notifyAdmins(fmt.Sprintf("⚠️ 用户 %s 第 %d 次触发防刷限制（%s），已冷却 %s。", openID, strikes, reason, cooldown))
+	}
+	return fmt.Sprintf(viper.GetString("abuse.reply"), int(cooldown.Seconds())), false
+}
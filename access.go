@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 名单类型
+const (
+	AccessBlock = "block" // 黑名单
+	AccessAllow = "allow" // 白名单
+)
+
+// 管理接口维护的名单条目，与 config.yaml 中的 access.blocklist / access.allowlist 合并生效
+type AccessEntry struct {
+	OpenID    string    `json:"openid"`
+	List      string    `json:"list"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func accessCacheKey(list, openID string) string { return "access:" + list + ":" + openID }
+
+func inAccessList(list, openID string) bool {
+	for _, id := range viper.GetStringSlice("access." + list + "list") {
+		if id == openID {
+			return true
+		}
+	}
+	ctx := context.Background()
+	var listed bool
+	if getCached(ctx, accessCacheKey(list, openID), &listed) {
+		return listed
+	}
+	err := db.QueryRow(`SELECT 1 FROM user_access WHERE openid = ? AND list = ?`, openID, list).Scan(new(int))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("⚠️ 查询 %s 名单失败 [%s]: %v", list, openID, err)
+		return false
+	}
+	listed = err == nil
+	fillCache(ctx, accessCacheKey(list, openID), listed)
+	return listed
+}
+
+// 检查用户是否可以使用机器人，不可用时返回拒绝回复
+func checkAccess(openID string) (string, bool) {
+	if inAccessList(AccessBlock, openID) {
+		return viper.GetString("access.blocked_reply"), false
+	}
+	if viper.GetBool("access.allowlist_only") && !inAccessList(AccessAllow, openID) {
+		return viper.GetString("access.not_allowed_reply"), false
+	}
+	return "", true
+}
+
+func addAccessEntry(e AccessEntry) error {
+	if e.List != AccessBlock && e.List != AccessAllow {
+		return fmt.Errorf("unknown list %q", e.List)
+	}
+	e.CreatedAt = time.Now()
+	if _, err := db.Exec(`INSERT INTO user_access (openid, list, note, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(openid, list) DO UPDATE SET note = excluded.note`,
+		e.OpenID, e.List, e.Note, e.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	storeCache(context.Background(), accessCacheKey(e.List, e.OpenID), true)
+	log.Printf("🚧 %s 已加入 %s 名单", e.OpenID, e.List)
+	return nil
+}
+
+func removeAccessEntry(list, openID string) error {
+	if _, err := db.Exec(`DELETE FROM user_access WHERE openid = ? AND list = ?`, openID, list); err != nil {
+		return err
+	}
+	storeCache(context.Background(), accessCacheKey(list, openID), false)
+	log.Printf("🚧 %s 已移出 %s 名单", openID, list)
+	return nil
+}
+
+func listAccessEntries(list string) ([]AccessEntry, error) {
+	rows, err := db.Query(`SELECT openid, list, note, created_at FROM user_access WHERE list = ? ORDER BY created_at`, list)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AccessEntry{}
+	for rows.Next() {
+		var e AccessEntry
+		var created int64
+		if err := rows.Scan(&e.OpenID, &e.List, &e.Note, &created); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.Unix(created, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
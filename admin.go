@@ -0,0 +1,746 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 管理接口鉴权：请求头 Authorization: Bearer <admin.token>
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := viper.GetString("admin.token")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api is disabled"})
+			return
+		}
+
+		got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 通过客服消息通知 admin.openids 中的管理员
+func notifyAdmins(text string) {
+	for _, openID := range viper.GetStringSlice("admin.openids") {
+		queueKefuText(openID, text)
+	}
+}
+
+// 是否为 admin.openids 中的管理员
+func isAdmin(openID string) bool {
+	for _, id := range viper.GetStringSlice("admin.openids") {
+		if id == openID {
+			return true
+		}
+	}
+	return false
+}
+
+func registerAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin", adminAuth(), resolveOpenIDParam())
+	registerDashboard(r, admin)
+
+	// 群发：to_all、tag_id 或 openids（可以是化名）三选一
+	admin.POST("/broadcasts", func(c *gin.Context) {
+		var b Broadcast
+		if err := c.ShouldBindJSON(&b); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for i, id := range b.OpenIDs {
+			b.OpenIDs[i] = resolveOpenID(id)
+		}
+		if err := createBroadcast(&b); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, b)
+	})
+
+	// 预览群发内容：发送给 openid，未指定时发送给 admin.openids 中的第一位管理员
+	admin.POST("/broadcasts/preview", func(c *gin.Context) {
+		var body struct {
+			Broadcast
+			PreviewOpenID string `json:"preview_openid"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		openID := resolveOpenID(body.PreviewOpenID)
+		if admins := viper.GetStringSlice("admin.openids"); openID == "" && len(admins) > 0 {
+			openID = admins[0]
+		}
+		if err := previewBroadcast(&body.Broadcast, openID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"previewed_to": openID})
+	})
+
+	admin.GET("/broadcasts", func(c *gin.Context) {
+		list, err := listBroadcasts()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	admin.GET("/broadcasts/:id", func(c *gin.Context) {
+		b, err := refreshBroadcastStatus(c.Param("id"))
+		if errors.Is(err, errBroadcastNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, b)
+	})
+
+	admin.DELETE("/broadcasts/:id", func(c *gin.Context) {
+		if err := cancelBroadcast(c.Param("id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.GET("/cron", func(c *gin.Context) {
+		jobs, err := listCronJobs()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, jobs)
+	})
+
+	admin.POST("/cron", func(c *gin.Context) {
+		job := CronJob{Enabled: true}
+		if err := c.ShouldBindJSON(&job); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := createCronJob(job)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, job)
+	})
+
+	admin.PUT("/cron/:id", func(c *gin.Context) {
+		job, err := getCronJob(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+			return
+		}
+		// 仅允许修改 spec / args / enabled
+		var patch struct {
+			Spec    *string           `json:"spec"`
+			Args    map[string]string `json:"args"`
+			Enabled *bool             `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if patch.Spec != nil {
+			job.Spec = *patch.Spec
+		}
+		if patch.Args != nil {
+			job.Args = patch.Args
+		}
+		if patch.Enabled != nil {
+			job.Enabled = *patch.Enabled
+		}
+		if err := modifyCronJob(job); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	admin.DELETE("/cron/:id", func(c *gin.Context) {
+		if err := deleteCronJob(c.Param("id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.POST("/cron/:id/run", func(c *gin.Context) {
+		if err := triggerCronJob(c.Param("id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusAccepted)
+	})
+
+	admin.GET("/users", func(c *gin.Context) {
+		offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		list, err := listUserProfiles(offset, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	admin.GET("/users/:openid", func(c *gin.Context) {
+		p, err := getUserProfile(c.Param("openid"))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	admin.POST("/users/:openid/refresh", func(c *gin.Context) {
+		p, err := refreshUserProfile(c.Param("openid"))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	admin.GET("/users/:openid/settings", func(c *gin.Context) {
+		c.JSON(http.StatusOK, getUserSettings(c.Param("openid")))
+	})
+
+	admin.PUT("/users/:openid/settings", func(c *gin.Context) {
+		var s UserSettings
+		if err := c.ShouldBindJSON(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if s.Model != "" && !isKnownModel(s.Model) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown model"})
+			return
+		}
+		if err := s.Generation.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := saveUserSettings(c.Param("openid"), s); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, s)
+	})
+
+	admin.GET("/users/:openid/points", func(c *gin.Context) {
+		balance, err := pointsBalance(c.Param("openid"))
+		if err == nil {
+			var entries []PointsEntry
+			if entries, err = pointsLedger(c.Param("openid"), 50); err == nil {
+				c.JSON(http.StatusOK, gin.H{"balance": balance, "entries": entries})
+				return
+			}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	})
+
+	// 管理员发放（delta 为负时扣除）积分
+	admin.POST("/users/:openid/points", func(c *gin.Context) {
+		var body struct {
+			Delta int    `json:"delta" binding:"required"`
+			Note  string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := addPoints(c.Param("openid"), body.Delta, "grant", "", body.Note); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		balance, _ := pointsBalance(c.Param("openid"))
+		c.JSON(http.StatusOK, gin.H{"balance": balance})
+	})
+
+	admin.GET("/users/:openid/membership", func(c *gin.Context) {
+		grants, err := membershipGrants(c.Param("openid"), 50)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"membership": getMembership(c.Param("openid")), "grants": grants})
+	})
+
+	// 管理员开通或续期会员
+	admin.POST("/users/:openid/membership", func(c *gin.Context) {
+		var body struct {
+			Days int    `json:"days" binding:"required,min=1"`
+			Note string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, _, err := grantMembership(c.Param("openid"), body.Days, "admin", "", body.Note); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, getMembership(c.Param("openid")))
+	})
+
+	admin.DELETE("/users/:openid/membership", func(c *gin.Context) {
+		if err := revokeMembership(c.Param("openid")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// 用户等级：列出各等级的模型和已指定等级的用户
+	admin.GET("/tiers", func(c *gin.Context) {
+		users, err := listUserTiers()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"default": viper.GetString("tiers.default"), "levels": tierLevels(), "users": users})
+	})
+
+	admin.GET("/users/:openid/tier", func(c *gin.Context) {
+		tier := userTier(c.Param("openid"))
+		c.JSON(http.StatusOK, gin.H{"tier": tier, "level": tierLevels()[tier]})
+	})
+
+	admin.PUT("/users/:openid/tier", func(c *gin.Context) {
+		var body struct {
+			Tier string `json:"tier" binding:"required"`
+			Note string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := setUserTier(c.Param("openid"), body.Tier, body.Note); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"tier": userTier(c.Param("openid"))})
+	})
+
+	admin.DELETE("/users/:openid/tier", func(c *gin.Context) {
+		if err := removeUserTier(c.Param("openid")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.GET("/prompt", func(c *gin.Context) {
+		versions, err := listPromptVersions(50)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"prompt": systemPrompt(), "active": currentPromptVersion(), "versions": versions})
+	})
+
+	// 发布新的系统提示词版本，立即生效
+	admin.PUT("/prompt", func(c *gin.Context) {
+		var body struct {
+			Prompt string `json:"prompt"`
+			Note   string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		v, err := publishPrompt(body.Prompt, body.Note, "admin")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, v)
+	})
+
+	// 回滚到 version 指定的版本，不指定时回滚到上一个版本
+	admin.POST("/prompt/rollback", func(c *gin.Context) {
+		var body struct {
+			Version int64 `json:"version"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		v, err := rollbackPrompt(body.Version)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"prompt": systemPrompt(), "active": v})
+	})
+
+	admin.GET("/experiments/prompt", func(c *gin.Context) {
+		days, _ := strconv.Atoi(c.DefaultQuery("days", "7"))
+		if days <= 0 {
+			days = 7
+		}
+		stats, err := promptExperimentStats(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":  viper.GetBool("experiments.prompt.enabled"),
+			"name":     viper.GetString("experiments.prompt.name"),
+			"days":     days,
+			"variants": stats,
+		})
+	})
+
+	admin.GET("/experiments/canary", func(c *gin.Context) {
+		days, _ := strconv.Atoi(c.DefaultQuery("days", "7"))
+		if days <= 0 {
+			days = 7
+		}
+		name := viper.GetString("experiments.canary.name")
+		stats, err := canaryExperimentStats(name, time.Now().AddDate(0, 0, -days+1))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":  viper.GetBool("experiments.canary.enabled"),
+			"name":     name,
+			"percent":  viper.GetFloat64("experiments.canary.percent"),
+			"provider": viper.GetString("experiments.canary.provider"),
+			"model":    viper.GetString("experiments.canary.model"),
+			"days":     days,
+			"arms":     stats,
+		})
+	})
+
+	// 影子流量的汇总和逐条对比结果，before_id 用于翻页
+	admin.GET("/experiments/shadow", func(c *gin.Context) {
+		days, _ := strconv.Atoi(c.DefaultQuery("days", "7"))
+		if days <= 0 {
+			days = 7
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		beforeID, _ := strconv.ParseInt(c.Query("before_id"), 10, 64)
+		name := viper.GetString("experiments.shadow.name")
+		stats, err := shadowExperimentStats(name, time.Now().AddDate(0, 0, -days+1))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		results, err := listShadowResults(name, beforeID, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":  viper.GetBool("experiments.shadow.enabled"),
+			"name":     name,
+			"percent":  viper.GetFloat64("experiments.shadow.percent"),
+			"provider": viper.GetString("experiments.shadow.provider"),
+			"model":    viper.GetString("experiments.shadow.model"),
+			"days":     days,
+			"stats":    stats,
+			"results":  results,
+		})
+	})
+
+	admin.GET("/plugins", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"enabled": viper.GetBool("plugins.enabled"), "plugins": loadedPlugins()})
+	})
+
+	// 修改插件清单后重新加载，无需重启
+	admin.POST("/plugins/reload", func(c *gin.Context) {
+		if err := loadPlugins(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"plugins": loadedPlugins()})
+	})
+
+	admin.POST("/hooks/reload", func(c *gin.Context) {
+		if err := loadHookScripts(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"scripts": len(loadedHookScripts())})
+	})
+
+	// 黑白名单：list 为 block 或 allow
+	admin.GET("/access/:list", func(c *gin.Context) {
+		entries, err := listAccessEntries(c.Param("list"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+	})
+
+	admin.POST("/access/:list", func(c *gin.Context) {
+		var e AccessEntry
+		if err := c.ShouldBindJSON(&e); err != nil || e.OpenID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "openid is required"})
+			return
+		}
+		e.List = c.Param("list")
+		if err := addAccessEntry(e); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.DELETE("/access/:list/:openid", func(c *gin.Context) {
+		if err := removeAccessEntry(c.Param("list"), c.Param("openid")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.POST("/knowledge", func(c *gin.Context) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		if file.Size > viper.GetInt64("rag.max_upload_bytes") {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		doc, err := addKnowledgeDocument(c.Request.Context(), file.Filename, data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, doc)
+	})
+
+	admin.GET("/knowledge", func(c *gin.Context) {
+		docs, err := listKnowledgeDocuments()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, docs)
+	})
+
+	admin.GET("/knowledge/search", func(c *gin.Context) {
+		topK, _ := strconv.Atoi(c.DefaultQuery("top_k", strconv.Itoa(viper.GetInt("rag.top_k"))))
+		hits, err := searchKnowledge(c.Request.Context(), c.Query("q"), topK)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, hits)
+	})
+
+	// 审计日志：按 openid、direction、关键词 q、时间范围 from/to 查询，before_id 翻页
+	admin.GET("/audit", func(c *gin.Context) {
+		from, err := parseQueryTime(c.Query("from"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseQueryTime(c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		beforeID, _ := strconv.ParseInt(c.Query("before_id"), 10, 64)
+		entries, err := searchAudit(AuditQuery{
+			OpenID: c.Query("openid"), Direction: c.Query("direction"), Keyword: c.Query("q"),
+			From: from, To: to, BeforeID: beforeID, Limit: limit,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+	})
+
+	admin.GET("/outbox", func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		items, err := listOutbox(c.Query("status"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, items)
+	})
+
+	admin.POST("/outbox/:id/retry", func(c *gin.Context) {
+		ok, err := retryOutboxItem(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "failed message not found"})
+			return
+		}
+		c.Status(http.StatusAccepted)
+	})
+
+	// 通知类型对应的模板消息，设置后覆盖 notifications.templates 中的配置，删除后恢复使用配置
+	admin.GET("/notifications", func(c *gin.Context) {
+		c.JSON(http.StatusOK, listNotificationTemplates())
+	})
+
+	admin.PUT("/notifications/:type", func(c *gin.Context) {
+		var t NotificationTemplate
+		if err := c.ShouldBindJSON(&t); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		e, err := setNotificationTemplate(c.Param("type"), t)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, e)
+	})
+
+	admin.DELETE("/notifications/:type", func(c *gin.Context) {
+		if err := resetNotificationTemplate(c.Param("type")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// 带参数二维码，扫码关注或扫码时按场景值触发 events 中的配置
+	admin.POST("/qrcode", func(c *gin.Context) {
+		var req QRCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		qr, err := createQRCode(req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, qr)
+	})
+
+	// 永久素材：type 为 image、voice、video、thumb 或 news
+	admin.GET("/materials", func(c *gin.Context) {
+		offset, _ := strconv.Atoi(c.Query("offset"))
+		count, _ := strconv.Atoi(c.DefaultQuery("count", "20"))
+		list, err := listMaterials(c.DefaultQuery("type", "image"), offset, count)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	admin.GET("/materials/count", func(c *gin.Context) {
+		count, err := countMaterials()
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, count)
+	})
+
+	// 上传永久素材：multipart 表单的 file、type，视频另需 title、introduction
+	admin.POST("/materials", func(c *gin.Context) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		if file.Size > viper.GetInt64("media.max_size") {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		m, err := addMaterial(MaterialUpload{
+			Type: c.PostForm("type"), Filename: file.Filename, Data: data,
+			Title: c.PostForm("title"), Introduction: c.PostForm("introduction"),
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, m)
+	})
+
+	admin.GET("/materials/:media_id", func(c *gin.Context) {
+		m, err := getMaterial(c.Param("media_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if m.IsJSON() {
+			c.Data(http.StatusOK, "application/json; charset=utf-8", m.Data)
+			return
+		}
+		c.Data(http.StatusOK, m.ContentType, m.Data)
+	})
+
+	admin.DELETE("/materials/:media_id", func(c *gin.Context) {
+		if err := deleteMaterial(c.Param("media_id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.DELETE("/knowledge/:id", func(c *gin.Context) {
+		ok, err := deleteKnowledgeDocument(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 推送告警：客服消息通知管理员，并发送到 alert.webhook_url（企业微信/钉钉群机器人格式）。
+// 在后台发送，避免 panic 恢复等调用方被较慢的 webhook 拖过微信的回复时限
+func sendAlert(text string) {
+	go notifyAdmins(text)
+
+	webhook := viper.GetString("alert.webhook_url")
+	if webhook == "" {
+		return
+	}
+	go func() {
+		if err := postWebhook(webhook, text); err != nil {
+			log.Printf("❌ 告警 webhook 推送失败: %v", err)
+		}
+	}()
+}
+
+// 以企业微信/钉钉群机器人的文本消息格式推送到 webhook
+func postWebhook(webhook, text string) error {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": text},
+	})
+	resp, err := wechatClient.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 记录 panic 并告警，堆栈过长时截断以适应消息长度限制
+func reportPanic(where string, r interface{}, stack []byte) {
+	log.Printf("💥 %s 发生 panic: %v\n%s", where, r, stack)
+	reportPanicError(where, r, stack)
+	sendAlert(fmt.Sprintf("💥 %s 发生 panic\n时间：%s\n错误：%v\n\n%s",
+		where, time.Now().Format("2006-01-02 15:04:05"), r, truncateRunes(string(stack), 1500)))
+}
+
+// 启动带 panic 恢复的 goroutine
+func safeGo(name string, fn func()) {
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				reportPanic(name, r, debug.Stack())
+			}
+		}()
+		fn()
+	}()
+}
+
+// 微信消息接口的 panic 恢复：告警后仍返回一条安全的回复，避免微信重试
+func recoverMessage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			reportPanic(fmt.Sprintf("handleMessage[%s]", requestID(c.Request.Context())), r, debug.Stack())
+			if c.Writer.Written() {
+				return
+			}
+			if msg, ok := c.Get("wechat_msg"); ok {
+				replyText(c, msg.(WeChatMessage), viper.GetString("alert.panic_reply"))
+				return
+			}
+			c.String(http.StatusOK, "success")
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 告警规则支持的指标
+const (
+	AlertErrorRate  = "error_rate"  // 窗口内模型调用失败的比例（%）
+	AlertLatencyP95 = "latency_p95" // 窗口内模型调用耗时的 p95（秒）
+	AlertDailySpend = "daily_spend" // 当天按 pricing 估算的模型费用（元）
+)
+
+var alertMetrics = []string{AlertErrorRate, AlertLatencyP95, AlertDailySpend}
+
+// 告警规则，按 alert.rules 配置
+type AlertRule struct {
+	Name      string        `mapstructure:"name"`
+	Metric    string        `mapstructure:"metric"`
+	Threshold float64       `mapstructure:"threshold"` // 超过该值时告警
+	Window    time.Duration `mapstructure:"window"`    // error_rate、latency_p95 统计的时间窗口
+	MinCalls  int           `mapstructure:"min_calls"` // 窗口内调用次数少于该值时不评估，避免少量请求产生误报
+	Model     string        `mapstructure:"model"`     // 只统计该模型，留空统计全部模型
+}
+
+func alertRules() []AlertRule {
+	var rules []AlertRule
+	if err := viper.UnmarshalKey("alert.rules", &rules); err != nil {
+		log.Printf("⚠️ 解析 alert.rules 失败: %v", err)
+		return nil
+	}
+	for i := range rules {
+		if rules[i].Window <= 0 {
+			rules[i].Window = 10 * time.Minute
+		}
+		if rules[i].Name == "" {
+			rules[i].Name = rules[i].Metric
+		}
+	}
+	return rules
+}
+
+// 最近的模型调用，保留最长的规则窗口，用于计算错误率和耗时分位数
+type callSample struct {
+	At      time.Time
+	Model   string
+	Latency time.Duration
+	Failed  bool
+}
+
+const maxCallSamples = 20000
+
+var (
+	callSamplesMu sync.Mutex
+	callSamples   []callSample
+)
+
+func recordCallSample(model string, latency time.Duration, failed bool) {
+	callSamplesMu.Lock()
+	defer callSamplesMu.Unlock()
+	callSamples = append(callSamples, callSample{At: time.Now(), Model: model, Latency: latency, Failed: failed})
+	if len(callSamples) > maxCallSamples {
+		callSamples = append(callSamples[:0:0], callSamples[len(callSamples)-maxCallSamples:]...)
+	}
+}
+
+// 丢弃超出 keep 的样本，返回 window 内指定模型的样本
+func recentCallSamples(keep, window time.Duration, model string) []callSample {
+	callSamplesMu.Lock()
+	defer callSamplesMu.Unlock()
+	now := time.Now()
+	i := sort.Search(len(callSamples), func(i int) bool { return now.Sub(callSamples[i].At) <= keep })
+	callSamples = callSamples[i:]
+
+	var list []callSample
+	for _, s := range callSamples {
+		if now.Sub(s.At) <= window && (model == "" || s.Model == model) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// 计算规则对应的指标值，样本不足时返回 false
+func evaluateAlertRule(r AlertRule, keep time.Duration) (float64, bool, error) {
+	if r.Metric == AlertDailySpend {
+		models, err := modelUsageOn(time.Now().Format("2006-01-02"))
+		if err != nil {
+			return 0, false, err
+		}
+		total := 0.0
+		for _, m := range models {
+			if r.Model != "" && m.Model != r.Model {
+				continue
+			}
+			if cost, ok := modelCost(m.Model, m.PromptTokens, m.CompletionTokens); ok {
+				total += cost
+			}
+		}
+		return total, true, nil
+	}
+
+	samples := recentCallSamples(keep, r.Window, r.Model)
+	if len(samples) == 0 || len(samples) < r.MinCalls {
+		return 0, false, nil
+	}
+	switch r.Metric {
+	case AlertErrorRate:
+		failed := 0
+		for _, s := range samples {
+			if s.Failed {
+				failed++
+			}
+		}
+		return float64(failed) * 100 / float64(len(samples)), true, nil
+	case AlertLatencyP95:
+		latencies := make([]float64, len(samples))
+		for i, s := range samples {
+			latencies[i] = s.Latency.Seconds()
+		}
+		sort.Float64s(latencies)
+		return latencies[int(math.Ceil(float64(len(latencies))*0.95))-1], true, nil
+	}
+	return 0, false, fmt.Errorf("unknown metric %q", r.Metric)
+}
+
+func formatAlertValue(metric string, v float64) string {
+	switch metric {
+	case AlertErrorRate:
+		return fmt.Sprintf("%.1f%%", v)
+	case AlertLatencyP95:
+		return fmt.Sprintf("%.2fs", v)
+	case AlertDailySpend:
+		return fmt.Sprintf("¥%.2f", v)
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// 本实例上正在告警的规则
+var (
+	firingMu     sync.Mutex
+	firingAlerts = map[string]bool{}
+)
+
+// 评估全部告警规则：超过阈值时告警，持续超过阈值时每隔 alert.repeat_interval 再次提醒，恢复时发送恢复通知。
+// 多实例部署时通过状态存储去重，同一规则在提醒间隔内只由一个实例推送
+func checkAlertRules() {
+	rules := alertRules()
+	var keep time.Duration
+	for _, r := range rules {
+		keep = max(keep, r.Window)
+	}
+
+	ctx := context.Background()
+	for _, r := range rules {
+		value, ok, err := evaluateAlertRule(r, keep)
+		if err != nil {
+			log.Printf("⚠️ 评估告警规则 %s 失败: %v", r.Name, err)
+			continue
+		}
+		key := "alert:firing:" + r.Name
+		firing := ok && value > r.Threshold
+
+		firingMu.Lock()
+		wasFiring := firingAlerts[r.Name]
+		firingAlerts[r.Name] = firing
+		firingMu.Unlock()
+
+		if firing {
+			if sent, err := state.SetNX(ctx, key, []byte(time.Now().Format(time.RFC3339)), viper.GetDuration("alert.repeat_interval")); err != nil || !sent {
+				continue
+			}
+			log.Printf("🚨 告警 %s：%s 超过 %s", r.Name, formatAlertValue(r.Metric, value), formatAlertValue(r.Metric, r.Threshold))
+			sendAlert(fmt.Sprintf("🚨 告警：%s\n指标：%s%s\n当前：%s，阈值：%s\n时间：%s",
+				r.Name, r.Metric, alertRuleScope(r), formatAlertValue(r.Metric, value), formatAlertValue(r.Metric, r.Threshold),
+				time.Now().Format("2006-01-02 15:04:05")))
+		} else if wasFiring && ok {
+			if err := state.Delete(ctx, key); err != nil {
+				log.Printf("⚠️ 清除告警状态 %s 失败: %v", r.Name, err)
+			}
+			log.Printf("✅ 告警 %s 已恢复", r.Name)
+			sendAlert(fmt.Sprintf("✅ 已恢复：%s\n当前：%s，阈值：%s", r.Name,
+				formatAlertValue(r.Metric, value), formatAlertValue(r.Metric, r.Threshold)))
+		}
+	}
+}
+
+func alertRuleScope(r AlertRule) string {
+	var s string
+	if r.Metric != AlertDailySpend {
+		s = fmt.Sprintf("（最近 %s", r.Window)
+	}
+	if r.Model != "" {
+		if s == "" {
+			s = "（"
+		} else {
+			s += "，"
+		}
+		s += "模型 " + r.Model
+	}
+	if s != "" {
+		s += "）"
+	}
+	return s
+}
+
+// 后台按 alert.check_interval 评估告警规则，未配置规则时不启动
+func startAlertRules() {
+	if len(alertRules()) == 0 {
+		return
+	}
+	safeGo("alertRules", func() {
+		ticker := time.NewTicker(viper.GetDuration("alert.check_interval"))
+		defer ticker.Stop()
+		for range ticker.C {
+			checkAlertRules()
+		}
+	})
+	log.Printf("✅ 已启用 %d 条告警规则", len(alertRules()))
+}
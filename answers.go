@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 缓存的回答，超过 cache.answer_ttl 未取走即过期
+type cachedAnswer struct {
+	Text      string
+	ExpiresAt time.Time
+}
+
+// 用户待查看的回答队列，按生成顺序保存在状态存储的列表中
+func answersKey(user string) string { return "answers:" + user }
+
+// 取回答的结果
+const (
+	answerNone    = iota // 没有待查看的回答
+	answerReady          // 取到回答
+	answerExpired        // 回答已过期
+)
+
+// 缓存回答。超过 cache.page_length 的回答分页保存，用户每次输入“继续”查看一页
+func storeAnswer(user, text string) {
+	for _, page := range answerPages(text) {
+		pushAnswer(user, page)
+	}
+}
+
+// 按 cache.page_length 切分回答，多页时在每页开头标注“(2/5)”
+func answerPages(text string) []string {
+	pages := splitText(text, viper.GetInt("cache.page_length"))
+	if len(pages) > 1 {
+		for i := range pages {
+			pages[i] = fmt.Sprintf("(%d/%d) %s", i+1, len(pages), pages[i])
+		}
+	}
+	return pages
+}
+
+// 队列保留两个 TTL：最后一条回答过期后再保留一个 TTL，使用户仍能收到“已过期”提示
+func pushAnswer(user, text string) {
+	ttl := viper.GetDuration("cache.answer_ttl")
+	data, _ := json.Marshal(cachedAnswer{Text: text, ExpiresAt: time.Now().Add(ttl)})
+	if _, err := state.Push(context.Background(), answersKey(user), data, 2*ttl); err != nil {
+		log.Printf("❌ 缓存回答失败 (%s): %v", user, err)
+	}
+}
+
+// 按顺序取出用户最早的一条回答，同时返回剩余条数。队首已过期的回答直接丢弃
+func takeAnswer(user string) (string, int, int) {
+	ctx := context.Background()
+	key := answersKey(user)
+	expired := false
+	for {
+		data, err := state.Pop(ctx, key)
+		if errors.Is(err, errStateNotFound) {
+			break
+		}
+		if err != nil {
+			log.Printf("❌ 读取缓存回答失败 (%s): %v", user, err)
+			return "", 0, answerNone
+		}
+
+		var answer cachedAnswer
+		if err := json.Unmarshal(data, &answer); err != nil {
+			continue
+		}
+		if time.Now().After(answer.ExpiresAt) {
+			expired = true
+			continue
+		}
+		remaining, err := state.Len(ctx, key)
+		if err != nil {
+			log.Printf("⚠️ 读取剩余回答数失败 (%s): %v", user, err)
+		}
+		return answer.Text, remaining, answerReady
+	}
+
+	if expired {
+		return "", 0, answerExpired
+	}
+	return "", 0, answerNone
+}
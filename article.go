@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 公众号文章摘要：文本或链接消息中包含 mp.weixin.qq.com 的文章链接时，下载文章、去掉 HTML 后交给模型总结要点。
+// 只发链接时的摘要按链接缓存 article.cache_ttl，同一篇文章被多人转发时不重复调用模型；链接附带的文字作为用户对文章的提问
+var articleClient = &http.Client{Timeout: 15 * time.Second}
+
+var (
+	articleURLPattern     = regexp.MustCompile(`https?://mp\.weixin\.qq\.com/s[/?][^\s<>"'，。！？）]+`)
+	articleTitlePattern   = regexp.MustCompile(`<meta\s+property="og:title"\s+content="([^"]*)"`)
+	articleScriptPattern  = regexp.MustCompile(`(?is)<script.*?</script>|<style.*?</style>`)
+	articleBreakPattern   = regexp.MustCompile(`(?i)<(br|/p|/div|/section|/h[1-6]|/li)\b[^>]*>`)
+	articleTagPattern     = regexp.MustCompile(`<[^>]+>`)
+	articleSpacesPattern  = regexp.MustCompile(`[ \t\x{a0}\x{3000}]+`)
+	articleNewlinePattern = regexp.MustCompile(`\s*\n\s*`)
+)
+
+type article struct {
+	Title   string
+	Content string
+}
+
+// 文本中的第一个公众号文章链接及其余文字
+func findArticleURL(text string) (url, rest string, ok bool) {
+	if !viper.GetBool("article.enabled") {
+		return "", "", false
+	}
+	loc := articleURLPattern.FindStringIndex(text)
+	if loc == nil {
+		return "", "", false
+	}
+	return text[loc[0]:loc[1]], strings.Join(strings.Fields(text[:loc[0]]+" "+text[loc[1]:]), " "), true
+}
+
+// 下载文章并提取标题和正文，正文超过 article.max_chars 时截断
+func fetchArticle(ctx context.Context, url string) (article, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return article{}, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 MicroMessenger/8.0.47")
+	resp, err := articleClient.Do(req)
+	if err != nil {
+		return article{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return article{}, fmt.Errorf("article returned %d", resp.StatusCode)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+	if err != nil {
+		return article{}, err
+	}
+
+	a := parseArticle(string(page))
+	if a.Content == "" {
+		return a, errors.New("article has no content")
+	}
+	a.Content = truncateRunes(a.Content, viper.GetInt("article.max_chars"))
+	return a, nil
+}
+
+// 正文在 id="js_content" 的元素中，其后的脚本不属于正文
+func parseArticle(page string) article {
+	var a article
+	if m := articleTitlePattern.FindStringSubmatch(page); m != nil {
+		a.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+	}
+	i := strings.Index(page, `id="js_content"`)
+	if i < 0 {
+		return a
+	}
+	body := page[i:]
+	if j := strings.Index(body, ">"); j >= 0 {
+		body = body[j+1:]
+	}
+	if j := strings.Index(body, "<script"); j >= 0 {
+		body = body[:j]
+	}
+	body = articleScriptPattern.ReplaceAllString(body, "")
+	body = articleBreakPattern.ReplaceAllString(body, "\n")
+	body = html.UnescapeString(articleTagPattern.ReplaceAllString(body, ""))
+	body = articleSpacesPattern.ReplaceAllString(body, " ")
+	a.Content = strings.TrimSpace(articleNewlinePattern.ReplaceAllString(body, "\n"))
+	return a
+}
+
+func articleCacheKey(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return "article:" + hex.EncodeToString(sum[:])
+}
+
+// 总结文章，question 为用户附带的提问。文章无法读取时返回说明而非错误，避免进入重试队列
+func summarizeArticle(ctx context.Context, user, url, question string) (string, error) {
+	cacheKey := articleCacheKey(url)
+	_, regenerating := regenerationFrom(ctx)
+	if question == "" && !regenerating {
+		if cached, err := state.Get(ctx, cacheKey); err == nil {
+			logf(ctx, "📰 文章摘要命中缓存: %s", url)
+			return string(cached), nil
+		}
+	}
+
+	a, err := fetchArticle(ctx, url)
+	if err != nil {
+		logf(ctx, "❌ 读取文章失败 %s: %v", url, err)
+		return "❌ 未能读取这篇文章，文章可能已被删除或需要在微信中打开。", nil
+	}
+	logf(ctx, "📰 已读取文章《%s》（%d 字）", a.Title, len([]rune(a.Content)))
+
+	content := fmt.Sprintf("标题：%s\n\n正文：\n%s", a.Title, a.Content)
+	if question != "" {
+		content += "\n\n用户的问题：" + question
+	}
+	provider, model := userModelVia(user)
+	params := userGenerationParams(user)
+	if r, ok := regenerationFrom(ctx); ok && r.Temperature != nil {
+		params.Temperature = r.Temperature
+	}
+
+	start := time.Now()
+	answer, err := chatCompletionVia(ctx, provider, model, []chatMessage{
+		{Role: "system", Content: renderPrompt(ctx, viper.GetString("article.prompt"), user)},
+		{Role: "user", Content: content},
+	}, params)
+	latency := time.Since(start)
+	recordQA(qaRecord{OpenID: user, Model: model, Question: strings.TrimSpace(url + " " + question),
+		Answer: answer, Latency: latency, Failed: err != nil})
+	recordAudit(ctx, AuditEntry{OpenID: user, Direction: AuditAnswer, Content: answer, Model: model,
+		LatencyMs: latency.Milliseconds(), Failed: err != nil, Moderation: answerModeration(err)})
+	if err != nil {
+		return "", err
+	}
+	if question == "" {
+		if err := state.Set(ctx, cacheKey, []byte(answer), viper.GetDuration("article.cache_ttl")); err != nil {
+			logf(ctx, "⚠️ 缓存文章摘要失败: %v", err)
+		}
+	}
+	return answer, nil
+}
+
+// 链接消息中的公众号文章转为文本消息，交给后续的扣费、排队和模型调用
+func articleMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType == "link" {
+			if url, _, ok := findArticleURL(msg.URL); ok {
+				msg.MsgType, msg.Content = "text", url
+			}
+		}
+		return next(ctx, msg)
+	}
+}
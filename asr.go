@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+var asrClient = &http.Client{Timeout: 60 * time.Second}
+
+// OpenAI 兼容的语音识别接口（POST multipart /audio/transcriptions）
+type openAISpeechToText struct {
+	name   string
+	config speechConfig
+}
+
+func newOpenAISpeechToText(name string, c speechConfig) *openAISpeechToText {
+	return &openAISpeechToText{name: name, config: c}
+}
+
+func (p *openAISpeechToText) Name() string { return p.name }
+
+func (p *openAISpeechToText) Transcribe(ctx context.Context, filename string, audio []byte) (string, error) {
+	apiURL := p.config.endpoint("/audio/transcriptions")
+	if apiURL == "" {
+		return "", fmt.Errorf("%s: api_url is not configured", p.name)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	_ = w.WriteField("model", p.config.Model)
+	if p.config.Language != "" {
+		_ = w.WriteField("language", p.config.Language)
+	}
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if p.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.APIKey)
+	}
+	resp, err := asrClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%s returned %d: %s", p.name, resp.StatusCode, msg)
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Text, nil
+}
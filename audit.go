@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 审计日志方向
+const (
+	AuditInbound = "in"     // 用户发来的消息或事件
+	AuditReply   = "reply"  // 被动回复
+	AuditAnswer  = "answer" // 模型生成的回答（可能随被动回复返回，也可能缓存或推送）
+)
+
+// 审计日志中的一条记录，只追加不修改
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	RequestID  string    `json:"request_id,omitempty"`
+	OpenID     string    `json:"openid"`
+	Direction  string    `json:"direction"`
+	MsgType    string    `json:"msg_type,omitempty"`
+	Content    string    `json:"content"`
+	Model      string    `json:"model,omitempty"`
+	LatencyMs  int64     `json:"latency_ms,omitempty"`
+	Failed     bool      `json:"failed,omitempty"`
+	Moderation string    `json:"moderation,omitempty"` // 回答的内容审核结果：passed 或 filtered
+}
+
+// 模型回答的内容审核结果：被模型服务的内容过滤拦截时为 filtered，否则为 passed
+func answerModeration(err error) string {
+	if isModerationBlocked(err) {
+		return "filtered"
+	}
+	return "passed"
+}
+
+func recordAudit(ctx context.Context, e AuditEntry) {
+	if !viper.GetBool("audit.enabled") {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO audit_log (created_at, request_id, openid, direction, msg_type, content, model, latency_ms, failed, moderation)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().Unix(), requestID(ctx), pseudonym(e.OpenID), e.Direction, e.MsgType, e.Content, e.Model, e.LatencyMs, e.Failed, e.Moderation)
+	if err != nil {
+		log.Printf("⚠️ 写入审计日志失败 [%s]: %v", e.OpenID, err)
+	}
+}
+
+// 记录收到的消息，事件和媒体消息记录事件名或素材 ID
+func auditInbound(ctx context.Context, msg WeChatMessage) {
+	content := msg.Content
+	switch msg.MsgType {
+	case "event":
+		content = strings.TrimSpace(msg.Event + " " + msg.EventKey)
+	case "text":
+	default:
+		content = msg.MediaID
+	}
+	recordAudit(ctx, AuditEntry{OpenID: msg.FromUserName, Direction: AuditInbound, MsgType: msg.MsgType, Content: content})
+}
+
+// 回调的审计中间件：记录收到的消息和被动回复
+func auditMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		auditInbound(ctx, msg)
+		response, ok := next(ctx, msg)
+		if ok {
+			msgType := "text"
+			if r, rich := richReply(ctx, msg); rich {
+				msgType = r.MsgType.Value
+			}
+			recordAudit(ctx, AuditEntry{OpenID: msg.FromUserName, Direction: AuditReply, MsgType: msgType, Content: response})
+		}
+		return response, ok
+	}
+}
+
+// 审计日志查询条件，零值表示不限
+type AuditQuery struct {
+	OpenID    string
+	Direction string
+	Keyword   string
+	From, To  time.Time
+	BeforeID  int64 // 翻页：只返回 id 小于该值的记录
+	Limit     int
+}
+
+// 按条件倒序查询审计日志
+func searchAudit(q AuditQuery) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	if q.OpenID != "" {
+		where = append(where, "openid = ?")
+		args = append(args, pseudonym(q.OpenID))
+	}
+	if q.Direction != "" {
+		where = append(where, "direction = ?")
+		args = append(args, q.Direction)
+	}
+	if q.Keyword != "" {
+		where = append(where, `content LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Keyword)+"%")
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.To.Unix())
+	}
+	if q.BeforeID > 0 {
+		where = append(where, "id < ?")
+		args = append(args, q.BeforeID)
+	}
+	if q.Limit <= 0 || q.Limit > 500 {
+		q.Limit = 100
+	}
+
+	query := `SELECT id, created_at, request_id, openid, direction, msg_type, content, model, latency_ms, failed, moderation FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	rows, err := db.Query(query, append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var created int64
+		if err := rows.Scan(&e.ID, &created, &e.RequestID, &e.OpenID, &e.Direction, &e.MsgType, &e.Content,
+			&e.Model, &e.LatencyMs, &e.Failed, &e.Moderation); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.Unix(created, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// 解析查询参数中的时间：Unix 秒、RFC3339 或 2006-01-02（本地时间）
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want unix seconds, RFC3339 or 2006-01-02", s)
+}
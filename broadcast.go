@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 群发任务状态
+const (
+	BroadcastPending   = "pending"   // 等待发送
+	BroadcastSending   = "sending"   // 已领取、正在提交微信；提交后未能保存结果（如进程退出）时停留在该状态，不自动重试，需人工确认
+	BroadcastSubmitted = "submitted" // 已提交微信，等待群发结果
+	BroadcastSuccess   = "success"   // 群发完成
+	BroadcastFailed    = "failed"    // 提交或群发失败
+	BroadcastCanceled  = "canceled"  // 已取消
+)
+
+// 定时群发任务
+type Broadcast struct {
+	ID          string    `json:"id"`
+	MsgType     string    `json:"msg_type"`           // text 或 news
+	Content     string    `json:"content,omitempty"`  // 文本内容（text）
+	MediaID     string    `json:"media_id,omitempty"` // 图文素材 media_id（news）
+	ToAll       bool      `json:"to_all"`
+	TagID       int       `json:"tag_id,omitempty"`
+	OpenIDs     []string  `json:"openids,omitempty"` // 按 OpenID 列表群发，2~10000 个
+	SendAt      time.Time `json:"send_at"`
+	Status      string    `json:"status"`
+	MsgID       int64     `json:"msg_id,omitempty"`
+	MsgDataID   int64     `json:"msg_data_id,omitempty"`
+	TotalCount  int       `json:"total_count"`
+	FilterCount int       `json:"filter_count"`
+	SentCount   int       `json:"sent_count"`
+	ErrorCount  int       `json:"error_count"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// 群发任务保存在 broadcasts 表中，定时发送的任务和发送结果在重启后仍然保留
+var errBroadcastNotFound = errors.New("broadcast not found")
+
+func saveBroadcast(b *Broadcast) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO broadcasts (id, status, send_at, msg_id, data, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET status = excluded.status, send_at = excluded.send_at, msg_id = excluded.msg_id,
+		data = excluded.data, updated_at = excluded.updated_at`,
+		b.ID, b.Status, b.SendAt.Unix(), b.MsgID, string(data), b.UpdatedAt.Unix())
+	return err
+}
+
+// 仅当任务仍处于 from 状态时保存，返回是否已保存。
+// 领取和取消都经此修改状态，多个实例或并发的请求不会覆盖彼此的结果
+func updateBroadcastFrom(b *Broadcast, from string) (bool, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`UPDATE broadcasts SET status = ?, msg_id = ?, data = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		b.Status, b.MsgID, string(data), b.UpdatedAt.Unix(), b.ID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// 按条件查询群发任务，按计划发送时间排序
+func queryBroadcasts(where string, args ...interface{}) ([]Broadcast, error) {
+	rows, err := db.Query(`SELECT data FROM broadcasts `+where+` ORDER BY send_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Broadcast{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var b Broadcast
+		if err := json.Unmarshal([]byte(data), &b); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 校验群发内容
+func validateBroadcastContent(b *Broadcast) error {
+	switch b.MsgType {
+	case "text":
+		if b.Content == "" {
+			return errors.New("content is required for text broadcast")
+		}
+	case "news":
+		if b.MediaID == "" {
+			return errors.New("media_id is required for news broadcast")
+		}
+	default:
+		return fmt.Errorf("unsupported msg_type %q", b.MsgType)
+	}
+	return nil
+}
+
+// 校验并登记一个群发任务
+func createBroadcast(b *Broadcast) error {
+	if err := validateBroadcastContent(b); err != nil {
+		return err
+	}
+	targets := 0
+	for _, set := range []bool{b.ToAll, b.TagID != 0, len(b.OpenIDs) > 0} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return errors.New("exactly one of to_all, tag_id or openids must be set")
+	}
+	if n := len(b.OpenIDs); n > 0 && (n < 2 || n > 10000) {
+		return errors.New("openids must contain 2 to 10000 entries")
+	}
+
+	now := time.Now()
+	b.ID = newID()
+	b.Status = BroadcastPending
+	if b.SendAt.IsZero() {
+		b.SendAt = now
+	}
+	b.CreatedAt = now
+	b.UpdatedAt = now
+
+	if err := saveBroadcast(b); err != nil {
+		return err
+	}
+	log.Printf("📣 群发任务 %s 已创建，计划发送时间 %s", b.ID, b.SendAt.Format(time.RFC3339))
+	return nil
+}
+
+func listBroadcasts() ([]Broadcast, error) {
+	return queryBroadcasts(``)
+}
+
+func getBroadcast(id string) (Broadcast, error) {
+	var data string
+	err := db.QueryRow(`SELECT data FROM broadcasts WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Broadcast{}, errBroadcastNotFound
+	}
+	if err != nil {
+		return Broadcast{}, err
+	}
+	var b Broadcast
+	err = json.Unmarshal([]byte(data), &b)
+	return b, err
+}
+
+// 取消尚未发送的群发任务
+func cancelBroadcast(id string) error {
+	b, err := getBroadcast(id)
+	if err != nil {
+		return err
+	}
+	if b.Status != BroadcastPending {
+		return fmt.Errorf("broadcast is %s and can no longer be canceled", b.Status)
+	}
+	b.Status = BroadcastCanceled
+	b.UpdatedAt = time.Now()
+	ok, err := updateBroadcastFrom(&b, BroadcastPending)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("broadcast is being sent and can no longer be canceled")
+	}
+	return nil
+}
+
+// 发送已到期的群发任务，由定时任务调度器周期性调用。启动前计划的任务同样从数据库读出发送
+func dispatchDueBroadcasts() {
+	due, err := queryBroadcasts(`WHERE status = ? AND send_at <= ?`, BroadcastPending, time.Now().Unix())
+	if err != nil {
+		log.Printf("❌ 读取待发送的群发任务失败: %v", err)
+		return
+	}
+
+	for _, b := range due {
+		// 先把任务从 pending 改为 sending 再调用群发接口：读出后可能已被取消或被其他实例领取，
+		// 提交后进程退出时任务停留在 sending，重启后不会再次群发
+		b.Status = BroadcastSending
+		b.UpdatedAt = time.Now()
+		claimed, err := updateBroadcastFrom(&b, BroadcastPending)
+		if err != nil {
+			log.Printf("❌ 领取群发任务 %s 失败: %v", b.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		msgID, msgDataID, err := sendMassMessage(&b)
+		if err != nil {
+			log.Printf("❌ 群发任务 %s 提交失败: %v", b.ID, err)
+			b.Status = BroadcastFailed
+			b.Error = err.Error()
+		} else {
+			log.Printf("📣 群发任务 %s 已提交，msg_id=%d", b.ID, msgID)
+			b.Status = BroadcastSubmitted
+			b.MsgID = msgID
+			b.MsgDataID = msgDataID
+		}
+		b.UpdatedAt = time.Now()
+		if err := saveBroadcast(&b); err != nil {
+			log.Printf("❌ 保存群发任务 %s 失败: %v", b.ID, err)
+		}
+	}
+}
+
+// 群发消息的内容部分
+func massMessageContent(b *Broadcast, payload map[string]interface{}) {
+	switch b.MsgType {
+	case "text":
+		payload["msgtype"] = "text"
+		payload["text"] = map[string]string{"content": b.Content}
+	case "news":
+		payload["msgtype"] = "mpnews"
+		payload["mpnews"] = map[string]string{"media_id": b.MediaID}
+		payload["send_ignore_reprint"] = 0
+	}
+}
+
+// 调用微信群发接口：按 OpenID 列表（mass/send），或按标签、全部粉丝（mass/sendall）
+func sendMassMessage(b *Broadcast) (int64, int64, error) {
+	path := "/cgi-bin/message/mass/sendall"
+	payload := map[string]interface{}{
+		"filter": map[string]interface{}{
+			"is_to_all": b.ToAll,
+			"tag_id":    b.TagID,
+		},
+	}
+	if len(b.OpenIDs) > 0 {
+		path = "/cgi-bin/message/mass/send"
+		payload = map[string]interface{}{"touser": b.OpenIDs}
+	}
+	massMessageContent(b, payload)
+
+	var result struct {
+		MsgID     int64 `json:"msg_id"`
+		MsgDataID int64 `json:"msg_data_id"`
+	}
+	if err := wechatPost(path, payload, &result); err != nil {
+		return 0, 0, err
+	}
+	return result.MsgID, result.MsgDataID, nil
+}
+
+// 把群发内容预览发送给一位用户（通常是管理员），确认无误后再正式群发
+func previewBroadcast(b *Broadcast, openID string) error {
+	if err := validateBroadcastContent(b); err != nil {
+		return err
+	}
+	if openID == "" {
+		return errors.New("openid is required")
+	}
+	payload := map[string]interface{}{"touser": openID}
+	massMessageContent(b, payload)
+	return wechatPost("/cgi-bin/message/mass/preview", payload, nil)
+}
+
+// 主动查询已提交群发任务的发送状态
+func refreshBroadcastStatus(id string) (Broadcast, error) {
+	b, err := getBroadcast(id)
+	if err != nil {
+		return Broadcast{}, err
+	}
+	if b.Status != BroadcastSubmitted {
+		return b, nil
+	}
+
+	var result struct {
+		MsgStatus string `json:"msg_status"`
+	}
+	if err := wechatPost("/cgi-bin/message/mass/get", map[string]interface{}{"msg_id": fmt.Sprint(b.MsgID)}, &result); err != nil {
+		log.Printf("⚠️ 查询群发任务 %s 状态失败: %v", b.ID, err)
+		return b, nil
+	}
+	applyBroadcastStatus(b.MsgID, result.MsgStatus, nil)
+	return getBroadcast(id)
+}
+
+// 根据微信返回的群发状态（mass/get 或 MASSSENDJOBFINISH 事件）更新任务
+func applyBroadcastStatus(msgID int64, status string, msg *WeChatMessage) {
+	list, err := queryBroadcasts(`WHERE msg_id = ? AND status = ?`, msgID, BroadcastSubmitted)
+	if err != nil {
+		log.Printf("❌ 读取群发任务失败: %v", err)
+		return
+	}
+	for _, b := range list {
+		switch status {
+		case "SENDING":
+			return
+		case "SEND_SUCCESS", "send success":
+			b.Status = BroadcastSuccess
+		default:
+			b.Status = BroadcastFailed
+			b.Error = status
+		}
+		if msg != nil {
+			b.TotalCount = msg.TotalCount
+			b.FilterCount = msg.FilterCount
+			b.SentCount = msg.SentCount
+			b.ErrorCount = msg.ErrorCount
+		}
+		b.UpdatedAt = time.Now()
+		if err := saveBroadcast(&b); err != nil {
+			log.Printf("❌ 保存群发任务 %s 失败: %v", b.ID, err)
+		}
+		log.Printf("📣 群发任务 %s 结果: %s (%d/%d)", b.ID, status, b.SentCount, b.TotalCount)
+		return
+	}
+}
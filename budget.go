@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 费用上限：按 pricing 估算当天和当月的模型费用，超过 budget.daily / budget.monthly 后
+// budget.action 为 fallback 时改用 budget.fallback_model，为 pause 时暂停调用模型并回复 messages.budget_exceeded
+const (
+	BudgetActionFallback = "fallback"
+	BudgetActionPause    = "pause"
+)
+
+// 费用超过上限、暂停调用模型时的错误
+var errBudgetExceeded = errors.New("llm budget exceeded")
+
+// 最近一次统计的费用，每隔 budget.refresh_interval 重新查询
+var (
+	budgetMu      sync.Mutex
+	budgetChecked time.Time
+	budgetScope   string // 超出的上限：daily、monthly，未超出时为空
+)
+
+// day 及之后全部模型的估算费用（元），未配置单价的模型不计入
+func spendSince(day string) (float64, error) {
+	rows, err := db.Query(`SELECT model, SUM(prompt_tokens), SUM(completion_tokens)
+		FROM model_usage WHERE day >= ? GROUP BY model`, day)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	total := 0.0
+	for rows.Next() {
+		var model string
+		var promptTokens, completionTokens int
+		if err := rows.Scan(&model, &promptTokens, &completionTokens); err != nil {
+			return 0, err
+		}
+		if cost, ok := modelCost(model, promptTokens, completionTokens); ok {
+			total += cost
+		}
+	}
+	return total, rows.Err()
+}
+
+// 返回已超出的上限（daily 或 monthly），未超出或未开启时返回空
+func budgetExceeded(ctx context.Context) string {
+	if !viper.GetBool("budget.enabled") {
+		return ""
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	if time.Since(budgetChecked) < viper.GetDuration("budget.refresh_interval") {
+		return budgetScope
+	}
+	budgetChecked = time.Now()
+
+	now := time.Now()
+	scope, spent, limit, err := checkBudget(now)
+	if err != nil {
+		// 统计失败时沿用上一次的结果
+		log.Printf("⚠️ 统计模型费用失败: %v", err)
+		return budgetScope
+	}
+	if scope != "" && scope != budgetScope {
+		notifyBudgetExceeded(ctx, now, scope, spent, limit)
+	}
+	if scope == "" && budgetScope != "" {
+		log.Printf("✅ 模型费用已回到上限以内，恢复正常调用")
+	}
+	budgetScope = scope
+	return scope
+}
+
+func checkBudget(now time.Time) (scope string, spent, limit float64, err error) {
+	if limit = viper.GetFloat64("budget.daily"); limit > 0 {
+		if spent, err = spendSince(now.Format("2006-01-02")); err != nil || spent >= limit {
+			return "daily", spent, limit, err
+		}
+	}
+	if limit = viper.GetFloat64("budget.monthly"); limit > 0 {
+		if spent, err = spendSince(now.Format("2006-01") + "-01"); err != nil || spent >= limit {
+			return "monthly", spent, limit, err
+		}
+	}
+	return "", 0, 0, nil
+}
+
+// 每个周期只通知一次管理员，多实例部署时通过状态存储去重
+func notifyBudgetExceeded(ctx context.Context, now time.Time, scope string, spent, limit float64) {
+	period, name, ttl := now.Format("2006-01-02"), "今日", 48*time.Hour
+	if scope == "monthly" {
+		period, name, ttl = now.Format("2006-01"), "本月", 32*24*time.Hour
+	}
+	action := "已暂停调用模型"
+	if viper.GetString("budget.action") == BudgetActionFallback {
+		action = "已切换到 " + viper.GetString("budget.fallback_model")
+	}
+	log.Printf("💸 %s模型费用 ¥%.2f 超过上限 ¥%.2f，%s", name, spent, limit, action)
+	if sent, err := state.SetNX(ctx, "budget:notified:"+scope+":"+period, []byte{1}, ttl); err != nil || !sent {
+		return
+	}
+	sendAlert(fmt.Sprintf("💸 %s模型费用 ¥%.2f 已超过上限 ¥%.2f，%s。", name, spent, limit, action))
+}
+
+// 调用模型前检查费用上限，返回实际使用的服务和模型；暂停时返回 errBudgetExceeded
+func applyBudget(ctx context.Context, providerName, model string) (string, string, error) {
+	if budgetExceeded(ctx) == "" {
+		return providerName, model, nil
+	}
+	if viper.GetString("budget.action") == BudgetActionPause {
+		return "", "", errBudgetExceeded
+	}
+	if fallback := viper.GetString("budget.fallback_model"); fallback != model {
+		logf(ctx, "💸 费用超过上限，模型 %s 改用 %s", model, fallback)
+		return viper.GetString("budget.fallback_provider"), fallback, nil
+	}
+	return providerName, model, nil
+}
+
+// 暂停调用模型时直接回复提问，不扣减积分
+func budgetMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType == "text" && viper.GetString("budget.action") == BudgetActionPause && budgetExceeded(ctx) != "" {
+			return userMessage(ctx, MessageBudgetExceeded, msg.FromUserName, nil), true
+		}
+		return next(ctx, msg)
+	}
+}
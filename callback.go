@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 回调接口的输入校验：/wx、/wecom 是公网接口，签名校验之前先限制请求体大小和类型，
+// 解析时只接受根元素为 <xml> 的单个文档，并检查必需的字段
+
+var callbackRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mpbot_callback_rejected_total",
+	Help: "Callback requests rejected before processing by reason (too_large, content_type, malformed).",
+}, []string{"reason"})
+
+// 微信回调使用的请求体类型，部分请求不带 Content-Type
+var callbackContentTypes = map[string]bool{"": true, "text/xml": true, "application/xml": true}
+
+var msgTypePattern = regexp.MustCompile(`^[a-z_]{1,32}$`)
+
+// 限制请求体不超过 server.callback_max_bytes、类型为 XML，读出后放回供后续处理
+func limitCallbackBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		mediaType := ""
+		if ct := c.GetHeader("Content-Type"); ct != "" {
+			var err error
+			if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+				mediaType = ct
+			}
+		}
+		if !callbackContentTypes[strings.ToLower(mediaType)] {
+			callbackRejected.WithLabelValues("content_type").Inc()
+			logf(ctx, "❌ 拒绝 Content-Type 为 %q 的回调，来源 %s", mediaType, c.ClientIP())
+			c.AbortWithStatus(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		limit := viper.GetInt64("server.callback_max_bytes")
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				callbackRejected.WithLabelValues("too_large").Inc()
+				logf(ctx, "❌ 拒绝超过 %d 字节的回调，来源 %s", limit, c.ClientIP())
+				c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+				return
+			}
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+// 解析回调消息：根元素必须是 <xml>，不允许 DOCTYPE 和根元素之后的内容，并校验必需的字段
+func parseWeChatMessage(body []byte) (WeChatMessage, error) {
+	var msg WeChatMessage
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var root *xml.StartElement
+	for root == nil {
+		tok, err := dec.Token()
+		if err != nil {
+			return msg, fmt.Errorf("missing root element: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			root = &t
+		case xml.Directive:
+			return msg, errors.New("DOCTYPE is not allowed")
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return msg, errors.New("text before root element")
+			}
+		}
+	}
+	if root.Name.Local != "xml" {
+		return msg, fmt.Errorf("unexpected root element <%s>", root.Name.Local)
+	}
+	if err := dec.DecodeElement(&msg, root); err != nil {
+		return msg, err
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return msg, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return msg, errors.New("text after root element")
+			}
+		case xml.Comment:
+		default:
+			return msg, errors.New("content after root element")
+		}
+	}
+	return msg, validateWeChatMessage(msg)
+}
+
+func validateWeChatMessage(msg WeChatMessage) error {
+	if msg.FromUserName == "" || len(msg.FromUserName) > 128 || strings.IndexFunc(msg.FromUserName, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return fmt.Errorf("invalid FromUserName %q", truncateRunes(msg.FromUserName, 32))
+	}
+	if !msgTypePattern.MatchString(msg.MsgType) {
+		return fmt.Errorf("invalid MsgType %q", truncateRunes(msg.MsgType, 32))
+	}
+	return nil
+}
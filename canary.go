@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 灰度发布的分组
+const (
+	CanaryArmStable = "stable"
+	CanaryArmCanary = "canary"
+)
+
+var (
+	canaryAnswers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_canary_answers_total",
+		Help: "Answers generated in the canary rollout by arm and result (ok or error).",
+	}, []string{"experiment", "arm", "result"})
+
+	canaryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mpbot_canary_answer_duration_seconds",
+		Help:    "Latency of answers in the canary rollout by arm.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"experiment", "arm"})
+)
+
+// 用户所在的分组及其使用的服务和模型
+type canaryAssignment struct {
+	Arm      string
+	Provider string
+	Model    string
+}
+
+// 开启 experiments.canary 时按 OpenID 稳定分桶，percent 比例的用户使用新的服务/模型，其余保持 deepseek.model。
+// 用户自己选择了模型时不参与
+func canaryForUser(user string) (canaryAssignment, bool) {
+	if !viper.GetBool("experiments.canary.enabled") || getUserSettings(user).Model != "" || hasSpecialTier(user) {
+		return canaryAssignment{}, false
+	}
+	// 以万分之一为单位分桶，支持 0.5% 这样的比例
+	bucket := experimentBucket(viper.GetString("experiments.canary.name"), user, 10000)
+	if float64(bucket) < viper.GetFloat64("experiments.canary.percent")*100 {
+		return canaryAssignment{
+			Arm:      CanaryArmCanary,
+			Provider: viper.GetString("experiments.canary.provider"),
+			Model:    viper.GetString("experiments.canary.model"),
+		}, true
+	}
+	return canaryAssignment{Arm: CanaryArmStable, Provider: "deepseek", Model: viper.GetString("deepseek.model")}, true
+}
+
+// 按天累计各分组的回答数、失败数和耗时，同时更新 Prometheus 指标
+func recordCanary(arm string, latency time.Duration, failed bool) {
+	name := viper.GetString("experiments.canary.name")
+	result, failures := "ok", 0
+	if failed {
+		result, failures = "error", 1
+	}
+	canaryAnswers.WithLabelValues(name, arm, result).Inc()
+	canaryDuration.WithLabelValues(name, arm).Observe(latency.Seconds())
+
+	_, err := db.Exec(`INSERT INTO canary_usage (day, experiment, arm, answers, failures, latency_ms)
+		VALUES (?, ?, ?, 1, ?, ?)
+		ON CONFLICT(day, experiment, arm) DO UPDATE SET answers = answers + 1, failures = failures + excluded.failures,
+			latency_ms = latency_ms + excluded.latency_ms`,
+		time.Now().Format("2006-01-02"), name, arm, failures, latency.Milliseconds())
+	if err != nil {
+		log.Printf("⚠️ 记录灰度用量失败 [%s]: %v", arm, err)
+	}
+}
+
+// 灰度分组的统计
+type canaryStats struct {
+	Arm          string  `json:"arm"`
+	Answers      int     `json:"answers"`
+	Failures     int     `json:"failures"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// 统计 since 当天起实验各分组的用量
+func canaryExperimentStats(experiment string, since time.Time) ([]canaryStats, error) {
+	rows, err := db.Query(`SELECT arm, SUM(answers), SUM(failures), SUM(latency_ms)
+		FROM canary_usage WHERE experiment = ? AND day >= ? GROUP BY arm ORDER BY arm DESC`,
+		experiment, since.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []canaryStats{}
+	for rows.Next() {
+		var s canaryStats
+		var latency int64
+		if err := rows.Scan(&s.Arm, &s.Answers, &s.Failures, &latency); err != nil {
+			return nil, err
+		}
+		if s.Answers > 0 {
+			s.ErrorRate = float64(s.Failures) * 100 / float64(s.Answers)
+			s.AvgLatencyMs = float64(latency) / float64(s.Answers)
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
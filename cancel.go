@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用户发送“取消”时放弃排队和正在生成的问题：正在生成的问题取消 context，中断对模型的请求；
+// 排队的问题从进程内队列移除，外部队列中的问题由 worker 按取消时间跳过。被取消的问题不缓存回答、不写入对话历史
+
+// 本进程正在生成的回答，同一用户的问题串行处理，每个用户最多一个
+type generation struct {
+	cancel  context.CancelFunc
+	started time.Time
+}
+
+var activeGenerations sync.Map // openid -> *generation
+
+func cancelKey(user string) string { return "cancel:" + user }
+
+// 开始生成回答，返回可被取消的 context 和结束时调用的函数。
+// 状态存储为 Redis 时问题可能在其他实例上被取消，生成期间每秒检查一次取消时间
+func startGeneration(ctx context.Context, user string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &generation{cancel: cancel, started: time.Now()}
+	activeGenerations.Store(user, g)
+
+	if _, shared := state.(*redisStateStore); shared {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if canceledSince(ctx, user, g.started) {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+	return ctx, func() {
+		activeGenerations.CompareAndDelete(user, g)
+		cancel()
+	}
+}
+
+// 用户是否在 t 之后取消过问题
+func canceledSince(ctx context.Context, user string, t time.Time) bool {
+	data, err := state.Get(ctx, cancelKey(user))
+	if err != nil {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339Nano, string(data))
+	return err == nil && !t.After(at)
+}
+
+// 生成是否因用户取消而中断
+func generationCanceled(ctx context.Context, err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled)
+}
+
+// 取消用户排队和正在生成的问题，返回取消的问题数
+func cancelQuestions(ctx context.Context, user string) int {
+	queued, _ := state.Len(ctx, queuedProgressKey(user))
+	p, ok := loadProgress(ctx, user)
+	generating := ok && p.Status == ProgressGenerating
+	if queued == 0 && !generating {
+		return 0
+	}
+
+	if err := state.Set(ctx, cancelKey(user), []byte(time.Now().Format(time.RFC3339Nano)), progressTTL()); err != nil {
+		logf(ctx, "⚠️ 记录取消时间失败: %v", err)
+	}
+	if err := state.Delete(ctx, queuedProgressKey(user)); err != nil {
+		logf(ctx, "⚠️ 清除排队进度失败: %v", err)
+	}
+	dropQueuedQuestions(user)
+	if v, ok := activeGenerations.Load(user); ok {
+		v.(*generation).cancel()
+	}
+	if generating {
+		p.Status, p.FinishedAt = ProgressCanceled, time.Now()
+		saveProgress(ctx, user, p)
+	}
+
+	n := queued
+	if generating {
+		n++
+	}
+	logf(ctx, "🛑 用户 %s 取消了 %d 个问题", user, n)
+	return n
+}
+
+// 处理“取消”指令
+func handleCancelCommand(openID, content string) (string, bool) {
+	if strings.TrimSpace(content) != "取消" {
+		return "", false
+	}
+	n := cancelQuestions(context.Background(), openID)
+	if n == 0 {
+		return "💤 目前没有处理中的问题。", true
+	}
+	return fmt.Sprintf("🛑 已取消 %d 个问题。", n), true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 构建信息，发布时通过 -ldflags "-X main.version=v1.2.3 -X main.commit=... -X main.buildDate=..." 注入
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// 配置文件路径，各子命令均可通过 -config 指定
+var configFile = "config.yaml"
+
+const cliUsage = `用法: mpbot <命令> [参数]
+
+命令:
+  serve          启动服务（默认）
+  chat           在终端中与机器人对话
+  check-config   检查配置并测试微信、DeepSeek 和数据库的连通性
+  simulate       向本地 /wx 发送带签名的模拟消息（text、event、image、voice）
+  replay         回放录制的回调请求（recording.enabled 开启时录制）
+  init-config    生成带注释的配置文件，-print 输出生效的配置（凭据已遮盖）
+  version        输出版本信息
+
+使用 "mpbot <命令> -h" 查看命令的参数。
+`
+
+func runCLI(args []string) {
+	// 不带子命令时保持原来的行为，直接启动服务
+	if len(args) == 0 || args[0] == "" || args[0][0] == '-' {
+		args = append([]string{"serve"}, args...)
+	}
+
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "serve":
+		newFlagSet("serve", "启动服务").Parse(rest)
+		serve()
+	case "chat":
+		runChatREPL(rest)
+	case "check-config":
+		newFlagSet("check-config", "检查配置并测试连通性").Parse(rest)
+		os.Exit(checkConfig())
+	case "simulate":
+		runSimulate(rest)
+	case "replay":
+		runReplay(rest)
+	case "init-config":
+		runInitConfig(rest)
+	case "version":
+		newFlagSet("version", "输出版本信息").Parse(rest)
+		printVersion()
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "未知命令 %q\n\n%s", cmd, cliUsage)
+		os.Exit(2)
+	}
+}
+
+// 子命令的参数集，统一带上 -config
+func newFlagSet(name, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&configFile, "config", configFile, "配置文件路径")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: mpbot %s [参数]\n%s\n\n", name, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// 构建信息，未通过 -ldflags 注入时从 Go 记录的 VCS 信息中补齐
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+func (b BuildInfo) String() string {
+	s := "mpbot " + b.Version
+	if b.Commit != "" {
+		s += " (" + b.Commit[:min(12, len(b.Commit))]
+		if b.BuildDate != "" {
+			s += ", " + b.BuildDate
+		}
+		s += ")"
+	}
+	return s
+}
+
+func printVersion() {
+	info := buildInfo()
+	fmt.Printf("mpbot %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit:  %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("built:   %s\n", info.BuildDate)
+	}
+	fmt.Printf("go:      %s %s/%s\n", info.GoVersion, runtime.GOOS, runtime.GOARCH)
+}
+
+// 逐项检查配置与外部依赖，全部通过时返回 0
+func checkConfig() int {
+	failed := 0
+	check := func(name string, fn func() error) {
+		if err := fn(); err != nil {
+			fmt.Printf("❌ %s: %v\n", name, err)
+			failed++
+			return
+		}
+		fmt.Printf("✅ %s\n", name)
+	}
+
+	check("配置文件 "+configFile, func() error {
+		initConfig()
+		return viper.ReadInConfig()
+	})
+	check("配置校验", func() error {
+		errs := validateConfig()
+		for _, err := range errs {
+			fmt.Printf("   - %v\n", err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d 项配置有误", len(errs))
+		}
+		return nil
+	})
+	check("数据库 "+viper.GetString("database.path"), initDatabase)
+	check("向量存储", initVectorStore)
+	check("状态存储", initStateStore)
+	check("微信 access_token", func() error {
+		_, err := getAccessToken()
+		return err
+	})
+	check("DeepSeek 接口", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		provider, err := getProvider("deepseek")
+		if err != nil {
+			return err
+		}
+		one := 1
+		_, err = provider.Chat(ctx, chatRequest{
+			Model:    viper.GetString("deepseek.model"),
+			Messages: []chatMessage{{Role: "user", Content: "ping"}},
+			Params:   generationParams{MaxTokens: &one},
+		})
+		return err
+	})
+
+	if failed > 0 {
+		fmt.Printf("\n共 %d 项检查未通过\n", failed)
+		return 1
+	}
+	fmt.Println("\n全部检查通过")
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 对比模式：管理员发送“对比 问题”，同时向 experiments.compare.models 中的两个模型提问，
+// 两个回答标注名称、模型和耗时后一并返回，用于评估更换模型或提示词的效果。对比不读写对话历史
+type compareModel struct {
+	Name     string `mapstructure:"name"`
+	Provider string `mapstructure:"provider"` // 留空使用 deepseek
+	Model    string `mapstructure:"model"`
+	Prompt   string `mapstructure:"prompt"` // 为空时使用管理员当前的系统提示词
+}
+
+type comparisonKey struct{}
+
+func withComparison(ctx context.Context) context.Context {
+	return context.WithValue(ctx, comparisonKey{}, true)
+}
+
+func comparing(ctx context.Context) bool {
+	v, _ := ctx.Value(comparisonKey{}).(bool)
+	return v
+}
+
+func compareModels() []compareModel {
+	var models []compareModel
+	if err := viper.UnmarshalKey("experiments.compare.models", &models); err != nil {
+		return nil
+	}
+	for i := range models {
+		if models[i].Provider == "" {
+			models[i].Provider = "deepseek"
+		}
+		if models[i].Name == "" {
+			models[i].Name = models[i].Model
+		}
+	}
+	return models
+}
+
+// 拦截管理员的“对比 问题”，标记为对比后交给后续的排队和模型调用
+func compareMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" || !viper.GetBool("experiments.compare.enabled") || !isAdmin(msg.FromUserName) {
+			return next(ctx, msg)
+		}
+		question, ok := parseCommand(msg.Content, "对比")
+		if !ok {
+			return next(ctx, msg)
+		}
+		if question == "" {
+			return "⚠️ 用法：对比 问题\n同时向两个模型提问并返回两个回答。", true
+		}
+		msg.Content = question
+		return next(withComparison(ctx), msg)
+	}
+}
+
+// 并行向各模型提问，按配置的顺序拼接回答；全部失败时返回第一个错误
+func compareAnswers(ctx context.Context, user, query string) (string, error) {
+	models := compareModels()
+	_, tmpl := promptForUser(user)
+	kb, _ := knowledgeContext(ctx, query)
+	suffix := runtimeContext(user) + languageInstruction()
+	if kb != "" {
+		suffix = "\n\n" + kb + suffix
+	}
+	logf(ctx, "⚖️ 管理员 %s 对比 %d 个模型", user, len(models))
+
+	type result struct {
+		answer  string
+		latency time.Duration
+		err     error
+	}
+	results := make([]result, len(models))
+	var wg sync.WaitGroup
+	for i, m := range models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prompt := tmpl
+			if m.Prompt != "" {
+				prompt = m.Prompt
+			}
+			start := time.Now()
+			answer, err := chatCompletionVia(ctx, m.Provider, m.Model, []chatMessage{
+				{Role: "system", Content: renderPrompt(ctx, prompt, user) + suffix},
+				{Role: "user", Content: query},
+			}, defaultGenerationParams())
+			results[i] = result{answer: answer, latency: time.Since(start), err: err}
+		}()
+	}
+	wg.Wait()
+
+	var b strings.Builder
+	var firstErr error
+	failed := 0
+	for i, m := range models {
+		r := results[i]
+		if i > 0 {
+			b.WriteString("\n\n━━━━━━━━━━\n\n")
+		}
+		fmt.Fprintf(&b, "【%s】%s/%s，%s\n", m.Name, m.Provider, m.Model, r.latency.Round(100*time.Millisecond))
+		if r.err != nil {
+			logf(ctx, "⚠️ 对比模型 %s 调用失败: %v", m.Name, r.err)
+			fmt.Fprintf(&b, "❌ 调用失败：%v", r.err)
+			failed++
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		b.WriteString(r.answer)
+	}
+	if failed == len(models) {
+		return "", firstErr
+	}
+	return b.String(), nil
+}
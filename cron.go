@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+)
+
+// 定时任务来源
+const (
+	CronSourceConfig = "config" // config.yaml 中 cron.jobs 定义
+	CronSourceAPI    = "api"    // 管理接口创建
+)
+
+// 持久化的定时任务
+type CronJob struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Spec      string            `json:"spec"`   // cron 表达式，支持 @every 1h 等写法
+	Action    string            `json:"action"` // 对应 cronActions 中注册的动作
+	Args      map[string]string `json:"args,omitempty"`
+	Enabled   bool              `json:"enabled"`
+	Source    string            `json:"source"`
+	LastRunAt time.Time         `json:"last_run_at,omitempty"`
+	LastError string            `json:"last_error,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// 定时任务可执行的动作
+var cronActions = map[string]func(args map[string]string) error{
+	"broadcast": cronBroadcast,
+	"digest": func(map[string]string) error {
+		runDigest()
+		return nil
+	},
+	"tag_sync": func(map[string]string) error {
+		return syncUserTags()
+	},
+	"usage_report": func(map[string]string) error {
+		runUsageReport()
+		return nil
+	},
+	"membership_reminder": func(map[string]string) error {
+		return notifyExpiringMemberships()
+	},
+}
+
+var (
+	scheduler   = cron.New(cron.WithChain(cron.Recover(cronLogger{}), cron.SkipIfStillRunning(cronLogger{})))
+	cronMu      sync.Mutex
+	cronEntries = map[string]cron.EntryID{} // 任务ID -> 调度器中的条目
+)
+
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...interface{}) {}
+
+// cron.Recover 捕获到 panic 时调用，错误中已包含堆栈
+func (cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.Printf("❌ 定时任务异常: %s %v %v", msg, err, keysAndValues)
+	reportError(context.Background(), "panic", err, map[string]interface{}{"where": "cron"})
+	sendAlert(fmt.Sprintf("💥 定时任务发生 panic\n%s", truncateRunes(err.Error(), 1500)))
+}
+
+// 启动调度器：注册内置任务，同步配置中的任务，并加载数据库中的全部任务
+func startCron() {
+	scheduleShared("broadcast_dispatch", "@every "+viper.GetDuration("broadcast.check_interval").String(), dispatchDueBroadcasts)
+	if viper.GetBool("digest.enabled") {
+		if spec, err := dailySpec(viper.GetString("digest.time")); err != nil {
+			log.Printf("⚠️ digest.time 格式错误: %v", err)
+		} else {
+			scheduleShared("digest", spec, runDigest)
+		}
+	}
+
+	if viper.GetBool("report.enabled") {
+		if spec, err := dailySpec(viper.GetString("report.time")); err != nil {
+			log.Printf("⚠️ report.time 格式错误: %v", err)
+		} else {
+			scheduleShared("usage_report", spec, runUsageReport)
+		}
+	}
+
+	// Redis 自行淘汰过期的键，内存存储需要定期清理
+	if m, ok := state.(*memoryStateStore); ok {
+		scheduleBuiltin("state_cleanup", "@every "+viper.GetDuration("cache.cleanup_interval").String(), m.cleanup)
+	}
+
+	scheduleShared("outbox_cleanup", "@every 1h", cleanupOutbox)
+	if viper.GetBool("history.enabled") && historyInDatabase() {
+		scheduleShared("conversations_cleanup", "@every 1h", cleanupConversations)
+	}
+	if viper.GetBool("experiments.shadow.enabled") {
+		scheduleShared("shadow_results_cleanup", "@every 1h", cleanupShadowResults)
+	}
+	if viper.GetBool("idempotency.enabled") {
+		scheduleShared("processed_messages_cleanup", "@every 1h", cleanupProcessedMessages)
+	}
+
+	if viper.GetBool("wechat_ips.enabled") && viper.GetBool("wechat_ips.fetch") {
+		go refreshWeChatIPs()
+		scheduleBuiltin("wechat_ip_refresh", "@every "+viper.GetDuration("wechat_ips.refresh").String(), refreshWeChatIPs)
+	}
+
+	if viper.GetBool("rate_limit.enabled") || viper.GetBool("push_api.enabled") && viper.GetBool("push_api.rate_limit.enabled") {
+		scheduleBuiltin("rate_limit_cleanup", "@every 10m", cleanupIPLimiters)
+	}
+
+	if viper.GetBool("tagging.enabled") {
+		scheduleShared("tag_sync", viper.GetString("tagging.spec"), func() {
+			if err := syncUserTags(); err != nil {
+				log.Printf("❌ 标签同步失败: %v", err)
+			}
+		})
+	}
+
+	if err := syncConfigCronJobs(); err != nil {
+		log.Printf("❌ 同步配置中的定时任务失败: %v", err)
+	}
+
+	jobs, err := listCronJobs()
+	if err != nil {
+		log.Printf("❌ 加载定时任务失败: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Enabled {
+			if err := scheduleCronJob(job); err != nil {
+				log.Printf("❌ 定时任务 %s 注册失败: %v", job.Name, err)
+			}
+		}
+	}
+
+	scheduler.Start()
+	log.Printf("✅ 定时任务调度器已启动，共 %d 个任务", len(scheduler.Entries()))
+}
+
+// 注册不落库的内置任务（由配置直接推导）
+func scheduleBuiltin(name, spec string, fn func()) {
+	if _, err := scheduler.AddFunc(spec, fn); err != nil {
+		log.Printf("❌ 内置任务 %s 注册失败: %v", name, err)
+	}
+}
+
+// 把 HH:MM 转换为每天执行的 cron 表达式
+func dailySpec(hhmm string) (string, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()), nil
+}
+
+// 注册多实例部署时只需一个实例执行的内置任务
+func scheduleShared(name, spec string, fn func()) {
+	scheduleBuiltin(name, spec, singleInstance(name, spec, fn))
+}
+
+// 多实例部署时每个副本都会触发定时任务，同一个周期内只让抢到锁的实例执行。
+// 周期为 @every 的间隔，其他 cron 表达式最小粒度为一分钟。锁不主动释放，避免触发时间略晚的实例在同一周期内再次执行
+func singleInstance(name, spec string, fn func()) func() {
+	period := time.Minute
+	if s, err := cron.ParseStandard(spec); err == nil {
+		if every, ok := s.(cron.ConstantDelaySchedule); ok {
+			period = every.Delay
+		}
+	}
+	return func() {
+		slot := time.Now().UnixNano() / int64(period)
+		if _, ok := tryLock(context.Background(), fmt.Sprintf("cron:%s:%d", name, slot), period); ok {
+			fn()
+		}
+	}
+}
+
+func scheduleCronJob(job CronJob) error {
+	action, ok := cronActions[job.Action]
+	if !ok {
+		return fmt.Errorf("unknown action %q", job.Action)
+	}
+
+	cronMu.Lock()
+	defer cronMu.Unlock()
+
+	if id, ok := cronEntries[job.ID]; ok {
+		scheduler.Remove(id)
+		delete(cronEntries, job.ID)
+	}
+	entryID, err := scheduler.AddFunc(job.Spec, singleInstance("job:"+job.ID, job.Spec, func() {
+		runCronJob(job.ID, job.Name, action, job.Args)
+	}))
+	if err != nil {
+		return err
+	}
+	cronEntries[job.ID] = entryID
+	return nil
+}
+
+func unscheduleCronJob(id string) {
+	cronMu.Lock()
+	defer cronMu.Unlock()
+
+	if entryID, ok := cronEntries[id]; ok {
+		scheduler.Remove(entryID)
+		delete(cronEntries, id)
+	}
+}
+
+// 执行任务并记录最近一次运行结果
+func runCronJob(id, name string, action func(map[string]string) error, args map[string]string) {
+	log.Printf("⏰ 执行定时任务 %s", name)
+	err := action(args)
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("❌ 定时任务 %s 执行失败: %v", name, err)
+	}
+	if _, dbErr := db.Exec(`UPDATE cron_jobs SET last_run_at = ?, last_error = ? WHERE id = ?`,
+		time.Now().Unix(), lastError, id); dbErr != nil {
+		log.Printf("⚠️ 记录定时任务 %s 运行结果失败: %v", name, dbErr)
+	}
+}
+
+// 以 name 为键同步 config.yaml 中的任务，配置里已删除的任务同时从数据库移除
+func syncConfigCronJobs() error {
+	var defs []CronJob
+	if err := viper.UnmarshalKey("cron.jobs", &defs); err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, def := range defs {
+		def.Source = CronSourceConfig
+		def.Enabled = true
+		if err := validateCronJob(def); err != nil {
+			log.Printf("⚠️ 跳过配置中的定时任务 %q: %v", def.Name, err)
+			continue
+		}
+		names[def.Name] = true
+
+		existing, err := getCronJobByName(def.Name)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := insertCronJob(def); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		existing.Spec, existing.Action, existing.Args = def.Spec, def.Action, def.Args
+		if err := updateCronJob(existing); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := listCronJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Source == CronSourceConfig && !names[job.Name] {
+			if _, err := db.Exec(`DELETE FROM cron_jobs WHERE id = ?`, job.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCronJob(job CronJob) error {
+	if job.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, ok := cronActions[job.Action]; !ok {
+		return fmt.Errorf("unknown action %q", job.Action)
+	}
+	if _, err := cron.ParseStandard(job.Spec); err != nil {
+		return fmt.Errorf("invalid spec %q: %v", job.Spec, err)
+	}
+	return nil
+}
+
+func insertCronJob(job CronJob) (CronJob, error) {
+	job.ID = newID()
+	job.CreatedAt = time.Now()
+	args, _ := json.Marshal(job.Args)
+	_, err := db.Exec(`INSERT INTO cron_jobs (id, name, spec, action, args, enabled, source, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, job.Name, job.Spec, job.Action, string(args), job.Enabled, job.Source, job.CreatedAt.Unix())
+	return job, err
+}
+
+func updateCronJob(job CronJob) error {
+	args, _ := json.Marshal(job.Args)
+	_, err := db.Exec(`UPDATE cron_jobs SET spec = ?, action = ?, args = ?, enabled = ? WHERE id = ?`,
+		job.Spec, job.Action, string(args), job.Enabled, job.ID)
+	return err
+}
+
+const cronJobColumns = `id, name, spec, action, args, enabled, source, last_run_at, last_error, created_at`
+
+func scanCronJob(row interface{ Scan(...interface{}) error }) (CronJob, error) {
+	var job CronJob
+	var args string
+	var lastRun, created int64
+	err := row.Scan(&job.ID, &job.Name, &job.Spec, &job.Action, &args, &job.Enabled, &job.Source, &lastRun, &job.LastError, &created)
+	if err != nil {
+		return job, err
+	}
+	_ = json.Unmarshal([]byte(args), &job.Args)
+	if lastRun > 0 {
+		job.LastRunAt = time.Unix(lastRun, 0)
+	}
+	job.CreatedAt = time.Unix(created, 0)
+	return job, nil
+}
+
+func getCronJob(id string) (CronJob, error) {
+	return scanCronJob(db.QueryRow(`SELECT `+cronJobColumns+` FROM cron_jobs WHERE id = ?`, id))
+}
+
+func getCronJobByName(name string) (CronJob, error) {
+	return scanCronJob(db.QueryRow(`SELECT `+cronJobColumns+` FROM cron_jobs WHERE name = ?`, name))
+}
+
+func listCronJobs() ([]CronJob, error) {
+	rows, err := db.Query(`SELECT ` + cronJobColumns + ` FROM cron_jobs ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []CronJob
+	for rows.Next() {
+		job, err := scanCronJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// 创建一个管理接口定义的任务并立即生效
+func createCronJob(job CronJob) (CronJob, error) {
+	job.Source = CronSourceAPI
+	if err := validateCronJob(job); err != nil {
+		return job, err
+	}
+	job, err := insertCronJob(job)
+	if err != nil {
+		return job, err
+	}
+	if job.Enabled {
+		return job, scheduleCronJob(job)
+	}
+	return job, nil
+}
+
+// 修改任务的表达式、参数或启用状态
+func modifyCronJob(job CronJob) error {
+	if err := validateCronJob(job); err != nil {
+		return err
+	}
+	if err := updateCronJob(job); err != nil {
+		return err
+	}
+	if job.Enabled {
+		return scheduleCronJob(job)
+	}
+	unscheduleCronJob(job.ID)
+	return nil
+}
+
+func deleteCronJob(id string) error {
+	job, err := getCronJob(id)
+	if err != nil {
+		return err
+	}
+	if job.Source == CronSourceConfig {
+		return errors.New("job is defined in config.yaml and must be removed there")
+	}
+	unscheduleCronJob(id)
+	_, err = db.Exec(`DELETE FROM cron_jobs WHERE id = ?`, id)
+	return err
+}
+
+// 立即执行一次任务
+func triggerCronJob(id string) error {
+	job, err := getCronJob(id)
+	if err != nil {
+		return err
+	}
+	action, ok := cronActions[job.Action]
+	if !ok {
+		return fmt.Errorf("unknown action %q", job.Action)
+	}
+	go runCronJob(job.ID, job.Name, action, job.Args)
+	return nil
+}
+
+// 周期性群发：args 支持 content、media_id（二选一）以及 tag_id，未指定 tag_id 时发给全部粉丝
+func cronBroadcast(args map[string]string) error {
+	b := &Broadcast{MsgType: "text", Content: args["content"], ToAll: true}
+	if args["media_id"] != "" {
+		b.MsgType, b.MediaID = "news", args["media_id"]
+	}
+	if args["tag_id"] != "" {
+		tagID, err := strconv.Atoi(args["tag_id"])
+		if err != nil {
+			return fmt.Errorf("invalid tag_id %q", args["tag_id"])
+		}
+		b.TagID, b.ToAll = tagID, false
+	}
+	return createBroadcast(b)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed web/dashboard.html
+var dashboardHTML []byte
+
+// 最近一小时每分钟的消息数，供管理后台绘制实时曲线
+const seriesMinutes = 60
+
+var (
+	messageSeriesMu sync.Mutex
+	messageSeries   [seriesMinutes]struct {
+		minute int64
+		count  int
+	}
+)
+
+// 记录一条收到的消息
+func recordMessage(msgType string) {
+	messagesReceived.WithLabelValues(msgType).Inc()
+
+	minute := time.Now().Unix() / 60
+	messageSeriesMu.Lock()
+	slot := &messageSeries[minute%seriesMinutes]
+	if slot.minute != minute {
+		slot.minute, slot.count = minute, 0
+	}
+	slot.count++
+	messageSeriesMu.Unlock()
+}
+
+// 最近 seriesMinutes 分钟的消息数，按时间先后排列
+func recentMessageCounts() []int {
+	now := time.Now().Unix() / 60
+	counts := make([]int, seriesMinutes)
+	messageSeriesMu.Lock()
+	for i := range counts {
+		minute := now - int64(seriesMinutes-1-i)
+		if slot := messageSeries[minute%seriesMinutes]; slot.minute == minute {
+			counts[i] = slot.count
+		}
+	}
+	messageSeriesMu.Unlock()
+	return counts
+}
+
+// 清空内存中的缓存：待查看的回答、用户设置、提示词模板和已创建的服务实例（使配置改动生效）
+func clearCaches() {
+	if err := state.DeletePrefix(context.Background(), "answers:"); err != nil {
+		log.Printf("⚠️ 清空缓存回答失败: %v", err)
+	}
+
+	if err := state.DeletePrefix(context.Background(), cacheKey("settings:")); err != nil {
+		log.Printf("⚠️ 清空用户设置缓存失败: %v", err)
+	}
+	promptTemplates.Clear()
+
+	providersMu.Lock()
+	providers = map[string]Provider{}
+	providersMu.Unlock()
+	log.Println("🧹 已清空缓存")
+}
+
+// 每分钟的 DeepSeek 调用情况
+type latencyPoint struct {
+	Minute       int64   `json:"minute"`
+	Calls        int     `json:"calls"`
+	Failures     int     `json:"failures"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+func recentLatency(since time.Time) ([]latencyPoint, error) {
+	rows, err := db.Query(`SELECT created_at / 60, COUNT(*), SUM(failed), AVG(latency_ms)
+		FROM qa_records WHERE created_at >= ? GROUP BY created_at / 60 ORDER BY 1`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []latencyPoint{}
+	for rows.Next() {
+		var p latencyPoint
+		if err := rows.Scan(&p.Minute, &p.Calls, &p.Failures, &p.AvgLatencyMs); err != nil {
+			return nil, err
+		}
+		p.Minute *= 60
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// 最近的问答记录
+type recentQA struct {
+	OpenID    string    `json:"openid"`
+	Nickname  string    `json:"nickname"`
+	Model     string    `json:"model"`
+	Variant   string    `json:"variant"`
+	Question  string    `json:"question"`
+	Answer    string    `json:"answer"`
+	LatencyMs int64     `json:"latency_ms"`
+	Failed    bool      `json:"failed"`
+	Feedback  int       `json:"feedback"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func recentQARecords(limit int) ([]recentQA, error) {
+	rows, err := db.Query(`SELECT openid, model, variant, question, answer, latency_ms, failed, feedback, created_at
+		FROM qa_records ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []recentQA{}
+	for rows.Next() {
+		var r recentQA
+		var created int64
+		if err := rows.Scan(&r.OpenID, &r.Model, &r.Variant, &r.Question, &r.Answer,
+			&r.LatencyMs, &r.Failed, &r.Feedback, &created); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.Unix(created, 0)
+		r.Question = truncateRunes(r.Question, 200)
+		r.Answer = truncateRunes(r.Answer, 300)
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// 数据库只有一个连接，需在结果集关闭后再查询用户信息
+	for i := range records {
+		if p, err := loadUserProfile(records[i].OpenID); err == nil {
+			records[i].Nickname = p.DisplayName()
+		}
+	}
+	return records, nil
+}
+
+// 今天提问的用户数和提问总数
+func todayActivity() (users, questions int, err error) {
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(questions), 0) FROM user_stats WHERE day = ?`,
+		time.Now().Format("2006-01-02")).Scan(&users, &questions)
+	return
+}
+
+// 管理后台：页面本身不含数据，由页面中的脚本带管理令牌调用 /admin/dashboard/* 接口
+func registerDashboard(r *gin.Engine, admin *gin.RouterGroup) {
+	r.GET("/admin/dashboard", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+	})
+
+	admin.GET("/dashboard/stats", func(c *gin.Context) {
+		users, questions, err := todayActivity()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		latency, err := recentLatency(time.Now().Add(-seriesMinutes * time.Minute))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recent, err := recentQARecords(20)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		quota, err := todayQuotaStatus()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"messages_per_minute": recentMessageCounts(),
+			"active_users_today":  users,
+			"questions_today":     questions,
+			"latency":             latency,
+			"recent":              recent,
+			"maintenance":         maintenanceEnabled(),
+			"quota":               quota,
+		})
+	})
+
+	admin.GET("/maintenance", func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentMaintenanceStatus(c.Request.Context()))
+	})
+
+	// notice 为空字符串时恢复使用 maintenance.reply，省略时保持不变
+	admin.POST("/maintenance", func(c *gin.Context) {
+		var body struct {
+			Enabled bool    `json:"enabled"`
+			Notice  *string `json:"notice"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if body.Notice != nil {
+			if err := setMaintenanceNotice(*body.Notice); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := setMaintenance(body.Enabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("🛠️ 维护模式: %v", body.Enabled)
+		status := currentMaintenanceStatus(c.Request.Context())
+		c.JSON(http.StatusOK, gin.H{"maintenance": status.Enabled, "notice": status.Notice, "pending": status.Pending})
+	})
+
+	admin.POST("/cache/clear", func(c *gin.Context) {
+		clearCaches()
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	_ "modernc.org/sqlite"
+)
+
+var db *sql.DB
+
+// 建表语句，启动时依次执行
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS database_info (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS cron_jobs (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL UNIQUE,
+		spec        TEXT NOT NULL,
+		action      TEXT NOT NULL,
+		args        TEXT NOT NULL DEFAULT '{}',
+		enabled     INTEGER NOT NULL DEFAULT 1,
+		source      TEXT NOT NULL,
+		last_run_at INTEGER NOT NULL DEFAULT 0,
+		last_error  TEXT NOT NULL DEFAULT '',
+		created_at  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS broadcasts (
+		id         TEXT PRIMARY KEY,
+		status     TEXT NOT NULL,
+		send_at    INTEGER NOT NULL,
+		msg_id     INTEGER NOT NULL DEFAULT 0,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcasts_status ON broadcasts (status, send_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_broadcasts_msg_id ON broadcasts (msg_id)`,
+	`CREATE TABLE IF NOT EXISTS user_profiles (
+		openid     TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_stats (
+		openid    TEXT NOT NULL,
+		day       TEXT NOT NULL,
+		questions INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (openid, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_access (
+		openid     TEXT NOT NULL,
+		list       TEXT NOT NULL,
+		note       TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (openid, list)
+	)`,
+	`CREATE TABLE IF NOT EXISTS digest_subscriptions (
+		openid     TEXT NOT NULL,
+		topic      TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (openid, topic)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_digest_subscriptions_topic ON digest_subscriptions (topic)`,
+	`CREATE TABLE IF NOT EXISTS user_settings (
+		openid     TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS openid_pseudonyms (
+		pseudonym  TEXT PRIMARY KEY,
+		openid     TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_tiers (
+		openid     TEXT PRIMARY KEY,
+		tier       TEXT NOT NULL,
+		note       TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS qa_records (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		openid     TEXT NOT NULL,
+		variant    TEXT NOT NULL DEFAULT '',
+		model      TEXT NOT NULL DEFAULT '',
+		question   TEXT NOT NULL,
+		answer     TEXT NOT NULL,
+		latency_ms INTEGER NOT NULL,
+		failed     INTEGER NOT NULL DEFAULT 0,
+		feedback   INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_qa_records_openid ON qa_records (openid, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_qa_records_created ON qa_records (created_at)`,
+	`CREATE TABLE IF NOT EXISTS kb_documents (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		size       INTEGER NOT NULL,
+		chunks     INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS vector_points (
+		collection TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		grp        TEXT NOT NULL DEFAULT '',
+		vector     BLOB NOT NULL,
+		payload    TEXT NOT NULL,
+		PRIMARY KEY (collection, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_vector_points_group ON vector_points (collection, grp)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id              TEXT PRIMARY KEY,
+		openid          TEXT NOT NULL,
+		kind            TEXT NOT NULL,
+		message         TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error      TEXT NOT NULL DEFAULT '',
+		created_at      INTEGER NOT NULL,
+		updated_at      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox (status, next_attempt_at)`,
+	`CREATE TABLE IF NOT EXISTS llm_retries (
+		id              TEXT PRIMARY KEY,
+		openid          TEXT NOT NULL,
+		query           TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error      TEXT NOT NULL DEFAULT '',
+		created_at      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_llm_retries_due ON llm_retries (next_attempt_at)`,
+	`CREATE TABLE IF NOT EXISTS subscribe_msg_grants (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		openid      TEXT NOT NULL,
+		template_id TEXT NOT NULL,
+		scene       INTEGER NOT NULL DEFAULT 0,
+		created_at  INTEGER NOT NULL,
+		used_at     INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_subscribe_msg_grants_openid ON subscribe_msg_grants (openid, used_at)`,
+	`CREATE TABLE IF NOT EXISTS deferred_questions (
+		id         TEXT PRIMARY KEY,
+		openid     TEXT NOT NULL,
+		query      TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_templates (
+		type       TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS prompt_versions (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		prompt     TEXT NOT NULL,
+		note       TEXT NOT NULL DEFAULT '',
+		author     TEXT NOT NULL DEFAULT '',
+		active     INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS conversations (
+		openid     TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS processed_messages (
+		msg_key    TEXT PRIMARY KEY,
+		openid     TEXT NOT NULL,
+		reply      TEXT NOT NULL DEFAULT '',
+		replied    INTEGER NOT NULL DEFAULT 0,
+		done       INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_processed_messages_created ON processed_messages (created_at)`,
+	`CREATE TABLE IF NOT EXISTS message_stats (
+		day      TEXT NOT NULL,
+		openid   TEXT NOT NULL,
+		messages INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, openid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS points_ledger (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		openid     TEXT NOT NULL,
+		delta      INTEGER NOT NULL,
+		reason     TEXT NOT NULL,
+		ref        TEXT NOT NULL DEFAULT '',
+		note       TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_points_ledger_openid ON points_ledger (openid)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_points_ledger_ref ON points_ledger (openid, reason, ref) WHERE ref != ''`,
+	`CREATE TABLE IF NOT EXISTS pay_orders (
+		out_trade_no   TEXT PRIMARY KEY,
+		openid         TEXT NOT NULL,
+		package        TEXT NOT NULL,
+		points         INTEGER NOT NULL,
+		amount         INTEGER NOT NULL,
+		status         TEXT NOT NULL,
+		transaction_id TEXT NOT NULL DEFAULT '',
+		created_at     INTEGER NOT NULL,
+		paid_at        INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS memberships (
+		openid     TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS membership_grants (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		openid     TEXT NOT NULL,
+		days       INTEGER NOT NULL,
+		source     TEXT NOT NULL,
+		ref        TEXT NOT NULL DEFAULT '',
+		note       TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_membership_grants_ref ON membership_grants (openid, source, ref) WHERE ref != ''`,
+	`CREATE TABLE IF NOT EXISTS invites (
+		code          TEXT PRIMARY KEY,
+		openid        TEXT NOT NULL UNIQUE,
+		qr_ticket     TEXT NOT NULL DEFAULT '',
+		qr_expires_at INTEGER NOT NULL DEFAULT 0,
+		created_at    INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS referrals (
+		invitee    TEXT PRIMARY KEY,
+		inviter    TEXT NOT NULL,
+		code       TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_referrals_inviter ON referrals (inviter)`,
+	`CREATE TABLE IF NOT EXISTS model_usage (
+		day               TEXT NOT NULL,
+		model             TEXT NOT NULL,
+		calls             INTEGER NOT NULL DEFAULT 0,
+		failures          INTEGER NOT NULL DEFAULT 0,
+		latency_ms        INTEGER NOT NULL DEFAULT 0,
+		prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, model)
+	)`,
+	`CREATE TABLE IF NOT EXISTS canary_usage (
+		day        TEXT NOT NULL,
+		experiment TEXT NOT NULL,
+		arm        TEXT NOT NULL,
+		answers    INTEGER NOT NULL DEFAULT 0,
+		failures   INTEGER NOT NULL DEFAULT 0,
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, experiment, arm)
+	)`,
+	`CREATE TABLE IF NOT EXISTS shadow_results (
+		id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at           INTEGER NOT NULL,
+		experiment           TEXT NOT NULL,
+		openid               TEXT NOT NULL,
+		question             TEXT NOT NULL,
+		primary_model        TEXT NOT NULL,
+		primary_answer       TEXT NOT NULL,
+		primary_latency_ms   INTEGER NOT NULL,
+		candidate_model      TEXT NOT NULL,
+		candidate_answer     TEXT NOT NULL DEFAULT '',
+		candidate_latency_ms INTEGER NOT NULL DEFAULT 0,
+		candidate_error      TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_shadow_results_experiment ON shadow_results (experiment, id)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		request_id TEXT NOT NULL DEFAULT '',
+		openid     TEXT NOT NULL,
+		direction  TEXT NOT NULL,
+		msg_type   TEXT NOT NULL DEFAULT '',
+		content    TEXT NOT NULL,
+		model      TEXT NOT NULL DEFAULT '',
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		failed     INTEGER NOT NULL DEFAULT 0,
+		moderation TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_log_openid ON audit_log (openid, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log (created_at)`,
+	// 审计日志只允许追加
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+}
+
+// 打开 SQLite 数据库并建表
+func initDatabase() error {
+	path := viper.GetString("database.path")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	var err error
+	db, err = sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return err
+	}
+	// SQLite 同一时间只允许一个写入者，单连接可避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	log.Printf("✅ 数据库已就绪: %s", path)
+	return nil
+}
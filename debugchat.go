@@ -0,0 +1,64 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+//go:embed web/chat.html
+var debugChatHTML []byte
+
+// 调试聊天页：无需公网回调即可通过浏览器走一遍完整的消息处理流程。
+// 页面本身不含数据，发送消息的接口使用管理令牌鉴权
+func registerDebugChat(r *gin.Engine) {
+	if !viper.GetBool("debug_chat.enabled") {
+		return
+	}
+
+	r.GET("/debug/chat", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", debugChatHTML)
+	})
+
+	r.POST("/debug/chat/message", adminAuth(), func(c *gin.Context) {
+		var body struct {
+			OpenID  string `json:"openid"`
+			Content string `json:"content"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Content == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "content is required"})
+			return
+		}
+		if body.OpenID == "" {
+			body.OpenID = viper.GetString("debug_chat.openid")
+		}
+
+		msg := WeChatMessage{
+			ToUserName:   "debug-chat",
+			FromUserName: body.OpenID,
+			CreateTime:   time.Now().Unix(),
+			MsgType:      "text",
+			Content:      body.Content,
+		}
+		reply, ok := processDebugMessage(c, msg)
+		c.JSON(http.StatusOK, gin.H{"reply": reply, "replied": ok})
+	})
+	log.Println("✅ 调试聊天页已挂载到 /debug/chat（需管理令牌）")
+}
+
+// 与 recoverMessage 一致，异常时返回 alert.panic_reply
+func processDebugMessage(c *gin.Context, msg WeChatMessage) (reply string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic(fmt.Sprintf("debugChat[%s]", requestID(c.Request.Context())), r, debug.Stack())
+			reply, ok = viper.GetString("alert.panic_reply"), true
+		}
+	}()
+	return processMessage(c.Request.Context(), msg)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 主动消息的投递方式，按 outbox.strategy 的顺序依次尝试：
+//   - kefu：客服消息，需用户 48 小时内与公众号有过互动
+//   - template：模板消息，消息未指定模板时使用 outbox.template_id（模板需包含 {{content.DATA}}）
+//   - subscribe：一次性订阅消息，消耗用户的一次授权，仅适用于文本消息
+//   - cache：写入回答缓存，用户输入“继续”时查看，仅适用于 CacheOnFailure 的消息
+const (
+	ChannelKefu      = "kefu"
+	ChannelTemplate  = "template"
+	ChannelSubscribe = "subscribe"
+	ChannelCache     = "cache"
+)
+
+var deliveryChannels = []string{ChannelKefu, ChannelTemplate, ChannelSubscribe, ChannelCache}
+
+// 发送失败后的处理方式
+type deliveryAction int
+
+const (
+	deliveryRetry   deliveryAction = iota // 临时错误，稍后用同一方式重试
+	deliverySkip                          // 该方式对这条消息不可用，改用下一种
+	deliveryDisable                       // 公众号没有该接口权限，一段时间内所有消息都跳过该方式
+	deliveryDrop                          // 任何方式都无法送达
+)
+
+func classifyDeliveryError(err error) deliveryAction {
+	if errors.Is(err, errWeComUnsupported) || errors.Is(err, errNoSubscribeMsgGrant) {
+		return deliverySkip
+	}
+	var apiErr *WeChatAPIError
+	if !errors.As(err, &apiErr) {
+		return deliveryRetry
+	}
+	switch apiErr.ErrCode {
+	case 48001: // api 未授权（如未认证的订阅号没有模板消息权限）
+		return deliveryDisable
+	case 43004, 45015, 45047, 40037, 43101: // 未关注、超出 48 小时窗口、客服消息条数超限、模板无效、用户拒收
+		return deliverySkip
+	case 40003: // openid 无效
+		return deliveryDrop
+	}
+	return deliveryRetry
+}
+
+// 消息可以使用的投递方式，顺序同 outbox.strategy
+func outboxChannels(openID string, m OutboxMessage) []string {
+	var channels []string
+	for _, ch := range viper.GetStringSlice("outbox.strategy") {
+		if channelSupports(openID, ch, m) {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+func channelSupports(openID, channel string, m OutboxMessage) bool {
+	switch channel {
+	case ChannelKefu:
+		return m.Text != "" || m.MiniProgram != nil || m.News != nil
+	case ChannelTemplate:
+		_, _, ok := outboxTemplate(m)
+		return ok && !isWeComUser(openID)
+	case ChannelSubscribe:
+		return viper.GetBool("subscribe_msg.enabled") && m.Text != "" && !isWeComUser(openID) && subscribeMsgGrants(openID) > 0
+	case ChannelCache:
+		return m.CacheOnFailure && m.Text != ""
+	}
+	return false
+}
+
+// 消息的模板形式：优先使用消息自带的模板，文本消息可套用 outbox.template_id
+func outboxTemplate(m OutboxMessage) (string, map[string]string, bool) {
+	if m.TemplateID != "" {
+		return m.TemplateID, m.Data, true
+	}
+	if templateID := viper.GetString("outbox.template_id"); templateID != "" && m.Text != "" {
+		return templateID, map[string]string{"content": truncateRunes(m.Text, 200)}, true
+	}
+	return "", nil, false
+}
+
+func sendViaChannel(openID, channel string, m OutboxMessage) error {
+	switch channel {
+	case ChannelKefu:
+		if isWeComUser(openID) {
+			return sendWeComMessage(openID, m)
+		}
+		if m.Text != "" {
+			return sendKefuText(openID, m.Text)
+		}
+		if m.News != nil {
+			return sendKefuNews(openID, *m.News)
+		}
+		return sendKefuMiniProgram(openID, *m.MiniProgram)
+	case ChannelTemplate:
+		templateID, data, _ := outboxTemplate(m)
+		return sendTemplateMessage(openID, templateID, m.Link, data)
+	case ChannelSubscribe:
+		return sendSubscribeMessage(openID, m)
+	case ChannelCache:
+		storeAnswer(openID, m.Text)
+		return nil
+	}
+	return errors.New("unknown delivery channel " + channel)
+}
+
+func channelUnavailableKey(channel string) string {
+	return "delivery:unavailable:" + channel
+}
+
+// 接口无权限时在 outbox.unavailable_ttl 内跳过该方式，避免每条消息都先失败一次
+func disableChannel(channel string, err error) {
+	log.Printf("🚫 投递方式 %s 不可用，%s 内跳过: %v", channel, viper.GetDuration("outbox.unavailable_ttl"), err)
+	if err := state.Set(context.Background(), channelUnavailableKey(channel), []byte(time.Now().Format(time.RFC3339)),
+		viper.GetDuration("outbox.unavailable_ttl")); err != nil {
+		log.Printf("⚠️ 记录投递方式 %s 不可用失败: %v", channel, err)
+	}
+}
+
+func channelAvailable(channel string) bool {
+	if channel == ChannelCache {
+		return true
+	}
+	_, err := state.Get(context.Background(), channelUnavailableKey(channel))
+	return errors.Is(err, errStateNotFound)
+}
+
+// 从 current 起（current 为空时从头开始）找到第一个可用的投递方式
+func nextChannel(channels []string, current string, after bool) (string, bool) {
+	start := 0
+	if i := slices.Index(channels, current); i >= 0 {
+		start = i
+		if after {
+			start++
+		}
+	}
+	for _, ch := range channels[min(start, len(channels)):] {
+		if channelAvailable(ch) {
+			return ch, true
+		}
+	}
+	return "", false
+}
+
+// 不经过发件箱直接按投递策略发送一次，写入发件箱失败时使用
+func sendOutboxMessage(openID string, m OutboxMessage) error {
+	channels := outboxChannels(openID, m)
+	err := errors.New("no delivery channel available")
+	for ch, ok := nextChannel(channels, "", false); ok; ch, ok = nextChannel(channels, ch, true) {
+		if err = sendViaChannel(openID, ch, m); err == nil {
+			return nil
+		}
+		switch classifyDeliveryError(err) {
+		case deliveryDisable:
+			disableChannel(ch, err)
+		case deliveryDrop:
+			return err
+		}
+	}
+	return err
+}
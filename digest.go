@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 主题订阅保存在 digest_subscriptions 表中，重启和多实例部署时不会丢失
+
+// 处理订阅相关指令，返回回复内容及是否为订阅指令
+func handleSubscriptionCommand(user, content string) (string, bool) {
+	content = strings.TrimSpace(content)
+
+	if content == "我的订阅" {
+		topics, err := userTopics(user)
+		if err != nil {
+			log.Printf("❌ 读取订阅失败 [%s]: %v", user, err)
+			return "❌ 查询失败，请稍后再试。", true
+		}
+		if len(topics) == 0 {
+			return "📭 你还没有订阅任何主题，发送“订阅 主题”即可订阅每日简报。", true
+		}
+		return "📬 你已订阅：\n" + strings.Join(topics, "\n"), true
+	}
+
+	if topic, ok := parseCommand(content, "取消订阅"); ok {
+		if topic == "" {
+			return "⚠️ 请输入要取消的主题，例如：取消订阅 AI新闻", true
+		}
+		removed, err := unsubscribe(user, topic)
+		if err != nil {
+			log.Printf("❌ 取消订阅失败 [%s]: %v", user, err)
+			return "❌ 取消订阅失败，请稍后再试。", true
+		}
+		if !removed {
+			return fmt.Sprintf("⚠️ 你没有订阅“%s”。", topic), true
+		}
+		return fmt.Sprintf("✅ 已取消订阅“%s”。", topic), true
+	}
+
+	if topic, ok := parseCommand(content, "订阅"); ok {
+		if topic == "" {
+			return "⚠️ 请输入要订阅的主题，例如：订阅 AI新闻", true
+		}
+		topics, err := userTopics(user)
+		if err == nil && len(topics) >= viper.GetInt("digest.max_topics") {
+			return fmt.Sprintf("⚠️ 每人最多订阅 %d 个主题，请先取消部分订阅。", viper.GetInt("digest.max_topics")), true
+		}
+		if err == nil {
+			err = subscribe(user, topic)
+		}
+		if err != nil {
+			log.Printf("❌ 订阅失败 [%s]: %v", user, err)
+			return "❌ 订阅失败，请稍后再试。", true
+		}
+		return fmt.Sprintf("✅ 已订阅“%s”，每天 %s 推送简报。", topic, viper.GetString("digest.time")), true
+	}
+	return "", false
+}
+
+func subscribe(user, topic string) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO digest_subscriptions (openid, topic, created_at) VALUES (?, ?, ?)`,
+		user, topic, time.Now().Unix())
+	return err
+}
+
+func unsubscribe(user, topic string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM digest_subscriptions WHERE openid = ? AND topic = ?`, user, topic)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func userTopics(user string) ([]string, error) {
+	rows, err := db.Query(`SELECT topic FROM digest_subscriptions WHERE openid = ? ORDER BY topic`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// 各主题的订阅者
+func digestTargets() (map[string][]string, error) {
+	rows, err := db.Query(`SELECT topic, openid FROM digest_subscriptions ORDER BY topic, created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := map[string][]string{}
+	for rows.Next() {
+		var topic, user string
+		if err := rows.Scan(&topic, &user); err != nil {
+			return nil, err
+		}
+		targets[topic] = append(targets[topic], user)
+	}
+	return targets, rows.Err()
+}
+
+// 为每个有订阅者的主题生成一份简报并推送
+func runDigest() {
+	if maintenanceEnabled() {
+		log.Println("🛠️ 维护模式中，跳过本次简报")
+		return
+	}
+	targets, err := digestTargets()
+	if err != nil {
+		log.Printf("❌ 读取简报订阅失败: %v", err)
+		return
+	}
+
+	ctx, span := tracer.Start(withRequestID(context.Background(), "digest-"+newID()), "digest.run")
+	defer span.End()
+
+	date := time.Now().Format("2006年01月02日")
+	for topic, users := range targets {
+		query := fmt.Sprintf(viper.GetString("digest.prompt"), date, topic)
+		digest, err := callDeepSeekWith(ctx, viper.GetString("digest.model"), renderPrompt(ctx, systemPrompt(), ""), query)
+		if err != nil {
+			logf(ctx, "❌ 生成简报失败 [%s]: %v", topic, err)
+			continue
+		}
+
+		text := fmt.Sprintf("📰 %s · %s\n\n%s", topic, date, digest)
+		for _, user := range users {
+			pushDigest(user, topic, text)
+		}
+		logf(ctx, "📰 简报 [%s] 已加入 %d 位订阅者的发件箱", topic, len(users))
+	}
+}
+
+// 按 outbox.strategy 推送，配置 digest.template_id 时可改用模板消息（如超过 48 小时未互动）
+func pushDigest(user, topic, text string) {
+	m := OutboxMessage{Text: text}
+	if templateID := viper.GetString("digest.template_id"); templateID != "" {
+		m.TemplateID = templateID
+		m.Data = map[string]string{
+			"topic":   topic,
+			"content": truncateRunes(text, 200),
+		}
+	}
+	queueOutbox(user, m)
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
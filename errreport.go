@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/spf13/viper"
+)
+
+var sentryEnabled bool
+
+// 初始化错误上报：配置了 DSN 时上报到 Sentry，配置了 webhook 时同时以 JSON 推送
+func initErrorReporting() {
+	dsn := viper.GetString("error_reporting.sentry_dsn")
+	if dsn == "" {
+		return
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: viper.GetString("error_reporting.environment"),
+		SampleRate:  viper.GetFloat64("error_reporting.sample_rate"),
+	})
+	if err != nil {
+		log.Printf("⚠️ Sentry 初始化失败: %v", err)
+		return
+	}
+	sentryEnabled = true
+	log.Println("✅ Sentry 错误上报已启用")
+}
+
+// 上报一个错误，kind 用于区分来源（deepseek、xml、panic 等）
+func reportError(ctx context.Context, kind string, err error, extra map[string]interface{}) {
+	if id := requestID(ctx); id != "" {
+		if extra == nil {
+			extra = map[string]interface{}{}
+		}
+		extra["request_id"] = id
+	}
+	if user, ok := extra["user"].(string); ok {
+		extra["user"] = pseudonym(user)
+	}
+	if sentryEnabled {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("kind", kind)
+			scope.SetExtras(extra)
+			sentry.CaptureException(err)
+		})
+	}
+	postErrorWebhook(kind, err.Error(), extra)
+}
+
+// 上报 panic，需在 recover 所在的 defer 中调用以保留堆栈
+func reportPanicError(where string, r interface{}, stack []byte) {
+	if sentryEnabled {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("kind", "panic")
+			scope.SetTag("where", where)
+			sentry.CurrentHub().Recover(r)
+		})
+	}
+	postErrorWebhook("panic", fmt.Sprintf("panic in %s: %v", where, r), map[string]interface{}{
+		"stack": string(stack),
+	})
+}
+
+// 按 error_reporting.sample_rate 采样后推送到通用错误 webhook
+func postErrorWebhook(kind, message string, extra map[string]interface{}) {
+	webhook := viper.GetString("error_reporting.webhook_url")
+	if webhook == "" || rand.Float64() >= viper.GetFloat64("error_reporting.sample_rate") {
+		return
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"kind":        kind,
+		"error":       message,
+		"environment": viper.GetString("error_reporting.environment"),
+		"extra":       extra,
+		"time":        time.Now().Format(time.RFC3339),
+	})
+	go func() {
+		resp, err := wechatClient.Post(webhook, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("⚠️ 错误上报 webhook 推送失败: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 事件处理动作，按 events.<事件名> 配置，CLICK 等带 EventKey 的事件可在 keys 下按 EventKey 单独配置。事件名和 EventKey 不区分大小写
+type EventHandler struct {
+	Action  string                  `mapstructure:"action"`  // reply、persona、tool、webhook 或 none
+	Reply   string                  `mapstructure:"reply"`   // reply 的回复模板；persona、webhook 时作为被动回复
+	Prompt  string                  `mapstructure:"prompt"`  // persona 使用的系统提示词模板
+	Query   string                  `mapstructure:"query"`   // persona 发给模型的问题模板
+	Model   string                  `mapstructure:"model"`   // persona 使用的模型，留空使用 deepseek.model
+	Tool    string                  `mapstructure:"tool"`    // tool 执行的文本指令，如“签到”“查询积分”，按用户发送该文本处理
+	Webhook string                  `mapstructure:"webhook"` // webhook 的地址
+	Keys    map[string]EventHandler `mapstructure:"keys"`
+}
+
+// 事件模板可用的变量：提示词模板的变量加上事件字段
+type eventVars struct {
+	promptVars
+	Event     string
+	EventKey  string
+	Ticket    string
+	Latitude  float64
+	Longitude float64
+	Precision float64
+	Status    string
+}
+
+func eventHandlerFor(msg WeChatMessage) EventHandler {
+	var h EventHandler
+	key := "events." + strings.ToLower(msg.Event)
+	if !viper.IsSet(key) {
+		key = "events.default"
+	}
+	if err := viper.UnmarshalKey(key, &h); err != nil {
+		logf(context.Background(), "⚠️ 解析 %s 失败: %v", key, err)
+	}
+	// viper 读取配置时键名统一转为小写
+	for key, k := range h.Keys {
+		if strings.EqualFold(key, msg.EventKey) {
+			return k
+		}
+	}
+	return h
+}
+
+// 按配置处理事件，返回被动回复；不需要回复时返回 false
+func handleEvent(ctx context.Context, msg WeChatMessage) (string, bool) {
+	h := eventHandlerFor(msg)
+	vars := eventVars{
+		promptVars: userPromptVars(msg.FromUserName),
+		Event:      msg.Event,
+		EventKey:   msg.EventKey,
+		Ticket:     msg.Ticket,
+		Latitude:   msg.Latitude,
+		Longitude:  msg.Longitude,
+		Precision:  msg.Precision,
+		Status:     msg.Status,
+	}
+	reply := ""
+	if h.Reply != "" {
+		reply = executeTemplate(ctx, h.Reply, vars)
+	}
+
+	switch h.Action {
+	case "reply":
+		return reply, reply != ""
+	case "persona":
+		// 事件回调需在 5 秒内响应，回答生成后通过发件箱推送
+		prompt, query := executeTemplate(ctx, h.Prompt, vars), executeTemplate(ctx, h.Query, vars)
+		detached := detachContext(ctx)
+		safeGo("eventPersona", func() {
+			answer, err := callDeepSeekWith(detached, h.Model, prompt, query)
+			if err != nil {
+				logf(detached, "❌ 事件 %s 生成回复失败: %v", msg.Event, err)
+				return
+			}
+			queueOutbox(msg.FromUserName, OutboxMessage{Text: answer, CacheOnFailure: true})
+		})
+		return reply, reply != ""
+	case "tool":
+		cmd := msg
+		cmd.MsgType, cmd.Content, cmd.MessageID = "text", h.Tool, 0
+		return processMessage(ctx, cmd)
+	case "webhook":
+		if r, err := callEventWebhook(ctx, h.Webhook, msg); err != nil {
+			logf(ctx, "❌ 事件 %s 调用 webhook 失败: %v", msg.Event, err)
+		} else if r != "" {
+			reply = r
+		}
+		return reply, reply != ""
+	}
+	return "", false
+}
+
+// 把事件以 JSON 发送到 webhook，响应 {"reply": "..."} 时用作被动回复
+func callEventWebhook(ctx context.Context, url string, msg WeChatMessage) (string, error) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"openid":      msg.FromUserName,
+		"event":       msg.Event,
+		"event_key":   msg.EventKey,
+		"ticket":      msg.Ticket,
+		"latitude":    msg.Latitude,
+		"longitude":   msg.Longitude,
+		"precision":   msg.Precision,
+		"status":      msg.Status,
+		"create_time": msg.CreateTime,
+	})
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("events.webhook_timeout"))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wechatClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	var result struct {
+		Reply string `json:"reply"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Reply, nil
+}
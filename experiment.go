@@ -0,0 +1,141 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 提示词实验的一个分组
+type promptVariant struct {
+	Name   string `mapstructure:"name"`
+	Weight int    `mapstructure:"weight"`
+	Prompt string `mapstructure:"prompt"` // 为空时使用当前的系统提示词
+}
+
+// 为用户选择提示词：用户启用了人设时使用人设的提示词，开启实验时按 OpenID 稳定分桶，返回分组名和提示词模板
+func promptForUser(user string) (string, string) {
+	if name := getUserSettings(user).Persona; name != "" {
+		if prompt, ok := personaPrompt(name); ok {
+			return "persona:" + name, prompt
+		}
+	}
+	base := systemPrompt()
+	if !viper.GetBool("experiments.prompt.enabled") {
+		return "", base
+	}
+
+	var variants []promptVariant
+	if err := viper.UnmarshalKey("experiments.prompt.variants", &variants); err != nil || len(variants) == 0 {
+		return "", base
+	}
+	total := 0
+	for _, v := range variants {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return "", base
+	}
+
+	bucket := experimentBucket(viper.GetString("experiments.prompt.name"), user, total)
+	for _, v := range variants {
+		if v.Weight <= 0 {
+			continue
+		}
+		if bucket < v.Weight {
+			if v.Prompt == "" {
+				return v.Name, base
+			}
+			return v.Name, v.Prompt
+		}
+		bucket -= v.Weight
+	}
+	return "", base
+}
+
+// 按 OpenID 稳定分桶，返回 [0, n) 之间的值。实验名参与哈希，换一个实验即重新分桶
+func experimentBucket(experiment, user string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(experiment + ":" + user))
+	return int(h.Sum32() % uint32(n))
+}
+
+// 一次问答记录
+type qaRecord struct {
+	OpenID   string
+	Variant  string
+	Model    string
+	Question string
+	Answer   string
+	Latency  time.Duration
+	Failed   bool
+}
+
+// 开启匿名模式时问答记录中保存 OpenID 的化名
+func recordQA(r qaRecord) {
+	_, err := db.Exec(`INSERT INTO qa_records (openid, variant, model, question, answer, latency_ms, failed, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		pseudonym(r.OpenID), r.Variant, r.Model, r.Question, r.Answer, r.Latency.Milliseconds(), r.Failed, time.Now().Unix())
+	if err != nil {
+		log.Printf("⚠️ 记录问答失败 [%s]: %v", r.OpenID, err)
+	}
+}
+
+// 处理用户对最近一次回答的评价：“好评”/“差评”
+func handleFeedbackCommand(user, content string) (string, bool) {
+	var score int
+	switch content {
+	case "好评", "👍":
+		score = 1
+	case "差评", "👎":
+		score = -1
+	default:
+		return "", false
+	}
+
+	res, err := db.Exec(`UPDATE qa_records SET feedback = ? WHERE id = (
+		SELECT id FROM qa_records WHERE openid = ? AND failed = 0 ORDER BY id DESC LIMIT 1)`, score, pseudonym(user))
+	if err != nil {
+		log.Printf("❌ 记录反馈失败 [%s]: %v", user, err)
+		return "❌ 反馈失败，请稍后再试。", true
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "🤔 还没有可以评价的回答。", true
+	}
+	return "🙏 感谢你的反馈！", true
+}
+
+// 各实验分组的统计
+type variantStats struct {
+	Variant      string  `json:"variant"`
+	Answers      int     `json:"answers"`
+	Failures     int     `json:"failures"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	Upvotes      int     `json:"upvotes"`
+	Downvotes    int     `json:"downvotes"`
+}
+
+// 统计 since 之后各分组的回答数、平均耗时和反馈
+func promptExperimentStats(since time.Time) ([]variantStats, error) {
+	rows, err := db.Query(`SELECT variant, COUNT(*), SUM(failed), AVG(latency_ms),
+		SUM(CASE WHEN feedback > 0 THEN 1 ELSE 0 END), SUM(CASE WHEN feedback < 0 THEN 1 ELSE 0 END)
+		FROM qa_records WHERE created_at >= ? GROUP BY variant ORDER BY variant`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []variantStats{}
+	for rows.Next() {
+		var s variantStats
+		if err := rows.Scan(&s.Variant, &s.Answers, &s.Failures, &s.AvgLatencyMs, &s.Upvotes, &s.Downvotes); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 用户的多轮对话上下文：较早的轮次被压缩进 Summary，最近的轮次原文保留在 Turns
+type conversation struct {
+	Summary   string
+	Turns     []chatMessage
+	UpdatedAt time.Time
+}
+
+func historyKey(user string) string { return "history:" + user }
+
+// 对话上下文保存在 Redis 或 SQLite 中，重启或发布后用户仍可继续之前的对话。
+// history.store 为 auto 时，状态存储为 redis 则存入 Redis，否则存入数据库
+func historyInDatabase() bool {
+	switch viper.GetString("history.store") {
+	case "database":
+		return true
+	case "state":
+		return false
+	default:
+		_, isRedis := state.(*redisStateStore)
+		return !isRedis
+	}
+}
+
+// 读取用户的对话上下文，超过 history.ttl 未更新的上下文视为不存在。开启匿名模式时数据库中按化名保存
+func loadConversation(ctx context.Context, user string) conversation {
+	var c conversation
+	var data []byte
+	var err error
+	if historyInDatabase() {
+		err = db.QueryRow(`SELECT data FROM conversations WHERE openid = ? AND updated_at >= ?`,
+			pseudonym(user), time.Now().Add(-viper.GetDuration("history.ttl")).Unix()).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errStateNotFound
+		}
+	} else {
+		data, err = state.Get(ctx, historyKey(user))
+	}
+	if err != nil {
+		if !errors.Is(err, errStateNotFound) {
+			logf(ctx, "⚠️ 读取对话历史失败: %v", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		logf(ctx, "⚠️ 对话历史格式错误，已忽略: %v", err)
+		return conversation{}
+	}
+	return c
+}
+
+func saveConversation(ctx context.Context, user string, c conversation) {
+	c.UpdatedAt = time.Now()
+	data, _ := json.Marshal(c)
+	var err error
+	if historyInDatabase() {
+		_, err = db.Exec(`INSERT INTO conversations (openid, data, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT(openid) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+			pseudonym(user), string(data), c.UpdatedAt.Unix())
+	} else {
+		err = state.Set(ctx, historyKey(user), data, viper.GetDuration("history.ttl"))
+	}
+	if err != nil {
+		logf(ctx, "❌ 保存对话历史失败: %v", err)
+	}
+}
+
+// 删除数据库中超过 history.ttl 的对话上下文，由定时任务调用
+func cleanupConversations() {
+	before := time.Now().Add(-viper.GetDuration("history.ttl")).Unix()
+	res, err := db.Exec(`DELETE FROM conversations WHERE updated_at < ?`, before)
+	if err != nil {
+		log.Printf("❌ 清理对话历史失败: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 已清理 %d 条过期的对话历史", n)
+	}
+}
+
+// 组装发送给 DeepSeek 的消息：系统提示词 + 历史摘要 + 最近轮次 + 本次问题
+func buildMessages(prompt string, c conversation, query string) []chatMessage {
+	messages := []chatMessage{{Role: "system", Content: prompt}}
+	if c.Summary != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: "以下是你与用户此前对话的摘要，请结合它理解上下文：\n" + c.Summary})
+	}
+	messages = append(messages, c.Turns...)
+	return append(messages, chatMessage{Role: "user", Content: query})
+}
+
+// 带多轮上下文向 DeepSeek 提问，并把本轮问答写回历史。
+// 同一用户的问题由本实例的队列串行处理，因此读改写历史无需额外加锁
+func askWithHistory(ctx context.Context, user, query string) (string, error) {
+	variant, tmpl := promptForUser(user)
+	prompt := renderPrompt(ctx, tmpl, user)
+	kb, hits := knowledgeContext(ctx, query)
+	if kb != "" {
+		prompt += "\n\n" + kb
+	}
+	prompt += runtimeContext(user) + languageInstruction()
+	provider, model := userModelVia(user)
+	canary, inCanary := canaryForUser(user)
+	if inCanary {
+		model, provider = canary.Model, canary.Provider
+	}
+	params := userGenerationParams(user)
+	regen, regenerating := regenerationFrom(ctx)
+	if regenerating && regen.Temperature != nil {
+		params.Temperature = regen.Temperature
+	}
+	runBeforeLLMHooks(ctx, user, &prompt, &query, &model)
+
+	start := time.Now()
+	var c conversation
+	var newSession bool
+	if viper.GetBool("history.enabled") {
+		c = loadConversation(ctx, user)
+		// 超过 history.idle_timeout 未对话时开启新会话，不再带上之前的上下文
+		if idle := viper.GetDuration("history.idle_timeout"); idle > 0 && !c.UpdatedAt.IsZero() && time.Since(c.UpdatedAt) > idle {
+			logf(ctx, "🆕 用户 %s 已 %s 未对话，开启新会话", user, time.Since(c.UpdatedAt).Round(time.Second))
+			c, newSession = conversation{}, true
+		}
+		if regenerating {
+			c = dropRegeneratedTurn(c, query)
+		}
+	}
+	messages := buildMessages(prompt, c, query)
+	answer, err := chatCompletionVia(ctx, provider, model, messages, params)
+	latency := time.Since(start)
+	if inCanary {
+		recordCanary(canary.Arm, latency, err != nil)
+	}
+	recordQA(qaRecord{OpenID: user, Variant: variant, Model: model, Question: query,
+		Answer: answer, Latency: latency, Failed: err != nil})
+	recordAudit(ctx, AuditEntry{OpenID: user, Direction: AuditAnswer, Content: answer, Model: model,
+		LatencyMs: latency.Milliseconds(), Failed: err != nil, Moderation: answerModeration(err)})
+	if err != nil {
+		return "", err
+	}
+	mirrorToShadow(ctx, user, messages, params, ShadowResult{Question: query, PrimaryModel: model,
+		PrimaryAnswer: answer, PrimaryLatencyMs: latency.Milliseconds()})
+	answer = enforceLanguage(ctx, user, answer)
+	if !viper.GetBool("history.enabled") {
+		return appendCitations(ctx, user, answer, hits), nil
+	}
+
+	c.Turns = append(c.Turns,
+		chatMessage{Role: "user", Content: query},
+		chatMessage{Role: "assistant", Content: answer})
+	if historyTokens(c) > viper.GetInt("history.token_budget") {
+		summarizeConversation(ctx, &c)
+	}
+	saveConversation(ctx, user, c)
+	// 来源不写入对话历史
+	answer = appendCitations(ctx, user, answer, hits)
+	if newSession {
+		answer = userMessage(ctx, MessageNewSession, user, nil) + "\n\n" + answer
+	}
+	return answer, nil
+}
+
+// 估算对话上下文的 token 数
+func historyTokens(c conversation) int {
+	return estimateTokens(c.Summary) + estimateMessagesTokens(c.Turns)
+}
+
+// 把除最近 history.keep_turns 轮以外的对话交给 DeepSeek 总结，合并进已有摘要。
+// 总结失败时丢弃最早的轮次，保证上下文不会无限增长
+func summarizeConversation(ctx context.Context, c *conversation) {
+	keep := viper.GetInt("history.keep_turns") * 2
+	if len(c.Turns) <= keep {
+		return
+	}
+	older, recent := c.Turns[:len(c.Turns)-keep], c.Turns[len(c.Turns)-keep:]
+
+	var b strings.Builder
+	if c.Summary != "" {
+		b.WriteString("已有摘要：\n" + c.Summary + "\n\n")
+	}
+	b.WriteString("新增对话：\n")
+	for _, m := range older {
+		role := "用户"
+		if m.Role == "assistant" {
+			role = "助手"
+		}
+		b.WriteString(role + "：" + m.Content + "\n")
+	}
+
+	summary, err := callDeepSeekWith(ctx, "", viper.GetString("history.summary_prompt"), b.String())
+	if err != nil {
+		logf(ctx, "⚠️ 对话摘要生成失败，丢弃较早的对话: %v", err)
+	} else {
+		c.Summary = summary
+	}
+	c.Turns = append([]chatMessage(nil), recent...)
+}
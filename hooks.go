@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// 脚本钩子：hooks.dir 下的 .lua 脚本按文件名顺序执行，脚本中定义同名全局函数即可挂载到对应位置：
+//   - on_message(msg)：收到消息时调用，返回字符串则作为被动回复并跳过后续处理；返回 {content = "..."} 可改写文本消息内容
+//   - before_llm(req)：调用模型前调用，返回的表中 prompt、query、model 字段会替换原值
+//   - after_llm(resp)：得到回答后调用，返回字符串则替换回答
+const (
+	HookOnMessage = "on_message"
+	HookBeforeLLM = "before_llm"
+	HookAfterLLM  = "after_llm"
+)
+
+type hookScript struct {
+	name  string
+	proto *lua.FunctionProto
+}
+
+var (
+	hookScriptsMu sync.RWMutex
+	hookScripts   []hookScript
+)
+
+// 编译 hooks.dir 下的全部脚本，任一脚本有语法错误时返回错误且保留已加载的脚本
+func loadHookScripts() error {
+	if !viper.GetBool("hooks.enabled") {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(viper.GetString("hooks.dir"), "*.lua"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	var scripts []hookScript
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		chunk, err := parse.Parse(f, file)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		proto, err := lua.Compile(chunk, file)
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, hookScript{name: filepath.Base(file), proto: proto})
+	}
+
+	hookScriptsMu.Lock()
+	hookScripts = scripts
+	hookScriptsMu.Unlock()
+	log.Printf("🪝 已加载 %d 个脚本钩子", len(scripts))
+	return nil
+}
+
+func loadedHookScripts() []hookScript {
+	hookScriptsMu.RLock()
+	defer hookScriptsMu.RUnlock()
+	return hookScripts
+}
+
+// 为一次调用创建沙箱：只开放 base、string、table、math，去掉读取文件的函数，提供 log(...)
+func newHookState(ctx context.Context, script string) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		logf(ctx, "🪝 [%s] %s", script, strings.Join(parts, " "))
+		return 0
+	}))
+	return L
+}
+
+// 依次调用各脚本中的钩子函数，args 生成参数（前一个脚本的改写对后一个脚本可见），fn 处理返回值，返回 false 时停止调用后续脚本。
+// 每次调用限时 hooks.timeout，脚本出错时记录日志并跳过
+func runHook(ctx context.Context, hook string, args func() map[string]string, fn func(lua.LValue) bool) {
+	for _, s := range loadedHookScripts() {
+		ret, err := callHookScript(ctx, s, hook, args())
+		if err != nil {
+			logf(ctx, "⚠️ 脚本 %s 执行 %s 失败: %v", s.name, hook, err)
+			continue
+		}
+		if ret != lua.LNil && !fn(ret) {
+			return
+		}
+	}
+}
+
+func callHookScript(ctx context.Context, s hookScript, hook string, arg map[string]string) (lua.LValue, error) {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("hooks.timeout"))
+	defer cancel()
+	L := newHookState(ctx, s.name)
+	defer L.Close()
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return lua.LNil, err
+	}
+	f, ok := L.GetGlobal(hook).(*lua.LFunction)
+	if !ok {
+		return lua.LNil, nil
+	}
+	t := L.NewTable()
+	for k, v := range arg {
+		t.RawSetString(k, lua.LString(v))
+	}
+	if err := L.CallByParam(lua.P{Fn: f, NRet: 1, Protect: true}, t); err != nil {
+		return lua.LNil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+// 读取钩子返回的表中的字符串字段
+func hookField(v lua.LValue, key string) (string, bool) {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return "", false
+	}
+	s, ok := t.RawGetString(key).(lua.LString)
+	return string(s), ok
+}
+
+// on_message 钩子，返回 true 时以 reply 作为被动回复
+func runMessageHooks(ctx context.Context, msg *WeChatMessage) (string, bool) {
+	var reply string
+	var handled bool
+	runHook(ctx, HookOnMessage, func() map[string]string {
+		return map[string]string{
+			"openid":    msg.FromUserName,
+			"msg_type":  msg.MsgType,
+			"content":   msg.Content,
+			"event":     msg.Event,
+			"event_key": msg.EventKey,
+			"media_id":  msg.MediaID,
+			"msg_id":    fmt.Sprint(msg.MessageID),
+		}
+	}, func(v lua.LValue) bool {
+		if s, ok := v.(lua.LString); ok {
+			reply, handled = string(s), true
+			return false
+		}
+		if content, ok := hookField(v, "content"); ok && msg.MsgType == "text" {
+			msg.Content = content
+		}
+		return true
+	})
+	return reply, handled
+}
+
+// before_llm 钩子，可改写提示词、问题和模型
+func runBeforeLLMHooks(ctx context.Context, user string, prompt, query, model *string) {
+	runHook(ctx, HookBeforeLLM, func() map[string]string {
+		return map[string]string{"openid": user, "prompt": *prompt, "query": *query, "model": *model}
+	}, func(v lua.LValue) bool {
+		if s, ok := hookField(v, "prompt"); ok {
+			*prompt = s
+		}
+		if s, ok := hookField(v, "query"); ok {
+			*query = s
+		}
+		if s, ok := hookField(v, "model"); ok && s != "" {
+			*model = s
+		}
+		return true
+	})
+}
+
+// after_llm 钩子，可改写回答
+func runAfterLLMHooks(ctx context.Context, user, query, answer string) string {
+	runHook(ctx, HookAfterLLM, func() map[string]string {
+		return map[string]string{"openid": user, "query": query, "answer": answer}
+	}, func(v lua.LValue) bool {
+		if s, ok := v.(lua.LString); ok {
+			answer = string(s)
+		}
+		return true
+	})
+	return answer
+}
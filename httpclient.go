@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// 出站请求共用的连接池：各客户端复用同一个 Transport，保持长连接并缓存 TLS 会话，
+// 避免高并发时频繁握手拖慢尾延迟。参数见 http_client 配置
+var (
+	httpTransportOnce sync.Once
+	httpTransport     *http.Transport
+)
+
+func sharedHTTPTransport() *http.Transport {
+	httpTransportOnce.Do(func() {
+		httpTransport = newHTTPTransport()
+	})
+	return httpTransport
+}
+
+func newHTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = viper.GetInt("http_client.max_idle_conns")
+	t.MaxIdleConnsPerHost = viper.GetInt("http_client.max_idle_conns_per_host")
+	t.MaxConnsPerHost = viper.GetInt("http_client.max_conns_per_host")
+	t.IdleConnTimeout = viper.GetDuration("http_client.idle_conn_timeout")
+	t.TLSHandshakeTimeout = viper.GetDuration("http_client.tls_handshake_timeout")
+	t.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(viper.GetInt("http_client.tls_session_cache")),
+	}
+	t.ForceAttemptHTTP2 = viper.GetBool("http_client.http2")
+	if !t.ForceAttemptHTTP2 {
+		// 自定义 TLSClientConfig 后需置空 TLSNextProto 才能完全关闭 HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// 微信、企业微信、语音识别与合成、图片识别、文章下载等全局客户端改用共享连接池
+func initHTTPClients() {
+	for _, c := range []*http.Client{wechatClient, asrClient, ttsClient, ocrClient, articleClient} {
+		c.Transport = sharedHTTPTransport()
+	}
+}
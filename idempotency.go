@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 微信在 5 秒内未收到响应时会重试同一条消息（最多 3 次）。已处理的消息键持久化，重试的回调不会再次调用 DeepSeek，
+// 而是返回首次处理的回复。state.backend 为 redis 时消息键保存在 Redis 中，重试落到其他实例同样能识别；
+// 否则保存在本地数据库的 processed_messages 表中
+
+// 消息键是否保存在状态存储中
+func idempotencyInState() bool {
+	_, isRedis := state.(*redisStateStore)
+	return isRedis
+}
+
+func processedKey(key string) string { return "processed:" + key }
+
+// 状态存储中消息的处理结果
+type processedMessage struct {
+	Reply   string `json:"reply,omitempty"`
+	Replied bool   `json:"replied,omitempty"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+// 普通消息使用 MsgId（企业微信消息加 wecom: 前缀）；事件没有 MsgId，使用 FromUserName + CreateTime + Event
+func messageKey(msg WeChatMessage) string {
+	if msg.MessageID != 0 {
+		if isWeComUser(msg.FromUserName) {
+			return fmt.Sprintf("wecom:msg:%d", msg.MessageID)
+		}
+		return fmt.Sprintf("msg:%d", msg.MessageID)
+	}
+	return fmt.Sprintf("event:%s:%d:%s", msg.FromUserName, msg.CreateTime, msg.Event)
+}
+
+// 登记消息键。first 为 false 表示该消息已被处理（或正在处理），此时返回首次处理的回复
+func claimMessage(ctx context.Context, key, openID string) (reply string, replied bool, first bool) {
+	claimed, err := insertMessageKey(ctx, key, openID)
+	if err != nil {
+		// 存储不可用时宁可重复处理也不丢消息
+		logf(ctx, "⚠️ 登记消息 %s 失败: %v", key, err)
+		return "", false, true
+	}
+	if claimed {
+		return "", false, true
+	}
+
+	logf(ctx, "♻️ 收到重试的消息 %s，不再重复处理", key)
+	// 首次请求可能仍在等待回答，短暂等待它写入回复
+	deadline := time.Now().Add(viper.GetDuration("deepseek.reply_wait"))
+	for {
+		reply, replied, done, err := processedReply(key)
+		if err != nil {
+			logf(ctx, "⚠️ 读取消息 %s 的处理结果失败: %v", key, err)
+			break
+		}
+		if done {
+			return reply, replied, false
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return userMessage(ctx, MessageProcessing, openID, nil), true, false
+}
+
+// 写入消息键，已存在时返回 false
+func insertMessageKey(ctx context.Context, key, openID string) (bool, error) {
+	if idempotencyInState() {
+		data, _ := json.Marshal(processedMessage{})
+		return state.SetNX(ctx, processedKey(key), data, viper.GetDuration("idempotency.retention"))
+	}
+	res, err := db.Exec(`INSERT OR IGNORE INTO processed_messages (msg_key, openid, created_at) VALUES (?, ?, ?)`,
+		key, openID, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func processedReply(key string) (reply string, replied, done bool, err error) {
+	if idempotencyInState() {
+		data, err := state.Get(context.Background(), processedKey(key))
+		if errors.Is(err, errStateNotFound) {
+			return "", false, false, nil
+		}
+		if err != nil {
+			return "", false, false, err
+		}
+		var m processedMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return "", false, false, err
+		}
+		return m.Reply, m.Replied, m.Done, nil
+	}
+	err = db.QueryRow(`SELECT reply, replied, done FROM processed_messages WHERE msg_key = ?`, key).Scan(&reply, &replied, &done)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, false, nil
+	}
+	return reply, replied, done, err
+}
+
+// 记录首次处理的回复，供重试的回调直接返回
+func completeMessage(key, reply string, replied bool) {
+	var err error
+	if idempotencyInState() {
+		data, _ := json.Marshal(processedMessage{Reply: reply, Replied: replied, Done: true})
+		err = state.Set(context.Background(), processedKey(key), data, viper.GetDuration("idempotency.retention"))
+	} else {
+		_, err = db.Exec(`UPDATE processed_messages SET reply = ?, replied = ?, done = 1 WHERE msg_key = ?`, reply, replied, key)
+	}
+	if err != nil {
+		log.Printf("⚠️ 记录消息 %s 的处理结果失败: %v", key, err)
+	}
+}
+
+// 删除数据库中超过 idempotency.retention 的消息键，由定时任务调用。Redis 中的消息键按 TTL 过期
+func cleanupProcessedMessages() {
+	before := time.Now().Add(-viper.GetDuration("idempotency.retention")).Unix()
+	res, err := db.Exec(`DELETE FROM processed_messages WHERE created_at < ?`, before)
+	if err != nil {
+		log.Printf("❌ 清理已处理的消息键失败: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 已清理 %d 条已处理的消息键", n)
+	}
+}
+
+// 回调的去重中间件：重试的消息直接返回首次处理的回复。普通消息没有 MsgId 时（调试聊天、命令行等）不去重
+func idempotencyMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if !viper.GetBool("idempotency.enabled") || (msg.MsgType != "event" && msg.MessageID == 0) {
+			return next(ctx, msg)
+		}
+		key := messageKey(msg)
+		if response, ok, first := claimMessage(ctx, key, msg.FromUserName); !first {
+			return response, ok
+		}
+		response, ok := next(ctx, msg)
+		completeMessage(key, response, ok)
+		return response, ok
+	}
+}
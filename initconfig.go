@@ -0,0 +1,160 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// 带注释的示例配置，即仓库中的 config.yaml
+//
+//go:embed config.yaml
+var configTemplate []byte
+
+// 配置项名称为这些之一时视为凭据，输出生效配置时遮盖
+var secretFieldNames = []string{
+	"token", "secret", "app_secret", "api_key", "api_keys", "password",
+	"encoding_aes_key", "api_v3_key", "sentry_dsn", "salt",
+}
+
+// 生成配置文件骨架，或输出合并默认值、配置文件后实际生效的配置（凭据已遮盖）
+func runInitConfig(args []string) {
+	fs := newFlagSet("init-config", "生成带注释的配置文件，或输出生效的配置")
+	output := fs.String("o", configFile, "写入的文件路径，- 表示输出到终端")
+	force := fs.Bool("force", false, "文件已存在时覆盖")
+	printOnly := fs.Bool("print", false, "输出 -config 合并默认值后实际生效的配置，凭据已遮盖")
+	fs.Parse(args)
+
+	if *printOnly {
+		log.SetOutput(io.Discard)
+		initConfig()
+		if err := writeEffectiveConfig(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ 输出配置失败: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *output == "-" {
+		os.Stdout.Write(configSkeleton())
+		return
+	}
+	if _, err := os.Stat(*output); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "❌ %s 已存在，使用 -force 覆盖\n", *output)
+		os.Exit(1)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, configSkeleton(), 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ 写入配置失败: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✅ 已生成 %s，请填写 wechat 和 deepseek 的凭据后运行 mpbot check-config 检查\n", *output)
+}
+
+// 示例配置之后以注释列出示例中没有出现、只有默认值的配置项
+func configSkeleton() []byte {
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(configTemplate, &tree); err != nil {
+		return configTemplate
+	}
+	listed, leaves := map[string]bool{}, map[string]bool{}
+	flattenConfigKeys("", tree, listed, leaves)
+
+	setConfigDefaults()
+	var missing []string
+	for _, key := range viper.AllKeys() {
+		if !listed[key] && !underLeaf(key, leaves) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return configTemplate
+	}
+	sort.Strings(missing)
+
+	var b strings.Builder
+	b.Write(configTemplate)
+	b.WriteString("\n# 以下配置项未在上面列出，取值为默认值，需要修改时复制到对应的小节中：\n")
+	for _, key := range missing {
+		entry, _ := yaml.Marshal(map[string]interface{}{key: viper.Get(key)})
+		for _, line := range strings.Split(strings.TrimRight(string(entry), "\n"), "\n") {
+			b.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// 记录 tree 中出现的全部配置项，键名统一为小写，与 viper 一致。
+// leaves 为取值不再展开的项（包括 pricing: {} 这样整体给出的小节）
+func flattenConfigKeys(prefix string, tree map[string]interface{}, listed, leaves map[string]bool) {
+	for k, v := range tree {
+		key := strings.ToLower(prefix + k)
+		listed[key] = true
+		if sub, ok := v.(map[string]interface{}); ok && len(sub) > 0 {
+			flattenConfigKeys(key+".", sub, listed, leaves)
+		} else {
+			leaves[key] = true
+		}
+	}
+}
+
+func underLeaf(key string, leaves map[string]bool) bool {
+	for i := strings.LastIndex(key, "."); i > 0; i = strings.LastIndex(key[:i], ".") {
+		if leaves[key[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+func writeEffectiveConfig(w io.Writer) error {
+	settings := maskConfigSecrets("", viper.AllSettings())
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// 遮盖凭据：非空的凭据值替换为 ***，留空的保持原样以便看出未填写
+func maskConfigSecrets(prefix string, settings map[string]interface{}) map[string]interface{} {
+	for k, v := range settings {
+		key := prefix + k
+		if sub, ok := v.(map[string]interface{}); ok {
+			settings[k] = maskConfigSecrets(key+".", sub)
+			continue
+		}
+		if !slices.Contains(secretFieldNames, k) && !slices.Contains(secretConfigKeys, key) {
+			continue
+		}
+		switch val := v.(type) {
+		case string:
+			if val != "" {
+				settings[k] = redactedMark
+			}
+		case []interface{}:
+			for i := range val {
+				val[i] = redactedMark
+			}
+		case []string:
+			masked := make([]string, len(val))
+			for i := range masked {
+				masked[i] = redactedMark
+			}
+			settings[k] = masked
+		}
+	}
+	return settings
+}
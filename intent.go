@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// 意图识别：开启 intent.enabled 后，较短的文本消息先交给模型以 JSON 模式分类，
+// 说法不同的指令（如“接着说”“后面呢”）改写为标准指令后继续处理，不要求与“继续”等字面完全一致
+const (
+	IntentQuestion = "question" // 普通提问
+	IntentCommand  = "command"  // 指令，command 字段为下方 intentCommands 之一
+	IntentFeedback = "feedback" // 对上一条回答的评价，sentiment 为 positive 或 negative
+	IntentHandover = "handover" // 要求转人工客服
+)
+
+// 可由意图识别改写的指令及说明
+var intentCommands = []struct{ Name, Desc string }{
+	{"继续", "查看尚未看完的回答或下一页"},
+	{"重新回答", "对上一个问题换一种回答"},
+	{"翻译模式", "开启或退出翻译模式"},
+	{"签到", "每日签到领取积分"},
+	{"查询积分", "查看积分余额和今日剩余免费次数"},
+	{"邀请码", "获取自己的邀请码"},
+	{"换模型", "查看或切换模型"},
+	{"设置", "查看生成参数设置"},
+}
+
+type messageIntent struct {
+	Intent    string `json:"intent"`
+	Command   string `json:"command"`
+	Sentiment string `json:"sentiment"`
+}
+
+func intentPrompt() string {
+	var b strings.Builder
+	b.WriteString("你是公众号消息的意图分类器。根据用户消息输出一个 JSON 对象，格式为 ")
+	b.WriteString(`{"intent": "question|command|feedback|handover", "command": "", "sentiment": ""}。`)
+	b.WriteString("\nintent 含义：question 为普通提问或闲聊；command 为想执行下列指令之一，command 填指令名；")
+	b.WriteString("feedback 为对上一条回答的评价，sentiment 填 positive 或 negative；handover 为要求转人工客服。\n可用指令：\n")
+	for _, c := range intentCommands {
+		fmt.Fprintf(&b, "- %s：%s\n", c.Name, c.Desc)
+	}
+	b.WriteString("无法确定时输出 question。只输出 JSON，不要输出其他内容。")
+	return b.String()
+}
+
+// 调用模型分类消息，限时 intent.timeout
+func classifyIntent(ctx context.Context, content string) (messageIntent, error) {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("intent.timeout"))
+	defer cancel()
+	params := generationParams{JSONMode: true}
+	temperature, maxTokens := 0.0, 100
+	params.Temperature, params.MaxTokens = &temperature, &maxTokens
+	answer, err := chatCompletion(ctx, viper.GetString("intent.model"), []chatMessage{
+		{Role: "system", Content: intentPrompt()},
+		{Role: "user", Content: content},
+	}, params)
+	var intent messageIntent
+	if err != nil {
+		return intent, err
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(answer)), &intent); err != nil {
+		return intent, fmt.Errorf("invalid intent %q: %w", truncateRunes(answer, 100), err)
+	}
+	return intent, nil
+}
+
+// 把识别出的意图改写为可由后续中间件处理的标准指令，返回空字符串表示按原文处理
+func intentContent(intent messageIntent) string {
+	switch intent.Intent {
+	case IntentCommand:
+		if slices.ContainsFunc(intentCommands, func(c struct{ Name, Desc string }) bool { return c.Name == intent.Command }) {
+			return intent.Command
+		}
+	case IntentFeedback:
+		switch intent.Sentiment {
+		case "positive":
+			return "好评"
+		case "negative":
+			return "差评"
+		}
+	}
+	return ""
+}
+
+// 位于关键词规则和指令之前。分类失败时按原文处理，不影响正常提问
+func intentMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		content := strings.TrimSpace(msg.Content)
+		if !viper.GetBool("intent.enabled") || msg.MsgType != "text" || content == "" ||
+			utf8.RuneCountInString(content) > viper.GetInt("intent.max_length") {
+			return next(ctx, msg)
+		}
+		intent, err := classifyIntent(ctx, content)
+		if err != nil {
+			logf(ctx, "⚠️ 意图识别失败，按原文处理: %v", err)
+			return next(ctx, msg)
+		}
+		if intent.Intent == IntentHandover && viper.GetBool("intent.handover") {
+			// 被动回复 transfer_customer_service，消息转给公众号的人工客服
+			logf(ctx, "👩‍💼 用户 %s 要求转人工客服", msg.FromUserName)
+			setRichReply(ctx, transferReply)
+			return viper.GetString("intent.handover_reply"), true
+		}
+		if rewritten := intentContent(intent); rewritten != "" && rewritten != content {
+			logf(ctx, "🧭 消息“%s”识别为 %s", truncateRunes(content, 30), rewritten)
+			msg.Content = rewritten
+		}
+		return next(ctx, msg)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 带参数二维码的场景值前缀，关注事件的 EventKey 为 qrscene_ + 场景值
+const inviteScenePrefix = "invite_"
+
+// 邀请码不含易混淆的 0/O、1/I
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func newInviteCode() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = inviteAlphabet[int(b[i])%len(inviteAlphabet)]
+	}
+	return string(b)
+}
+
+// 获取（首次调用时生成）用户的邀请码
+func inviteCodeFor(openID string) (string, error) {
+	var code string
+	err := db.QueryRow(`SELECT code FROM invites WHERE openid = ?`, openID).Scan(&code)
+	if err == nil {
+		return code, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		code = newInviteCode()
+		res, err := db.Exec(`INSERT OR IGNORE INTO invites (code, openid, created_at) VALUES (?, ?, ?)`, code, openID, time.Now().Unix())
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return code, nil
+		}
+		// 邀请码冲突，或其他请求已为该用户生成了邀请码
+		if err := db.QueryRow(`SELECT code FROM invites WHERE openid = ?`, openID).Scan(&code); err == nil {
+			return code, nil
+		}
+	}
+	return "", errors.New("could not allocate invite code")
+}
+
+// 邀请二维码：临时二维码有效期 invite.qr_expire（最长 30 天），过期前复用
+func inviteQRCodeURL(openID, code string) (string, error) {
+	var ticket string
+	var expiresAt int64
+	if err := db.QueryRow(`SELECT qr_ticket, qr_expires_at FROM invites WHERE code = ?`, code).Scan(&ticket, &expiresAt); err != nil {
+		return "", err
+	}
+	if ticket != "" && time.Now().Add(time.Hour).Unix() < expiresAt {
+		return qrCodeImageURL(ticket), nil
+	}
+
+	qr, err := createQRCode(QRCodeRequest{
+		SceneStr: inviteScenePrefix + code,
+		Expire:   viper.GetDuration("invite.qr_expire").String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(`UPDATE invites SET qr_ticket = ?, qr_expires_at = ? WHERE code = ?`,
+		qr.Ticket, time.Now().Unix()+qr.ExpireSeconds, code); err != nil {
+		log.Printf("⚠️ 保存邀请二维码失败 [%s]: %v", openID, err)
+	}
+	return qr.ImageURL, nil
+}
+
+// 今天之前没有发过消息的用户视为新用户，避免老用户取消关注后重新关注领取奖励
+func isNewUser(openID string) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM message_stats WHERE openid = ? AND day < ?`,
+		openID, time.Now().Format("2006-01-02")).Scan(&n)
+	return err == nil && n == 0
+}
+
+// 记录邀请关系并给双方发放积分。每个用户只能被邀请一次，返回给新用户的提示语
+func redeemInvite(invitee, code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	var inviter string
+	err := db.QueryRow(`SELECT openid FROM invites WHERE code = ?`, code).Scan(&inviter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "❌ 邀请码不存在。", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if inviter == invitee {
+		return "❌ 不能使用自己的邀请码。", nil
+	}
+	if !isNewUser(invitee) {
+		return "❌ 邀请奖励仅限新关注的用户领取。", nil
+	}
+
+	res, err := db.Exec(`INSERT OR IGNORE INTO referrals (invitee, inviter, code, created_at) VALUES (?, ?, ?, ?)`,
+		invitee, inviter, code, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "📮 你已经领取过邀请奖励了。", nil
+	}
+
+	inviterBonus, inviteeBonus := viper.GetInt("invite.inviter_bonus"), viper.GetInt("invite.invitee_bonus")
+	if _, err := addPoints(invitee, inviteeBonus, "referred", code, ""); err != nil {
+		return "", err
+	}
+	if _, err := addPoints(inviter, inviterBonus, "referral", invitee, ""); err != nil {
+		return "", err
+	}
+	log.Printf("🎁 用户 %s 通过邀请码 %s 加入，邀请人 %s", invitee, code, inviter)
+	queueKefuText(inviter, fmt.Sprintf("🎁 你邀请的好友已关注，获得 %d 积分。", inviterBonus))
+	return fmt.Sprintf("🎁 已通过好友的邀请加入，获得 %d 积分。", inviteeBonus), nil
+}
+
+// 通过邀请二维码关注时的关注事件处理，返回附加到欢迎语后的提示
+func handleInviteSubscribe(openID, eventKey string) string {
+	if !viper.GetBool("invite.enabled") {
+		return ""
+	}
+	code, ok := strings.CutPrefix(eventKey, "qrscene_"+inviteScenePrefix)
+	if !ok {
+		return ""
+	}
+	notice, err := redeemInvite(openID, code)
+	if err != nil {
+		log.Printf("❌ 处理邀请失败 [%s]: %v", openID, err)
+		return ""
+	}
+	return notice
+}
+
+// “邀请码”查看自己的邀请码和邀请二维码；“邀请码 XXXXXX”填写好友的邀请码
+func handleInviteCommand(openID, content string) (string, bool) {
+	if !viper.GetBool("invite.enabled") {
+		return "", false
+	}
+	arg, ok := parseCommand(content, "邀请码")
+	if !ok {
+		return "", false
+	}
+
+	if arg != "" {
+		notice, err := redeemInvite(openID, arg)
+		if err != nil {
+			log.Printf("❌ 处理邀请失败 [%s]: %v", openID, err)
+			return "❌ 系统繁忙，请稍后再试。", true
+		}
+		return notice, true
+	}
+
+	code, err := inviteCodeFor(openID)
+	if err != nil {
+		log.Printf("❌ 生成邀请码失败 [%s]: %v", openID, err)
+		return "❌ 系统繁忙，请稍后再试。", true
+	}
+	var invited int
+	_ = db.QueryRow(`SELECT COUNT(*) FROM referrals WHERE inviter = ?`, openID).Scan(&invited)
+
+	reply := fmt.Sprintf("🎁 你的邀请码：%s\n好友关注后发送“邀请码 %s”，或扫描你的邀请二维码关注，双方各得积分（你 %d，好友 %d）。已邀请 %d 人。",
+		code, code, viper.GetInt("invite.inviter_bonus"), viper.GetInt("invite.invitee_bonus"), invited)
+	if qr, err := inviteQRCodeURL(openID, code); err == nil {
+		reply += "\n邀请二维码：" + qr
+	} else {
+		log.Printf("⚠️ 生成邀请二维码失败 [%s]: %v", openID, err)
+	}
+	return reply, true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 微信回调服务器的 IP 段：接口获取的与 wechat_ips.static 中配置的合并使用
+var (
+	wechatIPsMu sync.RWMutex
+	wechatIPs   []*net.IPNet
+	wechatIPsOK bool // 是否已成功从接口获取过
+)
+
+// 解析 IP 或 CIDR
+func parseIPNet(s string) (*net.IPNet, bool) {
+	s = strings.TrimSpace(s)
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// 从微信接口拉取回调 IP 列表，由定时任务调用
+func refreshWeChatIPs() {
+	var resp struct {
+		IPList []string `json:"ip_list"`
+	}
+	if err := wechatGet("/cgi-bin/getcallbackip", nil, &resp); err != nil {
+		log.Printf("⚠️ 获取微信回调 IP 失败: %v", err)
+		return
+	}
+
+	nets := make([]*net.IPNet, 0, len(resp.IPList))
+	for _, s := range resp.IPList {
+		if n, ok := parseIPNet(s); ok {
+			nets = append(nets, n)
+		}
+	}
+	wechatIPsMu.Lock()
+	wechatIPs, wechatIPsOK = nets, true
+	wechatIPsMu.Unlock()
+	log.Printf("✅ 已更新微信回调 IP 列表，共 %d 条", len(nets))
+}
+
+func isWeChatIP(ip net.IP) (allowed, known bool) {
+	for _, s := range viper.GetStringSlice("wechat_ips.static") {
+		if n, ok := parseIPNet(s); ok {
+			known = true
+			if n.Contains(ip) {
+				return true, true
+			}
+		}
+	}
+
+	wechatIPsMu.RLock()
+	defer wechatIPsMu.RUnlock()
+	known = known || wechatIPsOK
+	for _, n := range wechatIPs {
+		if n.Contains(ip) {
+			return true, known
+		}
+	}
+	return false, known
+}
+
+// 仅允许微信服务器访问消息回调。尚未取得任何 IP 列表时（如启动时接口不可用）暂不拦截，避免误伤正常消息
+func wechatIPFilter() gin.HandlerFunc {
+	if !viper.GetBool("wechat_ips.enabled") {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.ClientIP())
+		if ip == nil {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		allowed, known := isWeChatIP(ip)
+		if !known {
+			logf(c.Request.Context(), "⚠️ 微信回调 IP 列表尚未加载，放行 %s", ip)
+			c.Next()
+			return
+		}
+		if !allowed {
+			logf(c.Request.Context(), "🚫 拒绝来自非微信服务器 IP 的回调: %s", ip)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+	"github.com/spf13/viper"
+)
+
+// 知识库文档
+type KnowledgeDoc struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int       `json:"size"`
+	Chunks    int       `json:"chunks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 知识库片段在向量库中的 collection
+const knowledgeCollection = "knowledge"
+
+// 检索结果
+type KnowledgeHit struct {
+	DocName string  `json:"doc_name"`
+	Seq     int     `json:"seq"`
+	Section string  `json:"section,omitempty"` // 片段所在的章节（Markdown 标题），没有标题的文档为空
+	Content string  `json:"content"`
+	Score   float64 `json:"score"`
+}
+
+// 从上传的文件中提取纯文本，支持 txt/md/pdf
+func extractDocumentText(name string, data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".markdown":
+		return string(data), nil
+	case ".pdf":
+		r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", fmt.Errorf("parse pdf: %w", err)
+		}
+		text, err := r.GetPlainText()
+		if err != nil {
+			return "", fmt.Errorf("extract pdf text: %w", err)
+		}
+		b, err := io.ReadAll(text)
+		return string(b), err
+	default:
+		return "", fmt.Errorf("unsupported file type %q, expected txt/md/pdf", filepath.Ext(name))
+	}
+}
+
+// 按段落切分文本，每段不超过 size 个字符，过长的段落按 overlap 重叠切开
+func chunkText(text string, size, overlap int) []string {
+	if size <= 0 {
+		size = 500
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	var chunks []string
+	var cur []rune
+	flush := func() {
+		if s := strings.TrimSpace(string(cur)); s != "" {
+			chunks = append(chunks, s)
+		}
+		cur = cur[:0]
+	}
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		p := []rune(strings.TrimSpace(para))
+		if len(p) == 0 {
+			continue
+		}
+		if len(cur)+len(p)+1 > size {
+			flush()
+		}
+		for len(p) > size {
+			chunks = append(chunks, string(p[:size]))
+			p = p[size-overlap:]
+		}
+		if len(cur) > 0 {
+			cur = append(cur, '\n')
+		}
+		cur = append(cur, p...)
+	}
+	flush()
+	return chunks
+}
+
+var headingPattern = regexp.MustCompile(`(?m)^[ \t]{0,3}#{1,6}[ \t]+(.+?)[ \t#]*$`)
+
+// 各片段所在的章节：片段以标题开头时取该标题，否则沿用之前最近的标题
+func chunkSections(chunks []string) []string {
+	sections := make([]string, len(chunks))
+	current := ""
+	for i, chunk := range chunks {
+		headings := headingPattern.FindAllStringSubmatchIndex(chunk, -1)
+		if len(headings) > 0 && strings.TrimSpace(chunk[:headings[0][0]]) == "" {
+			current = chunk[headings[0][2]:headings[0][3]]
+		}
+		sections[i] = current
+		if len(headings) > 0 {
+			last := headings[len(headings)-1]
+			current = chunk[last[2]:last[3]]
+		}
+	}
+	return sections
+}
+
+// 上传文档：提取文本、切分、生成向量并入库
+func addKnowledgeDocument(ctx context.Context, name string, data []byte) (*KnowledgeDoc, error) {
+	text, err := extractDocumentText(name, data)
+	if err != nil {
+		return nil, err
+	}
+	parts := chunkText(text, viper.GetInt("rag.chunk_size"), viper.GetInt("rag.chunk_overlap"))
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("document %q has no text", name)
+	}
+
+	vectors, err := embedTexts(ctx, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &KnowledgeDoc{ID: newID(), Name: name, Size: len(data), Chunks: len(parts), CreatedAt: time.Now()}
+	sections := chunkSections(parts)
+	points := make([]VectorPoint, len(parts))
+	for i, content := range parts {
+		points[i] = VectorPoint{
+			ID:      fmt.Sprintf("%s:%d", doc.ID, i),
+			Group:   doc.ID,
+			Vector:  vectors[i],
+			Payload: map[string]string{"doc_name": name, "seq": strconv.Itoa(i), "section": sections[i], "content": content},
+		}
+	}
+	if err := vectorStore.Upsert(ctx, knowledgeCollection, points); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`INSERT INTO kb_documents (id, name, size, chunks, created_at) VALUES (?, ?, ?, ?, ?)`,
+		doc.ID, doc.Name, doc.Size, doc.Chunks, doc.CreatedAt.Unix()); err != nil {
+		_ = vectorStore.DeleteGroup(ctx, knowledgeCollection, doc.ID)
+		return nil, err
+	}
+	logf(ctx, "📚 知识库新增文档 %s，共 %d 个片段", name, len(parts))
+	return doc, nil
+}
+
+func listKnowledgeDocuments() ([]KnowledgeDoc, error) {
+	rows, err := db.Query(`SELECT id, name, size, chunks, created_at FROM kb_documents ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []KnowledgeDoc{}
+	for rows.Next() {
+		var d KnowledgeDoc
+		var created int64
+		if err := rows.Scan(&d.ID, &d.Name, &d.Size, &d.Chunks, &created); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.Unix(created, 0)
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+func deleteKnowledgeDocument(ctx context.Context, id string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM kb_documents WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, vectorStore.DeleteGroup(ctx, knowledgeCollection, id)
+}
+
+// 检索与问题最相关的 topK 个片段
+func searchKnowledge(ctx context.Context, query string, topK int) ([]KnowledgeHit, error) {
+	vectors, err := embedTexts(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	matches, err := vectorStore.Search(ctx, knowledgeCollection, vectors[0], topK)
+	if err != nil {
+		return nil, err
+	}
+
+	minScore := viper.GetFloat64("rag.min_score")
+	hits := []KnowledgeHit{}
+	for _, m := range matches {
+		if m.Score < minScore {
+			continue
+		}
+		seq, _ := strconv.Atoi(m.Payload["seq"])
+		hits = append(hits, KnowledgeHit{DocName: m.Payload["doc_name"], Seq: seq, Section: m.Payload["section"], Content: m.Payload["content"], Score: m.Score})
+	}
+	return hits, nil
+}
+
+// 为问题检索知识库并拼接成追加到系统提示词的资料段，同时返回命中的片段供回答引用；未开启或无结果时返回空串
+func knowledgeContext(ctx context.Context, query string) (string, []KnowledgeHit) {
+	if !viper.GetBool("rag.enabled") {
+		return "", nil
+	}
+	hits, err := searchKnowledge(ctx, query, viper.GetInt("rag.top_k"))
+	if err != nil {
+		logf(ctx, "⚠️ 知识库检索失败: %v", err)
+		return "", nil
+	}
+	if len(hits) == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	for i, h := range hits {
+		fmt.Fprintf(&b, "%s\n%s\n\n", h.citation(i+1), h.Content)
+	}
+	logf(ctx, "📚 命中知识库片段 %d 条", len(hits))
+	return fmt.Sprintf(viper.GetString("rag.prompt"), strings.TrimSpace(b.String())), hits
+}
+
+// 编号的来源，如“[1]《手册.md》安装 / 第 3 段”
+func (h KnowledgeHit) citation(n int) string {
+	s := fmt.Sprintf("[%d]《%s》", n, h.DocName)
+	if h.Section != "" {
+		s += h.Section + " / "
+	}
+	return s + fmt.Sprintf("第 %d 段", h.Seq+1)
+}
+
+// 开启 rag.citations 时在回答末尾附上编号的来源，并记下本次的片段供“来源”指令展开
+func appendCitations(ctx context.Context, user, answer string, hits []KnowledgeHit) string {
+	if len(hits) == 0 || !viper.GetBool("rag.citations") {
+		return answer
+	}
+	data, _ := json.Marshal(hits)
+	if err := state.Set(ctx, citationsKey(user), data, viper.GetDuration("rag.citations_ttl")); err != nil {
+		logf(ctx, "⚠️ 保存回答来源失败: %v", err)
+	}
+	var b strings.Builder
+	b.WriteString(answer + "\n\n📎 来源：")
+	for i, h := range hits {
+		b.WriteString("\n" + h.citation(i+1))
+	}
+	b.WriteString("\n发送“来源”查看引用的原文。")
+	return b.String()
+}
+
+func citationsKey(user string) string {
+	return "citations:" + user
+}
+
+// 用户发送“来源”展开上一个回答引用的知识库原文
+func handleSourcesCommand(openID, content string) (string, bool) {
+	if strings.TrimSpace(content) != "来源" || !viper.GetBool("rag.enabled") || !viper.GetBool("rag.citations") {
+		return "", false
+	}
+	data, err := state.Get(context.Background(), citationsKey(openID))
+	if err != nil {
+		return "📎 上一个回答没有引用知识库，或来源已过期。", true
+	}
+	var hits []KnowledgeHit
+	if err := json.Unmarshal(data, &hits); err != nil || len(hits) == 0 {
+		return "📎 上一个回答没有引用知识库，或来源已过期。", true
+	}
+	var b strings.Builder
+	b.WriteString("📎 上一个回答引用的资料：")
+	for i, h := range hits {
+		fmt.Fprintf(&b, "\n\n%s（相似度 %.2f）\n%s", h.citation(i+1), h.Score,
+			truncateRunes(h.Content, viper.GetInt("rag.citation_length")))
+	}
+	return b.String(), true
+}
+
+// 通过 rag.embedding_provider 指定的服务生成向量，按 rag.batch_size 分批请求
+func embedTexts(ctx context.Context, texts []string) ([][]float32, error) {
+	provider, err := getProvider(viper.GetString("rag.embedding_provider"))
+	if err != nil {
+		return nil, err
+	}
+	batch := viper.GetInt("rag.batch_size")
+	if batch <= 0 {
+		batch = 16
+	}
+
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += batch {
+		end := min(start+batch, len(texts))
+		v, err := provider.Embed(ctx, viper.GetString("rag.embedding_model"), texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, v...)
+	}
+	return vectors, nil
+}
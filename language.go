@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+// 回答语言：设置 deepseek.force_language 后，在系统提示词末尾要求模型使用该语言回答，
+// 并按文字体系检查回答，不符合时让模型改写为该语言（模型有时会用英文回答中文问题）
+
+// 常用语言的名称和文字体系，其他语言只在提示词中要求，不检查回答
+var forcedLanguages = map[string]struct {
+	Name   string
+	Script *unicode.RangeTable
+}{
+	"zh":      {"简体中文", unicode.Han},
+	"zh-cn":   {"简体中文", unicode.Han},
+	"zh-hans": {"简体中文", unicode.Han},
+	"zh-tw":   {"繁體中文", unicode.Han},
+	"zh-hk":   {"繁體中文", unicode.Han},
+	"zh-hant": {"繁體中文", unicode.Han},
+	"en":      {"English", unicode.Latin},
+	"fr":      {"Français", unicode.Latin},
+	"de":      {"Deutsch", unicode.Latin},
+	"es":      {"Español", unicode.Latin},
+	"ru":      {"Русский", unicode.Cyrillic},
+	"ja":      {"日本語", unicode.Hiragana},
+	"ko":      {"한국어", unicode.Hangul},
+}
+
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// 检查回答语言前去掉的代码块，代码中的英文不计入
+var codeBlockPattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`")
+
+const languageRewritePrompt = "把用户发送的内容改写为%s，保留原有的格式、代码、链接和专有名词，只输出改写后的内容。"
+
+// 回答语言的名称，未设置时为空
+func forcedLanguage() string {
+	code := viper.GetString("deepseek.force_language")
+	if code == "" {
+		return ""
+	}
+	if lang, ok := forcedLanguages[strings.ToLower(code)]; ok {
+		return lang.Name
+	}
+	return code
+}
+
+// 附加在系统提示词末尾的语言要求
+func languageInstruction() string {
+	if name := forcedLanguage(); name != "" {
+		return "\n\n无论用户使用什么语言提问，请始终使用" + name + "回答。"
+	}
+	return ""
+}
+
+// 回答的文字体系与 deepseek.force_language 不符时，让模型改写；改写失败时保留原回答
+func enforceLanguage(ctx context.Context, user, answer string) string {
+	lang, ok := forcedLanguages[strings.ToLower(viper.GetString("deepseek.force_language"))]
+	if !ok || matchesScript(answer, lang.Script) {
+		return answer
+	}
+	logf(ctx, "🈯 回答不是%s，改写后发送给用户 %s", lang.Name, user)
+	provider, model := userModelVia(user)
+	rewritten, err := chatCompletionVia(ctx, provider, model, []chatMessage{
+		{Role: "system", Content: fmt.Sprintf(languageRewritePrompt, lang.Name)},
+		{Role: "user", Content: answer},
+	}, defaultGenerationParams())
+	if err != nil || strings.TrimSpace(rewritten) == "" {
+		logf(ctx, "⚠️ 改写回答语言失败，保留原回答: %v", err)
+		return answer
+	}
+	return rewritten
+}
+
+// 按文字统计：汉字、假名、谚文每个字符计一次，其他文字每个单词计一次。
+// 目标文字占比低于 20% 时视为不符；内容过短时不判断。日语的汉字同样计入，但至少要有假名
+func matchesScript(text string, script *unicode.RangeTable) bool {
+	japanese := script == unicode.Hiragana
+	text = codeBlockPattern.ReplaceAllString(text, "")
+	total, matched, kana := 0, 0, 0
+	inWord := false
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			inWord = false
+			continue
+		}
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			inWord = false
+			total++
+			if unicode.In(r, unicode.Hiragana, unicode.Katakana) {
+				kana++
+			}
+			if unicode.Is(script, r) || (japanese && unicode.In(r, unicode.Han, unicode.Katakana)) {
+				matched++
+			}
+			continue
+		}
+		if inWord {
+			continue
+		}
+		inWord = true
+		total++
+		if unicode.Is(script, r) {
+			matched++
+		}
+	}
+	if total < 10 {
+		return true
+	}
+	if japanese && kana == 0 {
+		return false
+	}
+	return matched*5 >= total
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha1"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
-	"io/ioutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sort"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type WeChatMessage struct {
@@ -23,6 +29,33 @@ type WeChatMessage struct {
 	MsgType      string `xml:"MsgType"`
 	Content      string `xml:"Content"`
 	Event        string `xml:"Event"`
+	EventKey     string `xml:"EventKey"` // 扫描带参数二维码关注时为 qrscene_ + 场景值
+	MessageID    int64  `xml:"MsgId"`    // 普通消息的消息 ID，群发结果事件使用 MsgID
+	Ticket       string `xml:"Ticket"`   // 扫描带参数二维码时的二维码 ticket
+	MediaID      string `xml:"MediaId"`  // 图片、语音、视频消息的素材 ID
+	ThumbMediaID string `xml:"ThumbMediaId"`
+
+	// 语音消息，公众号开启语音识别后 Recognition 为识别结果
+	Format      string `xml:"Format"`
+	Recognition string `xml:"Recognition"`
+
+	// 链接消息
+	Title       string `xml:"Title"`
+	Description string `xml:"Description"`
+	URL         string `xml:"Url"`
+
+	// 上报地理位置事件（LOCATION）
+	Latitude  float64 `xml:"Latitude"`
+	Longitude float64 `xml:"Longitude"`
+	Precision float64 `xml:"Precision"`
+
+	// 群发结果事件（MASSSENDJOBFINISH）
+	MsgID       int64  `xml:"MsgID"`
+	Status      string `xml:"Status"`
+	TotalCount  int    `xml:"TotalCount"`
+	FilterCount int    `xml:"FilterCount"`
+	SentCount   int    `xml:"SentCount"`
+	ErrorCount  int    `xml:"ErrorCount"`
 }
 
 type DeepSeekResponse struct {
@@ -30,13 +63,14 @@ type DeepSeekResponse struct {
 		Message struct {
 			Content string `json:"content"`
 		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage tokenUsage `json:"usage"`
 }
 
-var userResponses sync.Map // 缓存用户的 DeepSeek 结果
-
 func initConfig() {
-	viper.SetConfigFile("config.yaml")
+	setConfigDefaults()
+	viper.SetConfigFile(configFile)
 	if err := viper.ReadInConfig(); err != nil {
 		log.Println("⚠️ 加载配置文件失败:", err)
 	} else {
@@ -44,6 +78,255 @@ func initConfig() {
 	}
 }
 
+// 各配置项的默认值，配置文件中未填写的项使用这里的值
+func setConfigDefaults() {
+	viper.SetDefault("server.listen", ":80")
+	viper.SetDefault("server.gin_mode", gin.ReleaseMode)
+	viper.SetDefault("server.access_log", true)
+	viper.SetDefault("server.shutdown_timeout", "10s")
+	viper.SetDefault("server.callback_max_bytes", 64<<10)
+	viper.SetDefault("push_api.enabled", false)
+	viper.SetDefault("push_api.rate_limit.enabled", true)
+	viper.SetDefault("push_api.rate_limit.global_rps", 20)
+	viper.SetDefault("push_api.rate_limit.global_burst", 40)
+	viper.SetDefault("push_api.rate_limit.ip_rps", 10)
+	viper.SetDefault("push_api.rate_limit.ip_burst", 20)
+	viper.SetDefault("snapshot.enabled", true)
+	viper.SetDefault("snapshot.path", "data/snapshot.json")
+	viper.SetDefault("logging.redact_secrets", true)
+	viper.SetDefault("logging.content", "full")
+	viper.SetDefault("logging.content_max_length", 50)
+	viper.SetDefault("privacy.hash_openids", false)
+	viper.SetDefault("privacy.salt", "")
+	viper.SetDefault("privacy.openid_pattern", "o[A-Za-z0-9_-]{27}")
+	viper.SetDefault("rate_limit.enabled", true)
+	viper.SetDefault("rate_limit.global_rps", 50)
+	viper.SetDefault("rate_limit.global_burst", 100)
+	viper.SetDefault("rate_limit.ip_rps", 20)
+	viper.SetDefault("rate_limit.ip_burst", 40)
+	viper.SetDefault("wechat.verify_signature", true)
+	viper.SetDefault("wechat.timestamp_window", "5m")
+	viper.SetDefault("wechat_ips.fetch", true)
+	viper.SetDefault("wechat_ips.refresh", "6h")
+	viper.SetDefault("database.path", "data/mpbot.db")
+	viper.SetDefault("broadcast.check_interval", "30s")
+	viper.SetDefault("deepseek.max_concurrency", 10)
+	viper.SetDefault("deepseek.timeout", "180s")
+	viper.SetDefault("deepseek.max_retries", 2)
+	viper.SetDefault("deepseek.reply_wait", "2s")
+	viper.SetDefault("deepseek.context_window", 65536)
+	viper.SetDefault("deepseek.reply_reserve", 8192)
+	viper.SetDefault("deepseek.force_language", "")
+	viper.SetDefault("deepseek.runtime_context", true)
+	viper.SetDefault("deepseek.timezone", "Asia/Shanghai")
+	viper.SetDefault("profanity.enabled", false)
+	viper.SetDefault("profanity.dictionary", "")
+	viper.SetDefault("profanity.mask", "*")
+	viper.SetDefault("http_client.max_idle_conns", 100)
+	viper.SetDefault("http_client.max_idle_conns_per_host", 32)
+	viper.SetDefault("http_client.max_conns_per_host", 0)
+	viper.SetDefault("http_client.idle_conn_timeout", "90s")
+	viper.SetDefault("http_client.tls_handshake_timeout", "10s")
+	viper.SetDefault("http_client.tls_session_cache", 64)
+	viper.SetDefault("http_client.http2", true)
+	viper.SetDefault("model_switch.allow", "restricted")
+	viper.SetDefault("tiers.enabled", false)
+	viper.SetDefault("tiers.default", "free")
+	viper.SetDefault("tiers.admin_tier", "")
+	viper.SetDefault("generation.user_commands", true)
+	viper.SetDefault("generation.max_tokens_limit", 8192)
+	viper.SetDefault("experiments.prompt.enabled", false)
+	viper.SetDefault("experiments.prompt.name", "prompt")
+	viper.SetDefault("experiments.compare.enabled", false)
+	viper.SetDefault("experiments.shadow.enabled", false)
+	viper.SetDefault("experiments.shadow.name", "shadow")
+	viper.SetDefault("experiments.shadow.percent", 10)
+	viper.SetDefault("experiments.shadow.provider", "deepseek")
+	viper.SetDefault("experiments.shadow.max_concurrency", 2)
+	viper.SetDefault("experiments.shadow.retention", "720h")
+	viper.SetDefault("experiments.canary.enabled", false)
+	viper.SetDefault("experiments.canary.name", "canary")
+	viper.SetDefault("experiments.canary.provider", "deepseek")
+	viper.SetDefault("vector_store.backend", "local")
+	viper.SetDefault("state.backend", "memory")
+	viper.SetDefault("state.redis.addr", "localhost:6379")
+	viper.SetDefault("state.redis.db", 0)
+	viper.SetDefault("state.redis.prefix", "mpbot:")
+	viper.SetDefault("state.memory.max_entries", 200000)
+	viper.SetDefault("state.memory.max_bytes", 256<<20)
+	viper.SetDefault("queue.backend", "local")
+	viper.SetDefault("queue.workers", 4)
+	viper.SetDefault("queue.push_answers", true)
+	viper.SetDefault("queue.claim_idle", "5m")
+	viper.SetDefault("queue.max_length", 100000)
+	viper.SetDefault("queue.max_depth", 0)
+	viper.SetDefault("idempotency.enabled", true)
+	viper.SetDefault("idempotency.retention", "72h")
+	viper.SetDefault("outbox.poll_interval", "5s")
+	viper.SetDefault("outbox.max_attempts", 8)
+	viper.SetDefault("outbox.retention", "168h")
+	viper.SetDefault("outbox.strategy", []string{"kefu", "template", "cache"})
+	viper.SetDefault("outbox.unavailable_ttl", "1h")
+	viper.SetDefault("budget.enabled", false)
+	viper.SetDefault("budget.daily", 0)
+	viper.SetDefault("budget.monthly", 0)
+	viper.SetDefault("budget.action", BudgetActionFallback)
+	viper.SetDefault("budget.fallback_provider", "deepseek")
+	viper.SetDefault("budget.fallback_model", "")
+	viper.SetDefault("budget.refresh_interval", "1m")
+	viper.SetDefault("retry_queue.enabled", false)
+	viper.SetDefault("retry_queue.poll_interval", "30s")
+	viper.SetDefault("retry_queue.max_attempts", 10)
+	viper.SetDefault("retry_queue.max_age", "24h")
+	viper.SetDefault("throttle.default_pause", "30s")
+	viper.SetDefault("throttle.max_pause", "10m")
+	viper.SetDefault("throttle.action", ThrottleQueue)
+	viper.SetDefault("throttle.max_wait", "30m")
+	viper.SetDefault("rag.embedding_provider", "openai")
+	viper.SetDefault("rag.embedding_model", "text-embedding-3-small")
+	viper.SetDefault("rag.batch_size", 16)
+	viper.SetDefault("rag.chunk_size", 500)
+	viper.SetDefault("rag.chunk_overlap", 50)
+	viper.SetDefault("rag.top_k", 3)
+	viper.SetDefault("rag.min_score", 0.3)
+	viper.SetDefault("rag.max_upload_bytes", 10<<20)
+	viper.SetDefault("rag.citations", true)
+	viper.SetDefault("rag.citations_ttl", "24h")
+	viper.SetDefault("rag.citation_length", 300)
+	viper.SetDefault("rag.prompt", "以下是与用户问题可能相关的资料，回答时优先依据这些资料，资料中没有的内容不要编造：\n\n%s")
+	viper.SetDefault("history.enabled", true)
+	viper.SetDefault("history.token_budget", 3000)
+	viper.SetDefault("history.keep_turns", 3)
+	viper.SetDefault("history.ttl", "168h")
+	viper.SetDefault("history.idle_timeout", "0s")
+	viper.SetDefault("history.store", "auto")
+	viper.SetDefault("regenerate.enabled", true)
+	viper.SetDefault("regenerate.ttl", "24h")
+	viper.SetDefault("regenerate.temperature_boost", 0.3)
+	viper.SetDefault("translate.enabled", true)
+	viper.SetDefault("translate.target", "英文")
+	viper.SetDefault("translate.temperature", 1.3)
+	viper.SetDefault("translate.prompt", "你是专业的翻译。自动识别用户发送内容的语言，把它翻译成{{.Target}}。只输出译文，不要解释，也不要回答其中的问题；保留原文的格式、专有名词、代码和链接。")
+	viper.SetDefault("article.enabled", true)
+	viper.SetDefault("article.max_chars", 8000)
+	viper.SetDefault("article.cache_ttl", "24h")
+	viper.SetDefault("article.prompt", "你是阅读助手。请阅读用户转发的公众号文章，先用两三句话概括全文，再分条列出 3~5 个要点；用户附带问题时，结合文章内容回答。不要编造文章中没有的信息。")
+	viper.SetDefault("history.summary_prompt", "请把下面的对话整理成一段简洁的摘要，保留用户的身份、偏好、关键事实和尚未解决的问题，不超过 300 字。")
+	viper.SetDefault("profile.ttl", "24h")
+	viper.SetDefault("cache.answer_ttl", "30m")
+	viper.SetDefault("cache.cleanup_interval", "5m")
+	viper.SetDefault("cache.page_length", 600)
+	viper.SetDefault("tagging.spec", "0 3 * * *")
+	viper.SetDefault("abuse.window", "60s")
+	viper.SetDefault("abuse.max_messages", 10)
+	viper.SetDefault("abuse.max_repeats", 3)
+	viper.SetDefault("abuse.cooldown", "60s")
+	viper.SetDefault("abuse.max_cooldown", "1h")
+	viper.SetDefault("abuse.strike_reset", "24h")
+	viper.SetDefault("abuse.notify_after", 3)
+	viper.SetDefault("abuse.reply", "🧊 操作过于频繁，请 %d 秒后再试。")
+	viper.SetDefault("error_reporting.environment", "production")
+	viper.SetDefault("error_reporting.sample_rate", 1.0)
+	viper.SetDefault("metrics.enabled", true)
+	viper.SetDefault("tracing.endpoint", "localhost:4318")
+	viper.SetDefault("tracing.service_name", "mpbot")
+	viper.SetDefault("tracing.sample_rate", 1.0)
+	viper.SetDefault("alert.panic_reply", "😵 服务开小差了，请稍后再试。")
+	viper.SetDefault("intent.enabled", false)
+	viper.SetDefault("intent.model", "")
+	viper.SetDefault("intent.timeout", "3s")
+	viper.SetDefault("intent.max_length", 30)
+	viper.SetDefault("intent.handover", false)
+	viper.SetDefault("intent.handover_reply", "👩‍💼 正在为你转接人工客服，请稍候。")
+	viper.SetDefault("messages.processing", "⏳ 处理中，请输入“继续”查看答案。")
+	viper.SetDefault("messages.accepted", "⏳ 已收到，回答生成后会发送给你。")
+	viper.SetDefault("messages.queued", "📋 已排队，前面还有 {{.Ahead}} 个问题，请稍后输入“继续”查看答案。")
+	viper.SetDefault("messages.timeout", "⌛ DeepSeek 响应超时，请稍后再试。")
+	viper.SetDefault("messages.provider_error", "❌ DeepSeek 处理失败，请稍后再试。")
+	viper.SetDefault("messages.moderation_blocked", "🚫 该问题无法回答，请换个问题试试。")
+	viper.SetDefault("messages.quota_exceeded", "💰 今日 {{.DailyFree}} 次免费提问已用完，积分不足。发送“签到”领取积分，发送“查询积分”查看余额。")
+	viper.SetDefault("messages.queue_full", "🚦 当前人数过多，请稍后再试。")
+	viper.SetDefault("messages.retry_queued", "⚠️ DeepSeek 暂时无法回答，稍后会自动重试并推送结果。")
+	viper.SetDefault("messages.new_session", "🆕 已开启新会话，之前的对话不再作为上下文。")
+	viper.SetDefault("messages.budget_exceeded", "🛠️ 服务维护中，请稍后再试。")
+	viper.SetDefault("messages.out_of_office", "🌙 现在是休息时间，{{.Opens}} 起恢复回答，请届时再来提问。")
+	viper.SetDefault("messages.deferred", "🌙 现在是休息时间，问题已记下，{{.Opens}} 起处理，回答生成后会发送给你。")
+	viper.SetDefault("messages.throttled", "🚦 DeepSeek 当前繁忙，请 {{.RetryAfter}} 秒后再试。")
+	viper.SetDefault("messages.throttled_queued", "🚦 DeepSeek 当前繁忙，问题已排队，约 {{.RetryAfter}} 秒后开始回答，请稍后输入“继续”查看答案。")
+	viper.SetDefault("messages.throttled_accepted", "🚦 DeepSeek 当前繁忙，问题已排队，约 {{.RetryAfter}} 秒后开始回答，回答生成后会发送给你。")
+	viper.SetDefault("office_hours.enabled", false)
+	viper.SetDefault("office_hours.timezone", "Asia/Shanghai")
+	viper.SetDefault("office_hours.action", OfficeHoursReply)
+	viper.SetDefault("plugins.enabled", false)
+	viper.SetDefault("plugins.dir", "plugins")
+	viper.SetDefault("plugins.timeout", "3s")
+	viper.SetDefault("hooks.enabled", false)
+	viper.SetDefault("hooks.dir", "hooks")
+	viper.SetDefault("hooks.timeout", "200ms")
+	viper.SetDefault("alert.check_interval", "1m")
+	viper.SetDefault("alert.repeat_interval", "1h")
+	viper.SetDefault("debug_chat.openid", "debug-user")
+	viper.SetDefault("recording.enabled", false)
+	viper.SetDefault("recording.path", "data/recordings.jsonl")
+	viper.SetDefault("recording.max_bytes", 100<<20)
+	viper.SetDefault("maintenance.reply", "🛠️ 系统维护中，请稍后再来。")
+	viper.SetDefault("access.blocked_reply", "🚫 你已被限制使用本服务。")
+	viper.SetDefault("access.not_allowed_reply", "🔒 本服务目前仅对受邀用户开放。")
+	viper.SetDefault("digest.time", "08:00")
+	viper.SetDefault("points.enabled", false)
+	viper.SetDefault("points.daily_free", 10)
+	viper.SetDefault("points.checkin_reward", 5)
+	viper.SetDefault("pay.enabled", false)
+	viper.SetDefault("membership.enabled", false)
+	viper.SetDefault("membership.daily_free", 100)
+	viper.SetDefault("membership.tier", "")
+	viper.SetDefault("membership.skip_queue", true)
+	viper.SetDefault("membership.reserved_concurrency", 2)
+	viper.SetDefault("membership.points_price", 0)
+	viper.SetDefault("membership.points_days", 30)
+	viper.SetDefault("invite.enabled", false)
+	viper.SetDefault("invite.inviter_bonus", 20)
+	viper.SetDefault("invite.invitee_bonus", 10)
+	viper.SetDefault("invite.qr_expire", "720h")
+	viper.SetDefault("miniprogram.enabled", false)
+	viper.SetDefault("music.enabled", false)
+	viper.SetDefault("audit.enabled", false)
+	viper.SetDefault("wecom.enabled", false)
+	viper.SetDefault("media.max_size", 20<<20)
+	viper.SetDefault("media.reply_wait", "2s")
+	viper.SetDefault("media.transcribe_video", false)
+	viper.SetDefault("media.ffmpeg", "ffmpeg")
+	viper.SetDefault("asr.model", "whisper-1")
+	viper.SetDefault("asr.voice_fallback", false)
+	viper.SetDefault("tts.model", "tts-1")
+	viper.SetDefault("tts.voice", "alloy")
+	viper.SetDefault("tts.format", "mp3")
+	viper.SetDefault("onboarding.enabled", false)
+	viper.SetDefault("subscribe_msg.enabled", false)
+	viper.SetDefault("subscribe_msg.scene", 1000)
+	viper.SetDefault("subscribe_msg.title", "消息通知")
+	viper.SetDefault("notifications.quota_low_threshold", 5)
+	viper.SetDefault("notifications.membership_expiring_before", "72h")
+	viper.SetDefault("ocr.enabled", false)
+	viper.SetDefault("ocr.provider", "tesseract")
+	viper.SetDefault("ocr.tesseract", "tesseract")
+	viper.SetDefault("ocr.languages", "chi_sim+eng")
+	viper.SetDefault("ocr.max_chars", 2000)
+	viper.SetDefault("ocr.ttl", "10m")
+	viper.SetDefault("events.webhook_timeout", "3s")
+	viper.SetDefault("events.subscribe.action", "reply")
+	viper.SetDefault("events.subscribe.reply", "👻 {{if .Nickname}}{{.Nickname}}，{{end}}感谢您的关注！\n本公众号接入了 DeepSeek，你可以直接向我提问。")
+	viper.SetDefault("events.default.action", "reply")
+	viper.SetDefault("events.default.reply", "📢 事件已收到，但未做特殊处理。")
+	for _, event := range []string{"unsubscribe", "location", "view", "templatesendjobfinish"} {
+		viper.SetDefault("events."+event+".action", "none")
+	}
+	viper.SetDefault("report.enabled", false)
+	viper.SetDefault("report.time", "09:00")
+	viper.SetDefault("digest.max_topics", 5)
+	viper.SetDefault("digest.prompt", "今天是%s，请整理一份关于“%s”的每日简报，列出最值得关注的 3~5 条要点，每条一两句话。")
+}
+
 func checkSignature(signature, timestamp, nonce string) bool {
 	token := viper.GetString("wechat.token")
 	if token == "" || timestamp == "" || nonce == "" {
@@ -51,24 +334,81 @@ func checkSignature(signature, timestamp, nonce string) bool {
 		return false
 	}
 
-	strs := []string{token, timestamp, nonce}
+	sha1Hash := wechatSignature(token, timestamp, nonce)
+	if sha1Hash != signature {
+		log.Printf("🔍 签名不匹配: 计算值 %s, 传入的 signature = %s", sha1Hash, signature)
+		return false
+	}
+	return true
+}
+
+// 微信签名：参数按字典序排序后拼接，取 SHA1
+func wechatSignature(parts ...string) string {
+	strs := append([]string(nil), parts...)
 	sort.Strings(strs)
 
 	hash := sha1.New()
 	hash.Write([]byte(strings.Join(strs, "")))
-	sha1Hash := fmt.Sprintf("%x", hash.Sum(nil))
-
-	log.Printf("🔍 计算签名: sha1(%s) = %s, 传入的 signature = %s", strings.Join(strs, ""), sha1Hash, signature)
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
 
-	return sha1Hash == signature
+// 加载配置并初始化服务端与命令行共用的组件
+func initServices() {
+	initConfig()
+	if errs := validateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("❌ 配置错误: %v", err)
+		}
+		log.Fatalf("❌ 配置校验失败，共 %d 项，请修改 %s 后重试", len(errs), configFile)
+	}
+	gin.SetMode(viper.GetString("server.gin_mode"))
+	initLogRedaction()
+	initHTTPClients()
+	initErrorReporting()
+	initTracing()
+	if err := initDatabase(); err != nil {
+		log.Fatalf("❌ 数据库初始化失败: %v", err)
+	}
+	if err := loadProfanityDictionary(); err != nil {
+		log.Printf("⚠️ 加载遮盖词库失败: %v", err)
+	}
+	if err := loadPlugins(); err != nil {
+		log.Printf("⚠️ 加载插件失败: %v", err)
+	}
+	if err := loadHookScripts(); err != nil {
+		log.Printf("⚠️ 加载脚本钩子失败: %v", err)
+	}
+	if err := initStateStore(); err != nil {
+		log.Fatalf("❌ 状态存储初始化失败: %v", err)
+	}
+	if err := initVectorStore(); err != nil {
+		log.Fatalf("❌ 向量存储初始化失败: %v", err)
+	}
+	if err := initMessageQueue(); err != nil {
+		log.Fatalf("❌ 消息队列初始化失败: %v", err)
+	}
 }
 
 func main() {
-	initConfig()
-	r := gin.Default()
+	runCLI(os.Args[1:])
+}
+
+// 启动 HTTP 服务（serve 子命令）
+func serve() {
+	initServices()
+	log.Printf("🏷️ %s", buildInfo())
+	r := newEngine()
+	r.Use(requestIDMiddleware(), traceRequests())
+
+	// 构建信息，便于确认线上运行的版本
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, buildInfo())
+	})
+
+	limiter := rateLimit()
 
 	// 微信验证接口
-	r.GET("/wx", func(c *gin.Context) {
+	r.GET("/wx", limiter, func(c *gin.Context) {
 		signature := c.Query("signature")
 		timestamp := c.Query("timestamp")
 		nonce := c.Query("nonce")
@@ -82,113 +422,298 @@ func main() {
 	})
 
 	// 微信消息处理接口
-	r.POST("/wx", handleMessage)
+	r.POST("/wx", limitCallbackBody(), limiter, wechatIPFilter(), verifySignature(), recordRequests(), recoverMessage(), handleMessage)
+
+	// 企业微信回调接口
+	registerWeCom(r, limiter)
+
+	registerPay(r, limiter)
+	registerSubscribeMsg(r, limiter)
+	registerPushAPI(r)
 
-	log.Println("✅ Server started on port 80")
-	r.Run(":80")
+	// 管理接口
+	registerAdminRoutes(r)
+	registerPprof(r)
+	registerMetrics(r)
+	registerDebugChat(r)
+	startCron()
+	startQueueWorkers()
+	startOutboxSender()
+	startRetryQueue()
+	startDeferredQuestions()
+	startAlertRules()
+	if err := restoreSnapshot(); err != nil {
+		log.Printf("⚠️ 恢复状态快照失败: %v", err)
+	}
+
+	addr := viper.GetString("server.listen")
+	srv := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		log.Printf("✅ Server started on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("❌ 服务启动失败: %v", err)
+		}
+	}()
+
+	// 收到退出信号后停止接收回调，等待处理中的请求返回被动回复，再保存状态快照
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("👋 正在退出...")
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("server.shutdown_timeout"))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ 等待请求处理完成超时: %v", err)
+	}
+	if err := saveSnapshot(); err != nil {
+		log.Printf("❌ 保存状态快照失败: %v", err)
+	}
+}
+
+// 按 server 配置创建 gin 引擎：运行模式、访问日志和可信代理
+func newEngine() *gin.Engine {
+	r := gin.New()
+	if viper.GetBool("server.access_log") {
+		r.Use(gin.Logger())
+	}
+	r.Use(gin.Recovery())
+
+	// 未配置时不信任任何代理，ClientIP 直接取连接地址
+	proxies := viper.GetStringSlice("server.trusted_proxies")
+	if len(proxies) == 0 {
+		proxies = nil
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		log.Fatalf("❌ server.trusted_proxies 配置错误: %v", err)
+	}
+	return r
 }
 
 func handleMessage(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
 	var msg WeChatMessage
-	if err := c.ShouldBindXML(&msg); err != nil {
-		log.Printf("❌ XML 解析失败: %v", err)
+	if c.Query("encrypt_type") == "aes" {
+		msg, err = parseEncryptedMessage(c, body)
+	} else {
+		msg, err = parseWeChatMessage(body)
+	}
+	if err != nil {
+		callbackRejected.WithLabelValues("malformed").Inc()
+		logf(c.Request.Context(), "❌ XML 解析失败: %v", err)
+		reportError(c.Request.Context(), "xml", err, map[string]interface{}{"path": c.Request.URL.Path})
 		c.String(http.StatusBadRequest, "Bad Request")
 		return
 	}
+	respondToMessage(c, msg)
+}
 
-	var response string
+// 去重、处理消息并写入被动回复，公众号与企业微信回调共用
+func respondToMessage(c *gin.Context, msg WeChatMessage) {
+	c.Set("wechat_msg", msg)
+	c.Request = c.Request.WithContext(withRichReply(c.Request.Context()))
+	response, ok := runMessageChain(c.Request.Context(), msg, idempotencyMiddleware, auditMiddleware)
+	writeReply(c, msg, response, ok)
+}
 
-	switch msg.MsgType {
-	//触发关注事件后自动回复
-	case "event":
-		if msg.Event == "subscribe" {
-			response = "👻 感谢您的关注！\n本公众号接入了 DeepSeek，你可以直接向我提问。"
-		} else {
-			response = "📢 事件已收到，但未做特殊处理。"
-		}
-	//接受到文本消息
-	case "text":
-		// 用户查询 DeepSeek 结果
-		if strings.TrimSpace(msg.Content) == "继续" {
-			if cachedResponse, ok := userResponses.Load(msg.FromUserName); ok {
-				response = cachedResponse.(string)
-				userResponses.Delete(msg.FromUserName) // 取出后删除，避免缓存积累
-			} else {
-				response = "⌛ 目前没有待查看的回答，请先输入问题。"
-			}
-		} else {
-			// 异步调用 DeepSeek
-			go fetchDeepSeekResponse(msg.FromUserName, msg.Content)
-			time.Sleep(time.Second * 3)
-			response = "⏳ 处理中，请输入“继续”查看答案。"
-		}
-	default:
-		response = "📸 内容已收到，但当前不支持。"
+// ok 为 false 时无需回复用户，返回 success
+func writeReply(c *gin.Context, msg WeChatMessage, response string, ok bool) {
+	if r, rich := richReply(c.Request.Context(), msg); ok && rich {
+		writeXMLReply(c, r)
+	} else if ok {
+		replyText(c, msg, response)
+	} else {
+		c.String(http.StatusOK, "success")
 	}
+}
 
-	reply := fmt.Sprintf(`<xml>
-		<ToUserName><![CDATA[%s]]></ToUserName>
-		<FromUserName><![CDATA[%s]]></FromUserName>
-		<CreateTime>%d</CreateTime>
-		<MsgType><![CDATA[text]]></MsgType>
-		<Content><![CDATA[%s]]></Content>
-	</xml>`, msg.FromUserName, msg.ToUserName, time.Now().Unix(), response)
+// 处理一条消息并返回被动回复的内容，微信回调与调试聊天页共用；不需要回复时返回 false
+func processMessage(ctx context.Context, msg WeChatMessage) (string, bool) {
+	return runMessageChain(ctx, msg)
+}
 
-	c.Data(http.StatusOK, "application/xml", []byte(reply))
+// 被动回复文本消息
+func replyText(c *gin.Context, msg WeChatMessage, response string) {
+	writeXMLReply(c, textReply(msg, response))
 }
 
-// 异步调用 DeepSeek 并缓存结果
-func fetchDeepSeekResponse(user string, query string) {
-	response, err := callDeepSeek(query)
+// 解析“指令 参数”形式的消息，指令与参数之间需以空白分隔
+func parseCommand(content, name string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, name) {
+		return "", false
+	}
+	rest := content[len(name):]
+	if r, _ := utf8.DecodeRuneInString(rest); rest != "" && !unicode.IsSpace(r) {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// 异步调用 DeepSeek，回答交给仍在等待的被动回复，否则缓存。
+// 队列 worker 没有等待者，开启 queue.push_answers 时经发件箱推送客服消息，最终推送失败再缓存
+func fetchDeepSeekResponse(ctx context.Context, user string, query string, waiter *answerWaiter) {
+	ctx, span := tracer.Start(ctx, "deepseek.fetch", trace.WithAttributes(attrUser.String(pseudonym(user))))
+	defer span.End()
+
+	ctx, done := startGeneration(ctx, user)
+	defer done()
+	markGenerating(ctx, user, query)
+	var parts []string
+	var response string
+	var err error
+	if url, question, ok := findArticleURL(query); ok {
+		response, err = summarizeArticle(ctx, user, url, question)
+	} else if _, ok := translationFrom(ctx); ok {
+		response, err = translateText(ctx, user, query)
+	} else if comparing(ctx) {
+		response, err = compareAnswers(ctx, user, query)
+	} else {
+		response, err = askWithHistory(ctx, user, query)
+	}
+	delivery := DeliveryCached
+	defer func() { markFinished(ctx, user, err != nil, delivery) }()
+	// 用户取消后不再缓存或推送回答
+	if generationCanceled(ctx, err) {
+		logf(ctx, "🛑 用户 %s 取消了问题，已中断生成", user)
+		span.AddEvent("canceled by user")
+		return
+	}
 	if err != nil {
-		log.Printf("❌ DeepSeek 调用失败: %v", err)
-		response = "❌ DeepSeek 处理失败，请稍后再试。"
+		spanError(span, err)
+		logf(ctx, "❌ DeepSeek 调用失败: %v", err)
+		reportError(ctx, "deepseek", err, map[string]interface{}{"user": user})
+		parts = []string{failureReply(ctx, user, query, err)}
+	} else {
+		rememberQuestion(ctx, user, query)
+		parts = postProcessAnswer(ctx, user, runAfterLLMHooks(ctx, user, query, response))
+	}
+	delivery = deliverAnswer(ctx, user, query, waiter, parts)
+	span.AddEvent("answer " + delivery)
+}
+
+// 问题未发给模型就结束（维护或限流等待中被取消、等待超时，或用户队列崩溃）。取消的问题由“取消”指令更新进度，这里不再回复
+func abandonQuestion(ctx context.Context, user, query string, waiter *answerWaiter, err error) {
+	if errors.Is(err, context.Canceled) {
+		logf(ctx, "🛑 用户 %s 已取消该问题，跳过", user)
+		return
 	}
-	userResponses.Store(user, response) // 缓存结果，供用户输入“继续”查询
+	logf(ctx, "⌛ 问题未能发给模型，回复失败提示: %v", err)
+	markGenerating(ctx, user, query)
+	delivery := deliverAnswer(ctx, user, query, waiter, []string{failureReply(ctx, user, query, err)})
+	markFinished(ctx, user, true, delivery)
 }
 
-// 调用 DeepSeek API
-func callDeepSeek(query string) (string, error) {
-	url := viper.GetString("deepseek.api_url")
-	apiKey := viper.GetString("deepseek.api_key")
-	prompt := viper.GetString("deepseek.prompt")
+// 模型调用失败时给用户的提示，开启重试队列时写入重试队列
+func failureReply(ctx context.Context, user, query string, err error) string {
+	scenario := failureScenario(err)
+	// 未通过内容审核的问题重试也不会成功，费用超过上限时等到下一个周期再提问
+	if viper.GetBool("retry_queue.enabled") && scenario != MessageModerationBlocked && scenario != MessageBudgetExceeded {
+		if qerr := enqueueRetry(user, query, err); qerr != nil {
+			logf(ctx, "❌ 写入重试队列失败: %v", qerr)
+		} else {
+			scenario = MessageRetryQueued
+		}
+	}
+	return userMessage(ctx, scenario, user, failureVars(err))
+}
 
-	payload := map[string]interface{}{
-		"model": viper.GetString("deepseek.model"),
-		"messages": []map[string]string{
-			{"role": "system", "content": prompt},
-			{"role": "user", "content": query},
-		},
-		"stream": false,
+// 送达回答或失败提示，返回回答的去向
+func deliverAnswer(ctx context.Context, user, query string, waiter *answerWaiter, parts []string) string {
+	if waiter == nil && viper.GetBool("queue.push_answers") {
+		for _, part := range parts {
+			m := OutboxMessage{Text: part, CacheOnFailure: true}
+			applyNotificationTemplate(ctx, &m, NotifyAnswerReady, user, map[string]string{"Question": query, "Answer": part})
+			queueOutbox(user, m)
+		}
+		return DeliveryPushed
+	}
+	// 回答切分为多条或多页时，被动回复第一页，其余缓存，供用户输入“继续”依次查看
+	var pages []string
+	for _, part := range parts {
+		pages = append(pages, answerPages(part)...)
 	}
+	first := pages[0]
+	if len(pages) > 1 {
+		first += fmt.Sprintf("\n\n📚 还有 %d 条回答，输入“继续”查看下一条。", len(pages)-1)
+	}
+	if waiter.deliver(first) {
+		for _, page := range pages[1:] {
+			pushAnswer(user, page)
+		}
+		return DeliveryReplied
+	}
+	for _, page := range pages {
+		pushAnswer(user, page) // 缓存结果，供用户输入“继续”查询
+	}
+	return DeliveryCached
+}
 
-	payloadBytes, _ := json.Marshal(payload)
-	log.Println("🔵 DeepSeek 请求 JSON:", string(payloadBytes))
+// 调用 DeepSeek API，使用指定模型和提示词，model 为空时使用 deepseek.model
+func callDeepSeekWith(ctx context.Context, model, prompt, query string) (string, error) {
+	return chatCompletion(ctx, model, []chatMessage{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: query},
+	}, defaultGenerationParams())
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	if err != nil {
+// 对话消息
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// 以完整的消息列表和生成参数调用 DeepSeek API
+func chatCompletion(ctx context.Context, model string, messages []chatMessage, params generationParams) (string, error) {
+	return chatCompletionVia(ctx, "deepseek", model, messages, params)
+}
+
+// 通过指定的服务（见 getProvider）调用模型
+func chatCompletionVia(ctx context.Context, providerName, model string, messages []chatMessage, params generationParams) (answer string, err error) {
+	if model == "" {
+		model = viper.GetString("deepseek.model")
+	}
+	if providerName, model, err = applyBudget(ctx, providerName, model); err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	ctx, span := tracer.Start(ctx, "deepseek.chat",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("llm.model", model)))
+	defer func() {
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
+	}()
+
+	if trimmed, ok := trimMessages(model, messages); ok {
+		logf(ctx, "✂️ 上下文超出 %s 的窗口，已裁剪 %d 条消息", model, len(messages)-len(trimmed))
+		messages = trimmed
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	provider, err := getProvider(providerName)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	span.SetAttributes(attribute.String("llm.provider", provider.Name()))
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Println("🟢 DeepSeek API 响应:", string(body))
-
-	var deepSeekResp DeepSeekResponse
-	if err := json.Unmarshal(body, &deepSeekResp); err != nil {
+	start := time.Now()
+	deepSeekResp, err := provider.Chat(ctx, chatRequest{Model: model, Messages: messages, Params: params})
+	if err != nil {
+		recordModelUsage(model, tokenUsage{}, time.Since(start), true)
 		return "", err
 	}
+	recordModelUsage(model, deepSeekResp.Usage, time.Since(start), false)
+	span.SetAttributes(attribute.Int("llm.usage.total_tokens", deepSeekResp.Usage.TotalTokens))
 
 	if len(deepSeekResp.Choices) > 0 {
+		if choice := deepSeekResp.Choices[0]; choice.FinishReason == "content_filter" && choice.Message.Content == "" {
+			return "", errContentFiltered
+		}
 		return deepSeekResp.Choices[0].Message.Content, nil
 	}
 
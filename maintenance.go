@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 维护模式：开启后仅管理员可以使用，其他用户的消息收到维护提示，不再调用模型。
+// 开关和提示保存在状态存储中由各实例共享，未切换过时使用 maintenance.enabled 和 maintenance.reply。
+// 维护期间队列 worker、重试队列、暂存问题和简报都会暂停，积压的问题保留到维护结束后继续处理
+const (
+	maintenanceKey       = "maintenance"
+	maintenanceNoticeKey = "maintenance:notice"
+)
+
+func maintenanceEnabled() bool {
+	data, err := state.Get(context.Background(), maintenanceKey)
+	if err != nil {
+		return viper.GetBool("maintenance.enabled")
+	}
+	return string(data) == "1"
+}
+
+func setMaintenance(enabled bool) error {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	return state.Set(context.Background(), maintenanceKey, []byte(value), 0)
+}
+
+// 维护期间回复给用户的提示
+func maintenanceNotice() string {
+	if data, err := state.Get(context.Background(), maintenanceNoticeKey); err == nil && len(data) > 0 {
+		return string(data)
+	}
+	return viper.GetString("maintenance.reply")
+}
+
+// 设置维护提示，为空时恢复使用 maintenance.reply
+func setMaintenanceNotice(notice string) error {
+	if notice == "" {
+		return state.Delete(context.Background(), maintenanceNoticeKey)
+	}
+	return state.Set(context.Background(), maintenanceNoticeKey, []byte(notice), 0)
+}
+
+func checkMaintenance(openID string) (string, bool) {
+	if maintenanceEnabled() && !isAdmin(openID) {
+		return maintenanceNotice(), false
+	}
+	return "", true
+}
+
+// 维护期间阻塞后台任务，每 5 秒检查一次开关
+func waitMaintenance(ctx context.Context) error {
+	for maintenanceEnabled() {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// 维护期间积压的问题数
+type maintenancePending struct {
+	Queued   int64 `json:"queued"`   // 问题队列中等待处理的问题
+	Retries  int64 `json:"retries"`  // 重试队列中的问题
+	Deferred int64 `json:"deferred"` // 工作时间外暂存的问题
+}
+
+type maintenanceStatus struct {
+	Enabled bool               `json:"enabled"`
+	Notice  string             `json:"notice"`
+	Pending maintenancePending `json:"pending"`
+}
+
+func currentMaintenanceStatus(ctx context.Context) maintenanceStatus {
+	s := maintenanceStatus{Enabled: maintenanceEnabled(), Notice: maintenanceNotice()}
+	s.Pending.Queued = queueDepth(ctx)
+	for table, n := range map[string]*int64{"llm_retries": &s.Pending.Retries, "deferred_questions": &s.Pending.Deferred} {
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(n); err != nil {
+			log.Printf("⚠️ 统计 %s 失败: %v", table, err)
+		}
+	}
+	return s
+}
+
+func (s maintenanceStatus) String() string {
+	label := "✅ 正常服务"
+	if s.Enabled {
+		label = "🛠️ 维护中"
+	}
+	return fmt.Sprintf("%s\n维护提示：%s\n积压问题：队列 %d / 重试 %d / 暂存 %d",
+		label, s.Notice, s.Pending.Queued, s.Pending.Retries, s.Pending.Deferred)
+}
+
+// 管理员指令：“维护”查看状态，“维护 开启 [提示]”进入维护模式，“维护 关闭”恢复服务
+func handleMaintenanceCommand(openID, content string) (string, bool) {
+	arg, ok := parseCommand(content, "维护")
+	if !ok || !isAdmin(openID) {
+		return "", false
+	}
+	ctx := context.Background()
+	if arg == "" {
+		return currentMaintenanceStatus(ctx).String(), true
+	}
+	if notice, ok := parseCommand(arg, "开启"); ok {
+		if notice != "" {
+			if err := setMaintenanceNotice(notice); err != nil {
+				return "❌ 设置维护提示失败：" + err.Error(), true
+			}
+		}
+		if err := setMaintenance(true); err != nil {
+			return "❌ 开启维护模式失败：" + err.Error(), true
+		}
+		log.Printf("🛠️ 管理员 %s 开启维护模式", openID)
+		return "🛠️ 已进入维护模式，普通用户将收到维护提示。\n" + currentMaintenanceStatus(ctx).String(), true
+	}
+	if _, ok := parseCommand(arg, "关闭"); ok {
+		if err := setMaintenance(false); err != nil {
+			return "❌ 关闭维护模式失败：" + err.Error(), true
+		}
+		log.Printf("🛠️ 管理员 %s 关闭维护模式", openID)
+		return "✅ 已退出维护模式，积压的问题将继续处理。\n" + currentMaintenanceStatus(ctx).String(), true
+	}
+	return "⚠️ 用法：维护 / 维护 开启 [提示] / 维护 关闭", true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 永久素材：欢迎语图片、菜单图标、常用语音等上传一次即可长期引用 media_id，不必在公众平台后台维护。
+// 图片、语音、视频、缩略图通过 add_material 上传；图文素材由公众平台的草稿箱管理，这里只支持查询和删除
+
+// 永久素材的类型
+var materialTypes = []string{"image", "voice", "video", "thumb", "news"}
+
+func validMaterialType(t string, upload bool) bool {
+	if upload && t == "news" {
+		return false
+	}
+	for _, v := range materialTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// 上传的永久素材，图片和缩略图返回可在图文中引用的 url
+type Material struct {
+	MediaID string `json:"media_id"`
+	URL     string `json:"url,omitempty"`
+}
+
+// 视频素材需附带标题和简介
+type MaterialUpload struct {
+	Type         string
+	Filename     string
+	Data         []byte
+	Title        string
+	Introduction string
+}
+
+// 新增永久素材（POST multipart /cgi-bin/material/add_material）
+func addMaterial(u MaterialUpload) (*Material, error) {
+	if !validMaterialType(u.Type, true) {
+		return nil, fmt.Errorf("unsupported material type %q (want image, voice, video or thumb)", u.Type)
+	}
+	if u.Type == "video" && u.Title == "" {
+		return nil, fmt.Errorf("video material requires a title")
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("media", u.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(u.Data); err != nil {
+		return nil, err
+	}
+	if u.Type == "video" {
+		desc, _ := json.Marshal(map[string]string{"title": u.Title, "introduction": u.Introduction})
+		_ = w.WriteField("description", string(desc))
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("type", u.Type)
+	data, _, err := wechatRequest(http.MethodPost, "/cgi-bin/material/add_material", query, body.Bytes(), w.FormDataContentType())
+	if err != nil {
+		return nil, err
+	}
+	var m Material
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// 获取的永久素材：图片、语音、缩略图返回文件内容，视频和图文返回接口的 JSON
+type MaterialContent struct {
+	Data        []byte
+	ContentType string
+}
+
+func (m MaterialContent) IsJSON() bool {
+	return strings.HasPrefix(m.ContentType, "application/json") || strings.HasPrefix(m.ContentType, "text/plain")
+}
+
+// 获取永久素材（POST /cgi-bin/material/get_material）
+func getMaterial(mediaID string) (MaterialContent, error) {
+	payload, _ := json.Marshal(map[string]string{"media_id": mediaID})
+	data, contentType, err := wechatRequest(http.MethodPost, "/cgi-bin/material/get_material", nil, payload, "application/json")
+	if err != nil {
+		return MaterialContent{}, err
+	}
+	return MaterialContent{Data: data, ContentType: contentType}, nil
+}
+
+// 删除永久素材
+func deleteMaterial(mediaID string) error {
+	return wechatPost("/cgi-bin/material/del_material", map[string]string{"media_id": mediaID}, nil)
+}
+
+// 素材列表中的一项，图文素材的 content 原样返回
+type MaterialItem struct {
+	MediaID    string          `json:"media_id"`
+	Name       string          `json:"name,omitempty"`
+	URL        string          `json:"url,omitempty"`
+	UpdateTime int64           `json:"update_time"`
+	Content    json.RawMessage `json:"content,omitempty"`
+}
+
+type MaterialList struct {
+	TotalCount int            `json:"total_count"`
+	ItemCount  int            `json:"item_count"`
+	Items      []MaterialItem `json:"item"`
+}
+
+// 分页获取某类永久素材，count 为 1~20
+func listMaterials(materialType string, offset, count int) (*MaterialList, error) {
+	if !validMaterialType(materialType, false) {
+		return nil, fmt.Errorf("unsupported material type %q", materialType)
+	}
+	count = min(max(count, 1), 20)
+	var list MaterialList
+	err := wechatPost("/cgi-bin/material/batchget_material", map[string]interface{}{
+		"type":   materialType,
+		"offset": max(offset, 0),
+		"count":  count,
+	}, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// 各类永久素材的数量
+type MaterialCount struct {
+	Voice int `json:"voice_count"`
+	Video int `json:"video_count"`
+	Image int `json:"image_count"`
+	News  int `json:"news_count"`
+}
+
+func countMaterials() (*MaterialCount, error) {
+	var c MaterialCount
+	if err := wechatGet("/cgi-bin/material/get_materialcount", nil, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 下载的临时素材
+type mediaFile struct {
+	Data        []byte
+	ContentType string
+}
+
+func (f mediaFile) String() string {
+	return fmt.Sprintf("%.1f KB，%s", float64(len(f.Data))/1024, f.ContentType)
+}
+
+// 通过 MediaId 下载临时素材，大小超过 media.max_size 时返回错误。
+// 视频素材的接口返回 {"video_url": "..."}，需再从该地址下载
+func downloadMedia(ctx context.Context, mediaID string) (mediaFile, error) {
+	token, err := getAccessToken()
+	if err != nil {
+		return mediaFile{}, err
+	}
+	query := url.Values{}
+	query.Set("access_token", token)
+	query.Set("media_id", mediaID)
+	f, err := fetchMedia(ctx, wechatAPIBase+"/cgi-bin/media/get?"+query.Encode())
+	if err != nil {
+		return f, err
+	}
+
+	if strings.HasPrefix(f.ContentType, "application/json") || strings.HasPrefix(f.ContentType, "text/plain") {
+		var result struct {
+			WeChatAPIError
+			VideoURL string `json:"video_url"`
+		}
+		if err := json.Unmarshal(f.Data, &result); err != nil {
+			return mediaFile{}, err
+		}
+		if result.ErrCode == 40001 || result.ErrCode == 42001 {
+			invalidateAccessToken()
+		}
+		if result.ErrCode != 0 {
+			return mediaFile{}, &result.WeChatAPIError
+		}
+		if result.VideoURL == "" {
+			return mediaFile{}, errors.New("media response has no content")
+		}
+		return fetchMedia(ctx, result.VideoURL)
+	}
+	return f, nil
+}
+
+func fetchMedia(ctx context.Context, rawURL string) (mediaFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return mediaFile{}, err
+	}
+	resp, err := wechatClient.Do(req)
+	if err != nil {
+		return mediaFile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return mediaFile{}, fmt.Errorf("media download returned %d", resp.StatusCode)
+	}
+
+	limit := viper.GetInt64("media.max_size")
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return mediaFile{}, err
+	}
+	if int64(len(data)) > limit {
+		return mediaFile{}, fmt.Errorf("media larger than %d bytes", limit)
+	}
+	return mediaFile{Data: data, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// 用 ffmpeg 从视频或语音中提取 16kHz 单声道 mp3 音轨，format 为素材的格式，如 mp4、amr
+func extractAudio(ctx context.Context, media []byte, format string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "mpbot-audio-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in."+format), filepath.Join(dir, "out.mp3")
+	if err := os.WriteFile(in, media, 0o600); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, viper.GetString("media.ffmpeg"), "-hide_banner", "-loglevel", "error",
+		"-i", in, "-vn", "-ac", "1", "-ar", "16000", "-f", "mp3", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return os.ReadFile(out)
+}
+
+// 视频、小视频消息：下载视频并回复大小和格式；开启 media.transcribe_video 时识别其中的语音并作为问题回答
+func handleVideoMessage(ctx context.Context, msg WeChatMessage) string {
+	transcribe := viper.GetBool("media.transcribe_video")
+	done := make(chan struct{})
+	var file mediaFile
+	var err error
+	detached := detachContext(ctx)
+	safeGo("handleVideo", func() {
+		defer close(done)
+		file, err = downloadMedia(detached, msg.MediaID)
+		if err != nil {
+			logf(detached, "❌ 下载视频 %s 失败: %v", msg.MediaID, err)
+			return
+		}
+		logf(detached, "🎬 已下载视频 %s（%s）", msg.MediaID, file)
+		if transcribe {
+			answerVideo(detached, msg.FromUserName, file)
+		}
+	})
+
+	// 下载较快时在被动回复中附带视频信息
+	received := "🎬 已收到视频"
+	select {
+	case <-done:
+		if err != nil {
+			return "❌ 视频下载失败，请稍后重试。"
+		}
+		received = fmt.Sprintf("🎬 已收到视频（%s）", file)
+	case <-time.After(viper.GetDuration("media.reply_wait")):
+	}
+	if transcribe {
+		return received + "，正在识别其中的语音，稍后输入“继续”查看回答。"
+	}
+	return received + "。目前只能识别文字问题，请用文字描述你的问题。"
+}
+
+func answerVideo(ctx context.Context, user string, file mediaFile) {
+	audio, err := extractAudio(ctx, file.Data, "mp4")
+	if err != nil {
+		logf(ctx, "❌ 提取视频音轨失败: %v", err)
+		storeAnswer(user, "❌ 视频中的语音提取失败，请用文字描述你的问题。")
+		return
+	}
+	text, err := transcribeAudio(ctx, "audio.mp3", audio)
+	if err != nil || strings.TrimSpace(text) == "" {
+		logf(ctx, "❌ 识别视频语音失败: %v", err)
+		storeAnswer(user, "❌ 未能识别视频中的语音，请用文字描述你的问题。")
+		return
+	}
+	logf(ctx, "🎙️ 视频语音识别结果: %s", redactContent(text))
+	askTranscribed(ctx, user, text)
+}
+
+// 把识别出的语音作为问题扣费后提交
+func askTranscribed(ctx context.Context, user, text string) {
+	if reply, ok := chargeQuestion(ctx, user); !ok {
+		storeAnswer(user, reply)
+		return
+	}
+	recordQuestion(user)
+	askInBackground(ctx, user, text)
+}
+
+// 不等待回答地提交问题，回答写入缓存或按 queue.push_answers 推送
+func askInBackground(ctx context.Context, user, content string) {
+	if messageQueue != nil {
+		publishQuestion(ctx, user, content)
+		return
+	}
+	enqueueQuestion(ctx, user, content, nil)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 会员：管理员开通、积分兑换或微信支付购买，到期后自动恢复为普通用户。
+// 会员权益：每天 membership.daily_free 次免费提问、使用 membership.tier 等级的模型、队列繁忙时不被拒绝并可使用专用并发名额
+type Membership struct {
+	OpenID    string    `json:"openid"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Active    bool      `json:"active"`
+}
+
+// 每一次开通记录，同一 (openid, source, ref) 只生效一次，用于支付回调防重复
+type MembershipGrant struct {
+	ID        int64     `json:"id"`
+	Days      int       `json:"days"`
+	Source    string    `json:"source"` // admin、points、pay
+	Ref       string    `json:"ref,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 会员到期时间，缓存为 Unix 秒数，0 表示不是会员
+func membershipExpiry(openID string) time.Time {
+	ctx := context.Background()
+	var expires int64
+	if !getCached(ctx, "membership:"+openID, &expires) {
+		err := db.QueryRow(`SELECT expires_at FROM memberships WHERE openid = ?`, openID).Scan(&expires)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("⚠️ 查询会员失败 [%s]: %v", openID, err)
+			return time.Time{}
+		}
+		fillCache(ctx, "membership:"+openID, expires)
+	}
+	if expires <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(expires, 0)
+}
+
+// 是否为有效期内的会员
+func isMember(openID string) bool {
+	return viper.GetBool("membership.enabled") && time.Now().Before(membershipExpiry(openID))
+}
+
+func getMembership(openID string) Membership {
+	m := Membership{OpenID: openID, ExpiresAt: membershipExpiry(openID)}
+	m.Active = time.Now().Before(m.ExpiresAt)
+	return m
+}
+
+// 开通或续期 days 天：未过期时从原到期时间顺延。ref 非空且已开通过时返回 false
+func grantMembership(openID string, days int, source, ref, note string) (time.Time, bool, error) {
+	if days <= 0 {
+		return time.Time{}, false, fmt.Errorf("days must be positive")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec(`INSERT OR IGNORE INTO membership_grants (openid, days, source, ref, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, openID, days, source, ref, note, now.Unix())
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return membershipExpiry(openID), false, nil
+	}
+
+	var expires int64
+	err = tx.QueryRow(`SELECT expires_at FROM memberships WHERE openid = ?`, openID).Scan(&expires)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, err
+	}
+	start := now
+	if current := time.Unix(expires, 0); current.After(now) {
+		start = current
+	}
+	until := start.AddDate(0, 0, days)
+	if _, err := tx.Exec(`INSERT INTO memberships (openid, expires_at, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(openid) DO UPDATE SET expires_at = excluded.expires_at, updated_at = excluded.updated_at`,
+		openID, until.Unix(), now.Unix()); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, false, err
+	}
+	storeCache(context.Background(), "membership:"+openID, until.Unix())
+	log.Printf("👑 %s 开通会员 %d 天（%s），有效期至 %s", openID, days, source, until.Format("2006-01-02 15:04"))
+	return until, true, nil
+}
+
+// 立即取消会员，开通记录保留
+func revokeMembership(openID string) error {
+	if _, err := db.Exec(`DELETE FROM memberships WHERE openid = ?`, openID); err != nil {
+		return err
+	}
+	storeCache(context.Background(), "membership:"+openID, int64(0))
+	log.Printf("👑 %s 的会员已取消", openID)
+	return nil
+}
+
+func membershipGrants(openID string, limit int) ([]MembershipGrant, error) {
+	rows, err := db.Query(`SELECT id, days, source, ref, note, created_at FROM membership_grants
+		WHERE openid = ? ORDER BY id DESC LIMIT ?`, openID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []MembershipGrant{}
+	for rows.Next() {
+		var g MembershipGrant
+		var created int64
+		if err := rows.Scan(&g.ID, &g.Days, &g.Source, &g.Ref, &g.Note, &created); err != nil {
+			return nil, err
+		}
+		g.CreatedAt = time.Unix(created, 0)
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// 用户每天的免费提问次数，会员为 membership.daily_free
+func dailyFreeQuestions(openID string) int {
+	if isMember(openID) {
+		return viper.GetInt("membership.daily_free")
+	}
+	return viper.GetInt("points.daily_free")
+}
+
+// 会员状态与权益说明，who 为回复中对用户的称呼
+func membershipStatus(openID, who string) string {
+	m := getMembership(openID)
+	if !m.Active {
+		reply := "👤 " + who + "还不是会员。"
+		if !m.ExpiresAt.IsZero() {
+			reply = fmt.Sprintf("👤 %s的会员已于 %s 到期。", who, m.ExpiresAt.Format("2006-01-02"))
+		}
+		if price := viper.GetInt("membership.points_price"); price > 0 && viper.GetBool("points.enabled") {
+			reply += fmt.Sprintf("\n发送“兑换会员”使用 %d 积分兑换 %d 天会员。", price, viper.GetInt("membership.points_days"))
+		}
+		return reply
+	}
+
+	left := int(time.Until(m.ExpiresAt).Hours()/24) + 1
+	benefits := []string{fmt.Sprintf("每天 %d 次免费提问", viper.GetInt("membership.daily_free"))}
+	if t, ok := tierModel(openID); ok {
+		benefits = append(benefits, "使用 "+t.Model+" 模型")
+	}
+	if viper.GetBool("membership.skip_queue") {
+		benefits = append(benefits, "高峰期优先回答")
+	}
+	return fmt.Sprintf("👑 会员有效期至 %s（剩余 %d 天）\n权益：%s", m.ExpiresAt.Format("2006-01-02 15:04"), left, strings.Join(benefits, "、"))
+}
+
+// 处理会员指令：“会员状态”查看；“兑换会员”用积分兑换；管理员发送“开通会员 openid 天数”开通，“取消会员 openid”取消
+func handleMembershipCommand(openID, content string) (string, bool) {
+	if !viper.GetBool("membership.enabled") {
+		return "", false
+	}
+	if arg, ok := parseCommand(content, "会员状态"); ok {
+		if arg != "" && isAdmin(openID) {
+			return membershipStatus(arg, arg+" "), true
+		}
+		return membershipStatus(openID, "你"), true
+	}
+	if strings.TrimSpace(content) == "兑换会员" {
+		return redeemMembership(openID), true
+	}
+	if arg, ok := parseCommand(content, "开通会员"); ok && isAdmin(openID) {
+		fields := strings.Fields(arg)
+		if len(fields) < 2 {
+			return "⚠️ 用法：开通会员 openid 天数 [备注]", true
+		}
+		days, err := strconv.Atoi(fields[1])
+		if err != nil || days <= 0 {
+			return "⚠️ 天数应为正整数。", true
+		}
+		until, _, err := grantMembership(fields[0], days, "admin", "", strings.Join(fields[2:], " "))
+		if err != nil {
+			log.Printf("❌ 开通会员失败 [%s]: %v", fields[0], err)
+			return "❌ 开通失败，请稍后再试。", true
+		}
+		return fmt.Sprintf("✅ 已为 %s 开通 %d 天会员，有效期至 %s。", fields[0], days, until.Format("2006-01-02 15:04")), true
+	}
+	if arg, ok := parseCommand(content, "取消会员"); ok && isAdmin(openID) && arg != "" {
+		if err := revokeMembership(arg); err != nil {
+			log.Printf("❌ 取消会员失败 [%s]: %v", arg, err)
+			return "❌ 取消失败，请稍后再试。", true
+		}
+		return fmt.Sprintf("✅ 已取消 %s 的会员。", arg), true
+	}
+	return "", false
+}
+
+// 使用 membership.points_price 积分兑换 membership.points_days 天会员，开通失败时退回积分
+func redeemMembership(openID string) string {
+	price, days := viper.GetInt("membership.points_price"), viper.GetInt("membership.points_days")
+	if price <= 0 || !viper.GetBool("points.enabled") {
+		return "⚠️ 暂不支持积分兑换会员。"
+	}
+	ok, err := spendPoints(openID, price, "membership")
+	if err != nil {
+		log.Printf("❌ 扣除积分失败 [%s]: %v", openID, err)
+		return "❌ 兑换失败，请稍后再试。"
+	}
+	if !ok {
+		balance, _ := pointsBalance(openID)
+		return fmt.Sprintf("💰 积分不足，兑换 %d 天会员需要 %d 积分，当前积分 %d。", days, price, balance)
+	}
+	until, _, err := grantMembership(openID, days, "points", "", "")
+	if err != nil {
+		log.Printf("❌ 开通会员失败 [%s]: %v", openID, err)
+		if _, rerr := addPoints(openID, price, "refund", "", "兑换会员失败"); rerr != nil {
+			log.Printf("❌ 退回积分失败 [%s]: %v", openID, rerr)
+		}
+		return "❌ 兑换失败，积分已退回，请稍后再试。"
+	}
+	return fmt.Sprintf("✅ 已兑换 %d 天会员，有效期至 %s。", days, until.Format("2006-01-02 15:04"))
+}
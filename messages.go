@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 面向用户的提示按场景在 messages 中配置，支持提示词模板变量（{{.Nickname}} {{.Date}} 等），
+// 部分场景另有 {{.DailyFree}}、{{.Ahead}}、{{.QueueDepth}}、{{.Opens}}、{{.RetryAfter}}
+const (
+	MessageProcessing        = "processing"         // 回答未能在被动回复期限内生成
+	MessageAccepted          = "accepted"           // 问题已交给外部队列，回答生成后推送
+	MessageQueued            = "queued"             // 用户前面还有问题在排队
+	MessageTimeout           = "timeout"            // 模型请求超时
+	MessageProviderError     = "provider_error"     // 模型服务返回错误
+	MessageModerationBlocked = "moderation_blocked" // 问题或回答未通过模型服务的内容审核
+	MessageQuotaExceeded     = "quota_exceeded"     // 免费次数用完且积分不足
+	MessageQueueFull         = "queue_full"         // 排队的问题超过 queue.max_depth
+	MessageRetryQueued       = "retry_queued"       // 失败的问题已写入重试队列
+	MessageNewSession        = "new_session"        // 超过 history.idle_timeout 未对话，附加在新会话的第一条回答前
+	MessageBudgetExceeded    = "budget_exceeded"    // 模型费用超过 budget 上限，暂停回答
+	MessageOutOfOffice       = "out_of_office"      // 工作时间外且 office_hours.action 为 reply
+	MessageDeferred          = "deferred"           // 工作时间外的问题已暂存，office_hours.action 为 queue
+	MessageThrottled         = "throttled"          // 模型服务限流暂停中，throttle.action 为 reply，或调用因限流未发出
+	MessageThrottledQueued   = "throttled_queued"   // 模型服务限流暂停中，问题已排队，throttle.action 为 queue
+	MessageThrottledAccepted = "throttled_accepted" // 同上，开启 queue.push_answers 时回答生成后推送
+)
+
+// 场景提示可用的模板变量
+type messageVars struct {
+	promptVars
+	DailyFree  int
+	Ahead      int
+	QueueDepth int64
+	Opens      string // 下一个工作时段的开始时间，如“明天 09:00”
+	RetryAfter int    // 模型服务恢复前的秒数
+}
+
+// 渲染场景提示，vars 为空时只使用用户相关的变量
+func userMessage(ctx context.Context, scenario, user string, vars *messageVars) string {
+	if vars == nil {
+		vars = &messageVars{}
+	}
+	vars.promptVars = userPromptVars(user)
+	return executeTemplate(ctx, viper.GetString("messages."+scenario), vars)
+}
+
+// 模型返回 finish_reason 为 content_filter 时的错误
+var errContentFiltered = errors.New("answer blocked by content filter")
+
+// 问题或回答未通过模型服务的内容审核：DeepSeek 以 400 和 Content Exists Risk 拒绝请求，OpenAI 兼容服务以 content_filter 结束生成
+func isModerationBlocked(err error) bool {
+	if errors.Is(err, errContentFiltered) {
+		return true
+	}
+	var pe *ProviderError
+	if !errors.As(err, &pe) || pe.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	body := strings.ToLower(pe.Body)
+	return strings.Contains(body, "content exists risk") || strings.Contains(body, "content_filter")
+}
+
+// 模型调用失败时回复给用户的提示
+func failureScenario(err error) string {
+	switch {
+	case isModerationBlocked(err):
+		return MessageModerationBlocked
+	case errors.Is(err, errBudgetExceeded):
+		return MessageBudgetExceeded
+	case errors.As(err, new(*ThrottledError)):
+		return MessageThrottled
+	case isTimeout(err):
+		return MessageTimeout
+	default:
+		return MessageProviderError
+	}
+}
+
+// 失败提示的模板变量：限流时为恢复前的秒数
+func failureVars(err error) *messageVars {
+	var te *ThrottledError
+	if errors.As(err, &te) {
+		return &messageVars{RetryAfter: retryAfterSeconds(te.RetryAfter)}
+	}
+	return nil
+}
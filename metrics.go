@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_messages_received_total",
+		Help: "Messages received from WeChat by message type.",
+	}, []string{"type"})
+
+	providerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_provider_requests_total",
+		Help: "Requests to LLM providers by operation, model and result (ok, HTTP status code or network).",
+	}, []string{"provider", "model", "op", "result"})
+
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mpbot_provider_request_duration_seconds",
+		Help:    "Latency of LLM provider calls including retries.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, []string{"provider", "model", "op"})
+
+	providerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_provider_retries_total",
+		Help: "Retried requests to LLM providers.",
+	}, []string{"provider", "model", "op"})
+
+	providerTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_provider_timeouts_total",
+		Help: "Requests to LLM providers that timed out.",
+	}, []string{"provider", "model", "op"})
+
+	providerTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_provider_tokens_total",
+		Help: "Tokens reported by LLM providers by type (prompt or completion).",
+	}, []string{"provider", "model", "type"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mpbot_queue_depth",
+		Help: "Questions waiting in the worker queue.",
+	}, func() float64 { return float64(queueDepth(context.Background())) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mpbot_state_memory_keys",
+		Help: "Keys held by the in-memory state store.",
+	}, func() float64 {
+		if m, ok := state.(*memoryStateStore); ok {
+			n, _ := m.usage()
+			return float64(n)
+		}
+		return 0
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mpbot_state_memory_bytes",
+		Help: "Estimated bytes held by the in-memory state store.",
+	}, func() float64 {
+		if m, ok := state.(*memoryStateStore); ok {
+			_, n := m.usage()
+			return float64(n)
+		}
+		return 0
+	})
+
+	queueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mpbot_queue_rejected_total",
+		Help: "Questions rejected because the queue exceeded queue.max_depth.",
+	})
+)
+
+// 开启 Prometheus 指标：配置了 metrics.listen 时在独立端口提供，
+// 否则挂载到主端口的 /metrics 并使用管理令牌鉴权
+func registerMetrics(r *gin.Engine) {
+	if !viper.GetBool("metrics.enabled") {
+		return
+	}
+
+	if addr := viper.GetString("metrics.listen"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Printf("✅ metrics 已在 %s 启动", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Printf("❌ metrics 服务退出: %v", err)
+			}
+		}()
+		return
+	}
+
+	r.GET("/metrics", adminAuth(), gin.WrapH(promhttp.Handler()))
+	log.Println("✅ metrics 已挂载到 /metrics（需管理令牌）")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 消息处理链：与 gin 的中间件类似，每条消息依次经过各中间件，最后交给 answerMessage 调用模型。
+// 中间件可以在调用 next 前后处理、改写消息后传给 next，或不调用 next 直接回复。
+// 扩展时在 init 中调用 useMessageMiddleware / insertMessageMiddleware，内置中间件的名称见 defaultMessageMiddlewares
+
+// 处理一条消息并返回被动回复的内容，不需要回复时返回 false
+type MessageHandler func(ctx context.Context, msg WeChatMessage) (string, bool)
+
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+type namedMiddleware struct {
+	Name   string
+	Handle MessageMiddleware
+	before string
+}
+
+var (
+	messageMiddlewaresMu sync.RWMutex
+	extraMiddlewares     []namedMiddleware
+)
+
+// 内置中间件，按顺序执行
+func defaultMessageMiddlewares() []namedMiddleware {
+	return []namedMiddleware{
+		{Name: "stats", Handle: statsMiddleware},               // 统计与追踪
+		{Name: "access", Handle: accessMiddleware},             // 黑白名单
+		{Name: "maintenance", Handle: maintenanceMiddleware},   // 维护模式
+		{Name: "voice", Handle: voiceMiddleware},               // 语音消息转为文本消息
+		{Name: "abuse", Handle: abuseMiddleware},               // 频率限制
+		{Name: "hooks", Handle: hooksMiddleware},               // 脚本钩子 on_message
+		{Name: "plugins", Handle: pluginsMiddleware},           // 插件的 message、command 钩子
+		{Name: "events", Handle: eventsMiddleware},             // 事件
+		{Name: "intent", Handle: intentMiddleware},             // 意图识别，把说法不同的指令改写为标准指令
+		{Name: "rules", Handle: rulesMiddleware},               // 音乐、小程序卡片等关键词规则
+		{Name: "commands", Handle: commandsMiddleware},         // 积分、邀请、模型等文本指令和“继续”
+		{Name: "regenerate", Handle: regenerateMiddleware},     // “重新回答”改写为上一个问题
+		{Name: "translate", Handle: translateMiddleware},       // “翻译 文本”和翻译模式
+		{Name: "compare", Handle: compareMiddleware},           // 管理员的“对比 问题”
+		{Name: "article", Handle: articleMiddleware},           // 公众号文章的链接消息转为文本，由模型总结
+		{Name: "ocr", Handle: ocrMiddleware},                   // 图片之后的第一个问题附上图片中的文字
+		{Name: "budget", Handle: budgetMiddleware},             // 费用超过上限时暂停回答
+		{Name: "officehours", Handle: officeHoursMiddleware},   // 工作时间外回复提示或暂存问题
+		{Name: "backpressure", Handle: backpressureMiddleware}, // 队列过载时拒绝新问题
+		{Name: "throttle", Handle: throttleMiddleware},         // 模型服务限流暂停期间直接回复提示
+		{Name: "billing", Handle: billingMiddleware},           // 提问扣减积分
+	}
+}
+
+// 在名为 before 的中间件之前插入中间件，before 不存在时启动失败
+func insertMessageMiddleware(before, name string, mw MessageMiddleware) {
+	messageMiddlewaresMu.Lock()
+	defer messageMiddlewaresMu.Unlock()
+	if before != "" && middlewareIndex(messageMiddlewaresLocked(), before) < 0 {
+		log.Fatalf("❌ 注册消息中间件 %s 失败: 中间件 %s 不存在", name, before)
+	}
+	extraMiddlewares = append(extraMiddlewares, namedMiddleware{Name: name, Handle: mw, before: before})
+}
+
+// 在处理链末尾（提问扣费之后、调用模型之前）追加中间件
+func useMessageMiddleware(name string, mw MessageMiddleware) {
+	insertMessageMiddleware("", name, mw)
+}
+
+func messageMiddlewares() []namedMiddleware {
+	messageMiddlewaresMu.RLock()
+	defer messageMiddlewaresMu.RUnlock()
+	return messageMiddlewaresLocked()
+}
+
+func messageMiddlewaresLocked() []namedMiddleware {
+	list := defaultMessageMiddlewares()
+	for _, m := range extraMiddlewares {
+		i := len(list)
+		if m.before != "" {
+			i = middlewareIndex(list, m.before)
+		}
+		list = slices.Insert(list, i, m)
+	}
+	return list
+}
+
+func middlewareIndex(list []namedMiddleware, name string) int {
+	return slices.IndexFunc(list, func(m namedMiddleware) bool { return m.Name == name })
+}
+
+// 依次经过 outer（仅本次调用使用，如回调的去重和审计）和已登记的中间件处理消息
+func runMessageChain(ctx context.Context, msg WeChatMessage, outer ...MessageMiddleware) (string, bool) {
+	h := MessageHandler(answerMessage)
+	list := messageMiddlewares()
+	for i := len(list) - 1; i >= 0; i-- {
+		h = list[i].Handle(h)
+	}
+	for i := len(outer) - 1; i >= 0; i-- {
+		h = outer[i](h)
+	}
+	return h(ctx, msg)
+}
+
+func statsMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		recordMessage(msg.MsgType)
+		recordUserMessage(msg.FromUserName)
+		logf(ctx, "📩 收到消息 from=%s type=%s", msg.FromUserName, msg.MsgType)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("request.id", requestID(ctx)),
+			attrUser.String(pseudonym(msg.FromUserName)),
+			attribute.String("wechat.msg_type", msg.MsgType),
+		)
+		return next(ctx, msg)
+	}
+}
+
+// 把访问检查包装为中间件，只检查用户发送的消息，不检查事件
+func checkMiddleware(check func(msg WeChatMessage) (string, bool)) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+			if msg.MsgType != "event" {
+				if notice, ok := check(msg); !ok {
+					return notice, true
+				}
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+var (
+	accessMiddleware = checkMiddleware(func(msg WeChatMessage) (string, bool) {
+		return checkAccess(msg.FromUserName)
+	})
+	maintenanceMiddleware = checkMiddleware(func(msg WeChatMessage) (string, bool) {
+		return checkMaintenance(msg.FromUserName)
+	})
+	abuseMiddleware = checkMiddleware(func(msg WeChatMessage) (string, bool) {
+		return checkAbuse(msg.FromUserName, strings.TrimSpace(msg.Content))
+	})
+)
+
+func hooksMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if reply, ok := runMessageHooks(ctx, &msg); ok {
+			return reply, reply != ""
+		}
+		return next(ctx, msg)
+	}
+}
+
+func pluginsMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if reply, ok := runMessagePlugins(ctx, msg); ok {
+			return reply, reply != ""
+		}
+		if msg.MsgType == "text" {
+			if reply, ok := handlePluginCommand(ctx, msg); ok {
+				return reply, reply != ""
+			}
+		}
+		return next(ctx, msg)
+	}
+}
+
+// 事件按 events 配置处理，不再经过后续中间件
+func eventsMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "event" {
+			return next(ctx, msg)
+		}
+		switch msg.Event {
+		case "subscribe":
+			// 回复仅使用已缓存的用户信息，避免拉取接口拖慢被动回复
+			go getUserProfile(msg.FromUserName)
+			response, ok := onboardingEvent(ctx, msg)
+			if notice := handleInviteSubscribe(msg.FromUserName, msg.EventKey); notice != "" {
+				response, ok = strings.TrimSpace(response+"\n\n"+notice), true
+			}
+			return response, ok
+		case "SCAN":
+			return onboardingEvent(ctx, msg)
+		case "MASSSENDJOBFINISH":
+			// 群发结果通知，记录后无需回复用户
+			applyBroadcastStatus(msg.MsgID, msg.Status, &msg)
+			return "", false
+		case "TEMPLATESENDJOBFINISH":
+			if msg.Status != "success" {
+				logf(ctx, "⚠️ 模板消息 %d 发送给 %s 失败: %s", msg.MsgID, msg.FromUserName, msg.Status)
+			}
+		}
+		return handleEvent(ctx, msg)
+	}
+}
+
+// 扫码场景配置了引导流程时回复场景的欢迎语，否则按 events 配置处理
+func onboardingEvent(ctx context.Context, msg WeChatMessage) (string, bool) {
+	welcome, notice, ok := runOnboarding(ctx, msg)
+	if !ok {
+		return handleEvent(ctx, msg)
+	}
+	response := welcome
+	if response == "" {
+		response, _ = handleEvent(ctx, msg)
+	}
+	response = strings.TrimSpace(response + "\n\n" + notice)
+	return response, response != ""
+}
+
+func rulesMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" {
+			return next(ctx, msg)
+		}
+		if reply, ok := handleMusicRule(ctx, msg.Content); ok {
+			return reply, true
+		}
+		if reply, ok := handleMiniProgramRule(msg.FromUserName, msg.Content); ok {
+			return reply, reply != ""
+		}
+		return next(ctx, msg)
+	}
+}
+
+func commandsMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" {
+			return next(ctx, msg)
+		}
+		for _, command := range []func(openID, content string) (string, bool){
+			handleStatsCommand,
+			handleMaintenanceCommand,
+			handleProgressCommand,
+			handleCancelCommand,
+			handlePromptCommand,
+			handlePointsCommand,
+			handlePayCommand,
+			handleMembershipCommand,
+			handleInviteCommand,
+			handleSubscriptionCommand,
+			handleSubscribeMsgCommand,
+			handleModelCommand,
+			handleTierCommand,
+			handleGenerationCommand,
+			handleTranslateCommand,
+			handleSourcesCommand,
+		} {
+			if reply, ok := command(msg.FromUserName, msg.Content); ok {
+				return reply, true
+			}
+		}
+		if reply, ok := handleFeedbackCommand(msg.FromUserName, strings.TrimSpace(msg.Content)); ok {
+			return reply, true
+		}
+		if strings.TrimSpace(msg.Content) == "继续" {
+			// 用户查询 DeepSeek 结果
+			switch answer, remaining, status := takeAnswer(msg.FromUserName); status {
+			case answerReady:
+				if remaining > 0 {
+					answer += fmt.Sprintf("\n\n📚 还有 %d 条回答，输入“继续”查看下一条。", remaining)
+				}
+				return answer, true
+			case answerExpired:
+				return "⌛ 回答已过期，请重新提问。", true
+			default:
+				return "⌛ 目前没有待查看的回答，请先输入问题。", true
+			}
+		}
+		return next(ctx, msg)
+	}
+}
+
+func billingMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType == "text" {
+			if reply, ok := chargeQuestion(ctx, msg.FromUserName); !ok {
+				return reply, true
+			}
+		}
+		return next(ctx, msg)
+	}
+}
+
+// 处理链的终点：文本消息交给模型回答，视频转写后回答，图片识别文字等待提问，其他类型暂不支持
+func answerMessage(ctx context.Context, msg WeChatMessage) (string, bool) {
+	switch msg.MsgType {
+	case "text":
+		// 异步调用 DeepSeek
+		recordQuestion(msg.FromUserName)
+		// 队列空闲时短暂等待，快速生成的回答直接随被动回复返回
+		waiter := newAnswerWaiter()
+		if messageQueue != nil {
+			// 交给外部队列的 worker，不在回调中等待
+			return publishQuestion(detachContext(ctx), msg.FromUserName, msg.Content), true
+		}
+		markQueued(ctx, msg.FromUserName, msg.Content)
+		// 模型服务限流暂停中，问题照常排队，不在回调中等待
+		if d := throttledFor("deepseek"); d > 0 {
+			enqueueQuestion(detachContext(ctx), msg.FromUserName, msg.Content, nil)
+			throttledQuestions.WithLabelValues(ThrottleQueue).Inc()
+			return userMessage(ctx, throttledQueuedScenario(), msg.FromUserName, &messageVars{RetryAfter: retryAfterSeconds(d)}), true
+		}
+		if ahead := enqueueQuestion(detachContext(ctx), msg.FromUserName, msg.Content, waiter); ahead > 0 {
+			waiter.abandon()
+			return userMessage(ctx, MessageQueued, msg.FromUserName, &messageVars{Ahead: ahead}), true
+		}
+		if answer, ok := waiter.wait(viper.GetDuration("deepseek.reply_wait")); ok {
+			return answer, true
+		}
+		return userMessage(ctx, MessageProcessing, msg.FromUserName, nil), true
+	case "video", "shortvideo":
+		return handleVideoMessage(ctx, msg), true
+	case "image":
+		if viper.GetBool("ocr.enabled") {
+			return handleImageMessage(ctx, msg), true
+		}
+		return "📸 内容已收到，但当前不支持。", true
+	default:
+		return "📸 内容已收到，但当前不支持。", true
+	}
+}
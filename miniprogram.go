@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 小程序卡片。小程序需已关联本公众号，封面图需先上传为永久或临时素材
+type MiniProgramCard struct {
+	Title        string `mapstructure:"title" json:"title"`
+	AppID        string `mapstructure:"appid" json:"appid"`
+	PagePath     string `mapstructure:"pagepath" json:"pagepath"`
+	ThumbMediaID string `mapstructure:"thumb_media_id" json:"thumb_media_id"`
+}
+
+// 关键词规则：消息等于 keywords 之一或包含 contains 之一时命中
+type KeywordMatcher struct {
+	Keywords []string `mapstructure:"keywords"`
+	Contains []string `mapstructure:"contains"`
+}
+
+func (r KeywordMatcher) match(content string) bool {
+	for _, k := range r.Keywords {
+		if content == k {
+			return true
+		}
+	}
+	for _, k := range r.Contains {
+		if k != "" && strings.Contains(content, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r KeywordMatcher) empty() bool {
+	return len(r.Keywords) == 0 && len(r.Contains) == 0
+}
+
+// 小程序卡片回复规则：命中时通过客服消息发送卡片
+type MiniProgramRule struct {
+	KeywordMatcher  `mapstructure:",squash"`
+	Reply           string `mapstructure:"reply"` // 随被动回复返回的文字，留空则只发卡片
+	MiniProgramCard `mapstructure:",squash"`
+}
+
+func miniProgramRules() []MiniProgramRule {
+	var rules []MiniProgramRule
+	if err := viper.UnmarshalKey("miniprogram.rules", &rules); err != nil {
+		log.Printf("⚠️ 解析 miniprogram.rules 失败: %v", err)
+	}
+	return rules
+}
+
+// 命中规则时把小程序卡片写入发件箱。被动回复不支持小程序卡片，只能返回规则中的文字；
+// 返回的 bool 表示消息已被处理，此时 reply 为空表示无需被动回复
+func handleMiniProgramRule(openID, content string) (reply string, handled bool) {
+	if !viper.GetBool("miniprogram.enabled") {
+		return "", false
+	}
+	content = strings.TrimSpace(content)
+	for _, rule := range miniProgramRules() {
+		if !rule.match(content) {
+			continue
+		}
+		card := rule.MiniProgramCard
+		queueOutbox(openID, OutboxMessage{MiniProgram: &card})
+		log.Printf("📎 向用户 %s 发送小程序卡片 %s", openID, card.Title)
+		return rule.Reply, true
+	}
+	return "", false
+}
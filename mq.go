@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// 发布到消息队列的问题。回调请求结束后由任意实例的 worker 处理
+type queuedJob struct {
+	RequestID  string    `json:"request_id"`
+	User       string    `json:"user"`
+	Content    string    `json:"content"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	// 由“重新回答”发起时的参数
+	Regenerate *regeneration `json:"regenerate,omitempty"`
+	// 快捷翻译
+	Translate *translation `json:"translate,omitempty"`
+	// 管理员的“对比 问题”
+	Compare bool `json:"compare,omitempty"`
+}
+
+// 外部消息队列：回调只负责发布问题，worker 消费后调用 DeepSeek 并推送回答。
+// handler 返回后才确认消息，进程在生成途中退出时消息会被重新投递
+type MessageQueue interface {
+	Publish(ctx context.Context, job queuedJob) error
+	Consume(ctx context.Context, handler func(context.Context, queuedJob))
+	Depth(ctx context.Context) (int64, error) // 尚未处理完成的问题数
+}
+
+// 为空表示使用进程内的用户队列（queue.go）
+var messageQueue MessageQueue
+
+func initMessageQueue() error {
+	switch backend := viper.GetString("queue.backend"); backend {
+	case "", "local":
+		messageQueue = nil
+	case "redis":
+		rs, ok := state.(*redisStateStore)
+		if !ok {
+			return errors.New("queue.backend redis requires state.backend redis")
+		}
+		q, err := newRedisStreamQueue(rs)
+		if err != nil {
+			return err
+		}
+		messageQueue = q
+		log.Println("📮 问题队列: Redis Streams")
+	default:
+		return fmt.Errorf("unknown queue backend %q", backend)
+	}
+	return nil
+}
+
+// 把问题及其上下文中的标记（重新回答、翻译、对比）转为可序列化的任务
+func newQueuedJob(ctx context.Context, user, content string) queuedJob {
+	job := queuedJob{RequestID: requestID(ctx), User: user, Content: content, EnqueuedAt: time.Now()}
+	if r, ok := regenerationFrom(ctx); ok {
+		job.Regenerate = &r
+	}
+	if t, ok := translationFrom(ctx); ok {
+		job.Translate = &t
+	}
+	job.Compare = comparing(ctx)
+	return job
+}
+
+// 还原任务的上下文标记
+func (job queuedJob) context(ctx context.Context) context.Context {
+	if job.RequestID != "" {
+		ctx = withRequestID(ctx, job.RequestID)
+	}
+	if job.Regenerate != nil {
+		ctx = withRegeneration(ctx, *job.Regenerate)
+	}
+	if job.Translate != nil {
+		ctx = withTranslation(ctx, *job.Translate)
+	}
+	if job.Compare {
+		ctx = withComparison(ctx)
+	}
+	return ctx
+}
+
+// 发布问题，返回给用户的被动回复
+func publishQuestion(ctx context.Context, user, content string) string {
+	job := newQueuedJob(ctx, user, content)
+	// 先记录进度，避免 worker 在记录前就开始处理
+	markQueued(ctx, user, content)
+	if err := messageQueue.Publish(ctx, job); err != nil {
+		logf(ctx, "❌ 发布问题到队列失败: %v", err)
+		unmarkQueued(ctx, user)
+		return "❌ 系统繁忙，请稍后再试。"
+	}
+	if viper.GetBool("queue.push_answers") {
+		return userMessage(ctx, MessageAccepted, user, nil)
+	}
+	return userMessage(ctx, MessageProcessing, user, nil)
+}
+
+// 启动 queue.workers 个 worker，serve 时调用
+func startQueueWorkers() {
+	if messageQueue == nil {
+		return
+	}
+	n := viper.GetInt("queue.workers")
+	for i := 0; i < n; i++ {
+		safeGo("queueWorker", func() { messageQueue.Consume(context.Background(), handleQueuedJob) })
+	}
+	log.Printf("✅ 已启动 %d 个队列 worker", n)
+}
+
+func handleQueuedJob(ctx context.Context, job queuedJob) {
+	ctx = job.context(ctx)
+	defer func() {
+		// panic 的消息同样确认，避免反复投递
+		if r := recover(); r != nil {
+			reportPanic(fmt.Sprintf("queueWorker[%s]", job.RequestID), r, debug.Stack())
+		}
+	}()
+
+	// 同一用户的问题跨实例串行处理，保证对话历史的顺序
+	unlock, err := lockUser(ctx, job.User)
+	if err != nil {
+		logf(ctx, "⚠️ 等待用户 %s 的上一个问题超时，直接处理: %v", job.User, err)
+	} else {
+		defer unlock()
+	}
+
+	if canceledSince(ctx, job.User, job.EnqueuedAt) {
+		logf(ctx, "🛑 用户 %s 已取消该问题，跳过", job.User)
+		return
+	}
+	// 模型服务限流暂停期间等待恢复，不消耗重试次数；等待中被取消或超时则不再调用模型
+	if err := waitThrottle(ctx, job.User, job.EnqueuedAt); err != nil {
+		abandonQuestion(ctx, job.User, job.Content, nil, err)
+		return
+	}
+	release := acquireLLMSlot(job.User)
+	defer release()
+	logf(ctx, "📤 队列 worker 开始处理，排队 %s", time.Since(job.EnqueuedAt).Round(time.Millisecond))
+	fetchDeepSeekResponse(ctx, job.User, job.Content, nil)
+}
+
+// 等待并获取用户锁，锁的有效期覆盖一次带重试的 DeepSeek 调用
+func lockUser(ctx context.Context, user string) (func(), error) {
+	ttl := viper.GetDuration("deepseek.timeout")*time.Duration(viper.GetInt("deepseek.max_retries")+1) + time.Minute
+	deadline := time.Now().Add(ttl)
+	for time.Now().Before(deadline) {
+		if unlock, ok := tryLock(ctx, "user:"+user, ttl); ok {
+			return unlock, nil
+		}
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errors.New("timeout")
+}
+
+// Redis Streams 实现：所有实例加入同一个消费组，
+// 崩溃实例未确认的消息在 queue.claim_idle 后由其他 worker 接手
+type redisStreamQueue struct {
+	client   *redis.Client
+	stream   string
+	group    string
+	consumer string
+}
+
+func newRedisStreamQueue(rs *redisStateStore) (*redisStreamQueue, error) {
+	host, _ := os.Hostname()
+	q := &redisStreamQueue{
+		client:   rs.client,
+		stream:   rs.prefix + "questions",
+		group:    "workers",
+		consumer: fmt.Sprintf("%s-%d", host, os.Getpid()),
+	}
+	err := q.client.XGroupCreateMkStream(context.Background(), q.stream, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("create consumer group: %w", err)
+	}
+	return q, nil
+}
+
+func (q *redisStreamQueue) Publish(ctx context.Context, job queuedJob) error {
+	data, _ := json.Marshal(job)
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.stream,
+		MaxLen: viper.GetInt64("queue.max_length"),
+		Approx: true,
+		Values: map[string]interface{}{"job": data},
+	}).Err()
+}
+
+// 处理完成的消息会被删除，流的长度即为排队和处理中的问题数
+func (q *redisStreamQueue) Depth(ctx context.Context) (int64, error) {
+	return q.client.XLen(ctx, q.stream).Result()
+}
+
+func (q *redisStreamQueue) Consume(ctx context.Context, handler func(context.Context, queuedJob)) {
+	claimIdle := viper.GetDuration("queue.claim_idle")
+	for ctx.Err() == nil {
+		// 维护期间不读取消息，积压的问题留在流中（管理员的问题同样等待）
+		if waitMaintenance(ctx) != nil {
+			return
+		}
+		// 先接手其他消费者超时未确认的消息，再读取新消息
+		msgs, _, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream: q.stream, Group: q.group, Consumer: q.consumer,
+			MinIdle: claimIdle, Start: "0", Count: 1,
+		}).Result()
+		if err == nil && len(msgs) == 0 {
+			var streams []redis.XStream
+			streams, err = q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group: q.group, Consumer: q.consumer,
+				Streams: []string{q.stream, ">"}, Count: 1, Block: 5 * time.Second,
+			}).Result()
+			for _, s := range streams {
+				msgs = append(msgs, s.Messages...)
+			}
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			log.Printf("⚠️ 读取问题队列失败: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, m := range msgs {
+			var job queuedJob
+			if raw, ok := m.Values["job"].(string); ok && json.Unmarshal([]byte(raw), &job) == nil {
+				handler(ctx, job)
+			} else {
+				log.Printf("⚠️ 丢弃无法解析的队列消息 %s", m.ID)
+			}
+			if err := q.client.XAck(ctx, q.stream, q.group, m.ID).Err(); err != nil {
+				log.Printf("⚠️ 确认队列消息 %s 失败: %v", m.ID, err)
+			}
+			q.client.XDel(ctx, q.stream, m.ID)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// 消息加解密（WXBizMsgCrypt），企业微信回调与公众号安全模式使用同一算法：
+// AES-256-CBC，密钥为 EncodingAESKey Base64 解码后的 32 字节，IV 取密钥前 16 字节，PKCS#7 按 32 字节补位。
+// 明文为 16 字节随机串 + 4 字节网络字节序的消息长度 + 消息 + ReceiveID（企业微信为 CorpID，公众号为 AppID）
+type msgCrypter struct {
+	token     string
+	key       []byte
+	receiveID string
+}
+
+func newMsgCrypter(token, encodingAESKey, receiveID string) (*msgCrypter, error) {
+	if len(encodingAESKey) != 43 {
+		return nil, errors.New("EncodingAESKey must be 43 characters")
+	}
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, fmt.Errorf("invalid EncodingAESKey: %w", err)
+	}
+	return &msgCrypter{token: token, key: key, receiveID: receiveID}, nil
+}
+
+// msg_signature = sha1(sort(token, timestamp, nonce, Encrypt))
+func (m *msgCrypter) signature(timestamp, nonce, encrypted string) string {
+	return wechatSignature(m.token, timestamp, nonce, encrypted)
+}
+
+func (m *msgCrypter) decrypt(encrypted string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(m.key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, m.key[:aes.BlockSize]).CryptBlocks(plain, data)
+
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > 32 || pad > len(plain) {
+		return nil, errors.New("invalid padding")
+	}
+	plain = plain[:len(plain)-pad]
+	if len(plain) < 20 {
+		return nil, errors.New("plaintext too short")
+	}
+	size := int(binary.BigEndian.Uint32(plain[16:20]))
+	if size > len(plain)-20 {
+		return nil, errors.New("invalid message length")
+	}
+	msg, receiveID := plain[20:20+size], string(plain[20+size:])
+	if m.receiveID != "" && receiveID != m.receiveID {
+		return nil, fmt.Errorf("receive id mismatch: %s", receiveID)
+	}
+	return msg, nil
+}
+
+func (m *msgCrypter) encrypt(msg []byte) (string, error) {
+	var buf bytes.Buffer
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	buf.Write(random)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(msg)))
+	buf.Write(msg)
+	buf.WriteString(m.receiveID)
+
+	pad := 32 - buf.Len()%32
+	buf.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+
+	block, err := aes.NewCipher(m.key)
+	if err != nil {
+		return "", err
+	}
+	out := buf.Bytes()
+	cipher.NewCBCEncrypter(block, m.key[:aes.BlockSize]).CryptBlocks(out, out)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// 保存在 gin.Context 中的加密器，存在时被动回复需加密
+const replyCrypterKey = "reply_crypter"
+
+// 加密被动回复，生成带 MsgSignature 的回复包
+func (m *msgCrypter) encryptReply(reply []byte) ([]byte, error) {
+	encrypted, err := m.encrypt(reply)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newID()
+	return xml.Marshal(struct {
+		XMLName      xml.Name `xml:"xml"`
+		Encrypt      cdata    `xml:"Encrypt"`
+		MsgSignature cdata    `xml:"MsgSignature"`
+		TimeStamp    string   `xml:"TimeStamp"`
+		Nonce        cdata    `xml:"Nonce"`
+	}{Encrypt: cdata{encrypted}, MsgSignature: cdata{m.signature(timestamp, nonce, encrypted)}, TimeStamp: timestamp, Nonce: cdata{nonce}})
+}
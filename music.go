@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 音乐消息回复规则：命中时被动回复音乐卡片
+type MusicRule struct {
+	KeywordMatcher `mapstructure:",squash"`
+	MusicCard      `mapstructure:",squash"`
+}
+
+func musicRules() []MusicRule {
+	var rules []MusicRule
+	if err := viper.UnmarshalKey("music.rules", &rules); err != nil {
+		log.Printf("⚠️ 解析 music.rules 失败: %v", err)
+	}
+	return rules
+}
+
+// 命中规则时登记音乐消息作为被动回复，返回的文字在不支持音乐消息的场景（如调试聊天）中使用
+func handleMusicRule(ctx context.Context, content string) (string, bool) {
+	if !viper.GetBool("music.enabled") {
+		return "", false
+	}
+	content = strings.TrimSpace(content)
+	for _, rule := range musicRules() {
+		if !rule.match(content) {
+			continue
+		}
+		card := rule.MusicCard
+		setRichReply(ctx, func(msg WeChatMessage) replyMessage { return musicReply(msg, card) })
+		return "🎵 " + card.Title + "\n" + card.MusicURL, true
+	}
+	return "", false
+}
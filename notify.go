@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 通知类型：各类主动推送按类型映射到模板消息，模板 ID 与字段在 notifications.templates 中配置，
+// 也可通过管理接口覆盖，无需改代码即可更换模板
+const (
+	NotifyAnswerReady        = "answer_ready"        // 回答生成后推送，变量 Question、Answer
+	NotifyQuotaLow           = "quota_low"           // 积分低于 notifications.quota_low_threshold，变量 Balance、Threshold
+	NotifyMembershipExpiring = "membership_expiring" // 会员即将到期，变量 ExpiresAt、Days
+)
+
+var notificationTypes = []string{NotifyAnswerReady, NotifyQuotaLow, NotifyMembershipExpiring}
+
+// 通知使用的模板消息。fields 的键为模板中的字段名（如 {{first.DATA}} 的 first），值为模板，
+// 可使用提示词模板的变量以及各通知类型的变量
+type NotificationTemplate struct {
+	TemplateID string            `mapstructure:"template_id" json:"template_id"`
+	Fields     map[string]string `mapstructure:"fields" json:"fields"`
+	Link       string            `mapstructure:"link" json:"link,omitempty"` // 点击模板消息打开的链接模板
+	Text       string            `mapstructure:"text" json:"text,omitempty"` // 客服消息的文本模板，为空时使用默认文案
+}
+
+// 生效的通知模板及其来源
+type NotificationEntry struct {
+	Type      string               `json:"type"`
+	Template  NotificationTemplate `json:"template"`
+	Source    string               `json:"source"` // config 或 admin
+	UpdatedAt *time.Time           `json:"updated_at,omitempty"`
+}
+
+// 管理接口设置的模板，优先于配置。缓存在状态存储中，缓存 null 表示没有设置
+func notificationCacheKey(typ string) string { return "notify:" + typ }
+
+func notificationOverride(typ string) *NotificationEntry {
+	ctx := context.Background()
+	var e *NotificationEntry
+	if getCached(ctx, notificationCacheKey(typ), &e) {
+		return e
+	}
+	var data string
+	var updated int64
+	err := db.QueryRow(`SELECT data, updated_at FROM notification_templates WHERE type = ?`, typ).Scan(&data, &updated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("⚠️ 读取通知模板 %s 失败: %v", typ, err)
+		return nil
+	}
+	if err == nil {
+		var t NotificationTemplate
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			log.Printf("⚠️ 解析通知模板 %s 失败: %v", typ, err)
+		} else {
+			at := time.Unix(updated, 0)
+			e = &NotificationEntry{Type: typ, Template: t, Source: "admin", UpdatedAt: &at}
+		}
+	}
+	fillCache(ctx, notificationCacheKey(typ), e)
+	return e
+}
+
+func configNotificationTemplate(typ string) (NotificationTemplate, bool) {
+	var t NotificationTemplate
+	key := "notifications.templates." + typ
+	if !viper.IsSet(key) {
+		return t, false
+	}
+	if err := viper.UnmarshalKey(key, &t); err != nil {
+		log.Printf("⚠️ 解析 %s 失败: %v", key, err)
+		return t, false
+	}
+	return t, t.TemplateID != ""
+}
+
+// 通知类型当前使用的模板，未配置时返回 false
+func notificationTemplate(typ string) (NotificationEntry, bool) {
+	if e := notificationOverride(typ); e != nil {
+		return *e, true
+	}
+	if t, ok := configNotificationTemplate(typ); ok {
+		return NotificationEntry{Type: typ, Template: t, Source: "config"}, true
+	}
+	return NotificationEntry{}, false
+}
+
+func listNotificationTemplates() []NotificationEntry {
+	entries := []NotificationEntry{}
+	for _, typ := range notificationTypes {
+		if e, ok := notificationTemplate(typ); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func validateNotificationTemplate(typ string, t NotificationTemplate) error {
+	if !slices.Contains(notificationTypes, typ) {
+		return fmt.Errorf("unknown notification type %q", typ)
+	}
+	if t.TemplateID == "" {
+		return fmt.Errorf("template_id is required")
+	}
+	if len(t.Fields) == 0 {
+		return fmt.Errorf("fields is required")
+	}
+	return nil
+}
+
+func setNotificationTemplate(typ string, t NotificationTemplate) (NotificationEntry, error) {
+	if err := validateNotificationTemplate(typ, t); err != nil {
+		return NotificationEntry{}, err
+	}
+	data, _ := json.Marshal(t)
+	now := time.Now()
+	if _, err := db.Exec(`INSERT INTO notification_templates (type, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(type) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		typ, string(data), now.Unix()); err != nil {
+		return NotificationEntry{}, err
+	}
+	e := NotificationEntry{Type: typ, Template: t, Source: "admin", UpdatedAt: &now}
+	storeCache(context.Background(), notificationCacheKey(typ), &e)
+	return e, nil
+}
+
+// 删除管理接口设置的模板，恢复使用配置
+func resetNotificationTemplate(typ string) error {
+	if _, err := db.Exec(`DELETE FROM notification_templates WHERE type = ?`, typ); err != nil {
+		return err
+	}
+	storeCache(context.Background(), notificationCacheKey(typ), (*NotificationEntry)(nil))
+	return nil
+}
+
+// 通知模板的变量：提示词模板的变量加上通知类型的变量
+func notificationVars(user string, vars map[string]string) map[string]string {
+	p := userPromptVars(user)
+	data := map[string]string{
+		"Nickname": p.Nickname, "OpenID": p.OpenID, "Language": p.Language, "Date": p.Date,
+		"Time": p.Time, "Weekday": p.Weekday, "AccountName": p.AccountName,
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+	return data
+}
+
+// 按通知类型的模板填充消息的模板字段（以及配置的文本），类型未配置模板时不修改
+func applyNotificationTemplate(ctx context.Context, m *OutboxMessage, typ, user string, vars map[string]string) bool {
+	e, ok := notificationTemplate(typ)
+	if !ok {
+		return false
+	}
+	data := notificationVars(user, vars)
+	m.TemplateID = e.Template.TemplateID
+	m.Data = make(map[string]string, len(e.Template.Fields))
+	for field, tmpl := range e.Template.Fields {
+		m.Data[field] = truncateRunes(executeTemplate(ctx, tmpl, data), 200)
+	}
+	if e.Template.Link != "" {
+		m.Link = executeTemplate(ctx, e.Template.Link, data)
+	}
+	if e.Template.Text != "" {
+		m.Text = executeTemplate(ctx, e.Template.Text, data)
+	}
+	return true
+}
+
+// 推送通知，text 为默认的客服消息文本。类型未配置模板时不推送
+func sendNotification(ctx context.Context, user, typ, text string, vars map[string]string) {
+	m := OutboxMessage{Text: text}
+	if !applyNotificationTemplate(ctx, &m, typ, user, vars) {
+		return
+	}
+	queueOutbox(user, m)
+}
+
+// 扣除积分后余额低于 notifications.quota_low_threshold 时提醒，每天最多一次
+func notifyQuotaLow(ctx context.Context, user string) {
+	threshold := viper.GetInt("notifications.quota_low_threshold")
+	if _, ok := notificationTemplate(NotifyQuotaLow); !ok || threshold <= 0 {
+		return
+	}
+	balance, err := pointsBalance(user)
+	if err != nil || balance >= threshold {
+		return
+	}
+	if ok, err := state.SetNX(ctx, "notify:quota_low:"+user, []byte(strconv.Itoa(balance)), 24*time.Hour); err != nil || !ok {
+		return
+	}
+	sendNotification(ctx, user, NotifyQuotaLow,
+		fmt.Sprintf("💰 你的积分只剩 %d 了，发送“签到”领取积分或“充值”购买。", balance),
+		map[string]string{"Balance": strconv.Itoa(balance), "Threshold": strconv.Itoa(threshold)})
+}
+
+// 提醒 notifications.membership_expiring_before 内到期的会员，每次到期只提醒一次。由定时任务 membership_reminder 调用
+func notifyExpiringMemberships() error {
+	if _, ok := notificationTemplate(NotifyMembershipExpiring); !ok {
+		return fmt.Errorf("notification %s is not configured", NotifyMembershipExpiring)
+	}
+	before := viper.GetDuration("notifications.membership_expiring_before")
+	now := time.Now()
+	rows, err := db.Query(`SELECT openid, expires_at FROM memberships WHERE expires_at > ? AND expires_at <= ?`,
+		now.Unix(), now.Add(before).Unix())
+	if err != nil {
+		return err
+	}
+	type expiring struct {
+		openID  string
+		expires int64
+	}
+	var members []expiring
+	for rows.Next() {
+		var e expiring
+		if err := rows.Scan(&e.openID, &e.expires); err != nil {
+			rows.Close()
+			return err
+		}
+		members = append(members, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].expires < members[j].expires })
+
+	ctx := context.Background()
+	sent := 0
+	for _, m := range members {
+		key := fmt.Sprintf("notify:membership_expiring:%s:%d", m.openID, m.expires)
+		if ok, err := state.SetNX(ctx, key, []byte("1"), before+24*time.Hour); err != nil || !ok {
+			continue
+		}
+		expiresAt := time.Unix(m.expires, 0)
+		days := int(time.Until(expiresAt).Hours()/24) + 1
+		sendNotification(ctx, m.openID, NotifyMembershipExpiring,
+			fmt.Sprintf("👑 你的会员将于 %s 到期，发送“兑换会员”用积分续期。", expiresAt.Format("2006-01-02 15:04")),
+			map[string]string{"ExpiresAt": expiresAt.Format("2006-01-02 15:04"), "Days": strconv.Itoa(days)})
+		sent++
+	}
+	if sent > 0 {
+		log.Printf("👑 已提醒 %d 位即将到期的会员", sent)
+	}
+	return nil
+}
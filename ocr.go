@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 图片文字识别：收到图片后识别其中的文字，暂存 ocr.ttl，用户接着发送的问题（如“帮我看看这张截图说了什么”）附上图片文字后交给模型。
+// ocr.provider 为 tesseract 时调用本地的 tesseract，为 api 时把图片以 multipart 的 file 字段 POST 到 ocr.api_url，接口返回 {"text": "..."}
+var ocrClient = &http.Client{Timeout: 30 * time.Second}
+
+func imageTextKey(user string) string { return "ocr:" + user }
+
+// 识别图片中的文字
+func recognizeText(ctx context.Context, img mediaFile) (string, error) {
+	var text string
+	var err error
+	switch viper.GetString("ocr.provider") {
+	case "tesseract":
+		text, err = tesseractOCR(ctx, img.Data)
+	case "api":
+		text, err = apiOCR(ctx, img)
+	default:
+		return "", fmt.Errorf("unknown ocr provider %q", viper.GetString("ocr.provider"))
+	}
+	if err != nil {
+		return "", err
+	}
+	return truncateRunes(strings.TrimSpace(text), viper.GetInt("ocr.max_chars")), nil
+}
+
+func tesseractOCR(ctx context.Context, data []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "mpbot-ocr-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "image")
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, viper.GetString("ocr.tesseract"), in, "stdout", "-l", viper.GetString("ocr.languages"))
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tesseract: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// 中文按字识别，字与字之间会多出空格
+	return strings.Join(strings.Fields(strings.ReplaceAll(stdout.String(), "\n", " \n ")), " "), nil
+}
+
+func apiOCR(ctx context.Context, img mediaFile) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", "image")
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(img.Data); err != nil {
+		return "", err
+	}
+	if lang := viper.GetString("ocr.languages"); lang != "" {
+		_ = w.WriteField("language", lang)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, viper.GetString("ocr.api_url"), &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if key := viper.GetString("ocr.api_key"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := ocrClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("ocr returned %d: %s", resp.StatusCode, msg)
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Text, nil
+}
+
+// 图片消息：下载并识别文字，识别较快时在被动回复中提示识别结果
+func handleImageMessage(ctx context.Context, msg WeChatMessage) string {
+	done := make(chan struct{})
+	var text string
+	var err error
+	detached := detachContext(ctx)
+	safeGo("handleImage", func() {
+		defer close(done)
+		var img mediaFile
+		if img, err = downloadMedia(detached, msg.MediaID); err != nil {
+			logf(detached, "❌ 下载图片 %s 失败: %v", msg.MediaID, err)
+			return
+		}
+		if text, err = recognizeText(detached, img); err != nil {
+			logf(detached, "❌ 识别图片 %s 的文字失败: %v", msg.MediaID, err)
+			return
+		}
+		if text == "" {
+			logf(detached, "🖼️ 图片 %s 中没有识别到文字", msg.MediaID)
+			return
+		}
+		logf(detached, "🖼️ 已识别图片 %s 中的文字（%d 字）", msg.MediaID, len([]rune(text)))
+		if err = state.Set(detached, imageTextKey(msg.FromUserName), []byte(text), viper.GetDuration("ocr.ttl")); err != nil {
+			logf(detached, "❌ 暂存图片文字失败: %v", err)
+		}
+	})
+
+	select {
+	case <-done:
+		switch {
+		case err != nil:
+			return "❌ 图片识别失败，请稍后重试或用文字描述你的问题。"
+		case text == "":
+			return "🖼️ 图片中没有识别到文字，请用文字描述你的问题。"
+		}
+		return fmt.Sprintf("🖼️ 已识别图片中的 %d 个字，请发送你的问题，例如“帮我看看这张截图说了什么”。", len([]rune(text)))
+	case <-time.After(viper.GetDuration("media.reply_wait")):
+		return "🖼️ 正在识别图片中的文字，请稍后发送你的问题，例如“帮我看看这张截图说了什么”。"
+	}
+}
+
+// 取出暂存的图片文字，每张图片只用于其后的第一个问题
+func takeImageText(ctx context.Context, user string) (string, bool) {
+	data, err := state.Get(ctx, imageTextKey(user))
+	if err != nil {
+		if !errors.Is(err, errStateNotFound) {
+			logf(ctx, "⚠️ 读取图片文字失败: %v", err)
+		}
+		return "", false
+	}
+	if err := state.Delete(ctx, imageTextKey(user)); err != nil {
+		logf(ctx, "⚠️ 清除图片文字失败: %v", err)
+	}
+	return string(data), true
+}
+
+// 用户发送图片后的第一个问题附上图片中的文字
+func ocrMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" || !viper.GetBool("ocr.enabled") {
+			return next(ctx, msg)
+		}
+		// 重新回答的问题已带有图片文字
+		if _, ok := regenerationFrom(ctx); ok {
+			return next(ctx, msg)
+		}
+		if text, ok := takeImageText(ctx, msg.FromUserName); ok {
+			msg.Content = fmt.Sprintf("%s\n\n图片中的文字：\n%s", msg.Content, text)
+		}
+		return next(ctx, msg)
+	}
+}
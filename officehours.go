@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 工作时间：office_hours.schedule 按星期配置可回答的时段，时段外按 office_hours.action 处理：
+//   - answer：照常回答
+//   - reply：回复 messages.out_of_office，不调用模型
+//   - queue：提问照常扣费后暂存，下一个时段开始时由后台协程依次提问并推送回答
+const (
+	OfficeHoursAnswer = "answer"
+	OfficeHoursReply  = "reply"
+	OfficeHoursQueue  = "queue"
+)
+
+var weekdayKeys = [...]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// 一天中的时段，单位为从 0 点起的分钟数，end 可以为 24:00
+type officeWindow struct {
+	start, end int
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// 解析“09:00-18:00”形式的时段
+func parseOfficeWindow(s string) (officeWindow, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return officeWindow{}, fmt.Errorf("invalid window %q (want HH:MM-HH:MM)", s)
+	}
+	start, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return officeWindow{}, err
+	}
+	end, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return officeWindow{}, err
+	}
+	if end <= start {
+		return officeWindow{}, fmt.Errorf("window %q ends before it starts", s)
+	}
+	return officeWindow{start, end}, nil
+}
+
+// 某个星期几的时段，未配置的日子全天不在工作时间
+func officeWindows(day time.Weekday) []officeWindow {
+	var windows []officeWindow
+	for _, s := range viper.GetStringSlice("office_hours.schedule." + weekdayKeys[day]) {
+		if w, err := parseOfficeWindow(s); err == nil {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+func officeLocation() *time.Location {
+	if loc, err := time.LoadLocation(viper.GetString("office_hours.timezone")); err == nil {
+		return loc
+	}
+	return time.Local
+}
+
+// t 是否在工作时间内，未开启 office_hours 时始终为 true
+func inOfficeHours(t time.Time) bool {
+	if !viper.GetBool("office_hours.enabled") {
+		return true
+	}
+	t = t.In(officeLocation())
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range officeWindows(t.Weekday()) {
+		if minute >= w.start && minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// t 之后下一个时段的开始时间，一周内没有时段时返回 false
+func nextOfficeOpening(t time.Time) (time.Time, bool) {
+	t = t.In(officeLocation())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for d := 0; d <= 7; d++ {
+		day := midnight.AddDate(0, 0, d)
+		for _, w := range officeWindows(day.Weekday()) {
+			if start := day.Add(time.Duration(w.start) * time.Minute); start.After(t) {
+				return start, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// 下一个时段开始时间的文字描述，用于提示模板的 {{.Opens}}
+func officeOpensText(t time.Time) string {
+	opens, ok := nextOfficeOpening(t)
+	if !ok {
+		return "另行通知"
+	}
+	now := t.In(opens.Location())
+	switch opens.Format("2006-01-02") {
+	case now.Format("2006-01-02"):
+		return "今天 " + opens.Format("15:04")
+	case now.AddDate(0, 0, 1).Format("2006-01-02"):
+		return "明天 " + opens.Format("15:04")
+	}
+	return weekdays[opens.Weekday()] + " " + opens.Format("15:04")
+}
+
+// 工作时间外的问题按 office_hours.action 处理，管理员不受限制
+func officeHoursMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" || isAdmin(msg.FromUserName) || inOfficeHours(time.Now()) {
+			return next(ctx, msg)
+		}
+		vars := &messageVars{Opens: officeOpensText(time.Now())}
+		switch viper.GetString("office_hours.action") {
+		case OfficeHoursReply:
+			return userMessage(ctx, MessageOutOfOffice, msg.FromUserName, vars), true
+		case OfficeHoursQueue:
+			if reply, ok := chargeQuestion(ctx, msg.FromUserName); !ok {
+				return reply, true
+			}
+			if err := deferQuestion(msg.FromUserName, msg.Content); err != nil {
+				logf(ctx, "❌ 暂存工作时间外的问题失败: %v", err)
+				return next(ctx, msg)
+			}
+			logf(ctx, "🌙 工作时间外的问题已暂存，%s 开始处理", vars.Opens)
+			return userMessage(ctx, MessageDeferred, msg.FromUserName, vars), true
+		}
+		return next(ctx, msg)
+	}
+}
+
+// 暂存工作时间外的问题
+func deferQuestion(openID, query string) error {
+	_, err := db.Exec(`INSERT INTO deferred_questions (id, openid, query, created_at) VALUES (?, ?, ?, ?)`,
+		newID(), openID, query, time.Now().Unix())
+	return err
+}
+
+// 后台协程：工作时间内每分钟检查并提交暂存的问题
+func startDeferredQuestions() {
+	if !viper.GetBool("office_hours.enabled") || viper.GetString("office_hours.action") != OfficeHoursQueue {
+		return
+	}
+	safeGo("deferredQuestions", func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			if inOfficeHours(time.Now()) && !maintenanceEnabled() && throttledFor("deepseek") == 0 {
+				releaseDeferredQuestions()
+			}
+		}
+	})
+}
+
+// 按提问顺序提交暂存的问题，回答按 queue.push_answers 推送或缓存
+func releaseDeferredQuestions() {
+	rows, err := db.Query(`SELECT id, openid, query FROM deferred_questions ORDER BY created_at LIMIT 100`)
+	if err != nil {
+		log.Printf("❌ 读取暂存的问题失败: %v", err)
+		return
+	}
+	type deferred struct{ id, openID, query string }
+	var items []deferred
+	for rows.Next() {
+		var d deferred
+		if err := rows.Scan(&d.id, &d.openID, &d.query); err != nil {
+			log.Printf("❌ 读取暂存的问题失败: %v", err)
+			break
+		}
+		items = append(items, d)
+	}
+	rows.Close()
+
+	for _, d := range items {
+		// 多实例共享数据库时，删除成功的实例负责提问
+		res, err := db.Exec(`DELETE FROM deferred_questions WHERE id = ?`, d.id)
+		if err != nil {
+			log.Printf("❌ 领取暂存的问题 %s 失败: %v", d.id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		ctx := withRequestID(context.Background(), "deferred-"+d.id)
+		logf(ctx, "🌅 工作时间开始，提交用户 %s 暂存的问题", d.openID)
+		recordQuestion(d.openID)
+		askInBackground(ctx, d.openID, d.query)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 场景引导：扫描带参数二维码关注（EventKey 为 qrscene_ + 场景值）或已关注用户扫码（SCAN，EventKey 为场景值）时，
+// 按 onboarding.flows.<场景值> 发送专属欢迎语、为用户启用 personas 中的人设并赠送积分，用于推广活动的落地体验
+type OnboardingFlow struct {
+	Welcome string `mapstructure:"welcome"` // 欢迎语模板，变量与 events 的 reply 相同，为空时使用 events 中的配置
+	Persona string `mapstructure:"persona"` // 为用户启用的人设，对应 personas 中的名称
+	Points  int    `mapstructure:"points"`  // 赠送的积分，每个用户在同一场景只领取一次
+}
+
+// 按场景值查找引导流程，场景值不区分大小写
+func onboardingFlowFor(scene string) (OnboardingFlow, bool) {
+	var flows map[string]OnboardingFlow
+	if err := viper.UnmarshalKey("onboarding.flows", &flows); err != nil {
+		logf(context.Background(), "⚠️ 解析 onboarding.flows 失败: %v", err)
+		return OnboardingFlow{}, false
+	}
+	for name, f := range flows {
+		if strings.EqualFold(name, scene) {
+			return f, true
+		}
+	}
+	return OnboardingFlow{}, false
+}
+
+// 扫码事件的场景值
+func eventScene(msg WeChatMessage) (string, bool) {
+	switch msg.Event {
+	case "subscribe":
+		return strings.CutPrefix(msg.EventKey, "qrscene_")
+	case "SCAN":
+		return msg.EventKey, msg.EventKey != ""
+	}
+	return "", false
+}
+
+// 执行扫码场景的引导流程，返回欢迎语（为空时按 events 配置回复）和附加的提示；场景未配置流程时返回 false
+func runOnboarding(ctx context.Context, msg WeChatMessage) (welcome, notice string, ok bool) {
+	if !viper.GetBool("onboarding.enabled") {
+		return "", "", false
+	}
+	scene, ok := eventScene(msg)
+	if !ok {
+		return "", "", false
+	}
+	flow, ok := onboardingFlowFor(scene)
+	if !ok {
+		return "", "", false
+	}
+	user := msg.FromUserName
+	logf(ctx, "🚩 用户 %s 通过场景 %s 进入", user, scene)
+
+	var notices []string
+	if flow.Persona != "" {
+		if _, exists := personaPrompt(flow.Persona); !exists {
+			logf(ctx, "⚠️ 场景 %s 的人设 %s 不存在", scene, flow.Persona)
+		} else {
+			s := getUserSettings(user)
+			s.Persona = flow.Persona
+			if err := saveUserSettings(user, s); err != nil {
+				logf(ctx, "❌ 为用户 %s 启用人设失败: %v", user, err)
+			}
+		}
+	}
+	if flow.Points > 0 && viper.GetBool("points.enabled") {
+		granted, err := addPoints(user, flow.Points, "onboarding", strings.ToLower(scene), "")
+		if err != nil {
+			logf(ctx, "❌ 场景 %s 赠送积分失败 [%s]: %v", scene, user, err)
+		} else if granted {
+			notices = append(notices, fmt.Sprintf("🎁 已获得 %d 积分。", flow.Points))
+		}
+	}
+
+	if flow.Welcome != "" {
+		welcome = executeTemplate(ctx, flow.Welcome, eventVars{
+			promptVars: userPromptVars(user),
+			Event:      msg.Event,
+			EventKey:   msg.EventKey,
+			Ticket:     msg.Ticket,
+		})
+	}
+	return welcome, strings.Join(notices, "\n"), true
+}
+
+// 人设的系统提示词模板
+func personaPrompt(name string) (string, bool) {
+	for key, prompt := range viper.GetStringMapString("personas") {
+		if strings.EqualFold(key, name) && prompt != "" {
+			return prompt, true
+		}
+	}
+	return "", false
+}
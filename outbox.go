@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 待发送的主动消息，按 outbox.strategy 依次尝试客服消息（Text、MiniProgram 或 News）、模板消息和回答缓存
+type OutboxMessage struct {
+	Text        string            `json:"text,omitempty"`
+	MiniProgram *MiniProgramCard  `json:"miniprogram,omitempty"`
+	News        *NewsArticle      `json:"news,omitempty"` // 客服图文消息，点击跳转 URL
+	TemplateID  string            `json:"template_id,omitempty"`
+	Link        string            `json:"link,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`
+	// 其他方式都失败时可写入回答缓存，用户仍可输入“继续”查看
+	CacheOnFailure bool `json:"cache_on_failure,omitempty"`
+	// 当前使用的投递方式，由发送协程维护
+	Channel string `json:"channel,omitempty"`
+}
+
+func (m OutboxMessage) kind() string {
+	if m.Text != "" {
+		return "kefu"
+	}
+	if m.MiniProgram != nil {
+		return "miniprogram"
+	}
+	if m.News != nil {
+		return "news"
+	}
+	return "template"
+}
+
+// 发件箱中的一条记录
+type OutboxItem struct {
+	ID            string        `json:"id"`
+	OpenID        string        `json:"openid"`
+	Kind          string        `json:"kind"`
+	Message       OutboxMessage `json:"message"`
+	Status        string        `json:"status"`
+	Attempts      int           `json:"attempts"`
+	NextAttemptAt time.Time     `json:"next_attempt_at"`
+	LastError     string        `json:"last_error,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxCached  = "cached" // 未能推送，已写入回答缓存
+	OutboxFailed  = "failed"
+)
+
+// 有新消息时唤醒发送协程
+var outboxWake = make(chan struct{}, 1)
+
+// 把主动消息写入发件箱，由后台协程发送并在失败时按退避重试
+func enqueueOutbox(openID string, m OutboxMessage) (string, error) {
+	data, _ := json.Marshal(m)
+	id := newID()
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO outbox (id, openid, kind, message, status, attempts, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)`, id, openID, m.kind(), string(data), OutboxPending, now, now, now)
+	if err != nil {
+		return "", err
+	}
+	wakeOutbox()
+	return id, nil
+}
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// 把客服文本消息写入发件箱
+func queueKefuText(openID, text string) {
+	queueOutbox(openID, OutboxMessage{Text: text})
+}
+
+// 写入发件箱失败时直接发送一次，尽量不丢消息
+func queueOutbox(openID string, m OutboxMessage) {
+	if _, err := enqueueOutbox(openID, m); err != nil {
+		log.Printf("❌ 写入发件箱失败 [%s]，直接发送: %v", openID, err)
+		if err := sendOutboxMessage(openID, m); err != nil {
+			log.Printf("❌ 发送消息失败 [%s]: %v", openID, err)
+		}
+	}
+}
+
+// 后台发送协程：有新消息或每隔 outbox.poll_interval 发送到期的消息
+func startOutboxSender() {
+	safeGo("outboxSender", func() {
+		ticker := time.NewTicker(viper.GetDuration("outbox.poll_interval"))
+		defer ticker.Stop()
+		for {
+			sendDueOutbox()
+			select {
+			case <-outboxWake:
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+func sendDueOutbox() {
+	items, err := dueOutboxItems(50)
+	if err != nil {
+		log.Printf("❌ 读取发件箱失败: %v", err)
+		return
+	}
+	for _, item := range items {
+		if claimOutboxItem(item) {
+			deliverOutboxItem(item)
+		}
+	}
+}
+
+func dueOutboxItems(limit int) ([]OutboxItem, error) {
+	rows, err := db.Query(`SELECT id, openid, kind, message, status, attempts, next_attempt_at, last_error, created_at, updated_at
+		FROM outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?`,
+		OutboxPending, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOutboxItems(rows)
+}
+
+// 领取消息：把下次发送时间推后一个租期，多实例共享数据库时避免重复发送
+func claimOutboxItem(item OutboxItem) bool {
+	lease := time.Now().Add(time.Minute).Unix()
+	res, err := db.Exec(`UPDATE outbox SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?`,
+		lease, item.ID, OutboxPending, item.NextAttemptAt.Unix())
+	if err != nil {
+		log.Printf("❌ 领取发件箱消息 %s 失败: %v", item.ID, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func deliverOutboxItem(item OutboxItem) {
+	m := item.Message
+	channel, ok := nextChannel(outboxChannels(item.OpenID, m), m.Channel, false)
+	if !ok {
+		log.Printf("❌ 发件箱消息 %s 没有可用的投递方式 [%s]", item.ID, item.OpenID)
+		updateOutboxItem(item.ID, m, OutboxFailed, item.Attempts, time.Now(), "no delivery channel available")
+		return
+	}
+	m.Channel = channel
+
+	err := sendViaChannel(item.OpenID, channel, m)
+	now := time.Now()
+	if err == nil {
+		status := OutboxSent
+		if channel == ChannelCache {
+			status = OutboxCached
+			log.Printf("💾 消息 %s 未能推送，已缓存，用户 %s 可输入“继续”查看", item.ID, item.OpenID)
+		}
+		updateOutboxItem(item.ID, m, status, item.Attempts+1, now, "")
+		return
+	}
+
+	attempts := item.Attempts + 1
+	action := classifyDeliveryError(err)
+	if action == deliveryRetry && attempts < viper.GetInt("outbox.max_attempts") {
+		// 30s、1m、2m…，最长 1 小时
+		backoff := 30 * time.Second << uint(attempts-1)
+		if backoff > time.Hour || backoff <= 0 {
+			backoff = time.Hour
+		}
+		log.Printf("⚠️ 发件箱消息 %s 通过 %s 发送失败（第 %d 次），%s 后重试: %v", item.ID, channel, attempts, backoff, err)
+		updateOutboxItem(item.ID, m, OutboxPending, attempts, now.Add(backoff), err.Error())
+		return
+	}
+	if action == deliveryDisable {
+		disableChannel(channel, err)
+	}
+
+	// 换用下一种投递方式，重新计算尝试次数
+	if action != deliveryDrop {
+		if next, ok := nextChannel(outboxChannels(item.OpenID, m), channel, true); ok {
+			log.Printf("↪️ 发件箱消息 %s 通过 %s 发送失败，改用 %s: %v", item.ID, channel, next, err)
+			m.Channel = next
+			updateOutboxItem(item.ID, m, OutboxPending, 0, now, err.Error())
+			wakeOutbox()
+			return
+		}
+	}
+
+	log.Printf("❌ 发件箱消息 %s 发送失败，不再重试 [%s]: %v", item.ID, item.OpenID, err)
+	updateOutboxItem(item.ID, m, OutboxFailed, attempts, now, err.Error())
+}
+
+func updateOutboxItem(id string, m OutboxMessage, status string, attempts int, next time.Time, lastErr string) {
+	data, _ := json.Marshal(m)
+	_, err := db.Exec(`UPDATE outbox SET message = ?, status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ? WHERE id = ?`,
+		string(data), status, attempts, next.Unix(), lastErr, time.Now().Unix(), id)
+	if err != nil {
+		log.Printf("❌ 更新发件箱消息 %s 失败: %v", id, err)
+	}
+}
+
+// 按状态列出发件箱消息，status 为空时列出全部
+func listOutbox(status string, limit int) ([]OutboxItem, error) {
+	query := `SELECT id, openid, kind, message, status, attempts, next_attempt_at, last_error, created_at, updated_at FROM outbox`
+	args := []interface{}{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	rows, err := db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOutboxItems(rows)
+}
+
+// 按 id 查询发件箱中的消息，不存在时返回 false
+func getOutboxItem(id string) (OutboxItem, bool, error) {
+	rows, err := db.Query(`SELECT id, openid, kind, message, status, attempts, next_attempt_at, last_error, created_at, updated_at
+		FROM outbox WHERE id = ?`, id)
+	if err != nil {
+		return OutboxItem{}, false, err
+	}
+	defer rows.Close()
+	items, err := scanOutboxItems(rows)
+	if err != nil || len(items) == 0 {
+		return OutboxItem{}, false, err
+	}
+	return items[0], true, nil
+}
+
+// 把发送失败的消息重新放回队列
+func retryOutboxItem(id string) (bool, error) {
+	var message string
+	err := db.QueryRow(`SELECT message FROM outbox WHERE id = ? AND status = ?`, id, OutboxFailed).Scan(&message)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// 从第一种投递方式重新开始
+	var m OutboxMessage
+	_ = json.Unmarshal([]byte(message), &m)
+	m.Channel = ""
+	data, _ := json.Marshal(m)
+
+	res, err := db.Exec(`UPDATE outbox SET message = ?, status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		string(data), OutboxPending, time.Now().Unix(), time.Now().Unix(), id, OutboxFailed)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		wakeOutbox()
+	}
+	return n > 0, nil
+}
+
+func scanOutboxItems(rows *sql.Rows) ([]OutboxItem, error) {
+	var items []OutboxItem
+	for rows.Next() {
+		var item OutboxItem
+		var message string
+		var next, created, updated int64
+		if err := rows.Scan(&item.ID, &item.OpenID, &item.Kind, &message, &item.Status, &item.Attempts,
+			&next, &item.LastError, &created, &updated); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(message), &item.Message)
+		item.NextAttemptAt = time.Unix(next, 0)
+		item.CreatedAt = time.Unix(created, 0)
+		item.UpdatedAt = time.Unix(updated, 0)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// 删除超过 outbox.retention 的已发送消息，由定时任务调用。发送失败的消息保留以便排查和重试
+func cleanupOutbox() {
+	before := time.Now().Add(-viper.GetDuration("outbox.retention")).Unix()
+	res, err := db.Exec(`DELETE FROM outbox WHERE status = ? AND updated_at < ?`, OutboxSent, before)
+	if err != nil {
+		log.Printf("❌ 清理发件箱失败: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 已清理 %d 条已发送的发件箱消息", n)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const wechatPayBase = "https://api.mch.weixin.qq.com"
+
+// 可购买的积分套餐，Price 单位为分。MembershipDays 大于 0 时同时开通会员（需 membership.enabled）
+type payPackage struct {
+	Name           string `mapstructure:"name" json:"name"`
+	Points         int    `mapstructure:"points" json:"points"`
+	MembershipDays int    `mapstructure:"membership_days" json:"membership_days,omitempty"`
+	Price          int    `mapstructure:"price" json:"price"`
+}
+
+func payPackages() []payPackage {
+	var list []payPackage
+	_ = viper.UnmarshalKey("pay.packages", &list)
+	return list
+}
+
+func findPayPackage(name string) (payPackage, bool) {
+	for _, p := range payPackages() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return payPackage{}, false
+}
+
+// 充值订单
+type PayOrder struct {
+	OutTradeNo    string    `json:"out_trade_no"`
+	OpenID        string    `json:"openid"`
+	Package       string    `json:"package"`
+	Points        int       `json:"points"`
+	Amount        int       `json:"amount"`
+	Status        string    `json:"status"` // created、paid
+	TransactionID string    `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	PaidAt        time.Time `json:"paid_at,omitempty"`
+}
+
+// 商户私钥与微信支付公钥，首次使用时从 pay.private_key_path / pay.platform_public_key_path 加载
+var (
+	payKeysOnce       sync.Once
+	payKeysErr        error
+	merchantKey       *rsa.PrivateKey
+	platformPublicKey *rsa.PublicKey
+)
+
+func loadPayKeys() error {
+	payKeysOnce.Do(func() {
+		data, err := os.ReadFile(viper.GetString("pay.private_key_path"))
+		if err != nil {
+			payKeysErr = fmt.Errorf("read merchant key: %w", err)
+			return
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			payKeysErr = errors.New("merchant key is not PEM")
+			return
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			payKeysErr = fmt.Errorf("parse merchant key: %w", err)
+			return
+		}
+		var ok bool
+		if merchantKey, ok = key.(*rsa.PrivateKey); !ok {
+			payKeysErr = errors.New("merchant key is not RSA")
+			return
+		}
+
+		data, err = os.ReadFile(viper.GetString("pay.platform_public_key_path"))
+		if err != nil {
+			payKeysErr = fmt.Errorf("read platform public key: %w", err)
+			return
+		}
+		if block, _ = pem.Decode(data); block == nil {
+			payKeysErr = errors.New("platform public key is not PEM")
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			payKeysErr = fmt.Errorf("parse platform public key: %w", err)
+			return
+		}
+		if platformPublicKey, ok = pub.(*rsa.PublicKey); !ok {
+			payKeysErr = errors.New("platform public key is not RSA")
+		}
+	})
+	return payKeysErr
+}
+
+func randomNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func rsaSign(message string) (string, error) {
+	sum := sha256.Sum256([]byte(message))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, merchantKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// 调用微信支付 APIv3，请求按“方法\nURL\n时间戳\n随机串\n请求体\n”签名
+func wechatPayPost(path string, payload interface{}, out interface{}) error {
+	if err := loadPayKeys(); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(payload)
+	ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), randomNonce()
+	sig, err := rsaSign("POST\n" + path + "\n" + ts + "\n" + nonce + "\n" + string(body) + "\n")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wechatPayBase+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf(`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		viper.GetString("pay.mch_id"), nonce, sig, ts, viper.GetString("pay.serial_no")))
+
+	resp, err := wechatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wechat pay returned %d: %s", resp.StatusCode, truncateRunes(string(respBody), 200))
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// 创建充值订单。native 返回二维码链接 code_url；jsapi 返回网页内调起支付所需的参数
+func createPayOrder(openID string, pkg payPackage, tradeType string) (PayOrder, map[string]string, error) {
+	order := PayOrder{
+		OutTradeNo: time.Now().Format("20060102150405") + newID()[:8],
+		OpenID:     openID,
+		Package:    pkg.Name,
+		Points:     pkg.Points,
+		Amount:     pkg.Price,
+		Status:     "created",
+		CreatedAt:  time.Now(),
+	}
+	payload := map[string]interface{}{
+		"appid":        viper.GetString("wechat.app_id"),
+		"mchid":        viper.GetString("pay.mch_id"),
+		"description":  pkg.Name,
+		"out_trade_no": order.OutTradeNo,
+		"notify_url":   viper.GetString("pay.notify_url"),
+		"amount":       map[string]interface{}{"total": pkg.Price, "currency": "CNY"},
+	}
+	if tradeType == "jsapi" {
+		payload["payer"] = map[string]string{"openid": openID}
+	}
+
+	var result struct {
+		CodeURL  string `json:"code_url"`
+		PrepayID string `json:"prepay_id"`
+	}
+	if err := wechatPayPost("/v3/pay/transactions/"+tradeType, payload, &result); err != nil {
+		return order, nil, err
+	}
+	_, err := db.Exec(`INSERT INTO pay_orders (out_trade_no, openid, package, points, amount, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, order.OutTradeNo, openID, pkg.Name, pkg.Points, pkg.Price, order.Status, order.CreatedAt.Unix())
+	if err != nil {
+		return order, nil, err
+	}
+
+	if tradeType == "native" {
+		return order, map[string]string{"code_url": result.CodeURL}, nil
+	}
+	params := map[string]string{
+		"appId":     viper.GetString("wechat.app_id"),
+		"timeStamp": strconv.FormatInt(time.Now().Unix(), 10),
+		"nonceStr":  randomNonce(),
+		"package":   "prepay_id=" + result.PrepayID,
+		"signType":  "RSA",
+	}
+	params["paySign"], err = rsaSign(params["appId"] + "\n" + params["timeStamp"] + "\n" + params["nonceStr"] + "\n" + params["package"] + "\n")
+	return order, params, err
+}
+
+// 校验支付回调的签名：sha256withRSA(时间戳\n随机串\n请求体\n)，使用微信支付公钥
+func verifyPayNotification(header http.Header, body []byte) error {
+	if err := loadPayKeys(); err != nil {
+		return err
+	}
+	if id := viper.GetString("pay.platform_public_key_id"); id != "" && header.Get("Wechatpay-Serial") != id {
+		return fmt.Errorf("unexpected Wechatpay-Serial %q", header.Get("Wechatpay-Serial"))
+	}
+	ts, err := strconv.ParseInt(header.Get("Wechatpay-Timestamp"), 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > 5*time.Minute {
+		return errors.New("stale or missing Wechatpay-Timestamp")
+	}
+	sig, err := base64.StdEncoding.DecodeString(header.Get("Wechatpay-Signature"))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(header.Get("Wechatpay-Timestamp") + "\n" + header.Get("Wechatpay-Nonce") + "\n" + string(body) + "\n"))
+	return rsa.VerifyPKCS1v15(platformPublicKey, crypto.SHA256, sum[:], sig)
+}
+
+// 解密回调中的 resource（AEAD_AES_256_GCM，密钥为 APIv3 密钥）
+func decryptPayResource(ciphertext, nonce, associatedData string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher([]byte(viper.GetString("pay.api_v3_key")))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, []byte(nonce), data, []byte(associatedData))
+}
+
+// 支付成功：标记订单并入账积分、开通会员。以订单号作为流水和开通记录的 ref，重复回调不会重复入账
+func completePayOrder(outTradeNo, transactionID string, amount int) error {
+	var order PayOrder
+	err := db.QueryRow(`SELECT openid, package, points, amount, status FROM pay_orders WHERE out_trade_no = ?`, outTradeNo).
+		Scan(&order.OpenID, &order.Package, &order.Points, &order.Amount, &order.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("order %s not found", outTradeNo)
+	}
+	if err != nil {
+		return err
+	}
+	if amount != order.Amount {
+		return fmt.Errorf("order %s amount mismatch: paid %d, expected %d", outTradeNo, amount, order.Amount)
+	}
+
+	var credited bool
+	if order.Points > 0 {
+		if credited, err = addPoints(order.OpenID, order.Points, "topup", outTradeNo, "微信支付 "+transactionID); err != nil {
+			return err
+		}
+	}
+	// 会员天数以套餐当前的配置为准
+	var until time.Time
+	var granted bool
+	if pkg, ok := findPayPackage(order.Package); ok && pkg.MembershipDays > 0 && viper.GetBool("membership.enabled") {
+		if until, granted, err = grantMembership(order.OpenID, pkg.MembershipDays, "pay", outTradeNo, "微信支付 "+transactionID); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(`UPDATE pay_orders SET status = 'paid', transaction_id = ?, paid_at = ? WHERE out_trade_no = ?`,
+		transactionID, time.Now().Unix(), outTradeNo); err != nil {
+		return err
+	}
+	if credited {
+		log.Printf("💳 订单 %s 支付成功，用户 %s 获得 %d 积分", outTradeNo, order.OpenID, order.Points)
+		balance, _ := pointsBalance(order.OpenID)
+		queueKefuText(order.OpenID, fmt.Sprintf("✅ 充值成功，获得 %d 积分，当前积分 %d。", order.Points, balance))
+	}
+	if granted {
+		log.Printf("💳 订单 %s 支付成功，用户 %s 的会员有效期至 %s", outTradeNo, order.OpenID, until.Format("2006-01-02 15:04"))
+		queueKefuText(order.OpenID, fmt.Sprintf("👑 会员开通成功，有效期至 %s。", until.Format("2006-01-02 15:04")))
+	}
+	return nil
+}
+
+// 用户发送“充值”查看套餐和支付页面
+func handlePayCommand(openID, content string) (string, bool) {
+	if !viper.GetBool("pay.enabled") || strings.TrimSpace(content) != "充值" {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString("💳 充值套餐：")
+	for _, p := range payPackages() {
+		fmt.Fprintf(&b, "\n%s：¥%.2f", p.Name, float64(p.Price)/100)
+		if p.Points > 0 {
+			fmt.Fprintf(&b, "，%d 积分", p.Points)
+		}
+		if p.MembershipDays > 0 {
+			fmt.Fprintf(&b, "，%d 天会员", p.MembershipDays)
+		}
+	}
+	if page := viper.GetString("pay.page_url"); page != "" {
+		b.WriteString("\n\n点击购买：" + oauthAuthorizeURL(page))
+	}
+	return b.String(), true
+}
+
+// 支付接口：POST /pay/orders 创建订单，POST /pay/notify 接收支付结果通知。
+// 创建订单不信任客户端提交的 OpenID：支付页面经网页授权打开，提交授权得到的 code，由服务端换取 OpenID
+func registerPay(r *gin.Engine, limiter gin.HandlerFunc) {
+	if !viper.GetBool("pay.enabled") {
+		return
+	}
+
+	r.GET("/pay/packages", func(c *gin.Context) {
+		c.JSON(http.StatusOK, payPackages())
+	})
+
+	r.POST("/pay/orders", limiter, func(c *gin.Context) {
+		var body struct {
+			Code      string `json:"code" binding:"required"` // 网页授权（snsapi_base）得到的 code
+			Package   string `json:"package" binding:"required"`
+			TradeType string `json:"trade_type"` // native 或 jsapi，默认 jsapi
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if body.TradeType == "" {
+			body.TradeType = "jsapi"
+		}
+		if body.TradeType != "jsapi" && body.TradeType != "native" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "trade_type must be jsapi or native"})
+			return
+		}
+		pkg, ok := findPayPackage(body.Package)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown package"})
+			return
+		}
+		openID, err := oauthOpenID(body.Code)
+		if err != nil {
+			logf(c.Request.Context(), "❌ 网页授权 code 换取 OpenID 失败，来源 %s: %v", c.ClientIP(), err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+			return
+		}
+		order, params, err := createPayOrder(openID, pkg, body.TradeType)
+		if err != nil {
+			logf(c.Request.Context(), "❌ 创建支付订单失败: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "create order failed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"order": order, "params": params})
+	})
+
+	r.POST("/pay/notify", func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, viper.GetInt64("server.callback_max_bytes")))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				callbackRejected.WithLabelValues("too_large").Inc()
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"code": "FAIL", "message": "body too large"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"code": "FAIL", "message": "read body"})
+			return
+		}
+		if err := verifyPayNotification(c.Request.Header, body); err != nil {
+			logf(c.Request.Context(), "❌ 支付通知签名校验失败，来源 %s: %v", c.ClientIP(), err)
+			c.JSON(http.StatusUnauthorized, gin.H{"code": "FAIL", "message": "invalid signature"})
+			return
+		}
+
+		var notification struct {
+			EventType string `json:"event_type"`
+			Resource  struct {
+				Ciphertext     string `json:"ciphertext"`
+				Nonce          string `json:"nonce"`
+				AssociatedData string `json:"associated_data"`
+			} `json:"resource"`
+		}
+		if err := json.Unmarshal(body, &notification); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "FAIL", "message": "invalid body"})
+			return
+		}
+		if notification.EventType != "TRANSACTION.SUCCESS" {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		plain, err := decryptPayResource(notification.Resource.Ciphertext, notification.Resource.Nonce, notification.Resource.AssociatedData)
+		if err != nil {
+			logf(c.Request.Context(), "❌ 支付通知解密失败: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"code": "FAIL", "message": "decrypt failed"})
+			return
+		}
+
+		var tx struct {
+			OutTradeNo    string `json:"out_trade_no"`
+			TransactionID string `json:"transaction_id"`
+			TradeState    string `json:"trade_state"`
+			Amount        struct {
+				Total int `json:"total"`
+			} `json:"amount"`
+		}
+		if err := json.Unmarshal(plain, &tx); err != nil || tx.TradeState != "SUCCESS" {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		if err := completePayOrder(tx.OutTradeNo, tx.TransactionID, tx.Amount.Total); err != nil {
+			// 返回失败，微信支付会稍后重试通知
+			logf(c.Request.Context(), "❌ 处理支付结果失败: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "process failed"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	log.Println("✅ 微信支付接口已挂载到 /pay")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 插件可以挂载的位置
+const (
+	PluginHookMessage = "message" // 收到消息时调用，插件可直接回复并跳过后续处理
+	PluginHookCommand = "command" // 用户发送 commands 中的指令时调用，插件的回复作为被动回复
+	PluginHookAnswer  = "answer"  // 在 postprocess 中以 {type: plugin, plugin: 名称} 引用，改写模型的回答
+)
+
+var pluginHooks = []string{PluginHookMessage, PluginHookCommand, PluginHookAnswer}
+
+// 插件清单，plugins.dir 下的每个 .yaml/.yml/.json 文件描述一个插件
+type PluginManifest struct {
+	Name     string        `mapstructure:"name" json:"name"`
+	Type     string        `mapstructure:"type" json:"type"` // http：POST 到 url；exec：启动 command，请求写入 stdin，从 stdout 读取响应
+	URL      string        `mapstructure:"url" json:"url,omitempty"`
+	Command  []string      `mapstructure:"command" json:"command,omitempty"` // 相对路径相对于清单所在目录
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout"`
+	Hooks    []string      `mapstructure:"hooks" json:"hooks"`
+	Commands []string      `mapstructure:"commands" json:"commands,omitempty"` // command 钩子响应的指令，如 "天气"
+	Order    int           `mapstructure:"order" json:"order"`                 // 同一钩子按 order 从小到大调用
+	Disabled bool          `mapstructure:"disabled" json:"disabled"`
+
+	dir string
+}
+
+// 发送给插件的请求
+type pluginRequest struct {
+	Hook      string                 `json:"hook"`
+	OpenID    string                 `json:"openid"`
+	Message   map[string]interface{} `json:"message,omitempty"`
+	Command   string                 `json:"command,omitempty"`
+	Args      string                 `json:"args,omitempty"`
+	Answer    string                 `json:"answer,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// 插件的响应：handled 为 true 时使用 reply 作为被动回复（为空则不回复）；answer 钩子返回改写后的 answer
+type pluginResponse struct {
+	Handled bool    `json:"handled"`
+	Reply   string  `json:"reply"`
+	Answer  *string `json:"answer"`
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   []PluginManifest
+)
+
+func (p PluginManifest) hasHook(hook string) bool {
+	return slices.Contains(p.Hooks, hook)
+}
+
+// 读取 plugins.dir 下的插件清单，清单有误时返回错误且保留已加载的插件
+func loadPlugins() error {
+	dir := viper.GetString("plugins.dir")
+	if !viper.GetBool("plugins.enabled") || dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+
+	var list []PluginManifest
+	names := map[string]bool{}
+	for _, file := range files {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		m, err := readPluginManifest(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("%s: duplicate plugin name %q", file, m.Name)
+		}
+		names[m.Name] = true
+		if !m.Disabled {
+			list = append(list, m)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Order != list[j].Order {
+			return list[i].Order < list[j].Order
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	pluginsMu.Lock()
+	plugins = list
+	pluginsMu.Unlock()
+	log.Printf("🧩 已加载 %d 个插件", len(list))
+	return nil
+}
+
+func readPluginManifest(file string) (PluginManifest, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	var m PluginManifest
+	err := v.ReadInConfig()
+	if err == nil {
+		err = v.Unmarshal(&m)
+	}
+	if err != nil {
+		return m, err
+	}
+	if m.dir, err = filepath.Abs(filepath.Dir(file)); err != nil {
+		return m, err
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = viper.GetDuration("plugins.timeout")
+	}
+
+	switch {
+	case m.Name == "":
+		return m, errors.New("name is required")
+	case m.Type == "http" && m.URL == "":
+		return m, errors.New("http plugin needs url")
+	case m.Type == "exec" && len(m.Command) == 0:
+		return m, errors.New("exec plugin needs command")
+	case m.Type != "http" && m.Type != "exec":
+		return m, fmt.Errorf("type must be http or exec, got %q", m.Type)
+	}
+	for _, h := range m.Hooks {
+		if !slices.Contains(pluginHooks, h) {
+			return m, fmt.Errorf("unknown hook %q (want message, command or answer)", h)
+		}
+	}
+	if m.hasHook(PluginHookCommand) && len(m.Commands) == 0 {
+		return m, errors.New("command hook needs commands")
+	}
+	return m, nil
+}
+
+func loadedPlugins() []PluginManifest {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	return plugins
+}
+
+func findPlugin(name string) (PluginManifest, bool) {
+	for _, p := range loadedPlugins() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return PluginManifest{}, false
+}
+
+// 调用插件，超过插件的 timeout 视为失败
+func callPlugin(ctx context.Context, p PluginManifest, req pluginRequest) (pluginResponse, error) {
+	var resp pluginResponse
+	req.RequestID = requestID(ctx)
+	payload, _ := json.Marshal(req)
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	var out []byte
+	var err error
+	if p.Type == "http" {
+		out, err = callHTTPPlugin(ctx, p.URL, payload)
+	} else {
+		out, err = callExecPlugin(ctx, p, payload)
+	}
+	if err != nil {
+		return resp, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return resp, nil
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return resp, fmt.Errorf("invalid plugin response: %w", err)
+	}
+	return resp, nil
+}
+
+func callHTTPPlugin(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wechatClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("plugin returned %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func callExecPlugin(ctx context.Context, p PluginManifest, payload []byte) ([]byte, error) {
+	name := p.Command[0]
+	if strings.Contains(name, string(os.PathSeparator)) && !filepath.IsAbs(name) {
+		name = filepath.Join(p.dir, name)
+	}
+	cmd := exec.CommandContext(ctx, name, p.Command[1:]...)
+	cmd.Dir = p.dir
+	cmd.Stdin = bytes.NewReader(payload)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, truncateRunes(strings.TrimSpace(stderr.String()), 200))
+	}
+	return out, nil
+}
+
+func pluginMessage(msg WeChatMessage) map[string]interface{} {
+	return map[string]interface{}{
+		"msg_type":    msg.MsgType,
+		"content":     msg.Content,
+		"event":       msg.Event,
+		"event_key":   msg.EventKey,
+		"media_id":    msg.MediaID,
+		"msg_id":      msg.MessageID,
+		"create_time": msg.CreateTime,
+	}
+}
+
+// message 钩子：依次调用插件，第一个 handled 的插件的回复作为被动回复。插件出错时跳过，不影响正常处理
+func runMessagePlugins(ctx context.Context, msg WeChatMessage) (string, bool) {
+	for _, p := range loadedPlugins() {
+		if !p.hasHook(PluginHookMessage) {
+			continue
+		}
+		resp, err := callPlugin(ctx, p, pluginRequest{Hook: PluginHookMessage, OpenID: msg.FromUserName, Message: pluginMessage(msg)})
+		if err != nil {
+			logf(ctx, "⚠️ 插件 %s 处理消息失败: %v", p.Name, err)
+			continue
+		}
+		if resp.Handled {
+			logf(ctx, "🧩 消息由插件 %s 处理", p.Name)
+			return resp.Reply, true
+		}
+	}
+	return "", false
+}
+
+// command 钩子：消息为插件注册的指令（可带参数）时交给插件处理
+func handlePluginCommand(ctx context.Context, msg WeChatMessage) (string, bool) {
+	for _, p := range loadedPlugins() {
+		if !p.hasHook(PluginHookCommand) {
+			continue
+		}
+		for _, name := range p.Commands {
+			args, ok := parseCommand(msg.Content, name)
+			if !ok {
+				continue
+			}
+			resp, err := callPlugin(ctx, p, pluginRequest{Hook: PluginHookCommand, OpenID: msg.FromUserName,
+				Message: pluginMessage(msg), Command: name, Args: args})
+			if err != nil {
+				logf(ctx, "❌ 插件 %s 执行指令 %s 失败: %v", p.Name, name, err)
+				return "❌ 指令执行失败，请稍后再试。", true
+			}
+			return resp.Reply, true
+		}
+	}
+	return "", false
+}
+
+// answer 钩子：插件改写回答，出错或未返回 answer 时保持原样
+func transformAnswerWithPlugin(ctx context.Context, name, user, answer string) string {
+	p, ok := findPlugin(name)
+	if !ok || !p.hasHook(PluginHookAnswer) {
+		log.Printf("⚠️ postprocess 引用的插件 %s 未加载或未声明 answer 钩子", name)
+		return answer
+	}
+	resp, err := callPlugin(ctx, p, pluginRequest{Hook: PluginHookAnswer, OpenID: user, Answer: answer})
+	if err != nil {
+		logf(ctx, "⚠️ 插件 %s 处理回答失败: %v", p.Name, err)
+		return answer
+	}
+	if resp.Answer == nil {
+		return answer
+	}
+	return *resp.Answer
+}
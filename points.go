@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 积分流水。余额为全部流水之和；同一 (openid, reason, ref) 只记一次，用于签到、充值等防重复入账
+type PointsEntry struct {
+	ID        int64     `json:"id"`
+	OpenID    string    `json:"openid"`
+	Delta     int       `json:"delta"`
+	Reason    string    `json:"reason"` // checkin、grant、question 等
+	Ref       string    `json:"ref,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 记一笔积分，ref 非空且已入账过时返回 false
+func addPoints(openID string, delta int, reason, ref, note string) (bool, error) {
+	res, err := db.Exec(`INSERT OR IGNORE INTO points_ledger (openid, delta, reason, ref, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, openID, delta, reason, ref, note, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func pointsBalance(openID string) (int, error) {
+	var balance int
+	err := db.QueryRow(`SELECT COALESCE(SUM(delta), 0) FROM points_ledger WHERE openid = ?`, openID).Scan(&balance)
+	return balance, err
+}
+
+// 余额充足时扣除 1 积分
+func spendPoint(openID, reason string) (bool, error) {
+	return spendPoints(openID, 1, reason)
+}
+
+// 余额充足时扣除 amount 积分。检查与扣除在同一条语句中完成，多实例并发时不会扣成负数
+func spendPoints(openID string, amount int, reason string) (bool, error) {
+	res, err := db.Exec(`INSERT INTO points_ledger (openid, delta, reason, ref, note, created_at)
+		SELECT ?, ?, ?, '', '', ? WHERE (SELECT COALESCE(SUM(delta), 0) FROM points_ledger WHERE openid = ?) >= ?`,
+		openID, -amount, reason, time.Now().Unix(), openID, amount)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// 最近的积分流水
+func pointsLedger(openID string, limit int) ([]PointsEntry, error) {
+	rows, err := db.Query(`SELECT id, openid, delta, reason, ref, note, created_at FROM points_ledger
+		WHERE openid = ? ORDER BY id DESC LIMIT ?`, openID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []PointsEntry{}
+	for rows.Next() {
+		var e PointsEntry
+		var created int64
+		if err := rows.Scan(&e.ID, &e.OpenID, &e.Delta, &e.Reason, &e.Ref, &e.Note, &created); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.Unix(created, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// 用户今天已提问的次数
+func questionsToday(openID string) int {
+	var n int
+	_ = db.QueryRow(`SELECT COALESCE(SUM(questions), 0) FROM user_stats WHERE openid = ? AND day = ?`,
+		openID, time.Now().Format("2006-01-02")).Scan(&n)
+	return n
+}
+
+// 提问前扣费：每天前 points.daily_free 次（会员为 membership.daily_free 次）免费，之后每次消耗 1 积分。管理员不受限制。
+// 返回 false 时附带提示语
+func chargeQuestion(ctx context.Context, openID string) (string, bool) {
+	if !viper.GetBool("points.enabled") || isAdmin(openID) {
+		return "", true
+	}
+	free := dailyFreeQuestions(openID)
+	if questionsToday(openID) < free {
+		return "", true
+	}
+	ok, err := spendPoint(openID, "question")
+	if err != nil {
+		// 积分系统故障时放行，避免影响正常使用
+		log.Printf("❌ 扣除积分失败 [%s]: %v", openID, err)
+		return "", true
+	}
+	if !ok {
+		// 兼容旧配置 points.exhausted_reply（以 %d 表示免费次数）
+		if legacy := viper.GetString("points.exhausted_reply"); legacy != "" {
+			return fmt.Sprintf(legacy, free), false
+		}
+		return userMessage(ctx, MessageQuotaExceeded, openID, &messageVars{DailyFree: free}), false
+	}
+	notifyQuotaLow(ctx, openID)
+	return "", true
+}
+
+// “签到”领取积分，“查询积分”查看余额和今日剩余的免费次数
+func handlePointsCommand(openID, content string) (string, bool) {
+	if !viper.GetBool("points.enabled") {
+		return "", false
+	}
+	switch strings.TrimSpace(content) {
+	case "签到":
+		reward := viper.GetInt("points.checkin_reward")
+		ok, err := addPoints(openID, reward, "checkin", time.Now().Format("2006-01-02"), "")
+		if err != nil {
+			log.Printf("❌ 签到失败 [%s]: %v", openID, err)
+			return "❌ 签到失败，请稍后再试。", true
+		}
+		balance, _ := pointsBalance(openID)
+		if !ok {
+			return fmt.Sprintf("📅 今天已经签到过了，当前积分 %d。", balance), true
+		}
+		return fmt.Sprintf("✅ 签到成功，获得 %d 积分，当前积分 %d。", reward, balance), true
+	case "查询积分":
+		balance, err := pointsBalance(openID)
+		if err != nil {
+			log.Printf("❌ 查询积分失败 [%s]: %v", openID, err)
+			return "❌ 查询失败，请稍后再试。", true
+		}
+		remaining := max(dailyFreeQuestions(openID)-questionsToday(openID), 0)
+		return fmt.Sprintf("💰 当前积分 %d\n今日剩余免费提问 %d 次，用完后每次提问消耗 1 积分。", balance, remaining), true
+	}
+	return "", false
+}
+
+// 今日额度概况，供管理后台展示
+type quotaStatus struct {
+	Enabled        bool `json:"enabled"`
+	DailyFree      int  `json:"daily_free"`
+	ExhaustedUsers int  `json:"exhausted_users"` // 今日免费次数已用完的用户数
+	EarnedToday    int  `json:"earned_today"`
+	SpentToday     int  `json:"spent_today"`
+}
+
+func todayQuotaStatus() (quotaStatus, error) {
+	q := quotaStatus{Enabled: viper.GetBool("points.enabled"), DailyFree: viper.GetInt("points.daily_free")}
+	if !q.Enabled {
+		return q, nil
+	}
+	now := time.Now()
+	err := db.QueryRow(`SELECT COUNT(*) FROM user_stats WHERE day = ? AND questions >= ?`,
+		now.Format("2006-01-02"), q.DailyFree).Scan(&q.ExhaustedUsers)
+	if err != nil {
+		return q, err
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	err = db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN delta > 0 THEN delta ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN delta < 0 THEN -delta ELSE 0 END), 0) FROM points_ledger WHERE created_at >= ?`, start).
+		Scan(&q.EarnedToday, &q.SpentToday)
+	return q, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// 回答的后处理步骤，按 postprocess 中的顺序依次执行
+type PostProcessor struct {
+	Type      string   `mapstructure:"type"`       // markdown、sensitive_words、split、footer 或 plugin
+	Words     []string `mapstructure:"words"`      // sensitive_words：需要屏蔽的词，不区分大小写
+	Mask      string   `mapstructure:"mask"`       // sensitive_words：替换每个字符的符号，默认 *
+	MaxLength int      `mapstructure:"max_length"` // split：每条消息的最大字符数
+	Text      string   `mapstructure:"text"`       // footer：附加在最后一条消息末尾的内容，支持提示词模板变量
+	Plugin    string   `mapstructure:"plugin"`     // plugin：调用该插件的 answer 钩子改写每一条消息
+}
+
+var postProcessorTypes = []string{"markdown", "sensitive_words", "split", "footer", "plugin"}
+
+func postProcessors() []PostProcessor {
+	var list []PostProcessor
+	if err := viper.UnmarshalKey("postprocess", &list); err != nil {
+		log.Printf("⚠️ 解析 postprocess 失败: %v", err)
+		return nil
+	}
+	return list
+}
+
+// 对模型的回答执行后处理（先遮盖脏话，见 profanity.go），返回依次发送的消息；split 之后的步骤对每一条消息分别处理（footer 只附加在最后一条）
+func postProcessAnswer(ctx context.Context, user, answer string) []string {
+	parts := []string{maskProfanity(ctx, answer)}
+	for _, p := range postProcessors() {
+		switch p.Type {
+		case "markdown":
+			for i := range parts {
+				parts[i] = stripMarkdown(parts[i])
+			}
+		case "sensitive_words":
+			for i := range parts {
+				parts[i] = maskWords(parts[i], p.Words, p.Mask)
+			}
+		case "split":
+			var split []string
+			for _, s := range parts {
+				split = append(split, splitText(s, p.MaxLength)...)
+			}
+			parts = split
+		case "plugin":
+			for i := range parts {
+				parts[i] = transformAnswerWithPlugin(ctx, p.Plugin, user, parts[i])
+			}
+		case "footer":
+			if footer := executeTemplate(ctx, p.Text, userPromptVars(user)); footer != "" {
+				parts[len(parts)-1] += "\n\n" + footer
+			}
+		}
+	}
+	return parts
+}
+
+var markdownRules = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile("(?m)^[ \\t]*```.*$\n?"), ""},                   // 代码块的围栏
+	{regexp.MustCompile(`(?m)^[ \t]{0,3}#{1,6}[ \t]+`), ""},             // 标题
+	{regexp.MustCompile(`(?m)^[ \t]{0,3}>[ \t]?`), ""},                  // 引用
+	{regexp.MustCompile(`(?m)^[ \t]*([-*_][ \t]*){3,}$`), "——————"},     // 分隔线
+	{regexp.MustCompile(`(?m)^([ \t]*)[-*+][ \t]+`), "${1}• "},          // 无序列表
+	{regexp.MustCompile(`!\[([^\]]*)\]\(([^)]*)\)`), "$1"},              // 图片
+	{regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`), "$1（$2）"},           // 链接
+	{regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`), "$2"},               // 加粗
+	{regexp.MustCompile(`(^|[^*\w])\*([^*\n]+)\*([^*\w]|$)`), "$1$2$3"}, // 斜体
+	{regexp.MustCompile("`([^`\n]+)`"), "$1"},                           // 行内代码
+	{regexp.MustCompile(`~~(.+?)~~`), "$1"},                             // 删除线
+}
+
+// 去掉微信无法渲染的 Markdown 标记，保留文字内容
+func stripMarkdown(s string) string {
+	for _, r := range markdownRules {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return strings.TrimSpace(s)
+}
+
+// 把敏感词的每个字符替换为 mask
+func maskWords(s string, words []string, mask string) string {
+	if mask == "" {
+		mask = "*"
+	}
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(w))
+		s = re.ReplaceAllStringFunc(s, func(m string) string {
+			return strings.Repeat(mask, utf8.RuneCountInString(m))
+		})
+	}
+	return s
+}
+
+// 按最大字符数切分长回答，优先在换行处、其次在句末标点处断开
+func splitText(s string, n int) []string {
+	if n <= 0 {
+		return []string{s}
+	}
+	var parts []string
+	r := []rune(s)
+	for len(r) > n {
+		cut := n
+		for _, seps := range []string{"\n", "。！？!?；;"} {
+			if i := lastRuneIndex(r[:n], seps); i >= n/2 {
+				cut = i + 1
+				break
+			}
+		}
+		if part := strings.TrimSpace(string(r[:cut])); part != "" {
+			parts = append(parts, part)
+		}
+		r = []rune(strings.TrimLeft(string(r[cut:]), "\n"))
+	}
+	if rest := strings.TrimSpace(string(r)); rest != "" || len(parts) == 0 {
+		parts = append(parts, rest)
+	}
+	return parts
+}
+
+func lastRuneIndex(r []rune, chars string) int {
+	for i := len(r) - 1; i >= 0; i-- {
+		if strings.ContainsRune(chars, r[i]) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 开启 pprof：配置了 pprof.listen 时在独立端口提供（建议仅监听内网地址），
+// 否则挂载到主端口的 /debug/pprof 并使用管理令牌鉴权
+func registerPprof(r *gin.Engine) {
+	if !viper.GetBool("pprof.enabled") {
+		return
+	}
+
+	if addr := viper.GetString("pprof.listen"); addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			log.Printf("✅ pprof 已在 %s 启动", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Printf("❌ pprof 服务退出: %v", err)
+			}
+		}()
+		return
+	}
+
+	g := r.Group("/debug/pprof", adminAuth())
+	g.GET("/", gin.WrapF(pprof.Index))
+	g.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	g.GET("/profile", gin.WrapF(pprof.Profile))
+	g.POST("/symbol", gin.WrapF(pprof.Symbol))
+	g.GET("/symbol", gin.WrapF(pprof.Symbol))
+	g.GET("/trace", gin.WrapF(pprof.Trace))
+	// goroutine、heap 等命名 profile
+	g.GET("/:name", func(c *gin.Context) {
+		pprof.Handler(c.Param("name")).ServeHTTP(c.Writer, c.Request)
+	})
+	log.Println("✅ pprof 已挂载到 /debug/pprof（需管理令牌）")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 匿名模式：开启 privacy.hash_openids 后，日志、追踪、错误上报和审计日志中的 OpenID 替换为加盐哈希（u_ 开头的化名）。
+// 化名与 OpenID 的对应关系只存于 openid_pseudonyms 表，管理接口收到化名时据此还原，以便推送消息等需要原始 OpenID 的操作
+const pseudonymPrefix = "u_"
+
+var (
+	openIDPatternOnce sync.Once
+	openIDPattern     *regexp.Regexp
+)
+
+func hashOpenIDs() bool {
+	return viper.GetBool("privacy.hash_openids")
+}
+
+// OpenID 的化名，未开启匿名模式时原样返回。同时记录化名的对应关系，不能在日志输出中调用
+func pseudonym(openID string) string {
+	p := hashOpenID(openID)
+	if p != openID {
+		savePseudonym(p, openID)
+	}
+	return p
+}
+
+// 只计算化名，不记录对应关系
+func hashOpenID(openID string) string {
+	if !hashOpenIDs() || openID == "" || strings.HasPrefix(openID, pseudonymPrefix) {
+		return openID
+	}
+	mac := hmac.New(sha256.New, []byte(viper.GetString("privacy.salt")))
+	mac.Write([]byte(openID))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// 记录化名的对应关系。已写入的化名记在状态存储中（受 state.memory 容量限制），过期前不再重复写入
+func savePseudonym(p, openID string) {
+	if db == nil || state == nil {
+		return
+	}
+	ctx := context.Background()
+	if ok, err := state.SetNX(ctx, cacheKey("pseudonym:"+p), []byte("1"), cacheTTL); err == nil && !ok {
+		return
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO openid_pseudonyms (pseudonym, openid, created_at) VALUES (?, ?, ?)`,
+		p, openID, time.Now().Unix()); err != nil {
+		_ = state.Delete(ctx, cacheKey("pseudonym:"+p))
+		log.Printf("⚠️ 保存 OpenID 化名失败: %v", err)
+	}
+}
+
+// 把化名还原为 OpenID，不是化名或找不到对应关系时原样返回
+func resolveOpenID(id string) string {
+	if !strings.HasPrefix(id, pseudonymPrefix) {
+		return id
+	}
+	var openID string
+	if err := db.QueryRow(`SELECT openid FROM openid_pseudonyms WHERE pseudonym = ?`, id).Scan(&openID); err != nil {
+		return id
+	}
+	return openID
+}
+
+// 替换日志文本中形如 OpenID（privacy.openid_pattern）的内容。
+// 在标准日志的输出中调用（此时持有日志的锁），只计算化名，不写日志也不读写数据库；
+// 对应关系在收到消息时由 statsMiddleware 记录
+func pseudonymizeText(s string) string {
+	openIDPatternOnce.Do(func() {
+		openIDPattern = regexp.MustCompile(`\b(?:` + viper.GetString("privacy.openid_pattern") + `)\b`)
+	})
+	return openIDPattern.ReplaceAllStringFunc(s, hashOpenID)
+}
+
+// 管理接口的 :openid 参数可以是化名，处理前还原为 OpenID
+func resolveOpenIDParam() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if hashOpenIDs() {
+			for i, p := range c.Params {
+				if p.Key == "openid" {
+					c.Params[i].Value = resolveOpenID(p.Value)
+				}
+			}
+		}
+		c.Next()
+	}
+}
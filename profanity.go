@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 脏话遮盖：与后处理 sensitive_words 不同，词库来自 profanity.dictionary 文件（每行一个词，# 开头为注释）和 profanity.words，
+// 对所有模型回答生效，命中的词逐字替换为 profanity.mask 后照常发送。
+// 英文等字母词只匹配完整的单词（不会把 class 中的 ass 遮盖），中文按字面匹配。词库文件修改后自动重新加载
+
+var profanityMasked = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "mpbot_profanity_masked_total",
+	Help: "Profanity occurrences masked in answers.",
+})
+
+var (
+	profanityMu      sync.RWMutex
+	profanityPattern *regexp.Regexp
+	profanityModTime time.Time // 已加载的词库文件修改时间
+)
+
+// 加载词库，启动时调用；词库文件不存在时只使用 profanity.words
+func loadProfanityDictionary() error {
+	if !viper.GetBool("profanity.enabled") {
+		return nil
+	}
+	words := viper.GetStringSlice("profanity.words")
+	var modTime time.Time
+	if path := viper.GetString("profanity.dictionary"); path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+		fromFile, err := readWordList(path)
+		if err != nil {
+			return err
+		}
+		words = append(words, fromFile...)
+	}
+
+	profanityMu.Lock()
+	profanityPattern = compileProfanity(words)
+	profanityModTime = modTime
+	profanityMu.Unlock()
+	log.Printf("🤐 已加载 %d 个遮盖词", len(words))
+	return nil
+}
+
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if w := strings.TrimSpace(scanner.Text()); w != "" && !strings.HasPrefix(w, "#") {
+			words = append(words, w)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// 把全部词合成一个正则，较长的词优先匹配
+func compileProfanity(words []string) *regexp.Regexp {
+	var alts []string
+	seen := map[string]bool{}
+	for _, w := range words {
+		key := strings.ToLower(w)
+		if w == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		alt := regexp.QuoteMeta(w)
+		if isASCIIWord(w) {
+			alt = `\b` + alt + `\b`
+		}
+		alts = append(alts, alt)
+	}
+	if len(alts) == 0 {
+		return nil
+	}
+	sort.Slice(alts, func(i, j int) bool { return len(alts[i]) > len(alts[j]) })
+	return regexp.MustCompile("(?i)" + strings.Join(alts, "|"))
+}
+
+// 由 ASCII 字符组成且首尾为字母或数字的词，按完整单词匹配
+func isASCIIWord(w string) bool {
+	for _, r := range w {
+		if r >= utf8.RuneSelf {
+			return false
+		}
+	}
+	isAlnum := func(b byte) bool {
+		return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+	}
+	return isAlnum(w[0]) && isAlnum(w[len(w)-1])
+}
+
+// 词库文件修改后重新加载
+func reloadProfanityIfChanged() {
+	path := viper.GetString("profanity.dictionary")
+	if path == "" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	profanityMu.RLock()
+	changed := !info.ModTime().Equal(profanityModTime)
+	profanityMu.RUnlock()
+	if changed {
+		if err := loadProfanityDictionary(); err != nil {
+			log.Printf("⚠️ 重新加载遮盖词库失败: %v", err)
+		}
+	}
+}
+
+// 遮盖回答中的脏话
+func maskProfanity(ctx context.Context, s string) string {
+	if !viper.GetBool("profanity.enabled") {
+		return s
+	}
+	reloadProfanityIfChanged()
+	profanityMu.RLock()
+	re := profanityPattern
+	profanityMu.RUnlock()
+	if re == nil {
+		return s
+	}
+	mask := viper.GetString("profanity.mask")
+	n := 0
+	s = re.ReplaceAllStringFunc(s, func(m string) string {
+		n++
+		return strings.Repeat(mask, utf8.RuneCountInString(m))
+	})
+	if n > 0 {
+		profanityMasked.Add(float64(n))
+		logf(ctx, "🤐 回答中遮盖了 %d 处脏话", n)
+	}
+	return s
+}
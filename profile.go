@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 微信用户基本信息（自 2021 年起接口不再返回昵称和头像，需用户授权或后台备注补充）
+type UserProfile struct {
+	OpenID         string    `json:"openid"`
+	Subscribe      int       `json:"subscribe"`
+	Nickname       string    `json:"nickname,omitempty"`
+	HeadImgURL     string    `json:"headimgurl,omitempty"`
+	Language       string    `json:"language,omitempty"`
+	City           string    `json:"city,omitempty"`
+	Province       string    `json:"province,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	SubscribeTime  int64     `json:"subscribe_time,omitempty"`
+	UnionID        string    `json:"unionid,omitempty"`
+	Remark         string    `json:"remark,omitempty"`
+	TagIDs         []int     `json:"tagid_list,omitempty"`
+	SubscribeScene string    `json:"subscribe_scene,omitempty"`
+	QrScene        int       `json:"qr_scene,omitempty"`
+	QrSceneStr     string    `json:"qr_scene_str,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// 展示用的称呼：备注 > 昵称
+func (p UserProfile) DisplayName() string {
+	if p.Remark != "" {
+		return p.Remark
+	}
+	return p.Nickname
+}
+
+// 获取用户信息，优先使用 profile.ttl 内的缓存，拉取失败时返回过期的缓存
+func getUserProfile(openID string) (UserProfile, error) {
+	cached, err := loadUserProfile(openID)
+	if err == nil && time.Since(cached.UpdatedAt) < viper.GetDuration("profile.ttl") {
+		return cached, nil
+	}
+
+	fresh, fetchErr := fetchUserProfile(openID)
+	if fetchErr != nil {
+		if err == nil {
+			log.Printf("⚠️ 拉取用户信息失败，使用缓存 [%s]: %v", openID, fetchErr)
+			return cached, nil
+		}
+		return UserProfile{}, fetchErr
+	}
+	if err := saveUserProfile(fresh); err != nil {
+		log.Printf("⚠️ 缓存用户信息失败 [%s]: %v", openID, err)
+	}
+	return fresh, nil
+}
+
+// 获取称呼，失败时返回空字符串
+func userDisplayName(openID string) string {
+	p, err := getUserProfile(openID)
+	if err != nil {
+		return ""
+	}
+	return p.DisplayName()
+}
+
+func fetchUserProfile(openID string) (UserProfile, error) {
+	if isWeComUser(openID) {
+		return UserProfile{}, errors.New("wecom users have no wechat profile")
+	}
+	query := url.Values{}
+	query.Set("openid", openID)
+	query.Set("lang", "zh_CN")
+
+	var p UserProfile
+	if err := wechatGet("/cgi-bin/user/info", query, &p); err != nil {
+		return p, err
+	}
+	p.UpdatedAt = time.Now()
+	return p, nil
+}
+
+func loadUserProfile(openID string) (UserProfile, error) {
+	var data string
+	var updated int64
+	err := db.QueryRow(`SELECT data, updated_at FROM user_profiles WHERE openid = ?`, openID).Scan(&data, &updated)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	var p UserProfile
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return p, err
+	}
+	p.UpdatedAt = time.Unix(updated, 0)
+	return p, nil
+}
+
+func saveUserProfile(p UserProfile) error {
+	data, _ := json.Marshal(p)
+	_, err := db.Exec(`INSERT INTO user_profiles (openid, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(openid) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		p.OpenID, string(data), p.UpdatedAt.Unix())
+	return err
+}
+
+// 分页列出已缓存的用户信息
+func listUserProfiles(offset, limit int) ([]UserProfile, error) {
+	rows, err := db.Query(`SELECT data, updated_at FROM user_profiles ORDER BY updated_at DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []UserProfile
+	for rows.Next() {
+		var data string
+		var updated int64
+		if err := rows.Scan(&data, &updated); err != nil {
+			return nil, err
+		}
+		var p UserProfile
+		_ = json.Unmarshal([]byte(data), &p)
+		p.UpdatedAt = time.Unix(updated, 0)
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// 强制刷新缓存，用于管理接口
+func refreshUserProfile(openID string) (UserProfile, error) {
+	p, err := fetchUserProfile(openID)
+	if err != nil {
+		return p, err
+	}
+	return p, saveUserProfile(p)
+}
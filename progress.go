@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 问题的处理进度，保存在状态存储中，多实例部署时任一实例都能查询。
+// 排队中的问题记在 progress:queued:<openid> 列表中，开始生成时取出；正在生成或最近完成的问题记在 progress:<openid>
+const (
+	ProgressGenerating = "generating"
+	ProgressReady      = "ready"
+	ProgressFailed     = "failed"
+	ProgressCanceled   = "canceled" // 用户发送“取消”
+)
+
+// 回答的去向
+const (
+	DeliveryReplied = "replied" // 随被动回复返回
+	DeliveryCached  = "cached"  // 缓存，等待用户输入“继续”
+	DeliveryPushed  = "pushed"  // 经发件箱推送
+)
+
+type questionProgress struct {
+	Status     string    `json:"status"`
+	Question   string    `json:"question"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Delivery   string    `json:"delivery,omitempty"`
+}
+
+func progressKey(user string) string       { return "progress:" + user }
+func queuedProgressKey(user string) string { return "progress:queued:" + user }
+
+// 进度记录与缓存的回答同时过期
+func progressTTL() time.Duration {
+	return 2 * viper.GetDuration("cache.answer_ttl")
+}
+
+// 问题进入队列
+func markQueued(ctx context.Context, user, question string) {
+	if _, err := state.Push(ctx, queuedProgressKey(user), []byte(question), progressTTL()); err != nil {
+		logf(ctx, "⚠️ 记录问题进度失败: %v", err)
+	}
+}
+
+// 问题未能进入队列
+func unmarkQueued(ctx context.Context, user string) {
+	if _, err := state.Pop(ctx, queuedProgressKey(user)); err != nil && !errors.Is(err, errStateNotFound) {
+		logf(ctx, "⚠️ 更新问题进度失败: %v", err)
+	}
+}
+
+// 开始生成回答，从排队列表中取出一个问题
+func markGenerating(ctx context.Context, user, question string) {
+	unmarkQueued(ctx, user)
+	saveProgress(ctx, user, questionProgress{Status: ProgressGenerating, Question: question, StartedAt: time.Now()})
+}
+
+// 回答生成完成或失败
+func markFinished(ctx context.Context, user string, failed bool, delivery string) {
+	p, ok := loadProgress(ctx, user)
+	if !ok || p.Status == ProgressCanceled {
+		return
+	}
+	p.Status, p.FinishedAt, p.Delivery = ProgressReady, time.Now(), delivery
+	if failed {
+		p.Status = ProgressFailed
+	}
+	saveProgress(ctx, user, p)
+}
+
+func saveProgress(ctx context.Context, user string, p questionProgress) {
+	data, _ := json.Marshal(p)
+	if err := state.Set(ctx, progressKey(user), data, progressTTL()); err != nil {
+		logf(ctx, "⚠️ 记录问题进度失败: %v", err)
+	}
+}
+
+func loadProgress(ctx context.Context, user string) (questionProgress, bool) {
+	var p questionProgress
+	data, err := state.Get(ctx, progressKey(user))
+	if err != nil {
+		if !errors.Is(err, errStateNotFound) {
+			log.Printf("⚠️ 读取问题进度失败 [%s]: %v", user, err)
+		}
+		return p, false
+	}
+	return p, json.Unmarshal(data, &p) == nil
+}
+
+// 描述用户问题的处理进度
+func progressStatus(ctx context.Context, user string) string {
+	queued, err := state.Len(ctx, queuedProgressKey(user))
+	if err != nil {
+		log.Printf("⚠️ 读取问题进度失败 [%s]: %v", user, err)
+	}
+	p, ok := loadProgress(ctx, user)
+
+	var lines []string
+	if ok {
+		question := truncateRunes(p.Question, 20)
+		switch p.Status {
+		case ProgressGenerating:
+			lines = append(lines, fmt.Sprintf("⏳ 正在生成“%s”的回答，已用时 %d 秒。", question, int(time.Since(p.StartedAt).Seconds())))
+		case ProgressReady:
+			took := p.FinishedAt.Sub(p.StartedAt).Round(time.Second)
+			switch n, _ := state.Len(ctx, answersKey(user)); {
+			case n > 0:
+				lines = append(lines, fmt.Sprintf("✅ “%s”的回答已生成（用时 %s），输入“继续”查看。", question, took))
+			case p.Delivery == DeliveryPushed:
+				lines = append(lines, fmt.Sprintf("✅ “%s”的回答已发送（用时 %s）。", question, took))
+			default:
+				lines = append(lines, fmt.Sprintf("✅ “%s”已回答（用时 %s）。", question, took))
+			}
+		case ProgressFailed:
+			lines = append(lines, fmt.Sprintf("❌ “%s”处理失败，请重新提问。", question))
+		case ProgressCanceled:
+			lines = append(lines, fmt.Sprintf("🛑 “%s”已取消。", question))
+		}
+	}
+	if queued > 0 {
+		lines = append(lines, fmt.Sprintf("📋 还有 %d 个问题在排队，当前共有 %d 个问题等待处理。", queued, queueDepth(ctx)))
+	}
+	if len(lines) == 0 {
+		return "💤 目前没有处理中的问题。"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 处理“进度”指令
+func handleProgressCommand(openID, content string) (string, bool) {
+	if strings.TrimSpace(content) != "进度" {
+		return "", false
+	}
+	return progressStatus(context.Background(), openID), true
+}
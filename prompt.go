@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 系统提示词模板可用的变量，例如：今天是{{.Date}} {{.Weekday}}，你正在为{{.Nickname}}服务
+type promptVars struct {
+	Nickname    string
+	OpenID      string
+	Language    string
+	Date        string
+	Time        string
+	Weekday     string
+	AccountName string
+}
+
+var weekdays = [...]string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"}
+
+// 已解析的模板，按模板原文缓存
+var promptTemplates sync.Map
+
+// 渲染用户的系统提示词，模板解析或执行失败时原样返回
+func renderPrompt(ctx context.Context, tmpl, user string) string {
+	if !strings.Contains(tmpl, "{{") {
+		return tmpl
+	}
+	return executeTemplate(ctx, tmpl, userPromptVars(user))
+}
+
+func userPromptVars(user string) promptVars {
+	now := promptNow()
+	vars := promptVars{
+		OpenID:      user,
+		Date:        now.Format("2006年01月02日"),
+		Time:        now.Format("15:04"),
+		Weekday:     weekdays[now.Weekday()],
+		AccountName: viper.GetString("wechat.account_name"),
+	}
+	if user != "" {
+		// 只使用缓存，避免在生成回答前额外请求微信接口
+		if p, err := loadUserProfile(user); err == nil {
+			vars.Nickname = p.DisplayName()
+			vars.Language = p.Language
+		}
+	}
+	return vars
+}
+
+// 提示词中使用的当前时间，按 deepseek.timezone 换算，留空或无效时使用服务器时区
+func promptNow() time.Time {
+	now := time.Now()
+	if tz := viper.GetString("deepseek.timezone"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return now.In(loc)
+		}
+	}
+	return now
+}
+
+// 开启 deepseek.runtime_context 时附加在系统提示词末尾的运行时信息：当前时间、用户昵称和语言、等级与会员状态，
+// 模型本身不知道今天的日期，也不知道在和谁对话
+func runtimeContext(user string) string {
+	if !viper.GetBool("deepseek.runtime_context") {
+		return ""
+	}
+	vars := userPromptVars(user)
+	lines := []string{fmt.Sprintf("当前时间：%s %s %s（%s）", vars.Date, vars.Weekday, vars.Time, promptNow().Location())}
+	if vars.Nickname != "" {
+		lines = append(lines, "用户昵称："+vars.Nickname)
+	}
+	if vars.Language != "" {
+		lines = append(lines, "用户语言："+vars.Language)
+	}
+	if user != "" && viper.GetBool("tiers.enabled") {
+		lines = append(lines, "用户等级："+userTier(user))
+	}
+	if user != "" && viper.GetBool("membership.enabled") {
+		if isMember(user) {
+			lines = append(lines, "会员状态：会员")
+		} else {
+			lines = append(lines, "会员状态：非会员")
+		}
+	}
+	return "\n\n以下是本次对话的运行时信息，仅在与问题相关时使用：\n" + strings.Join(lines, "\n")
+}
+
+// 执行 text/template 模板，解析或执行失败时原样返回
+func executeTemplate(ctx context.Context, tmpl string, data interface{}) string {
+	var t *template.Template
+	if v, ok := promptTemplates.Load(tmpl); ok {
+		t = v.(*template.Template)
+	} else {
+		parsed, err := template.New("prompt").Parse(tmpl)
+		if err != nil {
+			logf(ctx, "⚠️ 模板解析失败: %v", err)
+			return tmpl
+		}
+		promptTemplates.Store(tmpl, parsed)
+		t = parsed
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		logf(ctx, "⚠️ 模板渲染失败: %v", err)
+		return tmpl
+	}
+	return b.String()
+}
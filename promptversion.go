@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 系统提示词的版本：通过 PUT /admin/prompt 或管理员的“提示词”指令发布，立即生效无需重启。
+// 没有生效的版本时使用配置中的 deepseek.prompt
+type PromptVersion struct {
+	ID        int64     `json:"id"`
+	Prompt    string    `json:"prompt"`
+	Note      string    `json:"note,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 生效的版本缓存在状态存储中，多个实例发布或回滚后立即一致；缓存 null 表示使用 deepseek.prompt
+const promptCacheKey = "prompt"
+
+// 当前生效的系统提示词
+func systemPrompt() string {
+	if v := currentPromptVersion(); v != nil {
+		return v.Prompt
+	}
+	return viper.GetString("deepseek.prompt")
+}
+
+func currentPromptVersion() *PromptVersion {
+	ctx := context.Background()
+	var v *PromptVersion
+	if getCached(ctx, promptCacheKey, &v) {
+		return v
+	}
+	v, err := queryActivePrompt()
+	if err != nil {
+		log.Printf("⚠️ 读取提示词版本失败，使用 deepseek.prompt: %v", err)
+		return nil
+	}
+	fillCache(ctx, promptCacheKey, v)
+	return v
+}
+
+// 从数据库读取生效的版本，没有时返回 nil
+func queryActivePrompt() (*PromptVersion, error) {
+	v, err := scanPromptVersion(db.QueryRow(`SELECT id, prompt, note, author, active, created_at FROM prompt_versions WHERE active = 1`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func scanPromptVersion(row interface{ Scan(...any) error }) (PromptVersion, error) {
+	var v PromptVersion
+	var at int64
+	err := row.Scan(&v.ID, &v.Prompt, &v.Note, &v.Author, &v.Active, &at)
+	v.CreatedAt = time.Unix(at, 0)
+	return v, err
+}
+
+// 发布新版本并立即生效
+func publishPrompt(prompt, note, author string) (PromptVersion, error) {
+	if prompt == "" {
+		return PromptVersion{}, errors.New("prompt is required")
+	}
+	if _, err := template.New("prompt").Parse(prompt); err != nil {
+		return PromptVersion{}, fmt.Errorf("invalid prompt template: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return PromptVersion{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE prompt_versions SET active = 0 WHERE active = 1`); err != nil {
+		return PromptVersion{}, err
+	}
+	now := time.Now()
+	res, err := tx.Exec(`INSERT INTO prompt_versions (prompt, note, author, active, created_at) VALUES (?, ?, ?, 1, ?)`,
+		prompt, note, author, now.Unix())
+	if err != nil {
+		return PromptVersion{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return PromptVersion{}, err
+	}
+	id, _ := res.LastInsertId()
+	v := PromptVersion{ID: id, Prompt: prompt, Note: note, Author: author, Active: true, CreatedAt: time.Unix(now.Unix(), 0)}
+	storeCache(context.Background(), promptCacheKey, &v)
+	log.Printf("📝 %s 发布提示词版本 #%d", author, id)
+	return v, nil
+}
+
+// 回滚到指定版本；id 为 0 时回滚到当前版本的上一个版本，没有更早的版本时恢复 deepseek.prompt
+func rollbackPrompt(id int64) (*PromptVersion, error) {
+	if id == 0 {
+		cur := currentPromptVersion()
+		if cur == nil {
+			return nil, errors.New("already using deepseek.prompt from config")
+		}
+		err := db.QueryRow(`SELECT id FROM prompt_versions WHERE id < ? ORDER BY id DESC LIMIT 1`, cur.ID).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE prompt_versions SET active = 0 WHERE active = 1`); err != nil {
+		return nil, err
+	}
+	if id > 0 {
+		res, err := tx.Exec(`UPDATE prompt_versions SET active = 1 WHERE id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil, fmt.Errorf("prompt version %d not found", id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	v, err := queryActivePrompt()
+	if err != nil {
+		return nil, err
+	}
+	storeCache(context.Background(), promptCacheKey, v)
+	log.Printf("📝 提示词已回滚到 %s", promptVersionLabel(v))
+	return v, nil
+}
+
+func listPromptVersions(limit int) ([]PromptVersion, error) {
+	rows, err := db.Query(`SELECT id, prompt, note, author, active, created_at FROM prompt_versions ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := []PromptVersion{}
+	for rows.Next() {
+		v, err := scanPromptVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func promptVersionLabel(v *PromptVersion) string {
+	if v == nil {
+		return "配置文件中的 deepseek.prompt"
+	}
+	return fmt.Sprintf("版本 #%d", v.ID)
+}
+
+// 管理员指令：“提示词”查看当前提示词，“提示词 设置 内容”发布新版本，“提示词 回滚 [版本号]”回滚
+func handlePromptCommand(openID, content string) (string, bool) {
+	arg, ok := parseCommand(content, "提示词")
+	if !ok || !isAdmin(openID) {
+		return "", false
+	}
+	if arg == "" {
+		return fmt.Sprintf("📝 当前使用%s：\n%s\n\n发送“提示词 设置 内容”发布新版本，“提示词 回滚 [版本号]”回滚。",
+			promptVersionLabel(currentPromptVersion()), truncateRunes(systemPrompt(), 500)), true
+	}
+	if text, ok := parseCommand(arg, "设置"); ok {
+		v, err := publishPrompt(text, "", openID)
+		if err != nil {
+			return "❌ 发布失败：" + err.Error(), true
+		}
+		return fmt.Sprintf("✅ 已发布并启用提示词版本 #%d。", v.ID), true
+	}
+	if ver, ok := parseCommand(arg, "回滚"); ok {
+		var id int64
+		if ver != "" {
+			n, err := strconv.ParseInt(ver, 10, 64)
+			if err != nil || n <= 0 {
+				return "⚠️ 版本号应为正整数。", true
+			}
+			id = n
+		}
+		v, err := rollbackPrompt(id)
+		if err != nil {
+			return "❌ 回滚失败：" + err.Error(), true
+		}
+		return "✅ 已回滚到" + promptVersionLabel(v) + "。", true
+	}
+	return "⚠️ 用法：提示词 / 提示词 设置 内容 / 提示词 回滚 [版本号]", true
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 大模型服务，chat 与 embeddings 共用同一套密钥池、代理、重试与指标
+type Provider interface {
+	Name() string
+	Chat(ctx context.Context, req chatRequest) (*DeepSeekResponse, error)
+	Embed(ctx context.Context, model string, texts []string) ([][]float32, error)
+}
+
+type chatRequest struct {
+	Model    string
+	Messages []chatMessage
+	Params   generationParams
+}
+
+// 服务端返回的非 200 响应
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.Provider, e.StatusCode, truncateRunes(e.Body, 200))
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]Provider{}
+)
+
+// 按名称获取服务：deepseek 使用 deepseek 段的配置，其他名称读取 providers.<name>
+func getProvider(name string) (Provider, error) {
+	if name == "" {
+		name = "deepseek"
+	}
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if p, ok := providers[name]; ok {
+		return p, nil
+	}
+
+	var p *openAIProvider
+	var err error
+	if name == "deepseek" {
+		chatURL := viper.GetString("deepseek.api_url")
+		embeddingsURL := viper.GetString("deepseek.embeddings_url")
+		if embeddingsURL == "" {
+			embeddingsURL = strings.Replace(chatURL, "/chat/completions", "/embeddings", 1)
+		}
+		keys := viper.GetStringSlice("deepseek.api_keys")
+		if len(keys) == 0 {
+			keys = []string{viper.GetString("deepseek.api_key")}
+		}
+		p, err = newOpenAIProvider(name, chatURL, embeddingsURL, keys, viper.GetString("deepseek.proxy"),
+			viper.GetDuration("deepseek.timeout"), viper.GetInt("deepseek.max_retries"))
+	} else {
+		sub := viper.Sub("providers." + name)
+		if sub == nil {
+			return nil, fmt.Errorf("provider %q is not configured", name)
+		}
+		base := strings.TrimRight(sub.GetString("base_url"), "/")
+		timeout := viper.GetDuration("deepseek.timeout")
+		if sub.IsSet("timeout") {
+			timeout = sub.GetDuration("timeout")
+		}
+		retries := viper.GetInt("deepseek.max_retries")
+		if sub.IsSet("max_retries") {
+			retries = sub.GetInt("max_retries")
+		}
+		p, err = newOpenAIProvider(name, base+"/chat/completions", base+"/embeddings", sub.GetStringSlice("api_keys"),
+			sub.GetString("proxy"), timeout, retries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	providers[name] = p
+	return p, nil
+}
+
+// OpenAI 兼容接口（DeepSeek、OpenAI 及各类兼容服务）
+type openAIProvider struct {
+	name          string
+	chatURL       string
+	embeddingsURL string
+	keys          *keyPool
+	client        *http.Client
+	maxRetries    int
+}
+
+func newOpenAIProvider(name, chatURL, embeddingsURL string, keys []string, proxy string, timeout time.Duration, maxRetries int) (*openAIProvider, error) {
+	transport := sharedHTTPTransport()
+	if proxy != "" {
+		// 使用代理的服务需要单独的 Transport，连接池参数相同
+		transport = transport.Clone()
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: invalid proxy: %w", name, err)
+		}
+		// 支持 http、https 和 socks5 代理
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &openAIProvider{
+		name:          name,
+		chatURL:       chatURL,
+		embeddingsURL: embeddingsURL,
+		keys:          newKeyPool(keys),
+		client:        &http.Client{Timeout: timeout, Transport: transport},
+		maxRetries:    maxRetries,
+	}, nil
+}
+
+func (p *openAIProvider) Name() string { return p.name }
+
+func (p *openAIProvider) Chat(ctx context.Context, req chatRequest) (*DeepSeekResponse, error) {
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+		"stream":   false,
+	}
+	if req.Params.Temperature != nil {
+		payload["temperature"] = *req.Params.Temperature
+	}
+	if req.Params.TopP != nil {
+		payload["top_p"] = *req.Params.TopP
+	}
+	if req.Params.MaxTokens != nil {
+		payload["max_tokens"] = *req.Params.MaxTokens
+	}
+	if req.Params.JSONMode {
+		payload["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	// 请求与响应仅在 debug 模式下记录，避免生产日志中留存用户对话；其中的对话内容按 logging.content 处理
+	if gin.IsDebugging() {
+		payload["messages"] = redactMessages(req.Messages)
+		logged, _ := json.Marshal(payload)
+		logf(ctx, "🔵 %s 请求 JSON: %s", p.name, logged)
+	}
+	body, err := p.post(ctx, "chat", req.Model, p.chatURL, payloadBytes)
+	if err != nil {
+		return nil, err
+	}
+	fullContent := viper.GetString("logging.content") == "full"
+	if gin.IsDebugging() && fullContent {
+		logf(ctx, "🟢 %s API 响应: %s", p.name, body)
+	}
+
+	var resp DeepSeekResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	providerTokens.WithLabelValues(p.name, req.Model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	providerTokens.WithLabelValues(p.name, req.Model, "completion").Add(float64(resp.Usage.CompletionTokens))
+	if gin.IsDebugging() && !fullContent {
+		logged := resp
+		logged.Choices = nil
+		for _, choice := range resp.Choices {
+			choice.Message.Content = redactContent(choice.Message.Content)
+			logged.Choices = append(logged.Choices, choice)
+		}
+		loggedBytes, _ := json.Marshal(logged)
+		logf(ctx, "🟢 %s API 响应: %s", p.name, loggedBytes)
+	}
+	return &resp, nil
+}
+
+func (p *openAIProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	payload, _ := json.Marshal(map[string]interface{}{"model": model, "input": texts})
+	body, err := p.post(ctx, "embed", model, p.embeddingsURL, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d vectors for %d inputs", p.name, len(result.Data), len(texts))
+	}
+	sort.Slice(result.Data, func(i, j int) bool { return result.Data[i].Index < result.Data[j].Index })
+	vectors := make([][]float32, len(result.Data))
+	for i, d := range result.Data {
+		vectors[i] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// 发送请求：网络错误、429 和 5xx 按指数退避重试，401/403/429 的密钥暂时移出密钥池。
+// 429 时没有其他可用的密钥则按 Retry-After 暂停调用该服务（见 throttle.go），不再重试
+func (p *openAIProvider) post(ctx context.Context, op, model, endpoint string, payload []byte) ([]byte, error) {
+	if d := throttledFor(p.name); d > 0 {
+		return nil, &ThrottledError{Provider: p.name, RetryAfter: d}
+	}
+	start := time.Now()
+	defer func() { providerDuration.WithLabelValues(p.name, model, op).Observe(time.Since(start).Seconds()) }()
+
+	var lastErr error
+	for attempt := 0; attempt <= p.maxRetries; attempt++ {
+		if attempt > 0 {
+			providerRetries.WithLabelValues(p.name, model, op).Inc()
+			select {
+			case <-time.After(time.Duration(1<<(attempt-1)) * 500 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		key := p.keys.pick()
+		body, status, header, err := p.send(ctx, endpoint, key, payload)
+		if err != nil {
+			providerRequests.WithLabelValues(p.name, model, op, "network").Inc()
+			if isTimeout(err) {
+				providerTimeouts.WithLabelValues(p.name, model, op).Inc()
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		providerRequests.WithLabelValues(p.name, model, op, resultLabel(status)).Inc()
+		if status == http.StatusOK {
+			return body, nil
+		}
+
+		lastErr = &ProviderError{Provider: p.name, StatusCode: status, Body: string(body)}
+		switch {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			p.keys.cooldown(key, 10*time.Minute)
+		case status == http.StatusTooManyRequests:
+			pause := retryAfter(header)
+			p.keys.cooldown(key, pause)
+			if p.keys.exhausted() {
+				throttleProvider(ctx, p.name, pause)
+				return nil, &ThrottledError{Provider: p.name, RetryAfter: pause}
+			}
+		case status >= 500:
+		default:
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func (p *openAIProvider) send(ctx context.Context, endpoint, key string, payload []byte) ([]byte, int, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.StatusCode, resp.Header, err
+}
+
+// 客户端超时或请求的 context 到期
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func resultLabel(status int) string {
+	if status == http.StatusOK {
+		return "ok"
+	}
+	return strconv.Itoa(status)
+}
+
+// API 密钥池：轮询使用，出错的密钥在冷却期内跳过
+type keyPool struct {
+	mu    sync.Mutex
+	keys  []string
+	next  int
+	until map[string]time.Time
+}
+
+func newKeyPool(keys []string) *keyPool {
+	return &keyPool{keys: keys, until: map[string]time.Time{}}
+}
+
+// 取下一个可用的密钥，全部处于冷却期时仍按顺序返回
+func (k *keyPool) pick() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0 {
+		return ""
+	}
+	now := time.Now()
+	for i := 0; i < len(k.keys); i++ {
+		key := k.keys[(k.next+i)%len(k.keys)]
+		if now.After(k.until[key]) {
+			k.next = (k.next + i + 1) % len(k.keys)
+			return key
+		}
+	}
+	key := k.keys[k.next]
+	k.next = (k.next + 1) % len(k.keys)
+	return key
+}
+
+// 没有其他可用的密钥：只有一个密钥，或全部处于冷却期
+func (k *keyPool) exhausted() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) <= 1 {
+		return true
+	}
+	now := time.Now()
+	for _, key := range k.keys {
+		if now.After(k.until[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *keyPool) cooldown(key string, d time.Duration) {
+	if len(k.keys) <= 1 {
+		return
+	}
+	k.mu.Lock()
+	k.until[key] = time.Now().Add(d)
+	k.mu.Unlock()
+}
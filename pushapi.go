@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 推送接口：其他后端服务调用 POST /api/push 向指定用户发送文本、模板或图文消息，
+// 消息写入发件箱后按 outbox.strategy 投递并在失败时重试，使机器人成为公众号统一的通知出口。
+// 使用 push_api.tokens 中的令牌鉴权（Authorization: Bearer <token>），与管理令牌分开，便于按调用方分发和吊销
+
+var pushRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mpbot_push_api_requests_total",
+	Help: "Messages submitted through the push API by type and result (queued or rejected).",
+}, []string{"type", "result"})
+
+// 推送的消息类型
+const (
+	PushText     = "text"
+	PushTemplate = "template"
+	PushNews     = "news"
+)
+
+// 推送请求，openid 可以是化名
+type pushRequest struct {
+	OpenID     string            `json:"openid" binding:"required"`
+	Type       string            `json:"type"` // 留空为 text
+	Text       string            `json:"text"`
+	TemplateID string            `json:"template_id"`
+	Link       string            `json:"link"`
+	Data       map[string]string `json:"data"`
+	News       *NewsArticle      `json:"news"`
+}
+
+// 转为发件箱消息
+func (p pushRequest) outboxMessage() (OutboxMessage, error) {
+	switch p.Type {
+	case "", PushText:
+		if strings.TrimSpace(p.Text) == "" {
+			return OutboxMessage{}, errors.New("text is required")
+		}
+		return OutboxMessage{Text: p.Text}, nil
+	case PushTemplate:
+		if p.TemplateID == "" || len(p.Data) == 0 {
+			return OutboxMessage{}, errors.New("template_id and data are required")
+		}
+		return OutboxMessage{TemplateID: p.TemplateID, Link: p.Link, Data: p.Data}, nil
+	case PushNews:
+		if p.News == nil || p.News.Title == "" || p.News.URL == "" {
+			return OutboxMessage{}, errors.New("news.title and news.url are required")
+		}
+		return OutboxMessage{News: p.News}, nil
+	}
+	return OutboxMessage{}, errors.New("type must be text, template or news")
+}
+
+// 校验推送令牌
+func pushAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got := []byte(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		for _, token := range viper.GetStringSlice("push_api.tokens") {
+			if token != "" && subtle.ConstantTimeCompare(got, []byte(token)) == 1 {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+func registerPushAPI(r *gin.Engine) {
+	if !viper.GetBool("push_api.enabled") {
+		return
+	}
+	// 调用方不一定可信，错误信息中的凭据同样遮盖
+	loadSecretValues()
+	api := r.Group("/api", pushRateLimit(), pushAuth())
+
+	api.POST("/push", func(c *gin.Context) {
+		var req pushRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			pushRequests.WithLabelValues("invalid", "rejected").Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		m, err := req.outboxMessage()
+		if err != nil {
+			pushRequests.WithLabelValues("invalid", "rejected").Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		openID := resolveOpenID(req.OpenID)
+		if len(outboxChannels(openID, m)) == 0 {
+			pushRequests.WithLabelValues(m.kind(), "rejected").Inc()
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no delivery channel in outbox.strategy supports this message"})
+			return
+		}
+		id, err := enqueueOutbox(openID, m)
+		if err != nil {
+			log.Printf("❌ 推送消息写入发件箱失败 [%s]: %v", openID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pushRequests.WithLabelValues(m.kind(), "queued").Inc()
+		logf(c.Request.Context(), "📤 推送接口向 %s 发送 %s 消息 %s", pseudonym(openID), m.kind(), id)
+		c.JSON(http.StatusAccepted, gin.H{"id": id, "status": OutboxPending})
+	})
+
+	// 查询推送结果：pending、sent、cached 或 failed
+	api.GET("/push/:id", func(c *gin.Context) {
+		item, ok, err := getOutboxItem(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": item.ID, "status": item.Status, "channel": item.Message.Channel,
+			"attempts": item.Attempts, "last_error": redactSecrets(item.LastError), "updated_at": item.UpdatedAt})
+	})
+	log.Println("✅ 推送接口已启用: POST /api/push")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 排队中的问题
+type queuedQuestion struct {
+	ctx        context.Context
+	content    string
+	enqueuedAt time.Time
+	waiter     *answerWaiter
+}
+
+// 被动回复等待者：回答在等待期限内生成时直接随被动回复返回，否则写入缓存
+type answerWaiter struct {
+	mu        sync.Mutex
+	ch        chan string
+	abandoned bool
+}
+
+func newAnswerWaiter() *answerWaiter {
+	return &answerWaiter{ch: make(chan string, 1)}
+}
+
+// 把回答交给仍在等待的请求，等待者已放弃时返回 false
+func (w *answerWaiter) deliver(text string) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.abandoned {
+		return false
+	}
+	w.ch <- text
+	return true
+}
+
+// 在 timeout 内等待回答，超时后放弃（之后生成的回答会写入缓存）
+func (w *answerWaiter) wait(timeout time.Duration) (string, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case text := <-w.ch:
+		return text, true
+	case <-timer.C:
+	}
+
+	return w.abandon()
+}
+
+// 放弃等待，返回放弃前恰好送达的回答
+func (w *answerWaiter) abandon() (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.abandoned = true
+	select {
+	case text := <-w.ch:
+		return text, true
+	default:
+		return "", false
+	}
+}
+
+// 单个用户的问题队列，同一用户的问题按顺序逐个处理
+type userQueue struct {
+	pending []queuedQuestion
+	current *queuedQuestion // 已取出、正在等待或生成回答的问题
+	running bool
+}
+
+var (
+	queueMu    sync.Mutex
+	userQueues = map[string]*userQueue{}
+
+	llmSlotsOnce sync.Once
+	llmSlots     chan struct{} // 全局并发上限 deepseek.max_concurrency
+	memberSlots  chan struct{} // 会员专用的并发名额 membership.reserved_concurrency
+
+	localQueueDepth atomic.Int64 // 进程内队列中尚未开始处理的问题数
+)
+
+// 等待处理的问题数：外部队列为队列中的消息数，进程内队列为各用户队列中及等待并发名额的问题数
+func queueDepth(ctx context.Context) int64 {
+	if messageQueue != nil {
+		n, err := messageQueue.Depth(ctx)
+		if err != nil {
+			log.Printf("⚠️ 读取队列长度失败: %v", err)
+		}
+		return n
+	}
+	return localQueueDepth.Load()
+}
+
+// 队列过载保护：排队的问题超过 queue.max_depth 时直接回复 messages.queue_full，不再接收新问题（开启 membership.skip_queue 时会员除外）。
+// 位于提问扣费之前，被拒绝的问题不扣积分
+func backpressureMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if limit := viper.GetInt64("queue.max_depth"); limit > 0 && msg.MsgType == "text" && !skipsQueue(msg.FromUserName) {
+			if depth := queueDepth(ctx); depth >= limit {
+				queueRejected.Inc()
+				logf(ctx, "🚦 队列已有 %d 个问题，拒绝用户 %s 的新问题", depth, msg.FromUserName)
+				return userMessage(ctx, MessageQueueFull, msg.FromUserName, &messageVars{QueueDepth: depth}), true
+			}
+		}
+		return next(ctx, msg)
+	}
+}
+
+// 获取调用模型的并发名额，返回释放名额的函数。
+// 开启 membership.skip_queue 时会员另有 membership.reserved_concurrency 个专用名额，高峰时不必等待普通用户
+func acquireLLMSlot(user string) func() {
+	llmSlotsOnce.Do(func() {
+		llmSlots = make(chan struct{}, viper.GetInt("deepseek.max_concurrency"))
+		memberSlots = make(chan struct{}, viper.GetInt("membership.reserved_concurrency"))
+	})
+	if cap(memberSlots) > 0 && skipsQueue(user) {
+		select {
+		case llmSlots <- struct{}{}:
+		case memberSlots <- struct{}{}:
+			return func() { <-memberSlots }
+		}
+		return func() { <-llmSlots }
+	}
+	llmSlots <- struct{}{}
+	return func() { <-llmSlots }
+}
+
+// 会员在队列繁忙时优先
+func skipsQueue(user string) bool {
+	return viper.GetBool("membership.skip_queue") && isMember(user)
+}
+
+// 把问题加入用户队列，返回前面还有多少个问题（含正在处理的）。
+// waiter 不为空时，生成的回答优先交给 waiter
+func enqueueQuestion(ctx context.Context, user, content string, waiter *answerWaiter) int {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q := userQueues[user]
+	if q == nil {
+		q = &userQueue{}
+		userQueues[user] = q
+	}
+	ahead := len(q.pending)
+	if q.running {
+		ahead++
+	}
+	q.pending = append(q.pending, queuedQuestion{ctx: ctx, content: content, enqueuedAt: time.Now(), waiter: waiter})
+	localQueueDepth.Add(1)
+
+	if !q.running {
+		q.running = true
+		safeGo("processUserQueue", func() { processUserQueue(user) })
+	}
+	return ahead
+}
+
+// 移除用户排队中的问题（不含正在处理的），等待被动回复的请求直接放弃
+func dropQueuedQuestions(user string) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	q := userQueues[user]
+	if q == nil {
+		return
+	}
+	for _, next := range q.pending {
+		if next.waiter != nil {
+			next.waiter.abandon()
+		}
+	}
+	localQueueDepth.Add(-int64(len(q.pending)))
+	q.pending = nil
+}
+
+// 依次处理用户队列中的问题，队列清空后退出
+func processUserQueue(user string) {
+	defer func() {
+		// 处理过程中 panic 时丢弃该用户的队列，避免 running 状态卡死；排队中的问题回复失败提示
+		if r := recover(); r != nil {
+			queueMu.Lock()
+			var pending []queuedQuestion
+			if q := userQueues[user]; q != nil {
+				pending = q.pending
+				localQueueDepth.Add(-int64(len(pending)))
+			}
+			delete(userQueues, user)
+			queueMu.Unlock()
+			if len(pending) > 0 {
+				safeGo("abandonQueuedQuestions", func() {
+					err := fmt.Errorf("question queue of %s crashed: %v", user, r)
+					for _, next := range pending {
+						abandonQuestion(next.ctx, user, next.content, next.waiter, err)
+					}
+				})
+			}
+			panic(r)
+		}
+	}()
+
+	for {
+		queueMu.Lock()
+		q := userQueues[user]
+		if q == nil || len(q.pending) == 0 {
+			delete(userQueues, user)
+			queueMu.Unlock()
+			return
+		}
+		next := q.pending[0]
+		q.pending = q.pending[1:]
+		q.current = &next
+		queueMu.Unlock()
+
+		// 维护期间普通用户的问题留在队列中，维护结束后继续处理；
+		// 模型服务限流暂停期间等待恢复，不消耗重试次数。等待中被取消或超时则不再调用模型
+		var err error
+		if !isAdmin(user) {
+			err = waitMaintenance(next.ctx)
+		}
+		if err == nil {
+			err = waitThrottle(next.ctx, user, next.enqueuedAt)
+		}
+		if err == nil && canceledSince(next.ctx, user, next.enqueuedAt) {
+			err = context.Canceled
+		}
+		if err != nil {
+			localQueueDepth.Add(-1)
+			abandonQuestion(next.ctx, user, next.content, next.waiter, err)
+		} else {
+			release := acquireLLMSlot(user)
+			localQueueDepth.Add(-1)
+			func() {
+				defer release()
+				fetchDeepSeekResponse(next.ctx, user, next.content, next.waiter)
+			}()
+		}
+		queueMu.Lock()
+		q.current = nil
+		queueMu.Unlock()
+	}
+}
+
+// 尚未回答的问题，包括正在生成回答的问题，按用户和排队顺序排列
+func unansweredQuestions() []queuedJob {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	var jobs []queuedJob
+	for user, q := range userQueues {
+		questions := q.pending
+		if q.current != nil {
+			questions = append([]queuedQuestion{*q.current}, questions...)
+		}
+		for _, next := range questions {
+			job := newQueuedJob(next.ctx, user, next.content)
+			job.EnqueuedAt = next.enqueuedAt
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mpbot_rate_limited_total",
+	Help: "Webhook requests rejected by the rate limiter.",
+}, []string{"scope"})
+
+// 单个 IP 的令牌桶
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	ipLimitersMu sync.Mutex
+	ipLimiters   = map[string]*ipLimiter{}
+)
+
+// 回调接口限流：全局与单 IP 两级令牌桶，防止扫描器或异常客户端刷接口消耗 DeepSeek 额度。
+// 微信服务器的出口 IP 数量有限，单 IP 限额需按正常消息量的峰值预留
+func rateLimit() gin.HandlerFunc {
+	return newRateLimit("rate_limit", "", "回调请求")
+}
+
+// 推送接口使用独立的令牌桶（push_api.rate_limit），调用方突发的请求不会占用回调的额度
+func pushRateLimit() gin.HandlerFunc {
+	return newRateLimit("push_api.rate_limit", "push_", "推送接口请求")
+}
+
+// 按 prefix 下的配置创建限流器，scope 为指标 mpbot_rate_limited_total 的 scope 标签前缀
+func newRateLimit(prefix, scope, name string) gin.HandlerFunc {
+	if !viper.GetBool(prefix + ".enabled") {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	global := rate.NewLimiter(rate.Limit(viper.GetFloat64(prefix+".global_rps")), viper.GetInt(prefix+".global_burst"))
+	ipRate := rate.Limit(viper.GetFloat64(prefix + ".ip_rps"))
+	ipBurst := viper.GetInt(prefix + ".ip_burst")
+
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		ipLimitersMu.Lock()
+		l := ipLimiters[scope+ip]
+		if l == nil {
+			l = &ipLimiter{limiter: rate.NewLimiter(ipRate, ipBurst)}
+			ipLimiters[scope+ip] = l
+		}
+		l.lastSeen = time.Now()
+		ipAllowed := l.limiter.Allow()
+		ipLimitersMu.Unlock()
+
+		if !ipAllowed {
+			rateLimited.WithLabelValues(scope + "ip").Inc()
+			logf(c.Request.Context(), "🚦 IP %s 的%s过于频繁，已限流", ip, name)
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		if !global.Allow() {
+			rateLimited.WithLabelValues(scope + "global").Inc()
+			logf(c.Request.Context(), "🚦 %s总量超出限制，已限流", name)
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		c.Next()
+	}
+}
+
+// 清理长时间没有请求的 IP，由定时任务调用
+func cleanupIPLimiters() {
+	cutoff := time.Now().Add(-10 * time.Minute)
+	removed := 0
+
+	ipLimitersMu.Lock()
+	for ip, l := range ipLimiters {
+		if l.lastSeen.Before(cutoff) {
+			delete(ipLimiters, ip)
+			removed++
+		}
+	}
+	ipLimitersMu.Unlock()
+	if removed > 0 {
+		log.Printf("🧹 已清理 %d 个限流记录", removed)
+	}
+}
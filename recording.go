@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 录制的一条回调请求。签名参数在回放时重新生成，录制时直接遮盖
+type recordedRequest struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body"`
+}
+
+// 回放时重新生成的参数
+var signatureParams = []string{"signature", "msg_signature", "timestamp", "nonce"}
+
+var (
+	recordMu   sync.Mutex
+	recordFile *os.File
+	recordSize int64
+)
+
+// 开启 recording.enabled 时把原始回调请求追加写入 recording.path（JSON Lines），
+// 供 mpbot replay 回放，用于复现解析问题和流量高峰。位于限流、IP 白名单和签名校验之后，只记录通过校验的请求
+func recordRequests() gin.HandlerFunc {
+	// 配置中的凭据写入文件前同样遮盖
+	loadSecretValues()
+	return func(c *gin.Context) {
+		if !viper.GetBool("recording.enabled") {
+			c.Next()
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		recordCallback(c, body)
+		c.Next()
+	}
+}
+
+// 记录一条回调请求：遮盖签名参数和凭据，开启 privacy.hash_openids 时 OpenID 替换为化名
+func recordCallback(c *gin.Context, body []byte) {
+	if !viper.GetBool("recording.enabled") {
+		return
+	}
+	query := c.Request.URL.Query()
+	for _, p := range signatureParams {
+		if query.Has(p) {
+			query.Set(p, redactedMark)
+		}
+	}
+	r := recordedRequest{
+		Time:        time.Now(),
+		Method:      c.Request.Method,
+		Path:        c.Request.URL.Path,
+		Query:       redactSecrets(query.Encode()),
+		ContentType: c.ContentType(),
+		Body:        redactSecrets(string(body)),
+	}
+	if hashOpenIDs() {
+		r.Query, r.Body = pseudonymizeText(r.Query), pseudonymizeText(r.Body)
+	}
+	writeRecording(r)
+}
+
+func writeRecording(r recordedRequest) {
+	// 保留 XML 的尖括号，便于直接阅读录制文件
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		return
+	}
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	path := viper.GetString("recording.path")
+	// 超过 recording.max_bytes 时轮转：当前文件改名为 <path>.1（覆盖上一次轮转的文件），再写入新文件
+	if recordFile != nil && recordSize+int64(line.Len()) > viper.GetInt64("recording.max_bytes") {
+		recordFile.Close()
+		recordFile = nil
+		if err := os.Rename(path, path+".1"); err != nil {
+			log.Printf("❌ 轮转录制文件失败: %v", err)
+			return
+		}
+		log.Printf("📼 录制文件超过 %d 字节，已轮转为 %s.1", viper.GetInt64("recording.max_bytes"), path)
+	}
+	if recordFile == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Printf("❌ 创建录制目录失败: %v", err)
+			return
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Printf("❌ 打开录制文件失败: %v", err)
+			return
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			log.Printf("❌ 打开录制文件失败: %v", err)
+			return
+		}
+		recordFile, recordSize = f, info.Size()
+		log.Printf("📼 回调请求录制到 %s", path)
+	}
+	n, err := recordFile.Write(line.Bytes())
+	recordSize += int64(n)
+	if err != nil {
+		log.Printf("❌ 写入录制文件失败: %v", err)
+	}
+}
+
+// 回放录制的回调请求：按当前配置重新签名后发送到运行中的服务
+func runReplay(args []string) {
+	fs := newFlagSet("replay", "回放录制的回调请求")
+	file := fs.String("file", "", "录制文件，默认使用 recording.path")
+	target := fs.String("url", "", "服务地址，默认根据 server.listen 使用 http://127.0.0.1<端口>")
+	speed := fs.Float64("speed", 1, "回放速度倍数，按录制时的时间间隔并发发送；0 表示逐条依次发送")
+	freshIDs := fs.Bool("fresh-ids", true, "为明文消息生成新的 MsgId，避免被当作重复消息忽略")
+	limit := fs.Int("limit", 0, "最多回放的请求数，0 表示全部")
+	fs.Parse(args)
+
+	log.SetOutput(io.Discard)
+	initConfig()
+	if *file == "" {
+		*file = viper.GetString("recording.path")
+	}
+	if *target == "" {
+		*target = localServerURL()
+	}
+	records, err := readRecordings(*file, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ 读取录制文件失败: %v\n", err)
+		os.Exit(1)
+	}
+	if len(records) == 0 {
+		fmt.Println("录制文件中没有请求")
+		return
+	}
+	fmt.Printf("▶️ 回放 %d 个请求到 %s\n", len(records), *target)
+
+	var (
+		wg       sync.WaitGroup
+		failures atomic.Int64
+		total    atomic.Int64 // 累计耗时（毫秒）
+		start    = time.Now()
+	)
+	send := func(i int, r recordedRequest) {
+		status, elapsed, err := replayRequest(*target, r, *freshIDs)
+		total.Add(elapsed.Milliseconds())
+		if err != nil || status != http.StatusOK {
+			failures.Add(1)
+		}
+		if err != nil {
+			fmt.Printf("#%d %s %s ❌ %v\n", i+1, r.Method, r.Path, err)
+			return
+		}
+		fmt.Printf("#%d %s %s HTTP %d %s\n", i+1, r.Method, r.Path, status, elapsed.Round(time.Millisecond))
+	}
+	for i, r := range records {
+		if *speed <= 0 {
+			send(i, r)
+			continue
+		}
+		offset := time.Duration(float64(r.Time.Sub(records[0].Time)) / *speed)
+		time.Sleep(time.Until(start.Add(offset)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(i, r)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("\n共 %d 个请求，失败 %d 个，平均耗时 %d ms，总用时 %s\n", len(records), failures.Load(),
+		total.Load()/int64(len(records)), time.Since(start).Round(time.Millisecond))
+	if failures.Load() > 0 {
+		os.Exit(1)
+	}
+}
+
+func readRecordings(path string, limit int) ([]recordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []recordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r recordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, r)
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+	}
+	return records, scanner.Err()
+}
+
+var msgIDPattern = regexp.MustCompile(`<MsgId>\d+</MsgId>`)
+
+// 用当前时间戳和新的 nonce 重新签名：/wecom 使用 wecom.token 计算 msg_signature，
+// /wx 使用 wechat.token 计算 signature，安全模式下另算 msg_signature
+func replayRequest(base string, r recordedRequest, freshIDs bool) (int, time.Duration, error) {
+	query, err := url.ParseQuery(r.Query)
+	if err != nil {
+		return 0, 0, err
+	}
+	body := r.Body
+	if freshIDs {
+		body = msgIDPattern.ReplaceAllStringFunc(body, func(string) string {
+			return "<MsgId>" + strconv.FormatInt(time.Now().UnixNano(), 10) + "</MsgId>"
+		})
+	}
+
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), newID()
+	var envelope struct {
+		Encrypt string `xml:"Encrypt"`
+	}
+	xml.Unmarshal([]byte(body), &envelope)
+	token := viper.GetString("wechat.token")
+	if r.Path == "/wecom" {
+		token = viper.GetString("wecom.token")
+	} else {
+		query.Set("signature", wechatSignature(token, timestamp, nonce))
+	}
+	if envelope.Encrypt != "" {
+		query.Set("msg_signature", wechatSignature(token, timestamp, nonce, envelope.Encrypt))
+	}
+	query.Set("timestamp", timestamp)
+	query.Set("nonce", nonce)
+
+	req, err := http.NewRequest(r.Method, base+r.Path+"?"+query.Encode(), bytes.NewReader([]byte(body)))
+	if err != nil {
+		return 0, 0, err
+	}
+	if r.ContentType != "" {
+		req.Header.Set("Content-Type", r.ContentType)
+	}
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 日志中的凭据：Authorization 头、URL 参数中的 access_token/secret 等，以及形如 sk-xxx 的 API Key
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`(?i)((?:access_token|secret|corpsecret|api_key|apikey|key|password)=)[^&\s"']+`),
+	regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`),
+}
+
+// 配置中的凭据，原样出现在日志中时同样遮盖
+var secretConfigKeys = []string{
+	"wechat.token", "wechat.app_secret", "wechat.encoding_aes_key", "wecom.secret", "wecom.token", "wecom.encoding_aes_key",
+	"deepseek.api_key", "deepseek.api_keys", "asr.api_key", "tts.api_key", "ocr.api_key", "vector_store.qdrant.api_key",
+	"state.redis.password", "admin.token", "push_api.tokens", "error_reporting.sentry_dsn", "pay.api_v3_key", "privacy.salt",
+}
+
+var (
+	secretsMu     sync.RWMutex
+	secretsValues []string
+)
+
+const redactedMark = "***"
+
+// 收集配置中的凭据，按长度从长到短排列，避免较短的值先替换掉较长值的一部分
+func loadSecretValues() {
+	var values []string
+	add := func(v string) {
+		// 过短的值容易误伤普通文本
+		if len(v) >= 6 {
+			values = append(values, v)
+		}
+	}
+	for _, key := range secretConfigKeys {
+		for _, v := range viper.GetStringSlice(key) {
+			add(v)
+		}
+	}
+	for name := range viper.GetStringMap("providers") {
+		add(viper.GetString("providers." + name + ".api_key"))
+		for _, v := range viper.GetStringSlice("providers." + name + ".api_keys") {
+			add(v)
+		}
+	}
+	for name := range viper.GetStringMap("speech_providers") {
+		add(viper.GetString("speech_providers." + name + ".api_key"))
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	secretsMu.Lock()
+	secretsValues = values
+	secretsMu.Unlock()
+}
+
+func redactSecrets(s string) string {
+	secretsMu.RLock()
+	for _, v := range secretsValues {
+		s = strings.ReplaceAll(s, v, redactedMark)
+	}
+	secretsMu.RUnlock()
+	for _, re := range secretPatterns {
+		if re.NumSubexp() > 0 {
+			s = re.ReplaceAllString(s, "${1}"+redactedMark)
+		} else {
+			s = re.ReplaceAllString(s, redactedMark)
+		}
+	}
+	return s
+}
+
+// 写入前遮盖凭据、替换 OpenID 的日志输出
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	s := string(p)
+	if viper.GetBool("logging.redact_secrets") {
+		s = redactSecrets(s)
+	}
+	if hashOpenIDs() {
+		s = pseudonymizeText(s)
+	}
+	if _, err := io.WriteString(r.w, s); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 开启 logging.redact_secrets 或 privacy.hash_openids 时，标准日志和访问日志输出前遮盖凭据、替换 OpenID。需在 newEngine 之前调用
+func initLogRedaction() {
+	if !viper.GetBool("logging.redact_secrets") && !hashOpenIDs() {
+		return
+	}
+	loadSecretValues()
+	log.SetOutput(redactingWriter{os.Stderr})
+	gin.DefaultWriter = redactingWriter{os.Stdout}
+	gin.DefaultErrorWriter = redactingWriter{os.Stderr}
+}
+
+// 按 logging.content 处理写入日志的用户内容（问题、回答、提示词）：
+// full 原样记录，truncate 只保留前 logging.content_max_length 个字符，hash 只记录长度和 SHA-256 前缀
+func redactContent(s string) string {
+	switch viper.GetString("logging.content") {
+	case "truncate":
+		return truncateRunes(s, viper.GetInt("logging.content_max_length"))
+	case "hash":
+		sum := sha256.Sum256([]byte(s))
+		return fmt.Sprintf("[%d 字符 sha256:%s]", len([]rune(s)), hex.EncodeToString(sum[:6]))
+	}
+	return s
+}
+
+// 对话消息写入日志前逐条处理内容
+func redactMessages(messages []chatMessage) []chatMessage {
+	if viper.GetString("logging.content") == "full" {
+		return messages
+	}
+	out := make([]chatMessage, len(messages))
+	for i, m := range messages {
+		out[i] = chatMessage{Role: m.Role, Content: redactContent(m.Content)}
+	}
+	return out
+}
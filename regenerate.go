@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// 重新回答：用户收到回答后发送“重新回答”，把上一个问题重新交给模型。
+// “重新回答 高温”在当前温度上提高 regenerate.temperature_boost，“重新回答 1.5”指定温度。
+// 重新回答时从对话历史中去掉上一轮问答，避免模型看到自己的旧回答；与普通提问一样扣费、排队
+type regeneration struct {
+	Temperature *float64 `json:"temperature,omitempty"` // 为空时使用用户的生成参数
+}
+
+type regenerationKey struct{}
+
+func lastQuestionKey(user string) string { return "last_question:" + user }
+
+func withRegeneration(ctx context.Context, r regeneration) context.Context {
+	return context.WithValue(ctx, regenerationKey{}, r)
+}
+
+func regenerationFrom(ctx context.Context) (regeneration, bool) {
+	r, ok := ctx.Value(regenerationKey{}).(regeneration)
+	return r, ok
+}
+
+// 记录用户最近一个已回答的问题，保留 regenerate.ttl
+func rememberQuestion(ctx context.Context, user, question string) {
+	if !viper.GetBool("regenerate.enabled") {
+		return
+	}
+	// 单次翻译记为“翻译 原文”，重新回答时仍然翻译
+	if t, ok := translationFrom(ctx); ok && t.OneShot {
+		question = "翻译 " + question
+	}
+	if err := state.Set(ctx, lastQuestionKey(user), []byte(question), viper.GetDuration("regenerate.ttl")); err != nil {
+		logf(ctx, "⚠️ 记录上一个问题失败: %v", err)
+	}
+}
+
+// 重新回答使用的温度，arg 为空时不调整
+func regenerationTemperature(user, arg string) (*float64, bool) {
+	switch arg {
+	case "":
+		return nil, true
+	case "高温":
+		t := 1.0 // 未设置温度时 DeepSeek 的默认值
+		if p := userGenerationParams(user).Temperature; p != nil {
+			t = *p
+		}
+		t = min(t+viper.GetFloat64("regenerate.temperature_boost"), 2)
+		return &t, true
+	}
+	t, err := strconv.ParseFloat(arg, 64)
+	if err != nil || t < 0 || t > 2 {
+		return nil, false
+	}
+	return &t, true
+}
+
+// 拦截“重新回答”，把消息改写为上一个问题后交给后续的扣费、排队和模型调用
+func regenerateMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" || !viper.GetBool("regenerate.enabled") {
+			return next(ctx, msg)
+		}
+		arg, ok := parseCommand(msg.Content, "重新回答")
+		if !ok {
+			return next(ctx, msg)
+		}
+		user := msg.FromUserName
+		temperature, ok := regenerationTemperature(user, arg)
+		if !ok {
+			return "⚠️ 用法：重新回答 [高温 | 0~2 的温度]", true
+		}
+		if queued, _ := state.Len(ctx, queuedProgressKey(user)); queued > 0 {
+			return "⏳ 上一个问题还在处理中，请稍后再试。", true
+		}
+		if p, ok := loadProgress(ctx, user); ok && p.Status == ProgressGenerating {
+			return "⏳ 上一个问题还在处理中，请稍后再试。", true
+		}
+		question, err := state.Get(ctx, lastQuestionKey(user))
+		if err != nil {
+			if !errors.Is(err, errStateNotFound) {
+				logf(ctx, "⚠️ 读取上一个问题失败: %v", err)
+			}
+			return "💤 没有可以重新回答的问题，请先提问。", true
+		}
+
+		// 上一个回答尚未看完的部分不再需要
+		if err := state.Delete(ctx, answersKey(user)); err != nil {
+			logf(ctx, "⚠️ 清除缓存的回答失败: %v", err)
+		}
+		logf(ctx, "🔁 用户 %s 要求重新回答：%s", user, truncateRunes(string(question), 50))
+		msg.Content = string(question)
+		return next(withRegeneration(ctx, regeneration{Temperature: temperature}), msg)
+	}
+}
+
+// 重新回答时去掉对话历史中上一轮同一问题的问答
+func dropRegeneratedTurn(c conversation, question string) conversation {
+	n := len(c.Turns)
+	if n >= 2 && c.Turns[n-2].Role == "user" && c.Turns[n-2].Content == question && c.Turns[n-1].Role == "assistant" {
+		c.Turns = c.Turns[:n-2]
+	}
+	return c
+}
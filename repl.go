@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 在终端中与机器人对话：消息走与微信回调相同的处理流程（规则、历史、模型、后处理），
+// 用于离线调试提示词。输入 /user <openid> 切换模拟的用户，/quit 退出
+func runChatREPL(args []string) {
+	fs := newFlagSet("chat", "在终端中与机器人对话")
+	user := fs.String("user", "", "模拟的用户 OpenID，默认使用 debug_chat.openid")
+	verbose := fs.Bool("v", false, "输出运行日志")
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	initServices()
+	if *user == "" {
+		*user = viper.GetString("debug_chat.openid")
+	}
+	// 终端中不受微信 5 秒被动回复的限制，等待完整的回答
+	viper.Set("deepseek.reply_wait", viper.GetDuration("deepseek.timeout"))
+	// 终端中没有队列 worker，问题始终在本进程内处理
+	messageQueue = nil
+
+	fmt.Printf("💬 mpbot chat（用户 %s），输入 /quit 退出，/user <openid> 切换用户\n", *user)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == "/quit" || line == "/exit":
+			return
+		case strings.HasPrefix(line, "/user "):
+			*user = strings.TrimSpace(strings.TrimPrefix(line, "/user "))
+			fmt.Printf("👤 已切换到用户 %s\n", *user)
+			continue
+		}
+
+		msg := WeChatMessage{
+			ToUserName:   "cli",
+			FromUserName: *user,
+			CreateTime:   time.Now().Unix(),
+			MsgType:      "text",
+			Content:      line,
+		}
+		start := time.Now()
+		ctx := withRequestID(context.Background(), "cli-"+newID())
+		if reply, ok := processMessage(ctx, msg); ok {
+			fmt.Printf("%s\n（%s）\n", reply, time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
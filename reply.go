@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 被动回复消息，通过 encoding/xml 生成。字符串字段以 CDATA 输出，内容含 "]]>" 时会被正确拆分
+type replyMessage struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   cdata    `xml:"ToUserName"`
+	FromUserName cdata    `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      cdata    `xml:"MsgType"`
+
+	Content      *cdata         `xml:"Content,omitempty"`
+	Image        *replyMedia    `xml:"Image,omitempty"`
+	Voice        *replyMedia    `xml:"Voice,omitempty"`
+	Music        *replyMusic    `xml:"Music,omitempty"`
+	ArticleCount int            `xml:"ArticleCount,omitempty"`
+	Articles     *replyArticles `xml:"Articles,omitempty"`
+}
+
+type cdata struct {
+	Value string `xml:",cdata"`
+}
+
+type replyMedia struct {
+	MediaID cdata `xml:"MediaId"`
+}
+
+type replyMusic struct {
+	Title        cdata `xml:"Title"`
+	Description  cdata `xml:"Description"`
+	MusicURL     cdata `xml:"MusicUrl"`
+	HQMusicURL   cdata `xml:"HQMusicUrl"`
+	ThumbMediaID cdata `xml:"ThumbMediaId"`
+}
+
+// 音乐消息
+type MusicCard struct {
+	Title        string `mapstructure:"title" json:"title"`
+	Description  string `mapstructure:"description" json:"description"`
+	MusicURL     string `mapstructure:"music_url" json:"music_url"`
+	HQMusicURL   string `mapstructure:"hq_music_url" json:"hq_music_url"` // 高质量音乐链接，Wi-Fi 环境优先使用，留空时使用 music_url
+	ThumbMediaID string `mapstructure:"thumb_media_id" json:"thumb_media_id"`
+}
+
+// 图文消息中的一篇文章
+type NewsArticle struct {
+	Title       string `mapstructure:"title" json:"title"`
+	Description string `mapstructure:"description" json:"description"`
+	PicURL      string `mapstructure:"pic_url" json:"pic_url"`
+	URL         string `mapstructure:"url" json:"url"`
+}
+
+type replyArticles struct {
+	Items []replyArticle `xml:"item"`
+}
+
+type replyArticle struct {
+	Title       cdata `xml:"Title"`
+	Description cdata `xml:"Description"`
+	PicURL      cdata `xml:"PicUrl"`
+	URL         cdata `xml:"Url"`
+}
+
+// 回复给消息的发送者，企业微信用户去掉 ID 前缀
+func newReply(msg WeChatMessage, msgType string) replyMessage {
+	return replyMessage{
+		ToUserName:   cdata{strings.TrimPrefix(msg.FromUserName, wecomUserPrefix)},
+		FromUserName: cdata{msg.ToUserName},
+		CreateTime:   time.Now().Unix(),
+		MsgType:      cdata{msgType},
+	}
+}
+
+func textReply(msg WeChatMessage, content string) replyMessage {
+	r := newReply(msg, "text")
+	r.Content = &cdata{content}
+	return r
+}
+
+// 把消息转给公众号的人工客服
+func transferReply(msg WeChatMessage) replyMessage {
+	return newReply(msg, "transfer_customer_service")
+}
+
+func imageReply(msg WeChatMessage, mediaID string) replyMessage {
+	r := newReply(msg, "image")
+	r.Image = &replyMedia{cdata{mediaID}}
+	return r
+}
+
+func voiceReply(msg WeChatMessage, mediaID string) replyMessage {
+	r := newReply(msg, "voice")
+	r.Voice = &replyMedia{cdata{mediaID}}
+	return r
+}
+
+func musicReply(msg WeChatMessage, m MusicCard) replyMessage {
+	hq := m.HQMusicURL
+	if hq == "" {
+		hq = m.MusicURL
+	}
+	r := newReply(msg, "music")
+	r.Music = &replyMusic{
+		Title: cdata{m.Title}, Description: cdata{m.Description},
+		MusicURL: cdata{m.MusicURL}, HQMusicURL: cdata{hq}, ThumbMediaID: cdata{m.ThumbMediaID},
+	}
+	return r
+}
+
+// 图文消息，微信限制最多 8 篇
+func newsReply(msg WeChatMessage, articles []NewsArticle) replyMessage {
+	if len(articles) > 8 {
+		articles = articles[:8]
+	}
+	r := newReply(msg, "news")
+	r.ArticleCount = len(articles)
+	r.Articles = &replyArticles{}
+	for _, a := range articles {
+		r.Articles.Items = append(r.Articles.Items, replyArticle{
+			Title: cdata{a.Title}, Description: cdata{a.Description}, PicURL: cdata{a.PicURL}, URL: cdata{a.URL},
+		})
+	}
+	return r
+}
+
+// 写入被动回复，回调为加密模式时加密后回复
+func writeXMLReply(c *gin.Context, reply replyMessage) {
+	data, err := xml.Marshal(reply)
+	if err != nil {
+		logf(c.Request.Context(), "❌ 生成回复失败: %v", err)
+		c.String(http.StatusOK, "success")
+		return
+	}
+	if v, ok := c.Get(replyCrypterKey); ok {
+		if data, err = v.(*msgCrypter).encryptReply(data); err != nil {
+			logf(c.Request.Context(), "❌ 加密回复失败: %v", err)
+			c.String(http.StatusOK, "success")
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/xml", data)
+}
+
+// 非文本的被动回复。processMessage 只返回文本，需要回复其他类型的处理函数通过请求的 context 登记回复，
+// 返回的文本用于调试聊天、命令行以及微信重试时的回复
+type richReplyKey struct{}
+
+type richReplyHolder struct {
+	build func(WeChatMessage) replyMessage
+}
+
+func withRichReply(ctx context.Context) context.Context {
+	return context.WithValue(ctx, richReplyKey{}, &richReplyHolder{})
+}
+
+func setRichReply(ctx context.Context, build func(WeChatMessage) replyMessage) {
+	if h, ok := ctx.Value(richReplyKey{}).(*richReplyHolder); ok {
+		h.build = build
+	}
+}
+
+func richReply(ctx context.Context, msg WeChatMessage) (replyMessage, bool) {
+	h, ok := ctx.Value(richReplyKey{}).(*richReplyHolder)
+	if !ok || h.build == nil {
+		return replyMessage{}, false
+	}
+	return h.build(msg), true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// 某个模型一天的用量
+type modelDailyUsage struct {
+	Model            string
+	Calls            int
+	Failures         int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func modelUsageOn(day string) ([]modelDailyUsage, error) {
+	rows, err := db.Query(`SELECT model, calls, failures, prompt_tokens, completion_tokens
+		FROM model_usage WHERE day = ? ORDER BY calls DESC`, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []modelDailyUsage
+	for rows.Next() {
+		var m modelDailyUsage
+		if err := rows.Scan(&m.Model, &m.Calls, &m.Failures, &m.PromptTokens, &m.CompletionTokens); err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// 按 pricing.<model> 中每百万 token 的单价估算费用（元），未配置单价的模型返回 false
+func modelCost(model string, promptTokens, completionTokens int) (float64, bool) {
+	price, ok := viper.GetStringMap("pricing")[model]
+	if !ok {
+		return 0, false
+	}
+	p := cast.ToStringMap(price)
+	return (float64(promptTokens)*cast.ToFloat64(p["prompt"]) +
+		float64(completionTokens)*cast.ToFloat64(p["completion"])) / 1e6, true
+}
+
+// 生成 day 的使用报告：用量、各模型费用和用户反馈
+func buildUsageReport(day time.Time) (string, error) {
+	date := day.Format("2006-01-02")
+	u, err := dailyUsage(date)
+	if err != nil {
+		return "", err
+	}
+	models, err := modelUsageOn(date)
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	var answers, upvotes, downvotes int
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(CASE WHEN feedback > 0 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN feedback < 0 THEN 1 ELSE 0 END), 0)
+		FROM qa_records WHERE created_at >= ? AND created_at < ?`,
+		start.Unix(), start.AddDate(0, 0, 1).Unix()).Scan(&answers, &upvotes, &downvotes)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(u.String())
+
+	if len(models) > 0 {
+		b.WriteString("\n\n💰 模型用量")
+		total, priced := 0.0, false
+		for _, m := range models {
+			fmt.Fprintf(&b, "\n%s：%d 次，%d token", m.Model, m.Calls, m.PromptTokens+m.CompletionTokens)
+			if cost, ok := modelCost(m.Model, m.PromptTokens, m.CompletionTokens); ok {
+				fmt.Fprintf(&b, "，约 ¥%.2f", cost)
+				total += cost
+				priced = true
+			}
+		}
+		if priced {
+			fmt.Fprintf(&b, "\n合计约 ¥%.2f", total)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n\n💬 用户反馈\n回答 %d 条，👍 %d，👎 %d", answers, upvotes, downvotes)
+	if rated := upvotes + downvotes; rated > 0 {
+		fmt.Fprintf(&b, "，好评率 %.0f%%", float64(upvotes)*100/float64(rated))
+	}
+	return b.String(), nil
+}
+
+// 推送前一天的使用报告给 report.openids（为空时使用 admin.openids），并发送到 report.webhook_url
+func runUsageReport() {
+	text, err := buildUsageReport(time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		log.Printf("❌ 生成使用报告失败: %v", err)
+		return
+	}
+
+	recipients := viper.GetStringSlice("report.openids")
+	if len(recipients) == 0 {
+		recipients = viper.GetStringSlice("admin.openids")
+	}
+	for _, openID := range recipients {
+		queueKefuText(openID, text)
+	}
+	if webhook := viper.GetString("report.webhook_url"); webhook != "" {
+		if err := postWebhook(webhook, text); err != nil {
+			log.Printf("❌ 使用报告 webhook 推送失败: %v", err)
+		}
+	}
+	log.Printf("📊 使用报告已推送给 %d 位管理员", len(recipients))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+type requestIDKey struct{}
+
+// 上游传入的请求ID会写入每行日志并原样返回，只接受不含换行等特殊字符的短ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// 为每个请求生成请求ID（优先沿用上游传入的合法 X-Request-ID），写入 context 和响应头
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		c.Header("X-Request-ID", id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// 带请求ID前缀的日志，便于 grep 同一条消息的全部日志
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		format = fmt.Sprintf("[%s] %s", id, format)
+	}
+	log.Printf(format, args...)
+}
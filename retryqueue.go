@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 模型重试多次仍失败时，问题写入持久化的重试队列，后台协程按退避重新提问，
+// 服务恢复后经发件箱把回答推送给用户（推送失败则缓存，用户输入“继续”查看）
+
+// 重试队列中的一个问题
+type retryItem struct {
+	ID            string
+	OpenID        string
+	Query         string
+	Attempts      int
+	NextAttemptAt int64
+	CreatedAt     int64
+}
+
+// 把失败的问题写入重试队列
+func enqueueRetry(openID, query string, cause error) error {
+	now := time.Now()
+	_, err := db.Exec(`INSERT INTO llm_retries (id, openid, query, attempts, next_attempt_at, last_error, created_at)
+		VALUES (?, ?, ?, 0, ?, ?, ?)`, newID(), openID, query,
+		now.Add(retryBackoff(0)).Unix(), cause.Error(), now.Unix())
+	return err
+}
+
+// 1m、2m、4m…，最长 30 分钟
+func retryBackoff(attempts int) time.Duration {
+	backoff := time.Minute << uint(attempts)
+	if backoff > 30*time.Minute || backoff <= 0 {
+		backoff = 30 * time.Minute
+	}
+	return backoff
+}
+
+// 后台重试协程：每隔 retry_queue.poll_interval 重试到期的问题
+func startRetryQueue() {
+	if !viper.GetBool("retry_queue.enabled") {
+		return
+	}
+	safeGo("retryQueue", func() {
+		ticker := time.NewTicker(viper.GetDuration("retry_queue.poll_interval"))
+		defer ticker.Stop()
+		for range ticker.C {
+			retryDueQuestions()
+		}
+	})
+}
+
+func retryDueQuestions() {
+	// 维护或限流暂停期间不重试，问题保留在队列中
+	if maintenanceEnabled() || throttledFor("deepseek") > 0 {
+		return
+	}
+	items, err := dueRetryItems(20)
+	if err != nil {
+		log.Printf("❌ 读取重试队列失败: %v", err)
+		return
+	}
+	for _, item := range items {
+		if !claimRetryItem(item) {
+			continue
+		}
+		// 服务仍未恢复时本轮不再重试其余问题，等待下一次到期
+		if !retryQuestion(item) {
+			return
+		}
+	}
+}
+
+func dueRetryItems(limit int) ([]retryItem, error) {
+	rows, err := db.Query(`SELECT id, openid, query, attempts, next_attempt_at, created_at
+		FROM llm_retries WHERE next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?`, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []retryItem
+	for rows.Next() {
+		var it retryItem
+		if err := rows.Scan(&it.ID, &it.OpenID, &it.Query, &it.Attempts, &it.NextAttemptAt, &it.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// 领取问题：把下次重试时间推后一个租期，多实例共享数据库时避免重复提问
+func claimRetryItem(item retryItem) bool {
+	lease := time.Now().Add(viper.GetDuration("deepseek.timeout") + time.Minute).Unix()
+	res, err := db.Exec(`UPDATE llm_retries SET next_attempt_at = ? WHERE id = ? AND next_attempt_at = ?`,
+		lease, item.ID, item.NextAttemptAt)
+	if err != nil {
+		log.Printf("❌ 领取重试问题 %s 失败: %v", item.ID, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// 重新提问，成功时推送回答并移出队列；返回 false 表示仍然失败
+func retryQuestion(item retryItem) bool {
+	ctx := withRequestID(context.Background(), "retry-"+item.ID)
+	answer, err := askWithHistory(ctx, item.OpenID, item.Query)
+	if err == nil {
+		logf(ctx, "🔁 重试问题 %s 成功（第 %d 次），推送给用户 %s", item.ID, item.Attempts+1, item.OpenID)
+		for _, part := range postProcessAnswer(ctx, item.OpenID, runAfterLLMHooks(ctx, item.OpenID, item.Query, answer)) {
+			queueOutbox(item.OpenID, OutboxMessage{Text: part, CacheOnFailure: true})
+		}
+		deleteRetryItem(item.ID)
+		return true
+	}
+
+	attempts := item.Attempts + 1
+	expired := time.Since(time.Unix(item.CreatedAt, 0)) > viper.GetDuration("retry_queue.max_age")
+	if attempts >= viper.GetInt("retry_queue.max_attempts") || expired {
+		logf(ctx, "❌ 重试问题 %s 失败 %d 次，不再重试 [%s]: %v", item.ID, attempts, item.OpenID, err)
+		queueOutbox(item.OpenID, OutboxMessage{Text: "❌ 抱歉，DeepSeek 仍无法回答你的问题，请稍后重新提问。", CacheOnFailure: true})
+		deleteRetryItem(item.ID)
+		return false
+	}
+	backoff := retryBackoff(attempts)
+	logf(ctx, "⚠️ 重试问题 %s 失败（第 %d 次），%s 后重试: %v", item.ID, attempts, backoff, err)
+	_, dbErr := db.Exec(`UPDATE llm_retries SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?`,
+		attempts, time.Now().Add(backoff).Unix(), err.Error(), item.ID)
+	if dbErr != nil {
+		log.Printf("❌ 更新重试问题 %s 失败: %v", item.ID, dbErr)
+	}
+	return false
+}
+
+func deleteRetryItem(id string) {
+	if _, err := db.Exec(`DELETE FROM llm_retries WHERE id = ?`, id); err != nil {
+		log.Printf("❌ 删除重试问题 %s 失败: %v", id, err)
+	}
+}
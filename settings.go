@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 用户的个性化设置，以 JSON 存于 user_settings 表
+type UserSettings struct {
+	Model      string           `json:"model,omitempty"`     // 为空时使用 deepseek.model
+	Generation generationParams `json:"generation"`          // 未设置的参数使用 deepseek.temperature 等全局默认值
+	Translate  bool             `json:"translate,omitempty"` // 是否处于翻译模式
+	Persona    string           `json:"persona,omitempty"`   // 扫码场景启用的人设，对应 personas 中的名称
+}
+
+// 生成参数，nil 表示不传给 DeepSeek（使用服务端默认值）
+type generationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// 要求模型输出 JSON 对象（response_format: json_object），仅供内部调用使用，不属于用户设置
+	JSONMode bool `json:"-"`
+}
+
+// config.yaml 中的全局默认生成参数
+func defaultGenerationParams() generationParams {
+	var p generationParams
+	if viper.IsSet("deepseek.temperature") {
+		v := viper.GetFloat64("deepseek.temperature")
+		p.Temperature = &v
+	}
+	if viper.IsSet("deepseek.top_p") {
+		v := viper.GetFloat64("deepseek.top_p")
+		p.TopP = &v
+	}
+	if v := viper.GetInt("deepseek.max_tokens"); v > 0 {
+		p.MaxTokens = &v
+	}
+	return p
+}
+
+// 合并全局默认值与用户的个人设置
+func userGenerationParams(openID string) generationParams {
+	p := defaultGenerationParams()
+	g := getUserSettings(openID).Generation
+	if g.Temperature != nil {
+		p.Temperature = g.Temperature
+	}
+	if g.TopP != nil {
+		p.TopP = g.TopP
+	}
+	if g.MaxTokens != nil {
+		p.MaxTokens = g.MaxTokens
+	}
+	return p
+}
+
+// 校验生成参数的取值范围
+func (p generationParams) validate() error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return fmt.Errorf("top_p must be in (0, 1]")
+	}
+	if p.MaxTokens != nil && (*p.MaxTokens < 1 || *p.MaxTokens > viper.GetInt("generation.max_tokens_limit")) {
+		return fmt.Errorf("max_tokens must be between 1 and %d", viper.GetInt("generation.max_tokens_limit"))
+	}
+	return nil
+}
+
+func (p generationParams) String() string {
+	temperature, topP, maxTokens := "默认", "默认", "默认"
+	if p.Temperature != nil {
+		temperature = strconv.FormatFloat(*p.Temperature, 'f', -1, 64)
+	}
+	if p.TopP != nil {
+		topP = strconv.FormatFloat(*p.TopP, 'f', -1, 64)
+	}
+	if p.MaxTokens != nil {
+		maxTokens = strconv.Itoa(*p.MaxTokens)
+	}
+	return fmt.Sprintf("温度：%s\ntop_p：%s\n最大长度：%s", temperature, topP, maxTokens)
+}
+
+func getUserSettings(openID string) UserSettings {
+	ctx := context.Background()
+	var s UserSettings
+	if getCached(ctx, "settings:"+openID, &s) {
+		return s
+	}
+
+	var data string
+	err := db.QueryRow(`SELECT data FROM user_settings WHERE openid = ?`, openID).Scan(&data)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("⚠️ 查询用户设置失败 [%s]: %v", openID, err)
+		return s
+	}
+	if err == nil {
+		_ = json.Unmarshal([]byte(data), &s)
+	}
+	fillCache(ctx, "settings:"+openID, s)
+	return s
+}
+
+func saveUserSettings(openID string, s UserSettings) error {
+	data, _ := json.Marshal(s)
+	if _, err := db.Exec(`INSERT INTO user_settings (openid, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(openid) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		openID, string(data), time.Now().Unix()); err != nil {
+		return err
+	}
+	storeCache(context.Background(), "settings:"+openID, s)
+	return nil
+}
+
+// 用户当前使用的模型
+func userModel(openID string) string {
+	_, model := userModelVia(openID)
+	return model
+}
+
+// 用户当前使用的服务和模型：自己切换的模型优先，其次是用户等级对应的模型，最后是 deepseek.model
+func userModelVia(openID string) (provider, model string) {
+	if m := getUserSettings(openID).Model; m != "" && isKnownModel(m) {
+		return "deepseek", m
+	}
+	if t, ok := tierModel(openID); ok {
+		return t.Provider, t.Model
+	}
+	return "deepseek", viper.GetString("deepseek.model")
+}
+
+// deepseek.models 中列出的模型以及默认模型
+func availableModels() []string {
+	set := map[string]bool{strings.ToLower(viper.GetString("deepseek.model")): true}
+	for name := range viper.GetStringMap("deepseek.models") {
+		set[name] = true
+	}
+	models := make([]string, 0, len(set))
+	for name := range set {
+		models = append(models, name)
+	}
+	sort.Strings(models)
+	return models
+}
+
+func isKnownModel(model string) bool {
+	for _, m := range availableModels() {
+		if strings.EqualFold(m, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否允许该用户切换模型：model_switch.allow 为 all 时所有人可用，
+// 为 restricted 时仅管理员和 model_switch.openids 中的用户可用
+func canSwitchModel(openID string) bool {
+	if viper.GetString("model_switch.allow") == "all" {
+		return true
+	}
+	if isAdmin(openID) {
+		return true
+	}
+	for _, id := range viper.GetStringSlice("model_switch.openids") {
+		if id == openID {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理“换模型”指令
+func handleModelCommand(openID, content string) (string, bool) {
+	arg, ok := parseCommand(content, "换模型")
+	if !ok {
+		return "", false
+	}
+	if !viper.GetBool("model_switch.enabled") || !canSwitchModel(openID) {
+		return "🔒 你暂时没有切换模型的权限。", true
+	}
+
+	current := userModel(openID)
+	if arg == "" {
+		return fmt.Sprintf("🤖 当前模型：%s\n可选模型：\n%s\n\n发送“换模型 模型名”切换，“换模型 默认”恢复默认。",
+			current, strings.Join(availableModels(), "\n")), true
+	}
+
+	s := getUserSettings(openID)
+	if arg == "默认" {
+		s.Model = ""
+	} else if isKnownModel(arg) {
+		s.Model = strings.ToLower(arg)
+	} else {
+		return fmt.Sprintf("⚠️ 不支持的模型“%s”，可选：%s", arg, strings.Join(availableModels(), "、")), true
+	}
+	if err := saveUserSettings(openID, s); err != nil {
+		log.Printf("❌ 保存用户设置失败 [%s]: %v", openID, err)
+		return "❌ 切换失败，请稍后再试。", true
+	}
+	return fmt.Sprintf("✅ 已切换到 %s。", userModel(openID)), true
+}
+
+// 处理“设置”指令：设置 温度 0.7 / 设置 top_p 0.9 / 设置 长度 1024 / 设置 重置
+func handleGenerationCommand(openID, content string) (string, bool) {
+	arg, ok := parseCommand(content, "设置")
+	if !ok {
+		return "", false
+	}
+	if !viper.GetBool("generation.user_commands") {
+		return "🔒 暂不支持自定义生成参数。", true
+	}
+
+	s := getUserSettings(openID)
+	fields := strings.Fields(arg)
+	switch {
+	case len(fields) == 0:
+		return "⚙️ 当前生成参数：\n" + userGenerationParams(openID).String() +
+			"\n\n发送“设置 温度 0.7”“设置 top_p 0.9”“设置 长度 1024”调整，“设置 重置”恢复默认。", true
+	case len(fields) == 1 && fields[0] == "重置":
+		s.Generation = generationParams{}
+	case len(fields) == 2:
+		g := s.Generation
+		switch strings.ToLower(fields[0]) {
+		case "温度", "temperature":
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return "⚠️ 温度需为 0~2 之间的数字。", true
+			}
+			g.Temperature = &v
+		case "top_p":
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return "⚠️ top_p 需为 0~1 之间的数字。", true
+			}
+			g.TopP = &v
+		case "长度", "max_tokens":
+			v, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return "⚠️ 长度需为正整数。", true
+			}
+			g.MaxTokens = &v
+		default:
+			return "⚠️ 支持的参数：温度、top_p、长度。", true
+		}
+		if err := g.validate(); err != nil {
+			return "⚠️ " + err.Error(), true
+		}
+		s.Generation = g
+	default:
+		return "⚠️ 格式：设置 参数 值，例如“设置 温度 0.7”。", true
+	}
+
+	if err := saveUserSettings(openID, s); err != nil {
+		log.Printf("❌ 保存用户设置失败 [%s]: %v", openID, err)
+		return "❌ 设置失败，请稍后再试。", true
+	}
+	return "✅ 已更新生成参数：\n" + userGenerationParams(openID).String(), true
+}
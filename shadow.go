@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 影子流量：开启 experiments.shadow 时按 percent 比例抽取真实问题，在后台用同样的系统提示词和对话上下文
+// 向候选模型再问一次，两个回答和耗时存入 shadow_results 供离线对比，候选模型的回答不会发给用户。
+// 同时进行的影子请求超过 max_concurrency 时直接丢弃，不影响正常回答
+
+var shadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mpbot_shadow_requests_total",
+	Help: "Questions mirrored to the shadow candidate model by result (ok, error or dropped).",
+}, []string{"result"})
+
+var (
+	shadowSlotsOnce sync.Once
+	shadowSlots     chan struct{}
+)
+
+// 一次影子对比的结果
+type ShadowResult struct {
+	ID                 int64     `json:"id"`
+	CreatedAt          time.Time `json:"created_at"`
+	Experiment         string    `json:"experiment"`
+	OpenID             string    `json:"openid"`
+	Question           string    `json:"question"`
+	PrimaryModel       string    `json:"primary_model"`
+	PrimaryAnswer      string    `json:"primary_answer"`
+	PrimaryLatencyMs   int64     `json:"primary_latency_ms"`
+	CandidateModel     string    `json:"candidate_model"`
+	CandidateAnswer    string    `json:"candidate_answer"`
+	CandidateLatencyMs int64     `json:"candidate_latency_ms"`
+	CandidateError     string    `json:"candidate_error,omitempty"`
+}
+
+// 抽中的问题在后台发给候选模型，messages 为正式回答使用的完整消息
+func mirrorToShadow(ctx context.Context, user string, messages []chatMessage, params generationParams, primary ShadowResult) {
+	if !viper.GetBool("experiments.shadow.enabled") || rand.Float64()*100 >= viper.GetFloat64("experiments.shadow.percent") {
+		return
+	}
+	shadowSlotsOnce.Do(func() {
+		shadowSlots = make(chan struct{}, max(viper.GetInt("experiments.shadow.max_concurrency"), 1))
+	})
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		shadowRequests.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	// 正式回答已经返回，影子请求不随用户取消或请求结束而中断
+	ctx = withRequestID(context.Background(), requestID(ctx))
+	safeGo("shadow", func() {
+		defer func() { <-shadowSlots }()
+		provider, model := viper.GetString("experiments.shadow.provider"), viper.GetString("experiments.shadow.model")
+		start := time.Now()
+		answer, err := chatCompletionVia(ctx, provider, model, messages, params)
+
+		r := primary
+		r.Experiment = viper.GetString("experiments.shadow.name")
+		r.OpenID = pseudonym(user)
+		r.CandidateModel = model
+		r.CandidateAnswer = answer
+		r.CandidateLatencyMs = time.Since(start).Milliseconds()
+		if err != nil {
+			r.CandidateError = err.Error()
+			shadowRequests.WithLabelValues("error").Inc()
+			logf(ctx, "⚠️ 影子模型 %s 调用失败: %v", model, err)
+		} else {
+			shadowRequests.WithLabelValues("ok").Inc()
+		}
+		if err := saveShadowResult(r); err != nil {
+			logf(ctx, "⚠️ 保存影子对比结果失败: %v", err)
+		}
+	})
+}
+
+func saveShadowResult(r ShadowResult) error {
+	_, err := db.Exec(`INSERT INTO shadow_results (created_at, experiment, openid, question, primary_model, primary_answer,
+		primary_latency_ms, candidate_model, candidate_answer, candidate_latency_ms, candidate_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().Unix(), r.Experiment, r.OpenID, r.Question, r.PrimaryModel, r.PrimaryAnswer,
+		r.PrimaryLatencyMs, r.CandidateModel, r.CandidateAnswer, r.CandidateLatencyMs, r.CandidateError)
+	return err
+}
+
+// 影子实验的汇总
+type shadowStats struct {
+	Samples            int     `json:"samples"`
+	CandidateFailures  int     `json:"candidate_failures"`
+	AvgPrimaryMs       float64 `json:"avg_primary_latency_ms"`
+	AvgCandidateMs     float64 `json:"avg_candidate_latency_ms"`
+	AvgPrimaryLength   float64 `json:"avg_primary_length"`
+	AvgCandidateLength float64 `json:"avg_candidate_length"`
+}
+
+func shadowExperimentStats(experiment string, since time.Time) (shadowStats, error) {
+	var s shadowStats
+	var failures, primaryMs, candidateMs, primaryLen, candidateLen *float64
+	err := db.QueryRow(`SELECT COUNT(*), SUM(candidate_error != ''), AVG(primary_latency_ms),
+		AVG(CASE WHEN candidate_error = '' THEN candidate_latency_ms END),
+		AVG(LENGTH(primary_answer)), AVG(CASE WHEN candidate_error = '' THEN LENGTH(candidate_answer) END)
+		FROM shadow_results WHERE experiment = ? AND created_at >= ?`, experiment, since.Unix()).
+		Scan(&s.Samples, &failures, &primaryMs, &candidateMs, &primaryLen, &candidateLen)
+	if err != nil {
+		return s, err
+	}
+	deref := func(v *float64) float64 {
+		if v == nil {
+			return 0
+		}
+		return *v
+	}
+	s.CandidateFailures = int(deref(failures))
+	s.AvgPrimaryMs, s.AvgCandidateMs = deref(primaryMs), deref(candidateMs)
+	s.AvgPrimaryLength, s.AvgCandidateLength = deref(primaryLen), deref(candidateLen)
+	return s, nil
+}
+
+// 按 id 倒序列出实验的对比结果，beforeID 用于翻页
+func listShadowResults(experiment string, beforeID int64, limit int) ([]ShadowResult, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	query := `SELECT id, created_at, experiment, openid, question, primary_model, primary_answer, primary_latency_ms,
+		candidate_model, candidate_answer, candidate_latency_ms, candidate_error FROM shadow_results WHERE experiment = ?`
+	args := []interface{}{experiment}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	rows, err := db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ShadowResult{}
+	for rows.Next() {
+		var r ShadowResult
+		var created int64
+		if err := rows.Scan(&r.ID, &created, &r.Experiment, &r.OpenID, &r.Question, &r.PrimaryModel, &r.PrimaryAnswer,
+			&r.PrimaryLatencyMs, &r.CandidateModel, &r.CandidateAnswer, &r.CandidateLatencyMs, &r.CandidateError); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.Unix(created, 0)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// 删除超过 experiments.shadow.retention 的对比结果，由定时任务调用
+func cleanupShadowResults() {
+	before := time.Now().Add(-viper.GetDuration("experiments.shadow.retention")).Unix()
+	res, err := db.Exec(`DELETE FROM shadow_results WHERE created_at < ?`, before)
+	if err != nil {
+		log.Printf("❌ 清理影子对比结果失败: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 已清理 %d 条影子对比结果", n)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 校验消息回调的签名。明文模式校验 signature；安全模式（encrypt_type=aes）
+// 还需校验 msg_signature = sha1(sort(token, timestamp, nonce, Encrypt))
+func verifySignature() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !viper.GetBool("wechat.verify_signature") {
+			c.Next()
+			return
+		}
+
+		timestamp, nonce := c.Query("timestamp"), c.Query("nonce")
+		if !checkSignature(c.Query("signature"), timestamp, nonce) {
+			logf(c.Request.Context(), "❌ 消息回调签名校验失败，来源 %s", c.ClientIP())
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if reason, ok := checkFreshness(c.Request.Context(), timestamp, nonce); !ok {
+			logf(c.Request.Context(), "❌ 拒绝消息回调（%s），来源 %s", reason, c.ClientIP())
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if c.Query("encrypt_type") == "aes" {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			// 放回请求体供后续处理读取
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+			var envelope struct {
+				Encrypt string `xml:"Encrypt"`
+			}
+			if err := xml.Unmarshal(body, &envelope); err != nil || envelope.Encrypt == "" ||
+				wechatSignature(viper.GetString("wechat.token"), timestamp, nonce, envelope.Encrypt) != c.Query("msg_signature") {
+				logf(c.Request.Context(), "❌ 消息回调 msg_signature 校验失败，来源 %s", c.ClientIP())
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// 时间戳需在 wechat.timestamp_window 之内，且同一 nonce 在窗口内只能使用一次。
+// nonce 记录在状态存储中，多实例部署时重放到其他实例的请求同样会被拒绝
+func checkFreshness(ctx context.Context, timestamp, nonce string) (string, bool) {
+	window := viper.GetDuration("wechat.timestamp_window")
+	if window <= 0 {
+		return "", true
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "时间戳无效", false
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > window || d < -window {
+		return fmt.Sprintf("时间戳相差 %s", d.Round(time.Second)), false
+	}
+
+	// 时间戳超出窗口的请求已被拒绝，因此记录只需保留到时间戳过期
+	ttl := time.Unix(ts, 0).Add(window).Sub(now) + time.Second
+	fresh, err := state.SetNX(ctx, "nonce:"+timestamp+":"+nonce, []byte{1}, ttl)
+	if err != nil {
+		// 存储不可用时放行，签名已校验通过
+		logf(ctx, "⚠️ 记录 nonce 失败: %v", err)
+		return "", true
+	}
+	if !fresh {
+		return "nonce 重复", false
+	}
+	return "", true
+}
+
+// 公众号的消息加解密器，未配置 wechat.encoding_aes_key 时为 nil
+func newWeChatCrypter() (*msgCrypter, error) {
+	key := viper.GetString("wechat.encoding_aes_key")
+	if key == "" {
+		return nil, nil
+	}
+	return newMsgCrypter(viper.GetString("wechat.token"), key, viper.GetString("wechat.app_id"))
+}
+
+// 解析带 Encrypt 的回调。安全模式只有密文；兼容模式同时带明文字段和密文，两种模式可在同一处理流程中切换：
+// 配置了 wechat.encoding_aes_key 时解密密文并加密被动回复，未配置时使用兼容模式的明文字段、回复明文
+func parseEncryptedMessage(c *gin.Context, body []byte) (WeChatMessage, error) {
+	crypter, err := newWeChatCrypter()
+	if err != nil {
+		return WeChatMessage{}, err
+	}
+	if crypter == nil {
+		msg, err := parseWeChatMessage(body)
+		if err != nil {
+			return msg, fmt.Errorf("encrypted callback without wechat.encoding_aes_key (plaintext fields: %w)", err)
+		}
+		return msg, nil
+	}
+	var envelope struct {
+		Encrypt string `xml:"Encrypt"`
+	}
+	if err := xml.Unmarshal(body, &envelope); err != nil || envelope.Encrypt == "" {
+		return WeChatMessage{}, fmt.Errorf("missing Encrypt")
+	}
+	plain, err := crypter.decrypt(envelope.Encrypt)
+	if err != nil {
+		return WeChatMessage{}, fmt.Errorf("decrypt: %w", err)
+	}
+	msg, err := parseWeChatMessage(plain)
+	if err != nil {
+		return msg, err
+	}
+	c.Set(replyCrypterKey, crypter)
+	return msg, nil
+}
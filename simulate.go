@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 模拟微信服务器发来的消息回调，XML 格式与字段与真实回调一致
+type simulatedMessage struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   cdata    `xml:"ToUserName"`
+	FromUserName cdata    `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      cdata    `xml:"MsgType"`
+	Content      *cdata   `xml:"Content,omitempty"`
+	Event        *cdata   `xml:"Event,omitempty"`
+	EventKey     *cdata   `xml:"EventKey,omitempty"`
+	PicURL       *cdata   `xml:"PicUrl,omitempty"`
+	MediaID      *cdata   `xml:"MediaId,omitempty"`
+	Format       *cdata   `xml:"Format,omitempty"`
+	Recognition  *cdata   `xml:"Recognition,omitempty"`
+	MsgID        int64    `xml:"MsgId,omitempty"`
+}
+
+// 向本地 /wx 发送带正确签名的模拟消息，无需公网地址和真实公众号即可走完整的处理流程
+func runSimulate(args []string) {
+	fs := newFlagSet("simulate", "向本地 /wx 发送带签名的模拟消息")
+	target := fs.String("url", "", "回调地址，默认根据 server.listen 使用 http://127.0.0.1<端口>/wx")
+	msgType := fs.String("type", "text", "消息类型：text、event、image、voice")
+	user := fs.String("user", "", "发送者 OpenID，默认使用 debug_chat.openid")
+	content := fs.String("content", "你好", "text 的消息内容")
+	event := fs.String("event", "subscribe", "event 的事件类型，如 subscribe、unsubscribe、SCAN、CLICK")
+	eventKey := fs.String("event-key", "", "event 的 EventKey，如 qrscene_123 或菜单的 key")
+	mediaID := fs.String("media-id", "simulated-media-id", "image、voice 的素材 ID")
+	picURL := fs.String("pic-url", "", "image 的图片链接")
+	format := fs.String("format", "amr", "voice 的语音格式")
+	recognition := fs.String("recognition", "", "voice 的语音识别结果，留空表示公众号未开启语音识别")
+	mode := fs.String("mode", "plain", "消息加解密方式：plain 明文、compat 兼容模式、safe 安全模式（后两者需 wechat.encoding_aes_key）")
+	fs.Parse(args)
+
+	log.SetOutput(io.Discard)
+	initConfig()
+	if *user == "" {
+		*user = viper.GetString("debug_chat.openid")
+	}
+	if *target == "" {
+		*target = localServerURL() + "/wx"
+	}
+
+	msg := simulatedMessage{
+		ToUserName:   cdata{"gh_simulator"},
+		FromUserName: cdata{*user},
+		CreateTime:   time.Now().Unix(),
+		MsgType:      cdata{*msgType},
+		MsgID:        time.Now().UnixNano(),
+	}
+	switch *msgType {
+	case "text":
+		msg.Content = &cdata{*content}
+	case "event":
+		msg.Event = &cdata{*event}
+		msg.EventKey = &cdata{*eventKey}
+		msg.MsgID = 0
+	case "image":
+		msg.PicURL = &cdata{*picURL}
+		msg.MediaID = &cdata{*mediaID}
+	case "voice":
+		msg.MediaID = &cdata{*mediaID}
+		msg.Format = &cdata{*format}
+		if *recognition != "" {
+			msg.Recognition = &cdata{*recognition}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "❌ 不支持的消息类型 %q\n", *msgType)
+		os.Exit(2)
+	}
+
+	status, reply, elapsed, err := postSimulatedMessage(*target, msg, *mode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ 发送失败: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("HTTP %d，耗时 %s\n", status, elapsed.Round(time.Millisecond))
+	if elapsed > 5*time.Second {
+		fmt.Println("⚠️ 超过微信被动回复的 5 秒限制，真实环境中微信会重试该消息")
+	}
+	fmt.Println(describeReply(reply))
+	if status != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+// 本机监听地址对应的服务地址
+func localServerURL() string {
+	listen := viper.GetString("server.listen")
+	if strings.HasPrefix(listen, ":") {
+		listen = "127.0.0.1" + listen
+	}
+	return "http://" + listen
+}
+
+// 按 wechat.token 签名后发送，返回状态码、回复内容和耗时；compat、safe 模式下加密消息并解密被动回复
+func postSimulatedMessage(target string, msg simulatedMessage, mode string) (int, []byte, time.Duration, error) {
+	body, err := xml.Marshal(msg)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newID()
+	q := u.Query()
+	q.Set("signature", wechatSignature(viper.GetString("wechat.token"), timestamp, nonce))
+	q.Set("timestamp", timestamp)
+	q.Set("nonce", nonce)
+	q.Set("openid", msg.FromUserName.Value)
+
+	var crypter *msgCrypter
+	if mode != "plain" {
+		if crypter, err = newWeChatCrypter(); err != nil || crypter == nil {
+			return 0, nil, 0, fmt.Errorf("%s mode requires a valid wechat.encoding_aes_key", mode)
+		}
+		encrypted, err := crypter.encrypt(body)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		envelope := struct {
+			XMLName    xml.Name `xml:"xml"`
+			ToUserName cdata    `xml:"ToUserName"`
+			Encrypt    cdata    `xml:"Encrypt"`
+		}{ToUserName: msg.ToUserName, Encrypt: cdata{encrypted}}
+		switch mode {
+		case "safe":
+			body, err = xml.Marshal(envelope)
+		case "compat":
+			// 明文字段之后附上密文
+			body = bytes.Replace(body, []byte("</xml>"), []byte("<Encrypt><![CDATA["+encrypted+"]]></Encrypt></xml>"), 1)
+		default:
+			return 0, nil, 0, fmt.Errorf("unknown mode %q", mode)
+		}
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		q.Set("encrypt_type", "aes")
+		q.Set("msg_signature", crypter.signature(timestamp, nonce, encrypted))
+	}
+	u.RawQuery = q.Encode()
+
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: time.Minute}).Post(u.String(), "text/xml", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		return resp.StatusCode, nil, elapsed, err
+	}
+	var encrypted struct {
+		Encrypt string `xml:"Encrypt"`
+	}
+	if crypter != nil && xml.Unmarshal(reply, &encrypted) == nil && encrypted.Encrypt != "" {
+		if reply, err = crypter.decrypt(encrypted.Encrypt); err != nil {
+			return resp.StatusCode, nil, elapsed, fmt.Errorf("decrypt reply: %w", err)
+		}
+	}
+	return resp.StatusCode, reply, elapsed, nil
+}
+
+// 文本回复只输出内容，其他回复原样输出 XML
+func describeReply(reply []byte) string {
+	var r struct {
+		MsgType string `xml:"MsgType"`
+		Content string `xml:"Content"`
+	}
+	switch {
+	case len(reply) == 0 || string(reply) == "success":
+		return "（无被动回复）"
+	case xml.Unmarshal(reply, &r) == nil && r.MsgType == "text":
+		return r.Content
+	default:
+		return string(reply)
+	}
+}
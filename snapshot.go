@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 内存状态快照：state.backend 为 memory 时，待查看的回答、对话历史、防刷计数等只保存在进程内存中，
+// 进程内队列中尚未回答的问题也会随重启丢失。开启 snapshot.enabled 时退出前把它们写入 snapshot.path，
+// 启动时读回并删除快照文件，未回答的问题重新排队
+
+// 快照文件的内容
+type stateSnapshot struct {
+	SavedAt   time.Time       `json:"saved_at"`
+	Entries   []snapshotEntry `json:"entries"`
+	Questions []queuedJob     `json:"questions"`
+}
+
+type snapshotEntry struct {
+	Key       string    `json:"key"`
+	Value     []byte    `json:"value,omitempty"`
+	List      [][]byte  `json:"list,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// 是否需要快照：状态保存在 Redis 且使用 Redis 队列时无需快照
+func snapshotEnabled() bool {
+	if !viper.GetBool("snapshot.enabled") {
+		return false
+	}
+	_, memory := state.(*memoryStateStore)
+	return memory || messageQueue == nil
+}
+
+// 导出未过期的条目。锁与重启前的进程绑定，不导出
+func (s *memoryStateStore) export() []snapshotEntry {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]snapshotEntry, 0, len(s.entries))
+	for key, e := range s.entries {
+		if e.expired(now) || strings.HasPrefix(key, "lock:") {
+			continue
+		}
+		entries = append(entries, snapshotEntry{Key: key, Value: e.value, List: e.list, ExpiresAt: e.expiresAt})
+	}
+	return entries
+}
+
+// 导入快照中的条目，跳过已过期的条目，返回导入的数量
+func (s *memoryStateStore) restore(entries []snapshotEntry) int {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, e := range entries {
+		entry := &memoryEntry{value: e.Value, list: e.List, expiresAt: e.ExpiresAt}
+		if entry.expired(now) {
+			continue
+		}
+		s.put(e.Key, entry)
+		n++
+	}
+	return n
+}
+
+// 退出前保存快照，先写临时文件再替换，避免写到一半时留下损坏的快照
+func saveSnapshot() error {
+	if !snapshotEnabled() {
+		return nil
+	}
+	snap := stateSnapshot{SavedAt: time.Now()}
+	if m, ok := state.(*memoryStateStore); ok {
+		snap.Entries = m.export()
+	}
+	if messageQueue == nil {
+		snap.Questions = unansweredQuestions()
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := viper.GetString("snapshot.path")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("💾 已保存状态快照 %s：%d 条状态，%d 个未回答的问题", path, len(snap.Entries), len(snap.Questions))
+	return nil
+}
+
+// 启动时读回快照，在队列 worker 启动后调用。读取后删除快照文件，避免下次启动重复恢复
+func restoreSnapshot() error {
+	if !snapshotEnabled() {
+		return nil
+	}
+	path := viper.GetString("snapshot.path")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap stateSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	restored := 0
+	if m, ok := state.(*memoryStateStore); ok {
+		restored = m.restore(snap.Entries)
+	}
+	// 排队进度随问题重新记录
+	for _, job := range snap.Questions {
+		_ = state.Delete(context.Background(), queuedProgressKey(job.User))
+	}
+	for _, job := range snap.Questions {
+		ctx := job.context(context.Background())
+		if messageQueue != nil {
+			publishQuestion(ctx, job.User, job.Content)
+			continue
+		}
+		markQueued(ctx, job.User, job.Content)
+		enqueueQuestion(ctx, job.User, job.Content, nil)
+	}
+	log.Printf("💾 已从 %s 恢复快照（保存于 %s）：%d 条状态，%d 个未回答的问题",
+		path, snap.SavedAt.Format(time.DateTime), restored, len(snap.Questions))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// 语音服务：识别（asr）与合成（tts）各自按名称选择服务商，与大模型服务的配置方式相同。
+// 名称为空时使用 asr、tts 段的配置，其他名称读取 speech_providers.<name>
+type SpeechToText interface {
+	Name() string
+	// 识别音频中的文字，filename 的扩展名表示音频格式
+	Transcribe(ctx context.Context, filename string, audio []byte) (string, error)
+}
+
+type TextToSpeech interface {
+	Name() string
+	// 把文字合成为语音，返回音频及其格式（如 mp3）
+	Synthesize(ctx context.Context, text string) ([]byte, string, error)
+}
+
+// 语音服务商的配置
+type speechConfig struct {
+	Type     string `mapstructure:"type"`     // 接口类型，目前支持 openai（OpenAI 兼容接口）
+	BaseURL  string `mapstructure:"base_url"` // 接口根地址，如 https://api.openai.com/v1
+	APIURL   string `mapstructure:"api_url"`  // 完整接口地址，填写时忽略 base_url
+	APIKey   string `mapstructure:"api_key"`
+	Model    string `mapstructure:"model"`
+	Language string `mapstructure:"language"` // 识别的语言
+	Voice    string `mapstructure:"voice"`    // 合成的音色
+	Format   string `mapstructure:"format"`   // 合成的音频格式
+}
+
+// 接口地址：api_url 优先，否则在 base_url 后拼接 path
+func (c speechConfig) endpoint(path string) string {
+	if c.APIURL != "" {
+		return c.APIURL
+	}
+	if c.BaseURL == "" {
+		return ""
+	}
+	return strings.TrimRight(c.BaseURL, "/") + path
+}
+
+var (
+	speechMu       sync.Mutex
+	speechToTexts  = map[string]SpeechToText{}
+	textToSpeeches = map[string]TextToSpeech{}
+)
+
+// section 为名称为空时使用的配置段
+func loadSpeechConfig(section, name string) (speechConfig, error) {
+	key := section
+	if name != "" {
+		key = "speech_providers." + name
+		if !viper.IsSet(key) {
+			return speechConfig{}, fmt.Errorf("speech provider %q is not configured", name)
+		}
+	}
+	var c speechConfig
+	if err := viper.UnmarshalKey(key, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", key, err)
+	}
+	if c.Type == "" {
+		c.Type = "openai"
+	}
+	if c.Type != "openai" {
+		return c, fmt.Errorf("%s: unknown type %q", key, c.Type)
+	}
+	return c, nil
+}
+
+// 按名称获取语音识别服务
+func getSpeechToText(name string) (SpeechToText, error) {
+	speechMu.Lock()
+	defer speechMu.Unlock()
+	if p, ok := speechToTexts[name]; ok {
+		return p, nil
+	}
+	c, err := loadSpeechConfig("asr", name)
+	if err != nil {
+		return nil, err
+	}
+	p := newOpenAISpeechToText(speechProviderName("asr", name), c)
+	speechToTexts[name] = p
+	return p, nil
+}
+
+// 按名称获取语音合成服务
+func getTextToSpeech(name string) (TextToSpeech, error) {
+	speechMu.Lock()
+	defer speechMu.Unlock()
+	if p, ok := textToSpeeches[name]; ok {
+		return p, nil
+	}
+	c, err := loadSpeechConfig("tts", name)
+	if err != nil {
+		return nil, err
+	}
+	p := newOpenAITextToSpeech(speechProviderName("tts", name), c)
+	textToSpeeches[name] = p
+	return p, nil
+}
+
+func speechProviderName(section, name string) string {
+	if name == "" {
+		return section
+	}
+	return name
+}
+
+// 用 asr.provider 识别音频中的文字
+func transcribeAudio(ctx context.Context, filename string, audio []byte) (string, error) {
+	p, err := getSpeechToText(viper.GetString("asr.provider"))
+	if err != nil {
+		return "", err
+	}
+	return p.Transcribe(ctx, filename, audio)
+}
+
+// 用 tts.provider 把文字合成为语音
+func synthesizeSpeech(ctx context.Context, text string) ([]byte, string, error) {
+	p, err := getTextToSpeech(viper.GetString("tts.provider"))
+	if err != nil {
+		return nil, "", err
+	}
+	return p.Synthesize(ctx, text)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// 键不存在或已过期
+var errStateNotFound = errors.New("state: key not found")
+
+// 可变状态的存储：待查看的回答、对话历史、防刷状态、nonce 和 access_token。
+// 默认保存在进程内存中；多实例部署时改用 Redis，使各副本共享同一份状态。
+// ttl 为 0 表示不过期
+type StateStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// 键不存在时写入并返回 true，用于分布式锁和去重
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(ctx context.Context, keys ...string) error
+	// 删除指定前缀的全部键
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// 列表：尾部追加并刷新整个列表的 ttl，返回追加后的长度
+	Push(ctx context.Context, key string, value []byte, ttl time.Duration) (int, error)
+	// 取出列表头部的元素，列表为空时返回 errStateNotFound
+	Pop(ctx context.Context, key string) ([]byte, error)
+	Len(ctx context.Context, key string) (int, error)
+}
+
+var state StateStore = newMemoryStateStore(0, 0)
+
+var stateEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mpbot_state_evictions_total",
+	Help: "Keys evicted from the in-memory state store by the limit that was exceeded (entries or bytes).",
+}, []string{"reason"})
+
+// 根据 state.backend 初始化状态存储
+func initStateStore() error {
+	switch backend := viper.GetString("state.backend"); backend {
+	case "", "memory":
+		state = newMemoryStateStore(viper.GetInt("state.memory.max_entries"), viper.GetInt64("state.memory.max_bytes"))
+	case "redis":
+		s, err := newRedisStateStore()
+		if err != nil {
+			return err
+		}
+		state = s
+		if err := checkSharedDatabase(context.Background()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown state backend %q", backend)
+	}
+	log.Printf("🗄️ 状态存储后端: %T", state)
+	return nil
+}
+
+// 多实例部署时所有实例必须使用同一个数据库：积分、每日提问次数、会员、黑白名单等以数据库为准，
+// 各实例各用一个数据库时用户在每个实例各有一份免费次数和积分，管理接口的结果也取决于由哪个实例响应。
+// 数据库首次使用时生成随机 ID，启动时与 Redis 中记录的 ID 比较，不一致时拒绝启动
+func checkSharedDatabase(ctx context.Context) error {
+	if db == nil {
+		return nil
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO database_info (key, value) VALUES ('id', ?)`, newID()); err != nil {
+		return err
+	}
+	var id string
+	if err := db.QueryRow(`SELECT value FROM database_info WHERE key = 'id'`).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := state.SetNX(ctx, "database_id", []byte(id), 0); err != nil {
+		return err
+	}
+	shared, err := state.Get(ctx, "database_id")
+	if err != nil {
+		return err
+	}
+	if string(shared) != id {
+		return fmt.Errorf("database %s (id %s) is not the database used by other instances (id %s): "+
+			"with state.backend redis all instances must share database.path; delete the key %sdatabase_id to register a new database",
+			viper.GetString("database.path"), id, shared, viper.GetString("state.redis.prefix"))
+	}
+	return nil
+}
+
+// 进程内存存储，单实例部署时使用。
+// 设置 state.memory.max_entries / max_bytes 后按最近最少使用淘汰超出上限的键，关注量激增时不会耗尽内存。
+// 防重放的 nonce 和锁不参与淘汰（淘汰后会允许重放回调、定时任务重复执行），只按过期时间清理
+type memoryStateStore struct {
+	mu         sync.Mutex
+	entries    map[string]*memoryEntry
+	lru        *list.List // 元素为键，最近使用的在前，不含 pinned 的键
+	bytes      int64
+	maxEntries int   // 0 表示不限制
+	maxBytes   int64 // 0 表示不限制
+	lastSweep  time.Time
+}
+
+// 不参与淘汰的键前缀，这些键都带过期时间
+var pinnedStatePrefixes = []string{"nonce:", "lock:"}
+
+func pinnedStateKey(key string) bool {
+	for _, prefix := range pinnedStatePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryEntry struct {
+	value     []byte
+	list      [][]byte
+	expiresAt time.Time
+	elem      *list.Element // pinned 的条目为 nil
+	size      int64
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// 估算条目占用的内存，含键和 map、链表节点的固定开销
+func (e *memoryEntry) estimateSize(key string) int64 {
+	n := int64(len(key)+len(e.value)) + 128
+	for _, v := range e.list {
+		n += int64(len(v)) + 24
+	}
+	return n
+}
+
+func newMemoryStateStore(maxEntries int, maxBytes int64) *memoryStateStore {
+	return &memoryStateStore{entries: map[string]*memoryEntry{}, lru: list.New(), maxEntries: maxEntries, maxBytes: maxBytes}
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// 取未过期的条目并标记为最近使用，调用方需持有锁
+func (s *memoryStateStore) entry(key string) *memoryEntry {
+	e := s.entries[key]
+	if e == nil {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		s.remove(key)
+		return nil
+	}
+	if e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e
+}
+
+// 写入条目，替换同名的旧条目，调用方需持有锁
+func (s *memoryStateStore) put(key string, e *memoryEntry) {
+	if s.entries[key] != nil {
+		s.remove(key)
+	}
+	if pinnedStateKey(key) {
+		s.entries[key] = e
+		s.sweepPinned()
+		return
+	}
+	e.elem = s.lru.PushFront(key)
+	e.size = e.estimateSize(key)
+	s.entries[key] = e
+	s.bytes += e.size
+	s.evict()
+}
+
+// 条目内容变化后重新计算占用，调用方需持有锁
+func (s *memoryStateStore) resize(key string, e *memoryEntry) {
+	if e.elem == nil {
+		return
+	}
+	s.bytes -= e.size
+	e.size = e.estimateSize(key)
+	s.bytes += e.size
+	s.evict()
+}
+
+func (s *memoryStateStore) remove(key string) {
+	if e := s.entries[key]; e != nil {
+		if e.elem != nil {
+			s.lru.Remove(e.elem)
+			s.bytes -= e.size
+		}
+		delete(s.entries, key)
+	}
+}
+
+// 清理过期的 pinned 条目，至多每分钟一次，调用方需持有锁
+func (s *memoryStateStore) sweepPinned() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if e.elem == nil && e.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// 超出上限时从最久未使用的键开始淘汰，刚写入的键保留
+func (s *memoryStateStore) evict() {
+	for s.lru.Len() > 1 {
+		reason := ""
+		switch {
+		case s.maxEntries > 0 && s.lru.Len() > s.maxEntries:
+			reason = "entries"
+		case s.maxBytes > 0 && s.bytes > s.maxBytes:
+			reason = "bytes"
+		default:
+			return
+		}
+		s.remove(s.lru.Back().Value.(string))
+		stateEvictions.WithLabelValues(reason).Inc()
+	}
+}
+
+// 当前的键数和估算的字节数
+func (s *memoryStateStore) usage() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries), s.bytes
+}
+
+func (s *memoryStateStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil || e.value == nil {
+		return nil, errStateNotFound
+	}
+	return e.value, nil
+}
+
+func (s *memoryStateStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	s.put(key, &memoryEntry{value: value, expiresAt: expiry(ttl)})
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStateStore) SetNX(_ context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entry(key) != nil {
+		return false, nil
+	}
+	s.put(key, &memoryEntry{value: value, expiresAt: expiry(ttl)})
+	return true, nil
+}
+
+func (s *memoryStateStore) Delete(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	for _, key := range keys {
+		s.remove(key)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStateStore) DeletePrefix(_ context.Context, prefix string) error {
+	s.mu.Lock()
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(key)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStateStore) Push(_ context.Context, key string, value []byte, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil {
+		e = &memoryEntry{list: [][]byte{value}, expiresAt: expiry(ttl)}
+		s.put(key, e)
+		return 1, nil
+	}
+	e.list = append(e.list, value)
+	e.expiresAt = expiry(ttl)
+	s.resize(key, e)
+	return len(e.list), nil
+}
+
+func (s *memoryStateStore) Pop(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil || len(e.list) == 0 {
+		return nil, errStateNotFound
+	}
+	value := e.list[0]
+	e.list = e.list[1:]
+	if len(e.list) == 0 {
+		s.remove(key)
+	} else {
+		s.resize(key, e)
+	}
+	return value, nil
+}
+
+func (s *memoryStateStore) Len(_ context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.entry(key); e != nil {
+		return len(e.list), nil
+	}
+	return 0, nil
+}
+
+// 清理已过期的键，由定时任务调用
+func (s *memoryStateStore) cleanup() {
+	now := time.Now()
+	removed := 0
+	s.mu.Lock()
+	for key, e := range s.entries {
+		if e.expired(now) {
+			s.remove(key)
+			removed++
+		}
+	}
+	s.mu.Unlock()
+	if removed > 0 {
+		log.Printf("🧹 已清理 %d 条过期状态", removed)
+	}
+}
+
+// Redis 存储，多个副本共享。所有键带 state.redis.prefix 前缀，便于与其他应用共用实例
+type redisStateStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisStateStore() (*redisStateStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     viper.GetString("state.redis.addr"),
+		Password: viper.GetString("state.redis.password"),
+		DB:       viper.GetInt("state.redis.db"),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis %s: %w", viper.GetString("state.redis.addr"), err)
+	}
+	return &redisStateStore{client: client, prefix: viper.GetString("state.redis.prefix")}, nil
+}
+
+func (s *redisStateStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errStateNotFound
+	}
+	return value, err
+}
+
+func (s *redisStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *redisStateStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, s.prefix+key, value, ttl).Result()
+}
+
+func (s *redisStateStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = s.prefix + key
+	}
+	return s.client.Del(ctx, full...).Err()
+}
+
+func (s *redisStateStore) DeletePrefix(ctx context.Context, prefix string) error {
+	iter := s.client.Scan(ctx, 0, s.prefix+prefix+"*", 200).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 200 {
+			if err := s.client.Del(ctx, batch...).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return s.client.Del(ctx, batch...).Err()
+	}
+	return nil
+}
+
+func (s *redisStateStore) Push(ctx context.Context, key string, value []byte, ttl time.Duration) (int, error) {
+	var push *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		push = p.RPush(ctx, s.prefix+key, value)
+		if ttl > 0 {
+			p.Expire(ctx, s.prefix+key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(push.Val()), nil
+}
+
+func (s *redisStateStore) Pop(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.LPop(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errStateNotFound
+	}
+	return value, err
+}
+
+func (s *redisStateStore) Len(ctx context.Context, key string) (int, error) {
+	n, err := s.client.LLen(ctx, s.prefix+key).Result()
+	return int(n), err
+}
+
+// 基于 SetNX 的分布式锁，持有者崩溃时在 ttl 后自动释放。
+// 获取失败返回 false，调用方应稍后重试或读取其他实例写入的结果
+func tryLock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool) {
+	token := []byte(newID())
+	ok, err := state.SetNX(ctx, "lock:"+key, token, ttl)
+	if err != nil {
+		log.Printf("⚠️ 获取锁 %s 失败: %v", key, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	return func() {
+		// 只释放自己持有的锁，避免误删超时后被其他实例获取的锁
+		if v, err := state.Get(context.Background(), "lock:"+key); err == nil && string(v) == string(token) {
+			_ = state.Delete(context.Background(), "lock:"+key)
+		}
+	}, true
+}
+
+// 管理接口和指令修改的数据（黑白名单、用户等级、模型设置、会员、提示词版本、通知模板）以数据库为准，
+// 读取时经状态存储缓存：state.backend 为 redis 时各实例共享缓存，任一实例的修改其他实例立即可见；
+// 内存存储受 state.memory 的条目和字节上限约束，被淘汰的值下次读取时从数据库重新加载
+
+// 缓存的时长，各实例共享同一个数据库（见 checkSharedDatabase），过期后从数据库重新读取
+const cacheTTL = 10 * time.Minute
+
+func cacheKey(key string) string { return "cache:" + key }
+
+// 读取缓存的值，未命中或读取失败时返回 false
+func getCached(ctx context.Context, key string, v interface{}) bool {
+	data, err := state.Get(ctx, cacheKey(key))
+	if err != nil {
+		if !errors.Is(err, errStateNotFound) {
+			log.Printf("⚠️ 读取缓存 %s 失败: %v", key, err)
+		}
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// 缓存从数据库读出的值，其他实例已写入时不覆盖
+func fillCache(ctx context.Context, key string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if _, err := state.SetNX(ctx, cacheKey(key), data, cacheTTL); err != nil {
+		log.Printf("⚠️ 写入缓存 %s 失败: %v", key, err)
+	}
+}
+
+// 修改数据库后写入新值，覆盖其他实例缓存的旧值。删除时写入零值
+func storeCache(ctx context.Context, key string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err := state.Set(ctx, cacheKey(key), data, cacheTTL); err != nil {
+		log.Printf("⚠️ 写入缓存 %s 失败: %v", key, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// 记录用户当天的提问次数
+func recordQuestion(openID string) {
+	_, err := db.Exec(`INSERT INTO user_stats (openid, day, questions) VALUES (?, ?, 1)
+		ON CONFLICT(openid, day) DO UPDATE SET questions = questions + 1`,
+		openID, time.Now().Format("2006-01-02"))
+	if err != nil {
+		log.Printf("⚠️ 记录用户提问次数失败 [%s]: %v", openID, err)
+	}
+}
+
+// 最近 days 天内每个用户的提问总数及单日最高提问数
+type UserActivity struct {
+	OpenID    string `json:"openid"`
+	Total     int    `json:"total"`
+	DailyPeak int    `json:"daily_peak"`
+}
+
+func userActivitySince(days int) ([]UserActivity, error) {
+	since := time.Now().AddDate(0, 0, -days+1).Format("2006-01-02")
+	rows, err := db.Query(`SELECT openid, SUM(questions), MAX(questions) FROM user_stats
+		WHERE day >= ? GROUP BY openid`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []UserActivity
+	for rows.Next() {
+		var a UserActivity
+		if err := rows.Scan(&a.OpenID, &a.Total, &a.DailyPeak); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// 记录用户当天发送的消息数
+func recordUserMessage(openID string) {
+	_, err := db.Exec(`INSERT INTO message_stats (day, openid, messages) VALUES (?, ?, 1)
+		ON CONFLICT(day, openid) DO UPDATE SET messages = messages + 1`,
+		time.Now().Format("2006-01-02"), openID)
+	if err != nil {
+		log.Printf("⚠️ 记录消息数失败 [%s]: %v", openID, err)
+	}
+}
+
+// 接口返回的 token 用量
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// 按天、模型累计 DeepSeek 调用次数、失败次数、耗时和 token 用量（含摘要、简报等内部调用）
+func recordModelUsage(model string, usage tokenUsage, latency time.Duration, failed bool) {
+	recordCallSample(model, latency, failed)
+	failures := 0
+	if failed {
+		failures = 1
+	}
+	_, err := db.Exec(`INSERT INTO model_usage (day, model, calls, failures, latency_ms, prompt_tokens, completion_tokens)
+		VALUES (?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT(day, model) DO UPDATE SET calls = calls + 1, failures = failures + excluded.failures,
+			latency_ms = latency_ms + excluded.latency_ms, prompt_tokens = prompt_tokens + excluded.prompt_tokens,
+			completion_tokens = completion_tokens + excluded.completion_tokens`,
+		time.Now().Format("2006-01-02"), model, failures, latency.Milliseconds(), usage.PromptTokens, usage.CompletionTokens)
+	if err != nil {
+		log.Printf("⚠️ 记录模型用量失败 [%s]: %v", model, err)
+	}
+}
+
+// 某一天的使用情况
+type DailyUsage struct {
+	Day              string  `json:"day"`
+	Messages         int     `json:"messages"`
+	Users            int     `json:"users"`
+	Calls            int     `json:"calls"`
+	Failures         int     `json:"failures"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+}
+
+func dailyUsage(day string) (DailyUsage, error) {
+	u := DailyUsage{Day: day}
+	err := db.QueryRow(`SELECT COALESCE(SUM(messages), 0), COUNT(*) FROM message_stats WHERE day = ?`, day).
+		Scan(&u.Messages, &u.Users)
+	if err != nil {
+		return u, err
+	}
+	var latency int64
+	err = db.QueryRow(`SELECT COALESCE(SUM(calls), 0), COALESCE(SUM(failures), 0), COALESCE(SUM(latency_ms), 0),
+		COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0) FROM model_usage WHERE day = ?`, day).
+		Scan(&u.Calls, &u.Failures, &latency, &u.PromptTokens, &u.CompletionTokens)
+	if u.Calls > 0 {
+		u.AvgLatencyMs = float64(latency) / float64(u.Calls)
+	}
+	return u, err
+}
+
+func (u DailyUsage) String() string {
+	return fmt.Sprintf("📊 %s 统计\n消息数：%d\n用户数：%d\nDeepSeek 调用：%d 次（失败 %d 次）\n平均耗时：%.0f ms\nToken：%d（输入 %d / 输出 %d）",
+		u.Day, u.Messages, u.Users, u.Calls, u.Failures, u.AvgLatencyMs,
+		u.PromptTokens+u.CompletionTokens, u.PromptTokens, u.CompletionTokens)
+}
+
+// 管理员发送“统计”查看今天的使用情况
+func handleStatsCommand(openID, content string) (string, bool) {
+	if strings.TrimSpace(content) != "统计" || !isAdmin(openID) {
+		return "", false
+	}
+	u, err := dailyUsage(time.Now().Format("2006-01-02"))
+	if err != nil {
+		log.Printf("❌ 读取统计失败: %v", err)
+		return "❌ 读取统计失败，请稍后再试。", true
+	}
+	return u.String(), true
+}
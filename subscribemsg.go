@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 一次性订阅消息：用户打开授权页同意后，公众号可向其发送一条订阅消息，不受客服消息 48 小时窗口限制。
+// 用户发送“订阅通知”获取授权链接，授权结果回调 /subscribemsg/callback 记录一次授权；
+// outbox.strategy 中加入 subscribe 后，客服消息无法送达时消耗一次授权推送回答（如耗时较长的知识库问答）
+
+// 授权链接中 reserved 参数的有效期，回调时校验 reserved 与 openid 对应，防止伪造授权
+const subscribeMsgStateTTL = time.Hour
+
+func subscribeMsgStateKey(reserved string) string { return "subscribemsg:" + reserved }
+
+// 生成一次性订阅消息的授权链接
+func subscribeMsgAuthURL(ctx context.Context, openID string) (string, error) {
+	reserved := newID()
+	if err := state.Set(ctx, subscribeMsgStateKey(reserved), []byte(openID), subscribeMsgStateTTL); err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("action", "get_confirm")
+	q.Set("appid", viper.GetString("wechat.app_id"))
+	q.Set("scene", strconv.Itoa(viper.GetInt("subscribe_msg.scene")))
+	q.Set("template_id", viper.GetString("subscribe_msg.template_id"))
+	q.Set("redirect_url", viper.GetString("subscribe_msg.redirect_url"))
+	q.Set("reserved", reserved)
+	return "https://mp.weixin.qq.com/mp/subscribemsg?" + q.Encode() + "#wechat_redirect", nil
+}
+
+// 记录一次授权
+func addSubscribeMsgGrant(openID, templateID string, scene int) error {
+	_, err := db.Exec(`INSERT INTO subscribe_msg_grants (openid, template_id, scene, created_at, used_at) VALUES (?, ?, ?, ?, 0)`,
+		openID, templateID, scene, time.Now().Unix())
+	return err
+}
+
+// 用户未使用的授权次数
+func subscribeMsgGrants(openID string) int {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM subscribe_msg_grants WHERE openid = ? AND template_id = ? AND used_at = 0`,
+		openID, viper.GetString("subscribe_msg.template_id")).Scan(&n); err != nil {
+		log.Printf("⚠️ 查询订阅消息授权失败 [%s]: %v", openID, err)
+		return 0
+	}
+	return n
+}
+
+// 消耗最早的一次授权，没有可用授权时返回 false
+func takeSubscribeMsgGrant(openID string) (int64, int, bool, error) {
+	var id int64
+	var scene int
+	err := db.QueryRow(`SELECT id, scene FROM subscribe_msg_grants WHERE openid = ? AND template_id = ? AND used_at = 0
+		ORDER BY id LIMIT 1`, openID, viper.GetString("subscribe_msg.template_id")).Scan(&id, &scene)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	res, err := db.Exec(`UPDATE subscribe_msg_grants SET used_at = ? WHERE id = ? AND used_at = 0`, time.Now().Unix(), id)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, 0, false, nil
+	}
+	return id, scene, true, nil
+}
+
+// 发送失败且授权未被微信消耗时退回
+func restoreSubscribeMsgGrant(id int64) {
+	if _, err := db.Exec(`UPDATE subscribe_msg_grants SET used_at = 0 WHERE id = ?`, id); err != nil {
+		log.Printf("⚠️ 退回订阅消息授权 %d 失败: %v", id, err)
+	}
+}
+
+// 消耗一次授权发送订阅消息，正文超出 200 字时截断
+func sendSubscribeMessage(openID string, m OutboxMessage) error {
+	id, scene, ok, err := takeSubscribeMsgGrant(openID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNoSubscribeMsgGrant
+	}
+	err = wechatPost("/cgi-bin/message/template/subscribe", map[string]interface{}{
+		"touser":      openID,
+		"template_id": viper.GetString("subscribe_msg.template_id"),
+		"url":         m.Link,
+		"scene":       strconv.Itoa(scene),
+		"title":       viper.GetString("subscribe_msg.title"),
+		"data": map[string]interface{}{
+			"content": map[string]string{"value": truncateRunes(m.Text, 200)},
+		},
+	}, nil)
+	if err != nil {
+		// 43101: 用户拒收或授权已失效，授权不再可用
+		var apiErr *WeChatAPIError
+		if !errors.As(err, &apiErr) || apiErr.ErrCode != 43101 {
+			restoreSubscribeMsgGrant(id)
+		}
+	}
+	return err
+}
+
+var errNoSubscribeMsgGrant = errors.New("user has no subscribe message grant")
+
+// “订阅通知”：回复授权链接和剩余次数
+func handleSubscribeMsgCommand(openID, content string) (string, bool) {
+	if !viper.GetBool("subscribe_msg.enabled") {
+		return "", false
+	}
+	if _, ok := parseCommand(content, "订阅通知"); !ok {
+		return "", false
+	}
+	link, err := subscribeMsgAuthURL(context.Background(), openID)
+	if err != nil {
+		log.Printf("❌ 生成订阅消息授权链接失败 [%s]: %v", openID, err)
+		return "❌ 生成授权链接失败，请稍后再试。", true
+	}
+	return fmt.Sprintf("🔔 <a href=\"%s\">点击这里</a>授权后，回答较慢或超过 48 小时未互动时，可通过订阅消息通知你（每次授权可接收一条）。\n当前剩余 %d 次。",
+		link, subscribeMsgGrants(openID)), true
+}
+
+func registerSubscribeMsg(r *gin.Engine, limiter gin.HandlerFunc) {
+	if !viper.GetBool("subscribe_msg.enabled") {
+		return
+	}
+
+	// 授权结果回调：openid、template_id、action（confirm 或 cancel）、scene、reserved
+	r.GET("/subscribemsg/callback", limiter, func(c *gin.Context) {
+		ctx := c.Request.Context()
+		openID, reserved := c.Query("openid"), c.Query("reserved")
+		data, err := state.Get(ctx, subscribeMsgStateKey(reserved))
+		if err != nil || reserved == "" || string(data) != openID {
+			c.String(http.StatusBadRequest, "授权链接已失效，请在公众号中重新发送“订阅通知”。")
+			return
+		}
+		if c.Query("action") != "confirm" {
+			c.String(http.StatusOK, "已取消订阅。")
+			return
+		}
+		if c.Query("template_id") != viper.GetString("subscribe_msg.template_id") {
+			c.String(http.StatusBadRequest, "模板不匹配。")
+			return
+		}
+		_ = state.Delete(ctx, subscribeMsgStateKey(reserved))
+		scene, _ := strconv.Atoi(c.Query("scene"))
+		if err := addSubscribeMsgGrant(openID, c.Query("template_id"), scene); err != nil {
+			logf(ctx, "❌ 记录订阅消息授权失败 [%s]: %v", openID, err)
+			c.String(http.StatusInternalServerError, "订阅失败，请稍后重试。")
+			return
+		}
+		logf(ctx, "🔔 用户 %s 授权了一次订阅消息", openID)
+		c.String(http.StatusOK, "✅ 订阅成功，有新消息时将通知你。")
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/viper"
+)
+
+// 自动打标签规则：统计窗口内满足全部已设置条件的用户会被打上 Tag，openids 中的用户始终打上
+type TagRule struct {
+	Tag          string   `mapstructure:"tag"`
+	Days         int      `mapstructure:"days"`          // 统计窗口（天），默认 7
+	MinQuestions int      `mapstructure:"min_questions"` // 窗口内提问总数下限
+	MinDaily     int      `mapstructure:"min_daily"`     // 窗口内单日提问数峰值下限
+	OpenIDs      []string `mapstructure:"openids"`       // 手动指定的用户（如 VIP）
+}
+
+type wechatTag struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// 按规则同步所有标签成员：新命中的用户打标签，不再命中的用户取消标签
+func syncUserTags() error {
+	var rules []TagRule
+	if err := viper.UnmarshalKey("tagging.rules", &rules); err != nil {
+		return err
+	}
+
+	tags, err := listWeChatTags()
+	if err != nil {
+		return err
+	}
+	tagIDs := map[string]int{}
+	for _, t := range tags {
+		tagIDs[t.Name] = t.ID
+	}
+
+	for _, rule := range rules {
+		tagID, ok := tagIDs[rule.Tag]
+		if !ok {
+			if tagID, err = createWeChatTag(rule.Tag); err != nil {
+				log.Printf("❌ 创建标签 %s 失败: %v", rule.Tag, err)
+				continue
+			}
+		}
+
+		want, err := matchTagRule(rule)
+		if err != nil {
+			return err
+		}
+		current, err := listTagMembers(tagID)
+		if err != nil {
+			log.Printf("❌ 获取标签 %s 成员失败: %v", rule.Tag, err)
+			continue
+		}
+
+		var add, remove []string
+		for openID := range want {
+			if !current[openID] {
+				add = append(add, openID)
+			}
+		}
+		for openID := range current {
+			if !want[openID] {
+				remove = append(remove, openID)
+			}
+		}
+
+		if err := batchTagging("/cgi-bin/tags/members/batchtagging", tagID, add); err != nil {
+			log.Printf("❌ 标签 %s 添加成员失败: %v", rule.Tag, err)
+		}
+		if err := batchTagging("/cgi-bin/tags/members/batchuntagging", tagID, remove); err != nil {
+			log.Printf("❌ 标签 %s 移除成员失败: %v", rule.Tag, err)
+		}
+		log.Printf("🏷️ 标签 %s 同步完成：+%d -%d", rule.Tag, len(add), len(remove))
+	}
+	return nil
+}
+
+func matchTagRule(rule TagRule) (map[string]bool, error) {
+	matched := map[string]bool{}
+	for _, openID := range rule.OpenIDs {
+		matched[openID] = true
+	}
+	if rule.MinQuestions == 0 && rule.MinDaily == 0 {
+		return matched, nil
+	}
+
+	days := rule.Days
+	if days <= 0 {
+		days = 7
+	}
+	activity, err := userActivitySince(days)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range activity {
+		if a.Total >= rule.MinQuestions && a.DailyPeak >= rule.MinDaily {
+			matched[a.OpenID] = true
+		}
+	}
+	return matched, nil
+}
+
+func listWeChatTags() ([]wechatTag, error) {
+	var result struct {
+		Tags []wechatTag `json:"tags"`
+	}
+	err := wechatGet("/cgi-bin/tags/get", nil, &result)
+	return result.Tags, err
+}
+
+func createWeChatTag(name string) (int, error) {
+	var result struct {
+		Tag wechatTag `json:"tag"`
+	}
+	err := wechatPost("/cgi-bin/tags/create", map[string]interface{}{
+		"tag": map[string]string{"name": name},
+	}, &result)
+	return result.Tag.ID, err
+}
+
+// 分页获取标签下的全部粉丝
+func listTagMembers(tagID int) (map[string]bool, error) {
+	members := map[string]bool{}
+	next := ""
+	for {
+		var result struct {
+			Count int `json:"count"`
+			Data  struct {
+				OpenID []string `json:"openid"`
+			} `json:"data"`
+			NextOpenID string `json:"next_openid"`
+		}
+		if err := wechatPost("/cgi-bin/user/tag/get", map[string]interface{}{
+			"tagid":       tagID,
+			"next_openid": next,
+		}, &result); err != nil {
+			return nil, err
+		}
+		for _, openID := range result.Data.OpenID {
+			members[openID] = true
+		}
+		if result.Count == 0 || result.NextOpenID == "" || result.NextOpenID == next {
+			return members, nil
+		}
+		next = result.NextOpenID
+	}
+}
+
+// 批量打/取消标签，微信限制每次最多 50 个 OpenID
+func batchTagging(path string, tagID int, openIDs []string) error {
+	for start := 0; start < len(openIDs); start += 50 {
+		end := start + 50
+		if end > len(openIDs) {
+			end = len(openIDs)
+		}
+		if err := wechatPost(path, map[string]interface{}{
+			"openid_list": openIDs[start:end],
+			"tagid":       tagID,
+		}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// 模型服务限流：返回 429 且没有其他可用的密钥时，按 Retry-After 暂停调用该服务，不再消耗重试次数。
+// 暂停状态保存在状态存储中由各实例共享；暂停期间队列 worker 等待恢复，新问题按 throttle.action 排队或直接回复
+
+var (
+	providerThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_provider_throttled_total",
+		Help: "Times an LLM provider was paused after returning 429.",
+	}, []string{"provider"})
+
+	throttledQuestions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mpbot_throttled_questions_total",
+		Help: "Questions received while the provider was paused, by throttle.action.",
+	}, []string{"action"})
+)
+
+// 暂停期间的新问题
+const (
+	ThrottleQueue = "queue" // 照常排队，暂停结束后回答
+	ThrottleReply = "reply" // 回复 messages.throttled，不扣积分
+)
+
+// 服务处于暂停期间，调用未发出
+type ThrottledError struct {
+	Provider   string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s is rate limited, retry after %s", e.Provider, e.RetryAfter.Round(time.Second))
+}
+
+func throttleKey(provider string) string {
+	return "throttle:" + provider
+}
+
+// 解析 Retry-After（秒数或 HTTP 日期），缺失或无效时使用 throttle.default_pause，不超过 throttle.max_pause
+func retryAfter(header http.Header) time.Duration {
+	pause := viper.GetDuration("throttle.default_pause")
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			pause = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			pause = time.Until(t)
+		}
+	}
+	if max := viper.GetDuration("throttle.max_pause"); max > 0 && pause > max {
+		pause = max
+	}
+	if pause < time.Second {
+		pause = time.Second
+	}
+	return pause
+}
+
+// 暂停调用服务，已处于暂停时不会缩短
+func throttleProvider(ctx context.Context, provider string, pause time.Duration) {
+	if throttledFor(provider) >= pause {
+		return
+	}
+	until := time.Now().Add(pause).UnixMilli()
+	if err := state.Set(ctx, throttleKey(provider), []byte(strconv.FormatInt(until, 10)), pause); err != nil {
+		logf(ctx, "⚠️ 记录 %s 限流状态失败: %v", provider, err)
+	}
+	providerThrottled.WithLabelValues(provider).Inc()
+	logf(ctx, "🚦 %s 返回 429，暂停调用 %s", provider, pause.Round(time.Second))
+}
+
+// 服务剩余的暂停时长，未暂停时为 0
+func throttledFor(provider string) time.Duration {
+	data, err := state.Get(context.Background(), throttleKey(provider))
+	if err != nil {
+		return 0
+	}
+	until, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return max(time.Until(time.UnixMilli(until)), 0)
+}
+
+// 等待默认服务恢复，队列 worker 取出问题后、调用模型前调用。等待期间用户发送“取消”时返回 context.Canceled，
+// 超过 throttle.max_wait 仍未恢复时返回 ThrottledError，调用方不再调用模型
+func waitThrottle(ctx context.Context, user string, enqueuedAt time.Time) error {
+	var deadline time.Time
+	if max := viper.GetDuration("throttle.max_wait"); max > 0 {
+		deadline = time.Now().Add(max)
+	}
+	for {
+		d := throttledFor("deepseek")
+		if d <= 0 {
+			return nil
+		}
+		if canceledSince(ctx, user, enqueuedAt) {
+			return context.Canceled
+		}
+		wait := min(d, 5*time.Second)
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return &ThrottledError{Provider: "deepseek", RetryAfter: d}
+			}
+			wait = min(wait, left)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// 限流暂停期间排队的问题回复的提示：回答推送时不提示输入“继续”
+func throttledQueuedScenario() string {
+	if viper.GetBool("queue.push_answers") {
+		return MessageThrottledAccepted
+	}
+	return MessageThrottledQueued
+}
+
+// 默认服务暂停期间，throttle.action 为 reply 时直接回复 messages.throttled。位于提问扣费之前，被拒绝的问题不扣积分
+func throttleMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType == "text" && viper.GetString("throttle.action") == ThrottleReply {
+			if d := throttledFor("deepseek"); d > 0 {
+				throttledQuestions.WithLabelValues(ThrottleReply).Inc()
+				logf(ctx, "🚦 DeepSeek 限流中，拒绝用户 %s 的问题", msg.FromUserName)
+				return userMessage(ctx, MessageThrottled, msg.FromUserName, &messageVars{RetryAfter: retryAfterSeconds(d)}), true
+			}
+		}
+		return next(ctx, msg)
+	}
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 用户等级：tiers.levels 中每个等级对应一个模型，未指定等级的用户为 tiers.default，会员为 membership.tier，管理员默认为 tiers.admin_tier。
+// 用户自己通过“换模型”切换的模型优先于等级的模型
+type TierConfig struct {
+	Provider string `mapstructure:"provider" json:"provider"` // 留空使用 deepseek
+	Model    string `mapstructure:"model" json:"model"`
+}
+
+// 管理员为用户指定的等级，存于 user_tiers 表
+type UserTier struct {
+	OpenID    string    `json:"openid"`
+	Tier      string    `json:"tier"`
+	Note      string    `json:"note,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func tierLevels() map[string]TierConfig {
+	levels := map[string]TierConfig{}
+	if err := viper.UnmarshalKey("tiers.levels", &levels); err != nil {
+		log.Printf("⚠️ 解析 tiers.levels 失败: %v", err)
+	}
+	return levels
+}
+
+func tierNames() []string {
+	var names []string
+	for name := range tierLevels() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 管理员为用户指定的等级，未指定时 Tier 为空
+func assignedTier(openID string) UserTier {
+	ctx := context.Background()
+	var t UserTier
+	if getCached(ctx, "tier:"+openID, &t) {
+		return t
+	}
+	var updated int64
+	err := db.QueryRow(`SELECT openid, tier, note, updated_at FROM user_tiers WHERE openid = ?`, openID).
+		Scan(&t.OpenID, &t.Tier, &t.Note, &updated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("⚠️ 查询用户等级失败 [%s]: %v", openID, err)
+		return UserTier{}
+	}
+	if err == nil {
+		t.UpdatedAt = time.Unix(updated, 0)
+	}
+	fillCache(ctx, "tier:"+openID, t)
+	return t
+}
+
+// 用户所在的等级：管理员指定的等级优先，其次是会员和管理员的等级。指定的等级已从配置中删除时按未指定处理
+func userTier(openID string) string {
+	t := assignedTier(openID)
+	levels := tierLevels()
+	if _, known := levels[t.Tier]; t.Tier != "" && known {
+		return t.Tier
+	}
+	if member := viper.GetString("membership.tier"); member != "" && isMember(openID) {
+		return strings.ToLower(member)
+	}
+	if admin := viper.GetString("tiers.admin_tier"); admin != "" && isAdmin(openID) {
+		return strings.ToLower(admin)
+	}
+	return strings.ToLower(viper.GetString("tiers.default"))
+}
+
+// 用户等级对应的服务和模型，未开启或等级未配置模型时返回 false
+func tierModel(openID string) (TierConfig, bool) {
+	if !viper.GetBool("tiers.enabled") {
+		return TierConfig{}, false
+	}
+	t, ok := tierLevels()[userTier(openID)]
+	if !ok || t.Model == "" {
+		return TierConfig{}, false
+	}
+	if t.Provider == "" {
+		t.Provider = "deepseek"
+	}
+	return t, true
+}
+
+// 是否为默认等级以外的用户，这些用户不参与灰度
+func hasSpecialTier(openID string) bool {
+	return viper.GetBool("tiers.enabled") && userTier(openID) != strings.ToLower(viper.GetString("tiers.default"))
+}
+
+func setUserTier(openID, tier, note string) error {
+	tier = strings.ToLower(tier)
+	if _, ok := tierLevels()[tier]; !ok {
+		return fmt.Errorf("unknown tier %q", tier)
+	}
+	t := UserTier{OpenID: openID, Tier: tier, Note: note, UpdatedAt: time.Now()}
+	if _, err := db.Exec(`INSERT INTO user_tiers (openid, tier, note, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(openid) DO UPDATE SET tier = excluded.tier, note = excluded.note, updated_at = excluded.updated_at`,
+		t.OpenID, t.Tier, t.Note, t.UpdatedAt.Unix()); err != nil {
+		return err
+	}
+	storeCache(context.Background(), "tier:"+openID, t)
+	log.Printf("🎖️ %s 的等级已设为 %s", openID, tier)
+	return nil
+}
+
+func removeUserTier(openID string) error {
+	if _, err := db.Exec(`DELETE FROM user_tiers WHERE openid = ?`, openID); err != nil {
+		return err
+	}
+	storeCache(context.Background(), "tier:"+openID, UserTier{})
+	log.Printf("🎖️ %s 已恢复默认等级", openID)
+	return nil
+}
+
+func listUserTiers() ([]UserTier, error) {
+	rows, err := db.Query(`SELECT openid, tier, note, updated_at FROM user_tiers ORDER BY updated_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []UserTier{}
+	for rows.Next() {
+		var t UserTier
+		var updated int64
+		if err := rows.Scan(&t.OpenID, &t.Tier, &t.Note, &updated); err != nil {
+			return nil, err
+		}
+		t.UpdatedAt = time.Unix(updated, 0)
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// 处理“等级”指令：用户查看自己的等级；管理员发送“等级 openid 等级名 [备注]”指定，“等级 openid 默认”恢复默认
+func handleTierCommand(openID, content string) (string, bool) {
+	arg, ok := parseCommand(content, "等级")
+	if !ok || !viper.GetBool("tiers.enabled") {
+		return "", false
+	}
+	if arg == "" || !isAdmin(openID) {
+		reply := "🎖️ 你的等级：" + userTier(openID)
+		if t, ok := tierModel(openID); ok {
+			reply += "\n使用模型：" + t.Model
+		}
+		return reply, true
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 1 {
+		return fmt.Sprintf("🎖️ %s 的等级：%s", fields[0], userTier(fields[0])), true
+	}
+	target, tier := fields[0], strings.ToLower(fields[1])
+	if tier == "默认" {
+		if err := removeUserTier(target); err != nil {
+			log.Printf("❌ 删除用户等级失败 [%s]: %v", target, err)
+			return "❌ 设置失败，请稍后再试。", true
+		}
+		return fmt.Sprintf("✅ %s 已恢复默认等级 %s。", target, userTier(target)), true
+	}
+	if _, ok := tierLevels()[tier]; !ok {
+		return fmt.Sprintf("⚠️ 不存在的等级“%s”，可选：%s", tier, strings.Join(tierNames(), "、")), true
+	}
+	if err := setUserTier(target, tier, strings.Join(fields[2:], " ")); err != nil {
+		log.Printf("❌ 保存用户等级失败 [%s]: %v", target, err)
+		return "❌ 设置失败，请稍后再试。", true
+	}
+	return fmt.Sprintf("✅ %s 的等级已设为 %s。", target, tier), true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// 每条消息的格式开销（角色标记等）
+const messageOverheadTokens = 4
+
+// 估算文本的 token 数。按 DeepSeek 官方给出的换算：1 个中文字符约 0.6 个 token，
+// 1 个英文字符约 0.3 个 token，结果向上取整，宁可高估以免超出上下文窗口
+func estimateTokens(text string) int {
+	tenths := 0
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r), unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r), unicode.Is(unicode.Hangul, r):
+			tenths += 6
+		case r > unicode.MaxASCII:
+			// emoji、全角标点等按单独 token 计
+			tenths += 10
+		default:
+			tenths += 3
+		}
+	}
+	return (tenths + 9) / 10
+}
+
+func estimateMessagesTokens(messages []chatMessage) int {
+	n := 0
+	for _, m := range messages {
+		n += estimateTokens(m.Content) + messageOverheadTokens
+	}
+	return n
+}
+
+// 读取 deepseek.models 中某个模型的整数配置（模型名可能包含“.”，不能直接拼接成 viper 键）
+func modelSettingInt(model, key string) int {
+	settings, _ := viper.GetStringMap("deepseek.models")[strings.ToLower(model)].(map[string]interface{})
+	return cast.ToInt(settings[key])
+}
+
+// 模型的上下文窗口与回复预留，未在 deepseek.models 中配置时使用 deepseek.context_window / deepseek.reply_reserve
+func modelContextBudget(model string) int {
+	window := viper.GetInt("deepseek.context_window")
+	reserve := viper.GetInt("deepseek.reply_reserve")
+	if v := modelSettingInt(model, "context_window"); v > 0 {
+		window = v
+	}
+	if v := modelSettingInt(model, "reply_reserve"); v > 0 {
+		reserve = v
+	}
+	return window - reserve
+}
+
+// 裁剪消息列表以适应模型上下文：保留开头的系统消息和最后一条消息，
+// 从最早的对话开始丢弃；仍然超出时截断最后一条消息的内容
+func trimMessages(model string, messages []chatMessage) ([]chatMessage, bool) {
+	budget := modelContextBudget(model)
+	if budget <= 0 || estimateMessagesTokens(messages) <= budget || len(messages) == 0 {
+		return messages, false
+	}
+
+	head := 0
+	for head < len(messages)-1 && messages[head].Role == "system" {
+		head++
+	}
+	system, middle, last := messages[:head], messages[head:len(messages)-1], messages[len(messages)-1]
+
+	used := estimateMessagesTokens(system) + estimateTokens(last.Content) + messageOverheadTokens
+	for len(middle) > 0 && used+estimateMessagesTokens(middle) > budget {
+		middle = middle[1:]
+	}
+	// 避免以 assistant 消息开头
+	for len(middle) > 0 && middle[0].Role == "assistant" {
+		middle = middle[1:]
+	}
+
+	if used > budget {
+		last.Content = truncateToTokens(last.Content, budget-estimateMessagesTokens(system)-messageOverheadTokens)
+	}
+
+	trimmed := append([]chatMessage(nil), system...)
+	trimmed = append(trimmed, middle...)
+	return append(trimmed, last), true
+}
+
+// 截断文本使其不超过 maxTokens
+func truncateToTokens(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if estimateTokens(string(runes[:mid])) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return string(runes[:lo])
+}
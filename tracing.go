@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 未启用 tracing 时为 no-op 实现
+var tracer = otel.Tracer("mpbot")
+
+// 初始化 OpenTelemetry，通过 OTLP/HTTP 导出到 tracing.endpoint
+func initTracing() {
+	if !viper.GetBool("tracing.enabled") {
+		return
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(viper.GetString("tracing.endpoint"))}
+	if viper.GetBool("tracing.insecure") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		log.Printf("⚠️ OpenTelemetry 初始化失败: %v", err)
+		return
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing.sample_rate")))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(viper.GetString("tracing.service_name")))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = provider.Tracer("mpbot")
+	log.Printf("✅ OpenTelemetry 已启用，导出到 %s", viper.GetString("tracing.endpoint"))
+}
+
+// gin 中间件：为每个请求创建 server span，并把 context 写回 c.Request
+func traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", c.Request.Method, c.FullPath()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(c.FullPath()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprint(status))
+		}
+	}
+}
+
+// 记录错误并标记 span 失败
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// 异步任务使用的 context：保留 trace 信息，但不随请求结束而取消
+func detachContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+var attrUser = attribute.Key("wechat.openid")
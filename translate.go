@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+// 快捷翻译：“翻译 文本”翻译一次；“翻译模式”开启后用户发送的内容都直接翻译，再次发送退出。
+// 翻译不使用系统提示词、知识库和对话历史，改用 translate.prompt；中文译为 translate.target，其他语言译为中文
+type translation struct {
+	OneShot bool `json:"one_shot,omitempty"` // 由“翻译 文本”发起，而非翻译模式
+}
+
+type translationKey struct{}
+
+func withTranslation(ctx context.Context, t translation) context.Context {
+	return context.WithValue(ctx, translationKey{}, t)
+}
+
+func translationFrom(ctx context.Context) (translation, bool) {
+	t, ok := ctx.Value(translationKey{}).(translation)
+	return t, ok
+}
+
+// 译文的语言：汉字占一半以上时译为 translate.target，否则译为中文
+func translationTarget(text string) string {
+	han, letters := 0, 0
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han++
+			letters++
+		case unicode.IsLetter(r):
+			letters++
+		}
+	}
+	if letters > 0 && han*2 >= letters {
+		return viper.GetString("translate.target")
+	}
+	return "中文"
+}
+
+// 调用模型翻译，使用用户等级或自选的模型
+func translateText(ctx context.Context, user, text string) (string, error) {
+	target := translationTarget(text)
+	prompt := executeTemplate(ctx, viper.GetString("translate.prompt"), struct{ Target string }{target})
+	provider, model := userModelVia(user)
+	params := defaultGenerationParams()
+	temperature := viper.GetFloat64("translate.temperature")
+	params.Temperature = &temperature
+	if r, ok := regenerationFrom(ctx); ok && r.Temperature != nil {
+		params.Temperature = r.Temperature
+	}
+	logf(ctx, "🌐 用户 %s 翻译为%s", user, target)
+
+	start := time.Now()
+	answer, err := chatCompletionVia(ctx, provider, model, []chatMessage{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: text},
+	}, params)
+	latency := time.Since(start)
+	recordQA(qaRecord{OpenID: user, Model: model, Question: text,
+		Answer: answer, Latency: latency, Failed: err != nil})
+	recordAudit(ctx, AuditEntry{OpenID: user, Direction: AuditAnswer, Content: answer, Model: model,
+		LatencyMs: latency.Milliseconds(), Failed: err != nil, Moderation: answerModeration(err)})
+	return answer, err
+}
+
+// 拦截“翻译 文本”和翻译模式下的消息，标记为翻译后交给后续的扣费、排队和模型调用
+func translateMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "text" || !viper.GetBool("translate.enabled") {
+			return next(ctx, msg)
+		}
+		if text, ok := parseCommand(msg.Content, "翻译"); ok {
+			if text == "" {
+				return "⚠️ 用法：翻译 要翻译的内容\n发送“翻译模式”可连续翻译。", true
+			}
+			msg.Content = text
+			return next(withTranslation(ctx, translation{OneShot: true}), msg)
+		}
+		if getUserSettings(msg.FromUserName).Translate {
+			return next(withTranslation(ctx, translation{}), msg)
+		}
+		return next(ctx, msg)
+	}
+}
+
+// 处理“翻译模式”指令，开启和退出交替切换
+func handleTranslateCommand(openID, content string) (string, bool) {
+	if strings.TrimSpace(content) != "翻译模式" || !viper.GetBool("translate.enabled") {
+		return "", false
+	}
+	s := getUserSettings(openID)
+	s.Translate = !s.Translate
+	if err := saveUserSettings(openID, s); err != nil {
+		log.Printf("❌ 保存翻译模式失败 [%s]: %v", openID, err)
+		return "❌ 设置失败，请稍后再试。", true
+	}
+	if !s.Translate {
+		return "✅ 已退出翻译模式。", true
+	}
+	return fmt.Sprintf("🌐 已开启翻译模式：发送的中文将译为%s，其他语言译为中文。\n再次发送“翻译模式”退出。",
+		viper.GetString("translate.target")), true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ttsClient = &http.Client{Timeout: 60 * time.Second}
+
+// OpenAI 兼容的语音合成接口（POST JSON /audio/speech，返回音频）
+type openAITextToSpeech struct {
+	name   string
+	config speechConfig
+}
+
+func newOpenAITextToSpeech(name string, c speechConfig) *openAITextToSpeech {
+	return &openAITextToSpeech{name: name, config: c}
+}
+
+func (p *openAITextToSpeech) Name() string { return p.name }
+
+func (p *openAITextToSpeech) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	apiURL := p.config.endpoint("/audio/speech")
+	if apiURL == "" {
+		return nil, "", fmt.Errorf("%s: api_url is not configured", p.name)
+	}
+	format := p.config.Format
+	if format == "" {
+		format = "mp3"
+	}
+	payload, err := json.Marshal(map[string]string{
+		"model":           p.config.Model,
+		"voice":           p.config.Voice,
+		"input":           text,
+		"response_format": format,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.APIKey)
+	}
+	resp, err := ttsClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("%s returned %d: %s", p.name, resp.StatusCode, msg)
+	}
+	limit := viper.GetInt64("media.max_size")
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(audio)) > limit {
+		return nil, "", fmt.Errorf("speech larger than %d bytes", limit)
+	}
+	return audio, format, nil
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// 校验配置，返回全部问题而不是遇到第一个就停止，便于一次改完
+func validateConfig() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// 必填项
+	for _, key := range []string{"wechat.token", "deepseek.api_url", "deepseek.model", "database.path"} {
+		if strings.TrimSpace(viper.GetString(key)) == "" {
+			fail("%s is required", key)
+		}
+	}
+	if viper.GetString("deepseek.api_key") == "" && len(viper.GetStringSlice("deepseek.api_keys")) == 0 {
+		fail("deepseek.api_key or deepseek.api_keys is required")
+	}
+
+	// 地址格式
+	checkURL := func(key string, required bool) {
+		v := viper.GetString(key)
+		if v == "" {
+			if required {
+				fail("%s is required", key)
+			}
+			return
+		}
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("%s must be an http(s) URL, got %q", key, v)
+		}
+	}
+	checkURL("deepseek.api_url", false)
+	checkURL("deepseek.embeddings_url", false)
+	checkURL("alert.webhook_url", false)
+	checkURL("error_reporting.webhook_url", false)
+	checkURL("report.webhook_url", false)
+	if v := viper.GetString("deepseek.proxy"); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" {
+			fail("deepseek.proxy must be a proxy URL such as http://host:port or socks5://host:port, got %q", v)
+		}
+	}
+	for name := range viper.GetStringMap("providers") {
+		checkURL("providers."+name+".base_url", true)
+		if v := viper.GetString("providers." + name + ".proxy"); v != "" {
+			if u, err := url.Parse(v); err != nil || u.Host == "" {
+				fail("providers.%s.proxy must be a proxy URL, got %q", name, v)
+			}
+		}
+	}
+
+	switch mode := viper.GetString("server.gin_mode"); mode {
+	case gin.ReleaseMode, gin.DebugMode, gin.TestMode:
+	default:
+		fail("server.gin_mode must be release, debug or test, got %q", mode)
+	}
+	switch mode := viper.GetString("logging.content"); mode {
+	case "full", "truncate", "hash":
+	default:
+		fail("logging.content must be full, truncate or hash, got %q", mode)
+	}
+	if viper.GetString("logging.content") == "truncate" && viper.GetInt("logging.content_max_length") <= 0 {
+		fail("logging.content_max_length must be positive")
+	}
+	if hashOpenIDs() {
+		if len(viper.GetString("privacy.salt")) < 16 {
+			fail("privacy.hash_openids requires privacy.salt of at least 16 characters")
+		}
+		if _, err := regexp.Compile(viper.GetString("privacy.openid_pattern")); err != nil {
+			fail("privacy.openid_pattern: %v", err)
+		}
+	}
+	for _, p := range viper.GetStringSlice("server.trusted_proxies") {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				fail("server.trusted_proxies: %q is not an IP or CIDR", p)
+			}
+		}
+	}
+
+	for _, ip := range viper.GetStringSlice("wechat_ips.static") {
+		if _, ok := parseIPNet(ip); !ok {
+			fail("wechat_ips.static: %q is not an IP or CIDR", ip)
+		}
+	}
+	if viper.GetBool("wechat_ips.enabled") && !viper.GetBool("wechat_ips.fetch") && len(viper.GetStringSlice("wechat_ips.static")) == 0 {
+		fail("wechat_ips.enabled requires wechat_ips.fetch or a wechat_ips.static list")
+	}
+
+	// 时长
+	for _, key := range []string{
+		"deepseek.reply_wait", "deepseek.timeout", "cache.answer_ttl", "cache.cleanup_interval", "profile.ttl",
+		"broadcast.check_interval", "wechat_ips.refresh", "history.ttl", "queue.claim_idle", "outbox.poll_interval", "outbox.retention", "outbox.unavailable_ttl", "media.reply_wait", "events.webhook_timeout", "alert.check_interval", "alert.repeat_interval", "plugins.timeout", "hooks.timeout", "idempotency.retention", "abuse.window", "abuse.cooldown", "abuse.max_cooldown", "abuse.strike_reset",
+		"http_client.idle_conn_timeout", "http_client.tls_handshake_timeout", "retry_queue.poll_interval", "retry_queue.max_age", "intent.timeout", "budget.refresh_interval", "regenerate.ttl", "article.cache_ttl", "ocr.ttl", "notifications.membership_expiring_before",
+		"throttle.default_pause", "throttle.max_pause", "experiments.shadow.retention", "server.shutdown_timeout",
+	} {
+		if d, err := cast.ToDurationE(viper.Get(key)); err != nil {
+			fail("%s must be a duration such as \"30s\" or \"5m\", got %v", key, viper.Get(key))
+		} else if d <= 0 && key != "deepseek.reply_wait" && key != "deepseek.timeout" {
+			fail("%s must be positive", key)
+		}
+	}
+
+	if d, err := cast.ToDurationE(viper.Get("throttle.max_wait")); err != nil || d < 0 {
+		fail("throttle.max_wait must be a non-negative duration such as \"30m\", got %v", viper.Get("throttle.max_wait"))
+	}
+	if _, err := cast.ToDurationE(viper.Get("wechat.timestamp_window")); err != nil {
+		fail("wechat.timestamp_window must be a duration such as \"5m\", got %v", viper.Get("wechat.timestamp_window"))
+	}
+
+	// 取值范围
+	if viper.GetInt("deepseek.max_concurrency") < 1 {
+		fail("deepseek.max_concurrency must be at least 1")
+	}
+	for _, prefix := range []string{"rate_limit", "push_api.rate_limit"} {
+		if !viper.GetBool(prefix + ".enabled") {
+			continue
+		}
+		for _, key := range []string{"global_rps", "global_burst", "ip_rps", "ip_burst"} {
+			if viper.GetFloat64(prefix+"."+key) <= 0 {
+				fail("%s.%s must be positive", prefix, key)
+			}
+		}
+	}
+	if viper.GetBool("points.enabled") && (viper.GetInt("points.daily_free") < 0 || viper.GetInt("points.checkin_reward") < 0) {
+		fail("points.daily_free and points.checkin_reward must not be negative")
+	}
+	for _, ch := range viper.GetStringSlice("outbox.strategy") {
+		if !slices.Contains(deliveryChannels, ch) {
+			fail("outbox.strategy: unknown channel %q (want kefu, template, subscribe or cache)", ch)
+		}
+	}
+	if viper.GetBool("profanity.enabled") {
+		if viper.GetString("profanity.mask") == "" {
+			fail("profanity.mask must not be empty")
+		}
+		if path := viper.GetString("profanity.dictionary"); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				fail("profanity.dictionary: %v", err)
+			}
+		}
+	}
+	for _, p := range postProcessors() {
+		switch {
+		case !slices.Contains(postProcessorTypes, p.Type):
+			fail("postprocess: unknown type %q (want markdown, sensitive_words, split, footer or plugin)", p.Type)
+		case p.Type == "split" && p.MaxLength < 50:
+			fail("postprocess: split needs max_length of at least 50")
+		case p.Type == "footer" && p.Text == "":
+			fail("postprocess: footer needs text")
+		case p.Type == "plugin" && p.Plugin == "":
+			fail("postprocess: plugin needs the plugin name")
+		}
+	}
+	names := map[string]bool{}
+	for _, r := range alertRules() {
+		if !slices.Contains(alertMetrics, r.Metric) {
+			fail("alert.rules: unknown metric %q (want error_rate, latency_p95 or daily_spend)", r.Metric)
+		}
+		if r.Threshold <= 0 {
+			fail("alert.rules: %s needs a positive threshold", r.Name)
+		}
+		if names[r.Name] {
+			fail("alert.rules: duplicate rule name %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	if viper.GetInt("outbox.max_attempts") < 1 {
+		fail("outbox.max_attempts must be at least 1")
+	}
+	for _, scenario := range []string{MessageProcessing, MessageAccepted, MessageQueued, MessageTimeout, MessageProviderError,
+		MessageModerationBlocked, MessageQuotaExceeded, MessageQueueFull, MessageRetryQueued, MessageNewSession, MessageBudgetExceeded,
+		MessageOutOfOffice, MessageDeferred, MessageThrottled, MessageThrottledQueued, MessageThrottledAccepted} {
+		if _, err := template.New(scenario).Parse(viper.GetString("messages." + scenario)); err != nil {
+			fail("messages.%s: %v", scenario, err)
+		}
+	}
+	switch viper.GetString("history.store") {
+	case "auto", "state", "database":
+	default:
+		fail("history.store must be auto, state or database, got %q", viper.GetString("history.store"))
+	}
+	if d, err := cast.ToDurationE(viper.Get("history.idle_timeout")); err != nil || d < 0 {
+		fail("history.idle_timeout must be a non-negative duration such as \"30m\", got %v", viper.Get("history.idle_timeout"))
+	}
+	if viper.GetBool("intent.enabled") && viper.GetInt("intent.max_length") <= 0 {
+		fail("intent.max_length must be positive")
+	}
+	if viper.GetInt("cache.page_length") < 0 {
+		fail("cache.page_length must not be negative")
+	}
+	if viper.GetInt("queue.max_depth") < 0 {
+		fail("queue.max_depth must not be negative")
+	}
+	if viper.GetInt("retry_queue.max_attempts") < 1 {
+		fail("retry_queue.max_attempts must be at least 1")
+	}
+	if action := viper.GetString("throttle.action"); action != ThrottleQueue && action != ThrottleReply {
+		fail("throttle.action must be queue or reply, got %q", action)
+	}
+	if viper.GetFloat64("budget.daily") < 0 || viper.GetFloat64("budget.monthly") < 0 {
+		fail("budget.daily and budget.monthly must not be negative")
+	}
+	if viper.GetInt("deepseek.max_retries") < 0 {
+		fail("deepseek.max_retries must not be negative")
+	}
+	for _, key := range []string{"http_client.max_idle_conns", "http_client.max_idle_conns_per_host", "http_client.max_conns_per_host", "http_client.tls_session_cache"} {
+		if viper.GetInt(key) < 0 {
+			fail("%s must not be negative", key)
+		}
+	}
+	if err := defaultGenerationParams().validate(); err != nil {
+		fail("deepseek: %v", err)
+	}
+	if lang := viper.GetString("deepseek.force_language"); lang != "" && !languageTagPattern.MatchString(lang) {
+		fail("deepseek.force_language must be a language tag such as zh-CN or en, got %q", lang)
+	}
+	if _, err := time.LoadLocation(viper.GetString("deepseek.timezone")); err != nil {
+		fail("deepseek.timezone: %v", err)
+	}
+	if modelContextBudget(viper.GetString("deepseek.model")) <= 0 {
+		fail("deepseek.context_window must be larger than deepseek.reply_reserve")
+	}
+	for _, key := range []string{"error_reporting.sample_rate", "tracing.sample_rate"} {
+		if r := viper.GetFloat64(key); r < 0 || r > 1 {
+			fail("%s must be between 0 and 1", key)
+		}
+	}
+	if viper.GetBool("article.enabled") && (viper.GetInt("article.max_chars") <= 0 || viper.GetString("article.prompt") == "") {
+		fail("article.max_chars must be positive and article.prompt is required when article.enabled is true")
+	}
+	if viper.GetBool("translate.enabled") {
+		if viper.GetString("translate.target") == "" || viper.GetString("translate.prompt") == "" {
+			fail("translate.target and translate.prompt are required when translate.enabled is true")
+		}
+		if t := viper.GetFloat64("translate.temperature"); t < 0 || t > 2 {
+			fail("translate.temperature must be between 0 and 2")
+		}
+	}
+	if b := viper.GetFloat64("regenerate.temperature_boost"); b < 0 || b > 2 {
+		fail("regenerate.temperature_boost must be between 0 and 2")
+	}
+	if viper.GetInt("history.keep_turns") < 0 || viper.GetInt("history.token_budget") <= 0 {
+		fail("history.keep_turns must not be negative and history.token_budget must be positive")
+	}
+
+	// 定时任务
+	if viper.GetBool("digest.enabled") {
+		if _, err := dailySpec(viper.GetString("digest.time")); err != nil {
+			fail("digest.time must be HH:MM, got %q", viper.GetString("digest.time"))
+		}
+	}
+	if viper.GetBool("report.enabled") {
+		if _, err := dailySpec(viper.GetString("report.time")); err != nil {
+			fail("report.time must be HH:MM, got %q", viper.GetString("report.time"))
+		}
+		if len(viper.GetStringSlice("report.openids")) == 0 && len(viper.GetStringSlice("admin.openids")) == 0 &&
+			viper.GetString("report.webhook_url") == "" {
+			fail("report.enabled requires report.openids, admin.openids or report.webhook_url")
+		}
+	}
+	if viper.GetBool("tagging.enabled") {
+		if _, err := cron.ParseStandard(viper.GetString("tagging.spec")); err != nil {
+			fail("tagging.spec: %v", err)
+		}
+	}
+
+	// 相互依赖的选项
+	if len(alertRules()) > 0 && len(viper.GetStringSlice("admin.openids")) == 0 && viper.GetString("alert.webhook_url") == "" {
+		fail("alert.rules requires admin.openids or alert.webhook_url")
+	}
+	if viper.GetBool("budget.enabled") {
+		switch viper.GetString("budget.action") {
+		case BudgetActionFallback:
+			if viper.GetString("budget.fallback_model") == "" {
+				fail("budget.action fallback requires budget.fallback_model")
+			}
+		case BudgetActionPause:
+		default:
+			fail("budget.action must be fallback or pause, got %q", viper.GetString("budget.action"))
+		}
+		if viper.GetFloat64("budget.daily") == 0 && viper.GetFloat64("budget.monthly") == 0 {
+			fail("budget.enabled requires budget.daily or budget.monthly")
+		}
+		if len(viper.GetStringMap("pricing")) == 0 {
+			fail("budget.enabled requires pricing")
+		}
+	}
+	if viper.GetBool("debug_chat.enabled") && viper.GetString("admin.token") == "" {
+		fail("debug_chat.enabled requires admin.token")
+	}
+	if viper.GetBool("recording.enabled") && viper.GetString("recording.path") == "" {
+		fail("recording.enabled requires recording.path")
+	}
+	if viper.GetBool("recording.enabled") && viper.GetInt64("recording.max_bytes") <= 0 {
+		fail("recording.max_bytes must be positive")
+	}
+	if viper.GetInt64("server.callback_max_bytes") < 1024 {
+		fail("server.callback_max_bytes must be at least 1024")
+	}
+	if viper.GetBool("push_api.enabled") {
+		tokens := viper.GetStringSlice("push_api.tokens")
+		if len(tokens) == 0 {
+			fail("push_api.enabled requires push_api.tokens")
+		}
+		for _, t := range tokens {
+			if len(t) < 16 {
+				fail("push_api.tokens must be at least 16 characters")
+			}
+		}
+	}
+	if viper.GetBool("snapshot.enabled") && viper.GetString("snapshot.path") == "" {
+		fail("snapshot.enabled requires snapshot.path")
+	}
+	if viper.GetBool("pprof.enabled") && viper.GetString("pprof.listen") == "" && viper.GetString("admin.token") == "" {
+		fail("pprof.enabled without pprof.listen requires admin.token")
+	}
+	if viper.GetBool("tracing.enabled") && viper.GetString("tracing.endpoint") == "" {
+		fail("tracing.enabled requires tracing.endpoint")
+	}
+	switch backend := viper.GetString("vector_store.backend"); backend {
+	case "", "local":
+	case "qdrant":
+		checkURL("vector_store.qdrant.url", true)
+	default:
+		fail("vector_store.backend must be local or qdrant, got %q", backend)
+	}
+	switch backend := viper.GetString("state.backend"); backend {
+	case "", "memory":
+		if viper.GetInt("state.memory.max_entries") < 0 || viper.GetInt64("state.memory.max_bytes") < 0 {
+			fail("state.memory.max_entries and state.memory.max_bytes must not be negative")
+		}
+	case "redis":
+		if viper.GetString("state.redis.addr") == "" {
+			fail("state.backend redis requires state.redis.addr")
+		}
+	default:
+		fail("state.backend must be memory or redis, got %q", backend)
+	}
+	switch backend := viper.GetString("queue.backend"); backend {
+	case "", "local":
+	case "redis":
+		if viper.GetString("state.backend") != "redis" {
+			fail("queue.backend redis requires state.backend redis")
+		}
+		if viper.GetInt("queue.workers") < 1 {
+			fail("queue.workers must be at least 1")
+		}
+	default:
+		fail("queue.backend must be local or redis, got %q", backend)
+	}
+	if viper.GetBool("rag.enabled") {
+		if p := viper.GetString("rag.embedding_provider"); p != "" && p != "deepseek" && !viper.IsSet("providers."+p) {
+			fail("rag.embedding_provider %q is not defined in providers", p)
+		}
+		if viper.GetString("rag.embedding_model") == "" {
+			fail("rag.enabled requires rag.embedding_model")
+		}
+		if viper.GetInt("rag.top_k") < 1 {
+			fail("rag.top_k must be at least 1")
+		}
+		if size, overlap := viper.GetInt("rag.chunk_size"), viper.GetInt("rag.chunk_overlap"); size <= 0 || overlap < 0 || overlap >= size {
+			fail("rag.chunk_size must be positive and larger than rag.chunk_overlap")
+		}
+		if viper.GetBool("rag.citations") && (viper.GetDuration("rag.citations_ttl") <= 0 || viper.GetInt("rag.citation_length") <= 0) {
+			fail("rag.citations requires positive rag.citations_ttl and rag.citation_length")
+		}
+	}
+	if viper.GetBool("experiments.prompt.enabled") {
+		var variants []promptVariant
+		if err := viper.UnmarshalKey("experiments.prompt.variants", &variants); err != nil {
+			fail("experiments.prompt.variants: %v", err)
+		}
+		total := 0
+		for _, v := range variants {
+			if v.Name == "" {
+				fail("experiments.prompt.variants: every variant needs a name")
+			}
+			total += max(v.Weight, 0)
+		}
+		if total == 0 {
+			fail("experiments.prompt.enabled requires variants with a positive weight")
+		}
+	}
+	if viper.GetBool("experiments.canary.enabled") {
+		if p := viper.GetFloat64("experiments.canary.percent"); p < 0 || p > 100 {
+			fail("experiments.canary.percent must be between 0 and 100, got %v", p)
+		}
+		if strings.TrimSpace(viper.GetString("experiments.canary.model")) == "" {
+			fail("experiments.canary.model is required")
+		}
+		if provider := viper.GetString("experiments.canary.provider"); provider != "deepseek" && !viper.IsSet("providers."+provider) {
+			fail("experiments.canary.provider %q is not configured in providers", provider)
+		}
+	}
+	if viper.GetBool("experiments.shadow.enabled") {
+		if p := viper.GetFloat64("experiments.shadow.percent"); p < 0 || p > 100 {
+			fail("experiments.shadow.percent must be between 0 and 100, got %v", p)
+		}
+		if strings.TrimSpace(viper.GetString("experiments.shadow.model")) == "" {
+			fail("experiments.shadow.model is required")
+		}
+		if provider := viper.GetString("experiments.shadow.provider"); provider != "deepseek" && !viper.IsSet("providers."+provider) {
+			fail("experiments.shadow.provider %q is not configured in providers", provider)
+		}
+		if viper.GetInt("experiments.shadow.max_concurrency") < 1 {
+			fail("experiments.shadow.max_concurrency must be at least 1")
+		}
+	}
+	if viper.GetBool("experiments.compare.enabled") {
+		var models []compareModel
+		if err := viper.UnmarshalKey("experiments.compare.models", &models); err != nil {
+			fail("experiments.compare.models: %v", err)
+		}
+		if len(models) != 2 {
+			fail("experiments.compare.models must list exactly two models, got %d", len(models))
+		}
+		for _, m := range models {
+			if strings.TrimSpace(m.Model) == "" {
+				fail("experiments.compare.models: every entry needs a model")
+			}
+			if m.Provider != "" && m.Provider != "deepseek" && !viper.IsSet("providers."+m.Provider) {
+				fail("experiments.compare.models: provider %q is not configured in providers", m.Provider)
+			}
+		}
+	}
+	if viper.GetBool("tiers.enabled") {
+		levels := tierLevels()
+		if len(levels) == 0 {
+			fail("tiers.enabled requires tiers.levels")
+		}
+		for _, key := range []string{"tiers.default", "tiers.admin_tier"} {
+			if name := viper.GetString(key); name != "" {
+				if _, ok := levels[strings.ToLower(name)]; !ok {
+					fail("%s %q is not defined in tiers.levels", key, name)
+				}
+			}
+		}
+		for name, t := range levels {
+			if t.Provider != "" && t.Provider != "deepseek" && !viper.IsSet("providers."+t.Provider) {
+				fail("tiers.levels.%s.provider %q is not configured in providers", name, t.Provider)
+			}
+		}
+	}
+	if viper.GetBool("membership.enabled") {
+		if tier := viper.GetString("membership.tier"); tier != "" {
+			if _, ok := tierLevels()[strings.ToLower(tier)]; !ok || !viper.GetBool("tiers.enabled") {
+				fail("membership.tier %q requires tiers.enabled and an entry in tiers.levels", tier)
+			}
+		}
+		if viper.GetInt("membership.daily_free") < 0 || viper.GetInt("membership.reserved_concurrency") < 0 {
+			fail("membership.daily_free and membership.reserved_concurrency must not be negative")
+		}
+		if viper.GetInt("membership.points_price") > 0 && viper.GetInt("membership.points_days") <= 0 {
+			fail("membership.points_days must be positive")
+		}
+	}
+	if viper.GetBool("invite.enabled") {
+		if !viper.GetBool("points.enabled") {
+			fail("invite.enabled requires points.enabled")
+		}
+		if viper.GetInt("invite.inviter_bonus") < 0 || viper.GetInt("invite.invitee_bonus") < 0 {
+			fail("invite.inviter_bonus and invite.invitee_bonus must not be negative")
+		}
+		if d := viper.GetDuration("invite.qr_expire"); d < time.Minute || d > 720*time.Hour {
+			fail("invite.qr_expire must be between 1m and 720h")
+		}
+	}
+	for name := range viper.GetStringMap("events") {
+		if name == "webhook_timeout" {
+			continue
+		}
+		var h EventHandler
+		if err := viper.UnmarshalKey("events."+name, &h); err != nil {
+			fail("events.%s: %v", name, err)
+			continue
+		}
+		handlers := map[string]EventHandler{name: h}
+		for key, k := range h.Keys {
+			handlers[name+".keys."+key] = k
+		}
+		for path, h := range handlers {
+			switch h.Action {
+			case "", "none", "reply":
+			case "persona":
+				if h.Query == "" {
+					fail("events.%s: persona requires query", path)
+				}
+			case "tool":
+				if h.Tool == "" {
+					fail("events.%s: tool requires tool", path)
+				}
+			case "webhook":
+				if u, err := url.Parse(h.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					fail("events.%s: webhook must be an http(s) URL, got %q", path, h.Webhook)
+				}
+			default:
+				fail("events.%s: unknown action %q (want reply, persona, tool, webhook or none)", path, h.Action)
+			}
+		}
+	}
+	checkURL("asr.api_url", false)
+	checkURL("tts.api_url", false)
+	for name := range viper.GetStringMap("speech_providers") {
+		key := "speech_providers." + name
+		if t := viper.GetString(key + ".type"); t != "" && t != "openai" {
+			fail("%s.type must be openai, got %q", key, t)
+		}
+		if viper.GetString(key+".api_url") == "" {
+			checkURL(key+".base_url", true)
+		}
+	}
+	for _, section := range []string{"asr", "tts"} {
+		if p := viper.GetString(section + ".provider"); p != "" && !viper.IsSet("speech_providers."+p) {
+			fail("%s.provider %q is not configured in speech_providers", section, p)
+		}
+	}
+	for _, key := range []string{"media.transcribe_video", "asr.voice_fallback"} {
+		if viper.GetBool(key) {
+			if viper.GetString("asr.provider") == "" {
+				checkURL("asr.api_url", true)
+			}
+			if _, err := exec.LookPath(viper.GetString("media.ffmpeg")); err != nil {
+				fail("%s requires ffmpeg: %v", key, err)
+			}
+		}
+	}
+	for typ := range viper.GetStringMap("notifications.templates") {
+		var t NotificationTemplate
+		if err := viper.UnmarshalKey("notifications.templates."+typ, &t); err != nil {
+			fail("notifications.templates.%s: %v", typ, err)
+		} else if err := validateNotificationTemplate(typ, t); err != nil {
+			fail("notifications.templates.%s: %v", typ, err)
+		}
+	}
+	if viper.GetBool("office_hours.enabled") {
+		if _, err := time.LoadLocation(viper.GetString("office_hours.timezone")); err != nil {
+			fail("office_hours.timezone: %v", err)
+		}
+		switch viper.GetString("office_hours.action") {
+		case OfficeHoursAnswer, OfficeHoursReply, OfficeHoursQueue:
+		default:
+			fail("office_hours.action must be answer, reply or queue, got %q", viper.GetString("office_hours.action"))
+		}
+		for day := range viper.GetStringMap("office_hours.schedule") {
+			if !slices.Contains(weekdayKeys[:], day) {
+				fail("office_hours.schedule: unknown day %q (want monday ... sunday)", day)
+				continue
+			}
+			for _, s := range viper.GetStringSlice("office_hours.schedule." + day) {
+				if _, err := parseOfficeWindow(s); err != nil {
+					fail("office_hours.schedule.%s: %v", day, err)
+				}
+			}
+		}
+	}
+	if viper.GetBool("subscribe_msg.enabled") {
+		if viper.GetString("subscribe_msg.template_id") == "" {
+			fail("subscribe_msg.template_id is required when subscribe_msg.enabled is true")
+		}
+		checkURL("subscribe_msg.redirect_url", true)
+		if s := viper.GetInt("subscribe_msg.scene"); s < 0 || s > 10000 {
+			fail("subscribe_msg.scene must be between 0 and 10000")
+		}
+	}
+	if viper.GetBool("onboarding.enabled") {
+		var flows map[string]OnboardingFlow
+		if err := viper.UnmarshalKey("onboarding.flows", &flows); err != nil {
+			fail("onboarding.flows: %v", err)
+		}
+		for scene, f := range flows {
+			if f.Persona != "" {
+				if _, ok := personaPrompt(f.Persona); !ok {
+					fail("onboarding.flows.%s: persona %q is not configured in personas", scene, f.Persona)
+				}
+			}
+			if f.Points < 0 {
+				fail("onboarding.flows.%s: points must not be negative", scene)
+			}
+			if f.Points > 0 && !viper.GetBool("points.enabled") {
+				fail("onboarding.flows.%s: points requires points.enabled", scene)
+			}
+		}
+	}
+	if viper.GetBool("ocr.enabled") {
+		switch viper.GetString("ocr.provider") {
+		case "tesseract":
+			if _, err := exec.LookPath(viper.GetString("ocr.tesseract")); err != nil {
+				fail("ocr.provider tesseract requires tesseract: %v", err)
+			}
+		case "api":
+			checkURL("ocr.api_url", true)
+		default:
+			fail("ocr.provider must be tesseract or api, got %q", viper.GetString("ocr.provider"))
+		}
+		if viper.GetInt("ocr.max_chars") <= 0 {
+			fail("ocr.max_chars must be positive")
+		}
+	}
+	if _, err := newWeChatCrypter(); err != nil {
+		fail("wechat.encoding_aes_key: %v", err)
+	}
+	if viper.GetBool("wecom.enabled") {
+		for _, key := range []string{"wecom.corp_id", "wecom.agent_id", "wecom.secret", "wecom.token"} {
+			if viper.GetString(key) == "" {
+				fail("wecom.enabled requires %s", key)
+			}
+		}
+		if len(viper.GetString("wecom.encoding_aes_key")) != 43 {
+			fail("wecom.encoding_aes_key must be 43 characters")
+		}
+	}
+	if viper.GetBool("music.enabled") {
+		for i, rule := range musicRules() {
+			if rule.empty() {
+				fail("music.rules[%d] needs keywords or contains", i)
+			}
+			if rule.Title == "" || rule.MusicURL == "" {
+				fail("music.rules[%d] requires title and music_url", i)
+			}
+		}
+	}
+	if viper.GetBool("miniprogram.enabled") {
+		for i, rule := range miniProgramRules() {
+			if rule.empty() {
+				fail("miniprogram.rules[%d] needs keywords or contains", i)
+			}
+			if rule.Title == "" || rule.AppID == "" || rule.PagePath == "" || rule.ThumbMediaID == "" {
+				fail("miniprogram.rules[%d] requires title, appid, pagepath and thumb_media_id", i)
+			}
+		}
+	}
+	if viper.GetBool("pay.enabled") {
+		if !viper.GetBool("points.enabled") {
+			fail("pay.enabled requires points.enabled")
+		}
+		for _, key := range []string{"wechat.app_id", "wechat.app_secret", "pay.mch_id", "pay.serial_no", "pay.private_key_path", "pay.platform_public_key_path"} {
+			if viper.GetString(key) == "" {
+				fail("pay.enabled requires %s", key)
+			}
+		}
+		if len(viper.GetString("pay.api_v3_key")) != 32 {
+			fail("pay.api_v3_key must be 32 bytes")
+		}
+		checkURL("pay.notify_url", true)
+		checkURL("pay.page_url", false)
+		packages := payPackages()
+		if len(packages) == 0 {
+			fail("pay.enabled requires at least one pay.packages entry")
+		}
+		for _, p := range packages {
+			if p.Name == "" || p.Points < 0 || p.MembershipDays < 0 || p.Points+p.MembershipDays == 0 || p.Price <= 0 {
+				fail("pay.packages: every package needs a name, positive points or membership_days and a positive price")
+			}
+			if p.MembershipDays > 0 && !viper.GetBool("membership.enabled") {
+				fail("pay.packages: %s has membership_days but membership.enabled is false", p.Name)
+			}
+		}
+	}
+	if viper.GetBool("model_switch.enabled") {
+		if a := viper.GetString("model_switch.allow"); a != "all" && a != "restricted" {
+			fail("model_switch.allow must be all or restricted, got %q", a)
+		}
+	}
+
+	return errs
+}
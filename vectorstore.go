@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 向量库中的一条记录，Group 用于按来源批量删除（如同一文档的所有片段）
+type VectorPoint struct {
+	ID      string            `json:"id"`
+	Group   string            `json:"group"`
+	Vector  []float32         `json:"-"`
+	Payload map[string]string `json:"payload"`
+}
+
+type VectorMatch struct {
+	VectorPoint
+	Score float64 `json:"score"`
+}
+
+// 向量存储后端，按 collection 隔离不同用途（知识库、语义缓存等），相似度均为余弦相似度
+type VectorStore interface {
+	Upsert(ctx context.Context, collection string, points []VectorPoint) error
+	Search(ctx context.Context, collection string, vector []float32, topK int) ([]VectorMatch, error)
+	DeleteGroup(ctx context.Context, collection, group string) error
+}
+
+var vectorStore VectorStore
+
+// 根据 vector_store.backend 选择向量存储后端
+func initVectorStore() error {
+	switch backend := viper.GetString("vector_store.backend"); backend {
+	case "", "local":
+		vectorStore = newLocalVectorStore()
+	case "qdrant":
+		url := viper.GetString("vector_store.qdrant.url")
+		if url == "" {
+			return fmt.Errorf("vector_store.qdrant.url is required")
+		}
+		vectorStore = &qdrantVectorStore{
+			url:    strings.TrimRight(url, "/"),
+			apiKey: viper.GetString("vector_store.qdrant.api_key"),
+			client: &http.Client{Timeout: 30 * time.Second, Transport: sharedHTTPTransport()},
+		}
+	default:
+		return fmt.Errorf("unknown vector_store.backend %q", backend)
+	}
+	log.Printf("🧭 向量存储后端: %T", vectorStore)
+	return nil
+}
+
+// 本地向量存储：记录持久化在 SQLite，检索时在内存中暴力计算，适合数万条以内的规模
+type localVectorStore struct {
+	mu     sync.Mutex
+	loaded map[string][]VectorPoint // collection -> 已归一化的记录
+}
+
+func newLocalVectorStore() *localVectorStore {
+	return &localVectorStore{loaded: map[string][]VectorPoint{}}
+}
+
+// 首次访问某个 collection 时从数据库加载，调用方需持有锁
+func (s *localVectorStore) load(collection string) ([]VectorPoint, error) {
+	if points, ok := s.loaded[collection]; ok {
+		return points, nil
+	}
+	rows, err := db.Query(`SELECT id, grp, vector, payload FROM vector_points WHERE collection = ?`, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []VectorPoint{}
+	for rows.Next() {
+		var p VectorPoint
+		var blob []byte
+		var payload string
+		if err := rows.Scan(&p.ID, &p.Group, &blob, &payload); err != nil {
+			return nil, err
+		}
+		p.Vector = decodeVector(blob)
+		_ = json.Unmarshal([]byte(payload), &p.Payload)
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.loaded[collection] = points
+	return points, nil
+}
+
+func (s *localVectorStore) Upsert(ctx context.Context, collection string, points []VectorPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, err := s.load(collection)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	normalized := make([]VectorPoint, len(points))
+	for i, p := range points {
+		p.Vector = normalize(p.Vector)
+		payload, _ := json.Marshal(p.Payload)
+		if _, err := tx.Exec(`INSERT INTO vector_points (collection, id, grp, vector, payload) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(collection, id) DO UPDATE SET grp = excluded.grp, vector = excluded.vector, payload = excluded.payload`,
+			collection, p.ID, p.Group, encodeVector(p.Vector), string(payload)); err != nil {
+			return err
+		}
+		normalized[i] = p
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	replaced := map[string]bool{}
+	for _, p := range normalized {
+		replaced[p.ID] = true
+	}
+	kept := make([]VectorPoint, 0, len(existing)+len(normalized))
+	for _, p := range existing {
+		if !replaced[p.ID] {
+			kept = append(kept, p)
+		}
+	}
+	s.loaded[collection] = append(kept, normalized...)
+	return nil
+}
+
+func (s *localVectorStore) Search(ctx context.Context, collection string, vector []float32, topK int) ([]VectorMatch, error) {
+	s.mu.Lock()
+	points, err := s.load(collection)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	q := normalize(vector)
+	matches := make([]VectorMatch, 0, len(points))
+	for _, p := range points {
+		matches = append(matches, VectorMatch{VectorPoint: p, Score: dot(q, p.Vector)})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > topK {
+		matches = matches[:topK]
+	}
+	return matches, nil
+}
+
+func (s *localVectorStore) DeleteGroup(ctx context.Context, collection, group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	points, err := s.load(collection)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM vector_points WHERE collection = ? AND grp = ?`, collection, group); err != nil {
+		return err
+	}
+	kept := make([]VectorPoint, 0, len(points))
+	for _, p := range points {
+		if p.Group != group {
+			kept = append(kept, p)
+		}
+	}
+	s.loaded[collection] = kept
+	return nil
+}
+
+// Qdrant 向量存储，通过 REST 接口访问；collection 在首次写入时按向量维度自动创建
+type qdrantVectorStore struct {
+	url    string
+	apiKey string
+	client *http.Client
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func (s *qdrantVectorStore) do(ctx context.Context, method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		b, _ := json.Marshal(payload)
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("api-key", s.apiKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("qdrant %s %s returned %d: %s", method, path, resp.StatusCode, truncateRunes(string(raw), 200))
+	}
+	if out != nil {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
+
+func (s *qdrantVectorStore) ensureCollection(ctx context.Context, collection string, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[collection] {
+		return nil
+	}
+
+	var info struct {
+		Result struct{} `json:"result"`
+	}
+	if err := s.do(ctx, "GET", "/collections/"+collection, nil, &info); err != nil {
+		err = s.do(ctx, "PUT", "/collections/"+collection, map[string]interface{}{
+			"vectors": map[string]interface{}{"size": size, "distance": "Cosine"},
+		}, nil)
+		if err != nil {
+			return err
+		}
+		// 为 group 建立索引以便按组删除
+		_ = s.do(ctx, "PUT", "/collections/"+collection+"/index", map[string]interface{}{
+			"field_name": "group", "field_schema": "keyword",
+		}, nil)
+	}
+	if s.created == nil {
+		s.created = map[string]bool{}
+	}
+	s.created[collection] = true
+	return nil
+}
+
+// Qdrant 的点 ID 只能是整数或 UUID，这里把业务 ID 映射成确定的 UUID
+func qdrantPointID(id string) string {
+	h := md5.Sum([]byte(id))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func (s *qdrantVectorStore) Upsert(ctx context.Context, collection string, points []VectorPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	if err := s.ensureCollection(ctx, collection, len(points[0].Vector)); err != nil {
+		return err
+	}
+
+	items := make([]map[string]interface{}, len(points))
+	for i, p := range points {
+		payload := map[string]interface{}{"id": p.ID, "group": p.Group}
+		for k, v := range p.Payload {
+			payload["p_"+k] = v
+		}
+		items[i] = map[string]interface{}{"id": qdrantPointID(p.ID), "vector": p.Vector, "payload": payload}
+	}
+	return s.do(ctx, "PUT", "/collections/"+collection+"/points?wait=true", map[string]interface{}{"points": items}, nil)
+}
+
+func (s *qdrantVectorStore) Search(ctx context.Context, collection string, vector []float32, topK int) ([]VectorMatch, error) {
+	var result struct {
+		Result []struct {
+			Score   float64                `json:"score"`
+			Payload map[string]interface{} `json:"payload"`
+		} `json:"result"`
+	}
+	err := s.do(ctx, "POST", "/collections/"+collection+"/points/search", map[string]interface{}{
+		"vector": vector, "limit": topK, "with_payload": true,
+	}, &result)
+	if err != nil {
+		// collection 尚未创建时视为没有数据
+		if strings.Contains(err.Error(), "returned 404") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	matches := make([]VectorMatch, 0, len(result.Result))
+	for _, r := range result.Result {
+		p := VectorPoint{Payload: map[string]string{}}
+		for k, v := range r.Payload {
+			str, _ := v.(string)
+			switch {
+			case k == "id":
+				p.ID = str
+			case k == "group":
+				p.Group = str
+			case strings.HasPrefix(k, "p_"):
+				p.Payload[strings.TrimPrefix(k, "p_")] = str
+			}
+		}
+		matches = append(matches, VectorMatch{VectorPoint: p, Score: r.Score})
+	}
+	return matches, nil
+}
+
+func (s *qdrantVectorStore) DeleteGroup(ctx context.Context, collection, group string) error {
+	err := s.do(ctx, "POST", "/collections/"+collection+"/points/delete?wait=true", map[string]interface{}{
+		"filter": map[string]interface{}{
+			"must": []interface{}{map[string]interface{}{"key": "group", "match": map[string]interface{}{"value": group}}},
+		},
+	}, nil)
+	if err != nil && strings.Contains(err.Error(), "returned 404") {
+		return nil
+	}
+	return err
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	n := float32(math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x / n
+	}
+	return out
+}
+
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var s float64
+	for i := range a {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return s
+}
+
+// 向量以 float32 小端序存为 BLOB
+func encodeVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
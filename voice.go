@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 语音消息：公众号开启语音识别时直接使用微信的识别结果；未开启时（Recognition 为空）且开启 asr.voice_fallback，
+// 下载 AMR/Speex 语音，经 ffmpeg 转码后交给 asr 接口识别。识别出的文字作为文本消息继续经过后续中间件
+func voiceMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg WeChatMessage) (string, bool) {
+		if msg.MsgType != "voice" {
+			return next(ctx, msg)
+		}
+		if text := strings.TrimSpace(msg.Recognition); text != "" {
+			logf(ctx, "🎙️ 微信语音识别结果: %s", redactContent(text))
+			return next(ctx, voiceAsText(msg, text))
+		}
+		if !viper.GetBool("asr.voice_fallback") {
+			return next(ctx, msg)
+		}
+		return transcribeVoice(ctx, msg, next)
+	}
+}
+
+func voiceAsText(msg WeChatMessage, text string) WeChatMessage {
+	msg.MsgType = "text"
+	msg.Content = text
+	return msg
+}
+
+// 在 media.reply_wait 内识别完成时按文本消息继续处理，否则回复稍后查看，识别完成后在后台提问
+func transcribeVoice(ctx context.Context, msg WeChatMessage, next MessageHandler) (string, bool) {
+	// 识别结果由先到的一方处理：识别先完成时交给被动回复，等待先超时时交给后台
+	const (
+		pending = iota
+		replying
+		background
+	)
+	var owner atomic.Int32
+	done := make(chan struct{})
+	var text string
+	var err error
+	detached := detachContext(ctx)
+	safeGo("transcribeVoice", func() {
+		text, err = recognizeVoice(detached, msg)
+		if owner.CompareAndSwap(pending, replying) {
+			close(done)
+			return
+		}
+		if err != nil || text == "" {
+			storeAnswer(msg.FromUserName, "❌ 未能识别语音内容，请用文字描述你的问题。")
+			return
+		}
+		askTranscribed(detached, msg.FromUserName, text)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(viper.GetDuration("media.reply_wait")):
+		if owner.CompareAndSwap(pending, background) {
+			return "🎙️ 正在识别语音，稍后输入“继续”查看回答。", true
+		}
+		<-done
+	}
+	if err != nil || text == "" {
+		return "❌ 未能识别语音内容，请用文字描述你的问题。", true
+	}
+	return next(ctx, voiceAsText(msg, text))
+}
+
+func recognizeVoice(ctx context.Context, msg WeChatMessage) (string, error) {
+	file, err := downloadMedia(ctx, msg.MediaID)
+	if err != nil {
+		logf(ctx, "❌ 下载语音 %s 失败: %v", msg.MediaID, err)
+		return "", err
+	}
+	format := strings.ToLower(msg.Format)
+	if format == "" {
+		format = "amr"
+	}
+	audio, err := extractAudio(ctx, file.Data, format)
+	if err != nil {
+		logf(ctx, "❌ 转码语音 %s 失败: %v", msg.MediaID, err)
+		return "", err
+	}
+	text, err := transcribeAudio(ctx, "audio.mp3", audio)
+	if err != nil {
+		logf(ctx, "❌ 识别语音 %s 失败: %v", msg.MediaID, err)
+		return "", err
+	}
+	text = strings.TrimSpace(text)
+	logf(ctx, "🎙️ 语音识别结果: %s", redactContent(text))
+	return text, nil
+}
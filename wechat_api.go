@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const wechatAPIBase = "https://api.weixin.qq.com"
+
+// 微信接口返回的错误码
+type WeChatAPIError struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (e *WeChatAPIError) Error() string {
+	return fmt.Sprintf("wechat api error %d: %s", e.ErrCode, e.ErrMsg)
+}
+
+// access_token 保存在状态存储中，多个实例共用同一个 token：
+// 各实例分别刷新会使其他实例手中的 token 失效
+type accessToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+const accessTokenKey = "wechat:access_token"
+
+var accessTokenMu sync.Mutex // 本实例内同一时刻只有一个请求去刷新
+
+var wechatClient = &http.Client{Timeout: 10 * time.Second}
+
+func cachedAccessToken(ctx context.Context) (string, bool) {
+	data, err := state.Get(ctx, accessTokenKey)
+	if err != nil {
+		return "", false
+	}
+	var t accessToken
+	if json.Unmarshal(data, &t) != nil || t.Token == "" || time.Now().After(t.ExpiresAt) {
+		return "", false
+	}
+	return t.Token, true
+}
+
+// 获取（必要时刷新）公众号 access_token
+func getAccessToken() (string, error) {
+	ctx := context.Background()
+	if token, ok := cachedAccessToken(ctx); ok {
+		return token, nil
+	}
+
+	accessTokenMu.Lock()
+	defer accessTokenMu.Unlock()
+	if token, ok := cachedAccessToken(ctx); ok {
+		return token, nil
+	}
+
+	// 只由拿到锁的实例刷新，其他实例等待它写入新 token；等待超时则自行刷新
+	if unlock, ok := tryLock(ctx, accessTokenKey, 15*time.Second); ok {
+		defer unlock()
+	} else {
+		for i := 0; i < 20; i++ {
+			time.Sleep(500 * time.Millisecond)
+			if token, ok := cachedAccessToken(ctx); ok {
+				return token, nil
+			}
+		}
+	}
+
+	query := url.Values{}
+	query.Set("grant_type", "client_credential")
+	query.Set("appid", viper.GetString("wechat.app_id"))
+	query.Set("secret", viper.GetString("wechat.app_secret"))
+
+	resp, err := wechatClient.Get(wechatAPIBase + "/cgi-bin/token?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		WeChatAPIError
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.ErrCode != 0 {
+		return "", &result.WeChatAPIError
+	}
+
+	// 提前 5 分钟过期，避免临界时刻使用失效的 token
+	ttl := time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute
+	data, _ := json.Marshal(accessToken{Token: result.AccessToken, ExpiresAt: time.Now().Add(ttl)})
+	if err := state.Set(ctx, accessTokenKey, data, ttl); err != nil {
+		log.Printf("⚠️ 保存 access_token 失败: %v", err)
+	}
+	log.Println("✅ access_token 已刷新")
+	return result.AccessToken, nil
+}
+
+// 用网页授权的 code 换取用户的 OpenID（snsapi_base），code 只能使用一次
+func oauthOpenID(code string) (string, error) {
+	query := url.Values{}
+	query.Set("appid", viper.GetString("wechat.app_id"))
+	query.Set("secret", viper.GetString("wechat.app_secret"))
+	query.Set("code", code)
+	query.Set("grant_type", "authorization_code")
+
+	resp, err := wechatClient.Get(wechatAPIBase + "/sns/oauth2/access_token?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		WeChatAPIError
+		OpenID string `json:"openid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.ErrCode != 0 {
+		return "", &result.WeChatAPIError
+	}
+	if result.OpenID == "" {
+		return "", errors.New("oauth response has no openid")
+	}
+	return result.OpenID, nil
+}
+
+// 网页授权链接：用户在微信内打开后跳转到 redirect，并带上 code 参数
+func oauthAuthorizeURL(redirect string) string {
+	query := url.Values{}
+	query.Set("appid", viper.GetString("wechat.app_id"))
+	query.Set("redirect_uri", redirect)
+	query.Set("response_type", "code")
+	query.Set("scope", "snsapi_base")
+	return "https://open.weixin.qq.com/connect/oauth2/authorize?" + query.Encode() + "#wechat_redirect"
+}
+
+// 使缓存的 access_token 失效，下次调用时重新获取
+func invalidateAccessToken() {
+	if err := state.Delete(context.Background(), accessTokenKey); err != nil {
+		log.Printf("⚠️ 清除 access_token 失败: %v", err)
+	}
+}
+
+// 调用需要 access_token 的微信接口（POST JSON）
+func wechatPost(path string, payload interface{}, out interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return wechatDo(http.MethodPost, path, nil, payloadBytes, out)
+}
+
+// 调用需要 access_token 的微信接口（GET）
+func wechatGet(path string, query url.Values, out interface{}) error {
+	return wechatDo(http.MethodGet, path, query, nil, out)
+}
+
+func wechatDo(method, path string, query url.Values, body []byte, out interface{}) error {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	respBody, _, err := wechatRequest(method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// 调用需要 access_token 的微信接口，返回原始响应及其 Content-Type，供上传素材、下载文件等非 JSON 接口使用
+func wechatRequest(method, path string, query url.Values, body []byte, contentType string) ([]byte, string, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := getAccessToken()
+		if err != nil {
+			return nil, "", err
+		}
+
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("access_token", token)
+
+		req, err := http.NewRequest(method, wechatAPIBase+path+"?"+q.Encode(), bytes.NewReader(body))
+		if err != nil {
+			return nil, "", err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := wechatClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		var apiErr WeChatAPIError
+		_ = json.Unmarshal(respBody, &apiErr)
+		// 40001/42001: token 失效或过期，刷新后重试一次
+		if (apiErr.ErrCode == 40001 || apiErr.ErrCode == 42001) && attempt == 0 {
+			invalidateAccessToken()
+			continue
+		}
+		if apiErr.ErrCode != 0 {
+			return nil, "", &apiErr
+		}
+		return respBody, resp.Header.Get("Content-Type"), nil
+	}
+}
+
+// 发送客服文本消息（用户 48 小时内与公众号有过互动才能送达）
+func sendKefuText(openID, content string) error {
+	return wechatPost("/cgi-bin/message/custom/send", map[string]interface{}{
+		"touser":  openID,
+		"msgtype": "text",
+		"text":    map[string]string{"content": content},
+	}, nil)
+}
+
+// 发送客服小程序卡片消息
+func sendKefuMiniProgram(openID string, card MiniProgramCard) error {
+	return wechatPost("/cgi-bin/message/custom/send", map[string]interface{}{
+		"touser":  openID,
+		"msgtype": "miniprogrampage",
+		"miniprogrampage": map[string]string{
+			"title":          card.Title,
+			"appid":          card.AppID,
+			"pagepath":       card.PagePath,
+			"thumb_media_id": card.ThumbMediaID,
+		},
+	}, nil)
+}
+
+// 发送客服图文消息（外链图文，仅一篇）
+func sendKefuNews(openID string, a NewsArticle) error {
+	return wechatPost("/cgi-bin/message/custom/send", map[string]interface{}{
+		"touser":  openID,
+		"msgtype": "news",
+		"news": map[string]interface{}{
+			"articles": []map[string]string{{
+				"title":       a.Title,
+				"description": a.Description,
+				"url":         a.URL,
+				"picurl":      a.PicURL,
+			}},
+		},
+	}, nil)
+}
+
+// 发送模板消息，data 的键需与模板中的 {{xxx.DATA}} 对应
+func sendTemplateMessage(openID, templateID, link string, data map[string]string) error {
+	fields := map[string]interface{}{}
+	for k, v := range data {
+		fields[k] = map[string]string{"value": v}
+	}
+	payload := map[string]interface{}{
+		"touser":      openID,
+		"template_id": templateID,
+		"data":        fields,
+	}
+	if link != "" {
+		payload["url"] = link
+	}
+	return wechatPost("/cgi-bin/message/template/send", payload, nil)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// 企业微信自建应用回调。企业微信用户的 ID 加上前缀后与公众号 OpenID 共用一套数据（额度、历史、积分等）
+const wecomUserPrefix = "wecom:"
+
+const wecomAPIBase = "https://qyapi.weixin.qq.com"
+
+func isWeComUser(openID string) bool {
+	return strings.HasPrefix(openID, wecomUserPrefix)
+}
+
+// 企业微信应用消息只支持文本，模板消息、小程序卡片等无法发送
+var errWeComUnsupported = errors.New("message type not supported for wecom users")
+
+func newWeComCrypter() (*msgCrypter, error) {
+	return newMsgCrypter(viper.GetString("wecom.token"), viper.GetString("wecom.encoding_aes_key"), viper.GetString("wecom.corp_id"))
+}
+
+func registerWeCom(r *gin.Engine, limiter gin.HandlerFunc) {
+	if !viper.GetBool("wecom.enabled") {
+		return
+	}
+	crypter, err := newWeComCrypter()
+	if err != nil {
+		log.Fatalf("❌ 企业微信回调配置错误: %v", err)
+	}
+
+	// 回调地址验证：校验签名后解密 echostr，返回明文
+	r.GET("/wecom", limiter, func(c *gin.Context) {
+		echostr := c.Query("echostr")
+		if crypter.signature(c.Query("timestamp"), c.Query("nonce"), echostr) != c.Query("msg_signature") {
+			c.String(http.StatusForbidden, "Forbidden")
+			return
+		}
+		plain, err := crypter.decrypt(echostr)
+		if err != nil {
+			logf(c.Request.Context(), "❌ 企业微信 echostr 解密失败: %v", err)
+			c.String(http.StatusForbidden, "Forbidden")
+			return
+		}
+		c.String(http.StatusOK, string(plain))
+	})
+
+	// 回调在签名校验通过后录制，见 handleWeComMessage
+	r.POST("/wecom", limitCallbackBody(), limiter, recoverMessage(), func(c *gin.Context) {
+		handleWeComMessage(c, crypter)
+	})
+	log.Println("✅ 企业微信回调已启用: /wecom")
+}
+
+func handleWeComMessage(c *gin.Context, crypter *msgCrypter) {
+	ctx := c.Request.Context()
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+	var envelope struct {
+		Encrypt string `xml:"Encrypt"`
+	}
+	if err := xml.Unmarshal(body, &envelope); err != nil || envelope.Encrypt == "" {
+		c.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	timestamp, nonce := c.Query("timestamp"), c.Query("nonce")
+	if crypter.signature(timestamp, nonce, envelope.Encrypt) != c.Query("msg_signature") {
+		logf(ctx, "❌ 企业微信回调 msg_signature 校验失败，来源 %s", c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if reason, ok := checkFreshness(ctx, timestamp, nonce); !ok {
+		logf(ctx, "❌ 拒绝企业微信回调（%s），来源 %s", reason, c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	recordCallback(c, body)
+
+	plain, err := crypter.decrypt(envelope.Encrypt)
+	if err != nil {
+		logf(ctx, "❌ 企业微信消息解密失败: %v", err)
+		c.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+	msg, err := parseWeChatMessage(plain)
+	if err != nil {
+		callbackRejected.WithLabelValues("malformed").Inc()
+		logf(ctx, "❌ 企业微信消息解析失败: %v", err)
+		c.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+	// 进入应用等事件无需回复
+	if msg.MsgType == "event" && msg.Event != "subscribe" {
+		c.String(http.StatusOK, "success")
+		return
+	}
+
+	msg.FromUserName = wecomUserPrefix + msg.FromUserName
+	c.Set(replyCrypterKey, crypter)
+	respondToMessage(c, msg)
+}
+
+// 企业微信 access_token。重复获取会返回同一个有效的 token，各实例分别获取即可，无需加锁等待
+const wecomAccessTokenKey = "wecom:access_token"
+
+var wecomAccessTokenMu sync.Mutex
+
+func getWeComAccessToken() (string, error) {
+	ctx := context.Background()
+	wecomAccessTokenMu.Lock()
+	defer wecomAccessTokenMu.Unlock()
+
+	if data, err := state.Get(ctx, wecomAccessTokenKey); err == nil {
+		var t accessToken
+		if json.Unmarshal(data, &t) == nil && t.Token != "" && time.Now().Before(t.ExpiresAt) {
+			return t.Token, nil
+		}
+	}
+
+	query := url.Values{}
+	query.Set("corpid", viper.GetString("wecom.corp_id"))
+	query.Set("corpsecret", viper.GetString("wecom.secret"))
+	resp, err := wechatClient.Get(wecomAPIBase + "/cgi-bin/gettoken?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		WeChatAPIError
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.ErrCode != 0 {
+		return "", &result.WeChatAPIError
+	}
+
+	ttl := time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute
+	data, _ := json.Marshal(accessToken{Token: result.AccessToken, ExpiresAt: time.Now().Add(ttl)})
+	if err := state.Set(ctx, wecomAccessTokenKey, data, ttl); err != nil {
+		log.Printf("⚠️ 保存企业微信 access_token 失败: %v", err)
+	}
+	return result.AccessToken, nil
+}
+
+// 调用企业微信接口（POST JSON），token 失效时刷新后重试一次
+func wecomPost(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := getWeComAccessToken()
+		if err != nil {
+			return err
+		}
+		resp, err := wechatClient.Post(wecomAPIBase+path+"?access_token="+url.QueryEscape(token), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		var apiErr WeChatAPIError
+		err = json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		// 40014/42001: token 无效或过期
+		if (apiErr.ErrCode == 40014 || apiErr.ErrCode == 42001) && attempt == 0 {
+			_ = state.Delete(context.Background(), wecomAccessTokenKey)
+			continue
+		}
+		if apiErr.ErrCode != 0 {
+			return &apiErr
+		}
+		return nil
+	}
+}
+
+// 通过应用消息向企业微信用户发送主动消息
+func sendWeComMessage(openID string, m OutboxMessage) error {
+	if m.Text == "" {
+		return errWeComUnsupported
+	}
+	return wecomPost("/cgi-bin/message/send", map[string]interface{}{
+		"touser":  strings.TrimPrefix(openID, wecomUserPrefix),
+		"msgtype": "text",
+		"agentid": viper.GetInt64("wecom.agent_id"),
+		"text":    map[string]string{"content": m.Text},
+	})
+}